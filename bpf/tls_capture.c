@@ -0,0 +1,248 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// tls_capture captures the plaintext read from or written to TLS connections,
+// with uprobes on OpenSSL and on the crypto/tls package of Go binaries, for the
+// tls capture engine (see tlscapture_linux.go). It requires Linux 5.8 or later
+// with BTF. Build with, for x86 or arm64:
+//
+//	bpftool btf dump file /sys/kernel/btf/vmlinux format c > bpf/vmlinux.h
+//	clang -O2 -g -target bpf -D__TARGET_ARCH_x86 -c bpf/tls_capture.c -o tls_capture.o
+//	clang -O2 -g -target bpf -D__TARGET_ARCH_arm64 -c bpf/tls_capture.c -o tls_capture.o
+
+#include "vmlinux.h"
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+
+#define DATA_LEN 16384
+#define DATA_CHUNKS 4
+
+// The registers of the arguments and results of Go functions (ABIInternal,
+// Go 1.17 and later), and of the current goroutine.
+#if defined(__TARGET_ARCH_x86)
+#define GO_PARM1(x) ((x)->ax)
+#define GO_PARM2(x) ((x)->bx)
+#define GO_PARM3(x) ((x)->cx)
+#define GO_RET1(x) ((x)->ax)
+#define GO_G(x) ((x)->r14)
+#elif defined(__TARGET_ARCH_arm64)
+#define GO_PARM1(x) (((struct user_pt_regs *)(x))->regs[0])
+#define GO_PARM2(x) (((struct user_pt_regs *)(x))->regs[1])
+#define GO_PARM3(x) (((struct user_pt_regs *)(x))->regs[2])
+#define GO_RET1(x) (((struct user_pt_regs *)(x))->regs[0])
+#define GO_G(x) (((struct user_pt_regs *)(x))->regs[28])
+#else
+#error "Define __TARGET_ARCH_x86 or __TARGET_ARCH_arm64"
+#endif
+
+enum event_kind {
+	EVENT_DATA = 0,
+	// the connection was closed
+	EVENT_CLOSE = 1,
+	// data of the connection could not be captured, so its stream has a gap
+	EVENT_LOST = 2,
+};
+
+// event has the layout of the events of uds_capture.c, read by udsCapture.
+// conn identifies the connection: the address of its SSL or tls.Conn, mixed
+// with the process ID.
+struct event {
+	__u64 conn;
+	__u32 kind;
+	__u32 len;
+	__u8 data[DATA_LEN];
+};
+
+// read_args are the arguments of a read, kept until it returns
+struct read_args {
+	__u64 conn;
+	const __u8 *buf;
+	// the readbytes argument of SSL_read_ex
+	size_t *readbytes;
+};
+
+// reads holds the reads in progress, by thread for OpenSSL and by goroutine for Go
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u64);
+	__type(value, struct read_args);
+} reads SEC(".maps");
+
+// dropped counts the events that did not fit in the ring buffer
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, __u64);
+} dropped SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct event);
+} event_scratch SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_RINGBUF);
+	__uint(max_entries, 16 << 20);
+} events SEC(".maps");
+
+// conn_id mixes the address of a connection with the process ID, user space
+// addresses being below 2^48.
+static __always_inline __u64 conn_id(__u64 addr) {
+	return addr ^ ((bpf_get_current_pid_tgid() >> 32) << 48);
+}
+
+// goroutine_id returns the key of the reads of the current goroutine, which
+// may move between threads while it waits for data.
+static __always_inline __u64 goroutine_id(struct pt_regs *ctx) {
+	return conn_id(GO_G(ctx));
+}
+
+static __always_inline void output(struct event *e, __u32 len) {
+	if (bpf_ringbuf_output(&events, e, offsetof(struct event, data) + (len & (DATA_LEN - 1)), 0) != 0) {
+		__u32 zero = 0;
+		__u64 *count = bpf_map_lookup_elem(&dropped, &zero);
+		if (count)
+			*count += 1;
+	}
+}
+
+static __always_inline void notify(__u64 conn, __u32 kind) {
+	__u32 zero = 0;
+	struct event *e = bpf_map_lookup_elem(&event_scratch, &zero);
+	if (!e)
+		return;
+	e->conn = conn;
+	e->kind = kind;
+	e->len = 0;
+	output(e, 0);
+}
+
+// capture outputs the n bytes of the user buffer base, in chunks.
+static __always_inline void capture(__u64 conn, const __u8 *base, __s64 n) {
+	if (n <= 0)
+		return;
+	__u32 zero = 0;
+	struct event *e = bpf_map_lookup_elem(&event_scratch, &zero);
+	if (!e)
+		return;
+	for (int i = 0; i < DATA_CHUNKS && n > 0; i++) {
+		// the chunks are shorter than DATA_LEN, for the verifier
+		__u32 len = n < DATA_LEN - 1 ? n : DATA_LEN - 1;
+		e->conn = conn;
+		e->kind = EVENT_DATA;
+		e->len = len;
+		if (bpf_probe_read_user(e->data, len & (DATA_LEN - 1), base) != 0) {
+			notify(conn, EVENT_LOST);
+			return;
+		}
+		output(e, len);
+		base += len;
+		n -= len;
+	}
+	if (n > 0)
+		notify(conn, EVENT_LOST);
+}
+
+static __always_inline void start_read(__u64 key, __u64 conn, const void *buf, size_t *readbytes) {
+	struct read_args args = {.conn = conn, .buf = buf, .readbytes = readbytes};
+	bpf_map_update_elem(&reads, &key, &args, BPF_ANY);
+}
+
+// end_read captures the n bytes returned by the read of key.
+static __always_inline void end_read(__u64 key, __s64 n) {
+	struct read_args *args = bpf_map_lookup_elem(&reads, &key);
+	if (!args)
+		return;
+	struct read_args a = *args;
+	bpf_map_delete_elem(&reads, &key);
+	if (a.readbytes) {
+		size_t readbytes = 0;
+		if (n != 1 || bpf_probe_read_user(&readbytes, sizeof(readbytes), a.readbytes) != 0)
+			return;
+		n = readbytes;
+	}
+	capture(a.conn, a.buf, n);
+}
+
+// OpenSSL: int SSL_read(SSL *ssl, void *buf, int num), returning the bytes read,
+// and int SSL_read_ex(SSL *ssl, void *buf, size_t num, size_t *readbytes),
+// returning 1 on success.
+
+SEC("uprobe/SSL_read")
+int BPF_UPROBE(ssl_read, void *ssl, void *buf, int num) {
+	start_read(bpf_get_current_pid_tgid(), conn_id((__u64)ssl), buf, NULL);
+	return 0;
+}
+
+SEC("uretprobe/SSL_read")
+int BPF_URETPROBE(ssl_read_return, int ret) {
+	end_read(bpf_get_current_pid_tgid(), ret);
+	return 0;
+}
+
+SEC("uprobe/SSL_read_ex")
+int BPF_UPROBE(ssl_read_ex, void *ssl, void *buf, size_t num, size_t *readbytes) {
+	start_read(bpf_get_current_pid_tgid(), conn_id((__u64)ssl), buf, readbytes);
+	return 0;
+}
+
+SEC("uretprobe/SSL_read_ex")
+int BPF_URETPROBE(ssl_read_ex_return, int ret) {
+	end_read(bpf_get_current_pid_tgid(), ret);
+	return 0;
+}
+
+// The data written is captured before the write, which may still fail.
+
+SEC("uprobe/SSL_write")
+int BPF_UPROBE(ssl_write, void *ssl, const void *buf, int num) {
+	capture(conn_id((__u64)ssl), buf, num);
+	return 0;
+}
+
+SEC("uprobe/SSL_write_ex")
+int BPF_UPROBE(ssl_write_ex, void *ssl, const void *buf, size_t num) {
+	capture(conn_id((__u64)ssl), buf, num);
+	return 0;
+}
+
+SEC("uprobe/SSL_free")
+int BPF_UPROBE(ssl_free, void *ssl) {
+	notify(conn_id((__u64)ssl), EVENT_CLOSE);
+	return 0;
+}
+
+// Go: func (c *tls.Conn) Read(b []byte) (int, error), Write(b []byte) (int, error)
+// and Close() error. Uretprobes crash Go programs, whose stacks move, so the
+// return of Read is probed at each of its RET instructions instead.
+
+SEC("uprobe/go_tls_read")
+int go_tls_read(struct pt_regs *ctx) {
+	start_read(goroutine_id(ctx), conn_id(GO_PARM1(ctx)), (const void *)GO_PARM2(ctx), NULL);
+	return 0;
+}
+
+SEC("uprobe/go_tls_read_return")
+int go_tls_read_return(struct pt_regs *ctx) {
+	end_read(goroutine_id(ctx), (__s64)GO_RET1(ctx));
+	return 0;
+}
+
+SEC("uprobe/go_tls_write")
+int go_tls_write(struct pt_regs *ctx) {
+	capture(conn_id(GO_PARM1(ctx)), (const void *)GO_PARM2(ctx), (__s64)GO_PARM3(ctx));
+	return 0;
+}
+
+SEC("uprobe/go_tls_close")
+int go_tls_close(struct pt_regs *ctx) {
+	notify(conn_id(GO_PARM1(ctx)), EVENT_CLOSE);
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "Dual BSD/GPL";
@@ -0,0 +1,197 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// uds_capture captures the data written to Unix domain stream sockets bound to
+// the paths of the capture_paths map, for the uds capture engine (see
+// udscapture_linux.go). It requires Linux 5.14 or later with BTF. Build with:
+//
+//	bpftool btf dump file /sys/kernel/btf/vmlinux format c > bpf/vmlinux.h
+//	clang -O2 -g -target bpf -c bpf/uds_capture.c -o uds_capture.o
+
+#include "vmlinux.h"
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+
+#define PATH_LEN 108
+#define DATA_LEN 16384
+#define DATA_CHUNKS 4
+#define MAX_SEGMENTS 8
+
+enum event_kind {
+	EVENT_DATA = 0,
+	// the socket was closed
+	EVENT_CLOSE = 1,
+	// data of the socket could not be captured, so its stream has a gap
+	EVENT_LOST = 2,
+};
+
+// event is read by udsCapture, which mirrors its layout.
+struct event {
+	__u64 sock;
+	__u32 kind;
+	__u32 len;
+	__u8 data[DATA_LEN];
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 64);
+	__type(key, char[PATH_LEN]);
+	__type(value, __u8);
+} capture_paths SEC(".maps");
+
+// captured_socks holds the client sockets connected to a captured path
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __u64);
+	__type(value, __u8);
+} captured_socks SEC(".maps");
+
+// dropped counts the events that did not fit in the ring buffer
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, __u64);
+} dropped SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct event);
+} event_scratch SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, char[PATH_LEN]);
+} path_scratch SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_RINGBUF);
+	__uint(max_entries, 16 << 20);
+} events SEC(".maps");
+
+// iov_iter___old is the iov_iter of kernels before 6.4, where __iov was iov.
+struct iov_iter___old {
+	const struct iovec *iov;
+} __attribute__((preserve_access_index));
+
+static __always_inline void output(struct event *e, __u32 len) {
+	if (bpf_ringbuf_output(&events, e, offsetof(struct event, data) + (len & (DATA_LEN - 1)), 0) != 0) {
+		__u32 zero = 0;
+		__u64 *count = bpf_map_lookup_elem(&dropped, &zero);
+		if (count)
+			*count += 1;
+	}
+}
+
+static __always_inline void notify(__u64 sock, __u32 kind) {
+	__u32 zero = 0;
+	struct event *e = bpf_map_lookup_elem(&event_scratch, &zero);
+	if (!e)
+		return;
+	e->sock = sock;
+	e->kind = kind;
+	e->len = 0;
+	output(e, 0);
+}
+
+// capture outputs the n bytes of the user buffer base, in chunks.
+static __always_inline void capture(__u64 sock, const __u8 *base, __u64 n) {
+	__u32 zero = 0;
+	struct event *e = bpf_map_lookup_elem(&event_scratch, &zero);
+	if (!e)
+		return;
+	for (int i = 0; i < DATA_CHUNKS && n > 0; i++) {
+		// the chunks are shorter than DATA_LEN, for the verifier
+		__u32 len = n < DATA_LEN - 1 ? n : DATA_LEN - 1;
+		e->sock = sock;
+		e->kind = EVENT_DATA;
+		e->len = len;
+		if (bpf_probe_read_user(e->data, len & (DATA_LEN - 1), base) != 0) {
+			notify(sock, EVENT_LOST);
+			return;
+		}
+		output(e, len);
+		base += len;
+		n -= len;
+	}
+	if (n > 0)
+		notify(sock, EVENT_LOST);
+}
+
+// captured_peer reports whether the peer of the socket is bound to a captured path.
+static __always_inline bool captured_peer(struct sock *sk) {
+	struct unix_sock *peer = (struct unix_sock *)BPF_CORE_READ((struct unix_sock *)sk, peer);
+	if (!peer)
+		return false;
+	struct unix_address *addr = BPF_CORE_READ(peer, addr);
+	if (!addr)
+		return false;
+	__u32 zero = 0;
+	char *path = bpf_map_lookup_elem(&path_scratch, &zero);
+	if (!path)
+		return false;
+	// the key is zero padded; abstract paths start with a zero and never match
+	__builtin_memset(path, 0, PATH_LEN);
+	bpf_probe_read_kernel_str(path, PATH_LEN, &addr->name[0].sun_path);
+	return bpf_map_lookup_elem(&capture_paths, path) != NULL;
+}
+
+SEC("kprobe/unix_stream_sendmsg")
+int BPF_KPROBE(unix_stream_sendmsg, struct socket *sock, struct msghdr *msg, size_t len) {
+	struct sock *sk = BPF_CORE_READ(sock, sk);
+	__u64 id = (__u64)sk;
+	if (!bpf_map_lookup_elem(&captured_socks, &id)) {
+		if (!captured_peer(sk))
+			return 0;
+		__u8 one = 1;
+		bpf_map_update_elem(&captured_socks, &id, &one, BPF_ANY);
+	}
+
+	struct iov_iter *iter = &msg->msg_iter;
+	__u8 type = BPF_CORE_READ(iter, iter_type);
+	if (bpf_core_enum_value_exists(enum iter_type, ITER_UBUF) && type == bpf_core_enum_value(enum iter_type, ITER_UBUF)) {
+		// write and send of a single buffer
+		capture(id, BPF_CORE_READ(iter, ubuf), BPF_CORE_READ(iter, count));
+		return 0;
+	}
+	if (type != bpf_core_enum_value(enum iter_type, ITER_IOVEC)) {
+		notify(id, EVENT_LOST);
+		return 0;
+	}
+	const struct iovec *iov;
+	if (bpf_core_field_exists(iter->__iov))
+		iov = BPF_CORE_READ(iter, __iov);
+	else
+		iov = BPF_CORE_READ((struct iov_iter___old *)iter, iov);
+	__u64 segments = BPF_CORE_READ(iter, nr_segs);
+	for (int i = 0; i < MAX_SEGMENTS && i < segments; i++) {
+		struct iovec v;
+		if (bpf_probe_read_kernel(&v, sizeof(v), &iov[i]) != 0) {
+			notify(id, EVENT_LOST);
+			return 0;
+		}
+		capture(id, v.iov_base, v.iov_len);
+	}
+	if (segments > MAX_SEGMENTS)
+		notify(id, EVENT_LOST);
+	return 0;
+}
+
+SEC("kprobe/unix_release")
+int BPF_KPROBE(unix_release, struct socket *sock) {
+	__u64 id = (__u64)BPF_CORE_READ(sock, sk);
+	if (!bpf_map_lookup_elem(&captured_socks, &id))
+		return 0;
+	bpf_map_delete_elem(&captured_socks, &id);
+	notify(id, EVENT_CLOSE);
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "Dual BSD/GPL";
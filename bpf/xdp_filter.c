@@ -0,0 +1,187 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// xdp_filter drops the TCP packets of the capture interface that the BPF filter
+// of the capture would discard, before the kernel allocates and processes them
+// (see xdpfilter_linux.go). The maps are set from the filter flags. Other
+// packets are passed, and left to the BPF filter. Build with:
+//
+//	clang -O2 -g -target bpf -c bpf/xdp_filter.c -o xdp_filter.o
+
+#include <stdbool.h>
+#include <linux/bpf.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/ipv6.h>
+#include <linux/tcp.h>
+#include <bpf/bpf_endian.h>
+#include <bpf/bpf_helpers.h>
+
+#define DIRECTION_DST 0
+#define DIRECTION_SRC 1
+#define DIRECTION_EITHER 2
+
+#define HAS_SOURCE_INCLUDE 1
+#define HAS_SOURCE_EXCLUDE 2
+#define HAS_DESTINATION_INCLUDE 4
+#define ALLOW_VLAN 8
+
+// filter_config is written by xdpFilter.configure, which mirrors its layout.
+struct filter_config {
+	__u32 direction;
+	__u32 flags;
+};
+
+// lpm_key holds IPv6 addresses, and IPv4 addresses mapped to IPv6.
+struct lpm_key {
+	__u32 prefixlen;
+	__u8 addr[16];
+};
+
+struct vlan_hdr {
+	__be16 tci;
+	__be16 proto;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct filter_config);
+} config SEC(".maps");
+
+// ports has an entry per port, set to 1 for the captured ports
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 65536);
+	__type(key, __u32);
+	__type(value, __u8);
+} ports SEC(".maps");
+
+#define CIDR_MAP(name)                               \
+	struct {                                     \
+		__uint(type, BPF_MAP_TYPE_LPM_TRIE); \
+		__uint(max_entries, 1024);           \
+		__uint(map_flags, BPF_F_NO_PREALLOC); \
+		__type(key, struct lpm_key);         \
+		__type(value, __u8);                 \
+	} name SEC(".maps")
+
+CIDR_MAP(source_include);
+CIDR_MAP(source_exclude);
+CIDR_MAP(destination_include);
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, __u64);
+} dropped SEC(".maps");
+
+static __always_inline int drop(void) {
+	__u32 zero = 0;
+	__u64 *count = bpf_map_lookup_elem(&dropped, &zero);
+	if (count)
+		*count += 1;
+	return XDP_DROP;
+}
+
+static __always_inline bool in_cidrs(void *cidrs, const struct lpm_key *key) {
+	return bpf_map_lookup_elem(cidrs, key) != NULL;
+}
+
+// in_either reports whether the client (or server) address is in the CIDRs:
+// the source or destination, depending on the direction.
+static __always_inline bool in_either(void *cidrs, __u32 direction, bool client, const struct lpm_key *src, const struct lpm_key *dst) {
+	if (direction == DIRECTION_EITHER)
+		return in_cidrs(cidrs, src) || in_cidrs(cidrs, dst);
+	// the client is the source of the packets sent to the ports
+	bool source = (direction == DIRECTION_DST) == client;
+	return in_cidrs(cidrs, source ? src : dst);
+}
+
+static __always_inline bool captured_port(__u16 port) {
+	__u32 key = port;
+	__u8 *captured = bpf_map_lookup_elem(&ports, &key);
+	return captured && *captured;
+}
+
+SEC("xdp")
+int xdp_filter(struct xdp_md *ctx) {
+	void *data = (void *)(long)ctx->data;
+	void *end = (void *)(long)ctx->data_end;
+	__u32 zero = 0;
+	struct filter_config *cfg = bpf_map_lookup_elem(&config, &zero);
+	if (!cfg)
+		return XDP_PASS;
+
+	struct ethhdr *eth = data;
+	if ((void *)(eth + 1) > end)
+		return XDP_PASS;
+	void *cursor = eth + 1;
+	__u16 proto = eth->h_proto;
+	// single and double (QinQ) VLAN tags
+	for (int i = 0; i < 2; i++) {
+		if (proto != bpf_htons(ETH_P_8021Q) && proto != bpf_htons(ETH_P_8021AD))
+			break;
+		if (!(cfg->flags & ALLOW_VLAN))
+			return XDP_PASS;
+		struct vlan_hdr *vlan = cursor;
+		if ((void *)(vlan + 1) > end)
+			return XDP_PASS;
+		proto = vlan->proto;
+		cursor = vlan + 1;
+	}
+
+	struct lpm_key src = {.prefixlen = 128}, dst = {.prefixlen = 128};
+	struct tcphdr *tcp;
+	if (proto == bpf_htons(ETH_P_IP)) {
+		struct iphdr *ip = cursor;
+		if ((void *)(ip + 1) > end || ip->protocol != IPPROTO_TCP)
+			return XDP_PASS;
+		// fragments other than the first have no TCP header
+		if (ip->frag_off & bpf_htons(0x1fff))
+			return XDP_PASS;
+		src.addr[10] = src.addr[11] = dst.addr[10] = dst.addr[11] = 0xff;
+		__builtin_memcpy(&src.addr[12], &ip->saddr, 4);
+		__builtin_memcpy(&dst.addr[12], &ip->daddr, 4);
+		tcp = cursor + ip->ihl * 4;
+	} else if (proto == bpf_htons(ETH_P_IPV6)) {
+		struct ipv6hdr *ip = cursor;
+		// extension headers are left to the BPF filter
+		if ((void *)(ip + 1) > end || ip->nexthdr != IPPROTO_TCP)
+			return XDP_PASS;
+		__builtin_memcpy(src.addr, &ip->saddr, 16);
+		__builtin_memcpy(dst.addr, &ip->daddr, 16);
+		tcp = (void *)(ip + 1);
+	} else {
+		return XDP_PASS;
+	}
+	if ((void *)(tcp + 1) > end)
+		return XDP_PASS;
+
+	__u16 sport = bpf_ntohs(tcp->source), dport = bpf_ntohs(tcp->dest);
+	bool port;
+	switch (cfg->direction) {
+	case DIRECTION_DST:
+		port = captured_port(dport);
+		break;
+	case DIRECTION_SRC:
+		port = captured_port(sport);
+		break;
+	default:
+		port = captured_port(sport) || captured_port(dport);
+	}
+	if (!port)
+		return drop();
+	if ((cfg->flags & HAS_SOURCE_INCLUDE) && !in_either(&source_include, cfg->direction, true, &src, &dst))
+		return drop();
+	if ((cfg->flags & HAS_SOURCE_EXCLUDE) && in_either(&source_exclude, cfg->direction, true, &src, &dst))
+		return drop();
+	if ((cfg->flags & HAS_DESTINATION_INCLUDE) && !in_either(&destination_include, cfg->direction, false, &src, &dst))
+		return drop();
+	return XDP_PASS;
+}
+
+char LICENSE[] SEC("license") = "Dual BSD/GPL";
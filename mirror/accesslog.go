@@ -0,0 +1,291 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordSource is a source of records to replay: an archive or access logs.
+type recordSource interface {
+	// next returns the next record, or io.EOF at the end of the source.
+	next() (archiveRecord, error)
+	close() error
+}
+
+// accessLogReader turns the lines of access logs into records. Access logs
+// have no body and few headers, so the records are only as complete as the
+// format.
+type accessLogReader struct {
+	lines <-chan string
+	errc  <-chan error
+	parse func(line string) (archiveRecord, error)
+	// fields are the fields of the lines of CloudFront logs
+	fields []string
+}
+
+func openAccessLogReader(location, format string) (*accessLogReader, error) {
+	r := &accessLogReader{}
+	switch format {
+	case "alb":
+		r.parse = parseALBLine
+	case "cloudfront":
+		r.fields = cloudFrontFields
+		r.parse = r.parseCloudFrontLine
+	case "nginx-json":
+		r.parse = parseNginxJSONLine
+	default:
+		return nil, fmt.Errorf("Unknown access log format %s. Valid formats are: alb, cloudfront, nginx-json.", format)
+	}
+	r.lines, r.errc = openAccessLogLines(location)
+	return r, nil
+}
+
+func (r *accessLogReader) next() (archiveRecord, error) {
+	for line := range r.lines {
+		if strings.HasPrefix(line, "#") {
+			if fields := strings.TrimPrefix(line, "#Fields:"); fields != line {
+				r.fields = strings.Fields(fields)
+			}
+			continue
+		}
+		record, err := r.parse(line)
+		if err != nil {
+			stats.inc("access_log_lines_skipped")
+			log.Println("Error parsing access log line", ":", err)
+			continue
+		}
+		stats.inc("access_log_requests")
+		return record, nil
+	}
+	select {
+	case err := <-r.errc:
+		return archiveRecord{}, err
+	default:
+		return archiveRecord{}, io.EOF
+	}
+}
+
+func (r *accessLogReader) close() error {
+	return nil
+}
+
+// newAccessLogRecord returns the record of a logged request. The requests of
+// the same client address and port are given the same connection ID, so that
+// they keep their order and affinity like the requests of a captured connection.
+func newAccessLogRecord(t time.Time, client, method, uri, host string) archiveRecord {
+	sourceIP, sourcePort, err := net.SplitHostPort(client)
+	if err != nil {
+		sourceIP = client
+	}
+	h := fnv.New64a()
+	fmt.Fprint(h, client)
+	return archiveRecord{
+		Time:         t,
+		SourceIP:     sourceIP,
+		SourcePort:   sourcePort,
+		ConnectionID: fmt.Sprintf("%016x", h.Sum64()),
+		Method:       method,
+		URI:          uri,
+		Proto:        "HTTP/1.1",
+		Host:         host,
+		Headers:      http.Header{},
+	}
+}
+
+// splitALBFields splits a line of an ALB log on spaces, keeping the quoted
+// fields, like the request and the user agent, whole and unquoted.
+func splitALBFields(line string) []string {
+	var fields []string
+	for line = strings.TrimLeft(line, " "); line != ""; line = strings.TrimLeft(line, " ") {
+		if line[0] == '"' {
+			end := 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				// unterminated quote
+				fields = append(fields, line[1:])
+				break
+			}
+			fields = append(fields, strings.ReplaceAll(line[1:end], `\"`, `"`))
+			line = line[end+1:]
+			continue
+		}
+		end := strings.IndexByte(line, ' ')
+		if end < 0 {
+			end = len(line)
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+	return fields
+}
+
+// parseALBLine parses a line of an Application Load Balancer access log, whose
+// request is logged as "GET https://example.com:443/path?query HTTP/1.1".
+func parseALBLine(line string) (archiveRecord, error) {
+	fields := splitALBFields(line)
+	if len(fields) < 14 {
+		return archiveRecord{}, fmt.Errorf("ALB line has %d fields, expected at least 14", len(fields))
+	}
+	t, err := time.Parse(time.RFC3339Nano, fields[1])
+	if err != nil {
+		return archiveRecord{}, err
+	}
+	request := strings.Fields(fields[12])
+	if len(request) != 3 || request[0] == "-" {
+		return archiveRecord{}, fmt.Errorf("ALB line has no valid request: %q", fields[12])
+	}
+	u, err := url.Parse(request[1])
+	if err != nil {
+		return archiveRecord{}, err
+	}
+	host := u.Host
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		host = u.Hostname()
+	}
+	record := newAccessLogRecord(t, fields[3], request[0], u.RequestURI(), host)
+	record.Proto = request[2]
+	if fields[13] != "-" {
+		record.Headers.Set("User-Agent", fields[13])
+	}
+	return record, nil
+}
+
+// cloudFrontFields are the fields of CloudFront standard logs, used until the
+// #Fields header of a log file is read.
+var cloudFrontFields = strings.Fields("date time x-edge-location sc-bytes c-ip cs-method cs(Host) cs-uri-stem sc-status cs(Referer) cs(User-Agent) cs-uri-query cs(Cookie) x-edge-result-type x-edge-request-id x-host-header cs-protocol cs-bytes time-taken x-forwarded-for ssl-protocol ssl-cipher x-edge-response-result-type cs-protocol-version fle-status fle-encrypted-fields c-port")
+
+// parseCloudFrontLine parses a tab separated line of a CloudFront log, whose
+// values are URL encoded and "-" when empty.
+func (r *accessLogReader) parseCloudFrontLine(line string) (archiveRecord, error) {
+	values := strings.Split(line, "\t")
+	if len(values) != len(r.fields) {
+		return archiveRecord{}, fmt.Errorf("CloudFront line has %d fields, expected %d", len(values), len(r.fields))
+	}
+	field, raw := map[string]string{}, map[string]string{}
+	for i, name := range r.fields {
+		raw[name] = values[i]
+		if value, err := url.PathUnescape(values[i]); err == nil && value != "-" {
+			field[name] = value
+		}
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", field["date"]+" "+field["time"])
+	if err != nil {
+		return archiveRecord{}, err
+	}
+	if field["cs-method"] == "" || field["cs-uri-stem"] == "" {
+		return archiveRecord{}, fmt.Errorf("CloudFront line has no request")
+	}
+	uri := field["cs-uri-stem"]
+	if query := raw["cs-uri-query"]; query != "" && query != "-" {
+		// the query is kept encoded
+		uri += "?" + query
+	}
+	// the viewer's host, the host of the request being the distribution domain
+	host := field["x-host-header"]
+	if host == "" {
+		host = field["cs(Host)"]
+	}
+	client := field["c-ip"]
+	if port := field["c-port"]; port != "" {
+		client = net.JoinHostPort(client, port)
+	}
+	record := newAccessLogRecord(t, client, field["cs-method"], uri, host)
+	if proto := field["cs-protocol-version"]; proto != "" {
+		record.Proto = proto
+	}
+	for name, header := range map[string]string{"cs(User-Agent)": "User-Agent", "cs(Referer)": "Referer", "cs(Cookie)": "Cookie"} {
+		if value := field[name]; value != "" {
+			record.Headers.Set(header, value)
+		}
+	}
+	return record, nil
+}
+
+// parseNginxJSONLine parses a line of an nginx access log written with a JSON
+// log_format, whose keys are the names of the nginx variables: time_iso8601,
+// remote_addr, remote_port, request_method, request_uri, server_protocol,
+// host, request_body, and http_* for the headers. Without request_method and
+// request_uri, the request is read from request.
+func parseNginxJSONLine(line string) (archiveRecord, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &values); err != nil {
+		return archiveRecord{}, err
+	}
+	field := map[string]string{}
+	for key, value := range values {
+		switch value := value.(type) {
+		case string:
+			if value != "" && value != "-" {
+				field[key] = value
+			}
+		case float64:
+			field[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	}
+	method, uri, proto := field["request_method"], field["request_uri"], field["server_protocol"]
+	if request := strings.Fields(field["request"]); method == "" && len(request) == 3 {
+		method, uri, proto = request[0], request[1], request[2]
+	}
+	if method == "" || uri == "" {
+		return archiveRecord{}, fmt.Errorf("nginx line has no request")
+	}
+	t, err := nginxTime(field)
+	if err != nil {
+		return archiveRecord{}, err
+	}
+	client := field["remote_addr"]
+	if port := field["remote_port"]; port != "" {
+		client = net.JoinHostPort(client, port)
+	}
+	host := field["host"]
+	if host == "" {
+		host = field["http_host"]
+	}
+	record := newAccessLogRecord(t, client, method, uri, host)
+	if proto != "" {
+		record.Proto = proto
+	}
+	for key, value := range field {
+		if name := strings.TrimPrefix(key, "http_"); name != key && name != "host" {
+			record.Headers.Set(textproto.CanonicalMIMEHeaderKey(strings.ReplaceAll(name, "_", "-")), value)
+		}
+	}
+	if body, ok := field["request_body"]; ok {
+		record.Body = []byte(body)
+	}
+	return record, nil
+}
+
+// nginxTime returns the time of an nginx line, from time_iso8601, time_local or msec.
+func nginxTime(field map[string]string) (time.Time, error) {
+	if value, ok := field["time_iso8601"]; ok {
+		return time.Parse(time.RFC3339, value)
+	} else if value, ok := field["time_local"]; ok {
+		return time.Parse("02/Jan/2006:15:04:05 -0700", value)
+	} else if value, ok := field["msec"]; ok {
+		msec, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(msec*1e9)), nil
+	}
+	return time.Time{}, fmt.Errorf("nginx line has no time")
+}
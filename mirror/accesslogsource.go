@@ -0,0 +1,185 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// accessLogMaxLine is the maximum length of an access log line.
+const accessLogMaxLine = 1024 * 1024
+
+// openAccessLogLines returns the lines of the access logs at location:
+//   - a file, gzip compressed if its name ends with .gz
+//   - s3://bucket/prefix, the objects under the prefix in key order, like the
+//     logs delivered by ALB and CloudFront
+//   - kinesis://stream, the records of every shard of the stream, until the
+//     replay is stopped
+//
+// The lines are sent on the returned channel, which is closed at the end of
+// the logs; the error, if any, is sent on the error channel before.
+func openAccessLogLines(location string) (<-chan string, <-chan error) {
+	lines := make(chan string, 1000)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		var err error
+		switch {
+		case strings.HasPrefix(location, "s3://"):
+			err = readS3AccessLogs(strings.TrimPrefix(location, "s3://"), lines)
+		case strings.HasPrefix(location, "kinesis://"):
+			err = readKinesisAccessLogs(strings.TrimPrefix(location, "kinesis://"), lines)
+		default:
+			err = readAccessLogFile(location, lines)
+		}
+		if err != nil {
+			errc <- err
+		}
+	}()
+	return lines, errc
+}
+
+func readAccessLogFile(path string, lines chan<- string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sendLines(f, strings.HasSuffix(path, ".gz"), lines)
+}
+
+// sendLines sends the lines of r, decompressing it first if compressed is true.
+func sendLines(r io.Reader, compressed bool, lines chan<- string) error {
+	if compressed {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), accessLogMaxLine)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines <- line
+		}
+	}
+	return scanner.Err()
+}
+
+func readS3AccessLogs(location string, lines chan<- string) error {
+	parts := strings.SplitN(location, "/", 2)
+	bucket, prefix := parts[0], ""
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+	cfg, err := awsConfig()
+	if err != nil {
+		return err
+	}
+	client := s3.NewFromConfig(cfg)
+	ctx := context.Background()
+	// the listing is in key order, which is the time order of ALB and CloudFront logs
+	pages := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+			if err != nil {
+				return err
+			}
+			err = sendLines(out.Body, strings.HasSuffix(key, ".gz"), lines)
+			out.Body.Close()
+			if err != nil {
+				return fmt.Errorf("Error reading s3://%s/%s: %v", bucket, key, err)
+			}
+			stats.inc("access_log_objects_read")
+		}
+	}
+	return nil
+}
+
+// kinesisPollInterval is the interval between two reads of a shard, within the
+// limit of 5 reads per second and shard.
+const kinesisPollInterval = time.Second
+
+func readKinesisAccessLogs(stream string, lines chan<- string) error {
+	cfg, err := awsConfig()
+	if err != nil {
+		return err
+	}
+	client := kinesis.NewFromConfig(cfg)
+	ctx := context.Background()
+	out, err := client.ListShards(ctx, &kinesis.ListShardsInput{StreamName: aws.String(stream)})
+	if err != nil {
+		return err
+	}
+	iteratorType := kinesistypes.ShardIteratorTypeLatest
+	if *accessLogKinesisStart == "trim-horizon" {
+		iteratorType = kinesistypes.ShardIteratorTypeTrimHorizon
+	}
+	errc := make(chan error, len(out.Shards))
+	for _, shard := range out.Shards {
+		go func(shardID string) {
+			errc <- readKinesisShard(ctx, client, stream, shardID, iteratorType, lines)
+		}(aws.ToString(shard.ShardId))
+	}
+	// the shards are read until one fails; closed shards end without error
+	for range out.Shards {
+		if err := <-errc; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readKinesisShard(ctx context.Context, client *kinesis.Client, stream, shardID string, iteratorType kinesistypes.ShardIteratorType, lines chan<- string) error {
+	it, err := client.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(stream),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: iteratorType,
+	})
+	if err != nil {
+		return err
+	}
+	iterator := it.ShardIterator
+	for iterator != nil {
+		out, err := client.GetRecords(ctx, &kinesis.GetRecordsInput{ShardIterator: iterator})
+		if err != nil {
+			return fmt.Errorf("Error reading shard %s of %s: %v", shardID, stream, err)
+		}
+		for _, record := range out.Records {
+			// a record holds one or more lines, gzip compressed by some producers
+			compressed := bytes.HasPrefix(record.Data, []byte{0x1f, 0x8b})
+			if err := sendLines(bytes.NewReader(record.Data), compressed, lines); err != nil {
+				stats.inc("access_log_records_invalid")
+				log.Println("Error reading record of shard", shardID, ":", err)
+			}
+		}
+		iterator = out.NextShardIterator
+		if len(out.Records) == 0 {
+			time.Sleep(kinesisPollInterval)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// The admin API lets operators adjust a running mirror:
+//
+//	GET  /routes       returns the route table
+//	PUT  /routes       replaces the route table
+//	GET  /sampling     returns the sampling percentage
+//	PUT  /sampling     sets the sampling percentage, e.g. {"percentage": 10}
+//	GET  /sampling/bucket?value=v  tells in which bucket a header value or remote address falls
+//	POST /pause        stops forwarding requests, ?mode=count|drop (see pauseMode)
+//	POST /resume       resumes forwarding requests, and accepts new streams after a drain
+//	POST /drain        stops accepting new streams and waits for in-flight forwards
+//	POST /reload       reloads the configuration file, like SIGHUP
+//	GET  /stats        returns the pipeline counters
+//	GET  /metrics      returns the pipeline counters in the Prometheus text format
+//	GET  /paths?top=n  returns the paths with the most forwarded requests, with path-stats
+//	GET  /fingerprints?top=n  returns the endpoints with the most captured requests, with fingerprints
+//	GET  /coverage     returns the requests of the operations of the OpenAPI spec, with openapi-spec
+//	GET  /diffs        summarizes the response diffs by endpoint, with diff
+//	GET  /scorecard    returns the last shadow scorecard, with scorecard-interval
+//	GET  /guardrail    tells whether the guardrail paused forwarding, with guardrail-max-*
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", adminRoutes)
+	mux.HandleFunc("/sampling", adminSampling)
+	mux.HandleFunc("/sampling/bucket", adminBucket)
+	mux.HandleFunc("/pause", adminPause)
+	mux.HandleFunc("/resume", adminResume)
+	mux.HandleFunc("/drain", adminDrain)
+	mux.HandleFunc("/reload", adminReload)
+	mux.HandleFunc("/stats", adminStats)
+	mux.HandleFunc("/metrics", adminMetrics)
+	mux.HandleFunc("/paths", adminPaths)
+	mux.HandleFunc("/fingerprints", adminFingerprints)
+	mux.HandleFunc("/coverage", adminCoverage)
+	mux.HandleFunc("/diffs", adminDiffs)
+	mux.HandleFunc("/scorecard", adminScorecard)
+	mux.HandleFunc("/guardrail", adminGuardrail)
+	mux.HandleFunc("/ja3", adminJA3)
+	return mux
+}
+
+// serveAdmin listens on addr, and serves the admin API in the background.
+func serveAdmin(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Error listening on %s for the admin API: %v", addr, err)
+	}
+	log.Println("Admin API listening on", addr)
+	go func() {
+		<-captureStop
+		ln.Close()
+	}()
+	go func() {
+		if err := http.Serve(ln, newAdminMux()); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("Error serving admin API", ":", err)
+		}
+	}()
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminRoutes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fwdRoutes.mu.RLock()
+		defer fwdRoutes.mu.RUnlock()
+		writeJSON(w, fwdRoutes.routes)
+	case http.MethodPut:
+		var routes map[string]route
+		if err := json.NewDecoder(r.Body).Decode(&routes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateRoutes(routes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fwdRoutes.set(routes)
+		log.Println("Route table updated from admin API with", len(routes), "entries")
+		writeJSON(w, routes)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func adminSampling(w http.ResponseWriter, r *http.Request) {
+	var sampling struct {
+		Percentage float64 `json:"percentage"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&sampling); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if sampling.Percentage > 100 || sampling.Percentage < 0 {
+			http.Error(w, fmt.Sprintf("percentage is not between 0 and 100. Value: %f.", sampling.Percentage), http.StatusBadRequest)
+			return
+		}
+		setSamplingPercentage(sampling.Percentage)
+		log.Println("Sampling percentage set from admin API to", sampling.Percentage)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sampling.Percentage = samplingPercentage()
+	writeJSON(w, sampling)
+}
+
+func adminBucket(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, inspectBucket(currentConfig(), r.URL.Query().Get("value")))
+}
+
+func adminPause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mode, err := parsePauseMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setPauseMode(mode)
+	log.Println("Forwarding paused from admin API, mode", mode)
+	writeJSON(w, map[string]string{"paused": mode.String()})
+}
+
+func adminResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	setPauseMode(pauseNone)
+	undrain()
+	log.Println("Forwarding resumed from admin API")
+	writeJSON(w, map[string]string{"paused": pauseNone.String()})
+}
+
+func adminDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Println("Draining from admin API")
+	if !drain(currentConfig().drainTimeout) {
+		http.Error(w, "drain timed out with requests in flight", http.StatusGatewayTimeout)
+		return
+	}
+	writeJSON(w, map[string]bool{"drained": true})
+}
+
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]bool{"reloaded": true})
+}
+
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	recordPipelineGauges()
+	writeJSON(w, stats.snapshot())
+}
+
+// adminMetrics serves the same counters as /stats in the Prometheus text format.
+func adminMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	recordPipelineGauges()
+	stats.writePrometheus(w)
+}
+
+func adminPaths(w http.ResponseWriter, r *http.Request) {
+	conf := currentConfig()
+	paths := conf.paths
+	if paths == nil {
+		http.Error(w, "path statistics are disabled, see the path-stats flag", http.StatusNotFound)
+		return
+	}
+	n := conf.pathReportTop
+	if v := r.URL.Query().Get("top"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(w, "top must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, paths.top(n))
+}
+
+func adminFingerprints(w http.ResponseWriter, r *http.Request) {
+	fingerprints := currentConfig().fingerprints
+	if fingerprints == nil {
+		http.Error(w, "request fingerprints are disabled, see the fingerprints flag", http.StatusNotFound)
+		return
+	}
+	n := 0
+	if v := r.URL.Query().Get("top"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(w, "top must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, fingerprints.report(n))
+}
+
+func adminCoverage(w http.ResponseWriter, r *http.Request) {
+	coverage := currentConfig().coverage
+	if coverage == nil {
+		http.Error(w, "API coverage is disabled, see the openapi-spec flag", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, coverage.report())
+}
+
+func adminDiffs(w http.ResponseWriter, r *http.Request) {
+	diffs := fwdDiffs
+	if diffs == nil {
+		http.Error(w, "response diffs are disabled, see the diff flag", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, diffs.summary.report())
+}
+
+func adminScorecard(w http.ResponseWriter, r *http.Request) {
+	scorecard := fwdScorecard
+	if scorecard == nil {
+		http.Error(w, "scorecards are disabled, see the scorecard-interval flag", http.StatusNotFound)
+		return
+	}
+	report := scorecard.lastReport()
+	if report == nil {
+		http.Error(w, "no scorecard yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, report)
+}
+
+func adminGuardrail(w http.ResponseWriter, r *http.Request) {
+	guardrail := fwdGuardrail
+	if guardrail == nil {
+		http.Error(w, "the guardrail is disabled, see the guardrail-max-error-rate and guardrail-max-p99 flags", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"tripped": guardrail.state(), "paused": currentPauseMode().String()})
+}
+
+func adminJA3(w http.ResponseWriter, r *http.Request) {
+	ja3 := currentConfig().ja3
+	if ja3 == nil {
+		http.Error(w, "TLS fingerprints are disabled, see the ja3 flag", http.StatusNotFound)
+		return
+	}
+	n := 20
+	if v := r.URL.Query().Get("top"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(w, "top must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, ja3.top(n))
+}
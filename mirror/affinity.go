@@ -0,0 +1,103 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// affinityIdleTimeout is how long the upstream connections of a captured
+// connection are kept after its last forward.
+const affinityIdleTimeout = 2 * time.Minute
+
+// connectionAffinity maps each captured client connection to its own HTTP
+// client, whose transport keeps a single persistent connection per
+// destination, so that stateful destinations see the requests of a client
+// connection on one connection, like production.
+type connectionAffinity struct {
+	mu      sync.Mutex
+	clients map[string]*affinityClient
+}
+
+type affinityClient struct {
+	client   *http.Client
+	lastUsed time.Time
+}
+
+var fwdAffinity *connectionAffinity
+
+func newConnectionAffinity() *connectionAffinity {
+	a := &connectionAffinity{clients: map[string]*affinityClient{}}
+	go a.expireLoop()
+	return a
+}
+
+// client returns the HTTP client of the captured connection id.
+func (a *connectionAffinity) client(id string) *http.Client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.clients[id]
+	if !ok {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxConnsPerHost = 1
+		transport.MaxIdleConnsPerHost = 1
+		transport.IdleConnTimeout = affinityIdleTimeout
+		c = &affinityClient{client: &http.Client{Transport: transport}}
+		a.clients[id] = c
+		stats.set("affinity_connections", int64(len(a.clients)))
+	}
+	c.lastUsed = time.Now()
+	return c.client
+}
+
+// expireLoop closes the connections of the clients idle for affinityIdleTimeout.
+// It never returns.
+func (a *connectionAffinity) expireLoop() {
+	for {
+		time.Sleep(affinityIdleTimeout / 2)
+		a.mu.Lock()
+		for id, c := range a.clients {
+			if time.Since(c.lastUsed) > affinityIdleTimeout {
+				c.client.CloseIdleConnections()
+				fwdRawTransport.closePool(id)
+				delete(a.clients, id)
+			}
+		}
+		stats.set("affinity_connections", int64(len(a.clients)))
+		a.mu.Unlock()
+	}
+}
+
+// validAffinityKey reports whether key is empty or like header:<name> or cookie:<name>.
+func validAffinityKey(key string) bool {
+	if key == "" {
+		return true
+	}
+	for _, prefix := range []string{"header:", "cookie:"} {
+		if strings.HasPrefix(key, prefix) {
+			return len(key) > len(prefix)
+		}
+	}
+	return false
+}
+
+// setAffinityKey sets the affinity-key header or cookie of a forwarded request
+// to the ID of its captured connection, so that sticky load balancers in front
+// of the destination route the requests of a connection to the same backend.
+func setAffinityKey(header http.Header, key, connectionID string) {
+	switch {
+	case strings.HasPrefix(key, "header:"):
+		header.Set(strings.TrimPrefix(key, "header:"), connectionID)
+	case strings.HasPrefix(key, "cookie:"):
+		cookie := fmt.Sprintf("%s=%s", strings.TrimPrefix(key, "cookie:"), connectionID)
+		if existing := header.Get("Cookie"); existing != "" {
+			cookie = existing + "; " + cookie
+		}
+		header.Set("Cookie", cookie)
+	}
+}
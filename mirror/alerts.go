@@ -0,0 +1,105 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// alertEvent is a structured alert, logged and sent to the alert-webhook and
+// alert-sns-topic flags if they are set.
+type alertEvent struct {
+	Time    time.Time              `json:"time"`
+	Kind    string                 `json:"kind"`
+	Name    string                 `json:"name"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// sendAlert delivers event to every configured alert sink, in the background so
+// that a slow sink does not delay the caller.
+func sendAlert(event alertEvent) {
+	conf := currentConfig()
+	event.Time = time.Now().UTC()
+	data, _ := json.Marshal(event)
+	log.Println("Alert", string(data))
+	stats.inc(labeled("alerts", "kind", event.Kind))
+
+	if conf.alertWebhook != "" {
+		payload := data
+		if conf.alertWebhookFormat == "slack" {
+			payload = slackMessage(event)
+		}
+		go func() {
+			if err := postAlert(conf.alertWebhook, payload); err != nil {
+				stats.inc("alert_errors")
+				log.Println("Error sending alert to webhook", ":", err)
+			}
+		}()
+	}
+	if conf.alertSNSTopic != "" {
+		go func() {
+			if err := publishAlert(conf.alertSNSTopic, event, data); err != nil {
+				stats.inc("alert_errors")
+				log.Println("Error publishing alert to SNS", ":", err)
+			}
+		}()
+	}
+}
+
+// slackMessage returns the payload of a Slack incoming webhook for event.
+func slackMessage(event alertEvent) []byte {
+	data, _ := json.Marshal(map[string]string{"text": fmt.Sprintf(":warning: *%s*\n%s", event.title(), event.Message)})
+	return data
+}
+
+func (event alertEvent) title() string {
+	if event.Name == "" {
+		return "Mirror alert: " + event.Kind
+	}
+	return fmt.Sprintf("Mirror alert: %s %s", event.Kind, event.Name)
+}
+
+func postAlert(url string, data []byte) error {
+	resp, err := alertClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func publishAlert(topic string, event alertEvent, data []byte) error {
+	cfg, err := awsConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	subject := event.title()
+	if len(subject) > 100 {
+		// the maximum length of SNS subjects
+		subject = subject[:100]
+	}
+	_, err = sns.NewFromConfig(cfg).Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(topic),
+		Subject:  aws.String(subject),
+		Message:  aws.String(string(data)),
+	})
+	return err
+}
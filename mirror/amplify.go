@@ -0,0 +1,44 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	math_rand "math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// amplifyRequest forwards amplify-1 copies of a sampled request, each with its own
+// request ID and delayed by a random duration up to the amplify-jitter flag.
+// The copies go through the rest of the pipeline like the request, but are not
+// diffed, as production answered only once, and are forwarded without the raw
+// TCP sink.
+func amplifyRequest(conf *configSnapshot, req *http.Request, info captureInfo, body []byte) {
+	for i := 1; i < conf.amplify; i++ {
+		// the request is cloned now, as the hooks may modify it
+		copyReq := req.Clone(req.Context())
+		copyInfo := info
+		copyInfo.requestID = newRequestID()
+		copyInfo.amplified = i
+		copyInfo.index = 0
+		copyInfo.raw = nil
+		stats.inc("requests_amplified")
+		atomic.AddInt64(&fwdInFlight, 1)
+		go func() {
+			if conf.amplifyJitter > 0 {
+				timer := time.NewTimer(time.Duration(math_rand.Int63n(int64(conf.amplifyJitter))))
+				select {
+				case <-timer.C:
+				case <-fwdCtx.Done():
+					timer.Stop()
+					atomic.AddInt64(&fwdInFlight, -1)
+					stats.inc("forward_cancelled")
+					return
+				}
+			}
+			forwardRequest(copyReq, copyInfo, body)
+		}()
+	}
+}
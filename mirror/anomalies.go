@@ -0,0 +1,129 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// anomalyMinForwards is the minimum number of forwards in an interval for its
+// error rate to be meaningful.
+const anomalyMinForwards = 10
+
+// anomalyDetector watches the pipeline for conditions that need attention and
+// alerts when one holds for anomaly-windows consecutive intervals. A condition
+// alerts once, and again only after it has cleared.
+type anomalyDetector struct {
+	// streaks counts the consecutive intervals each condition held, by name
+	streaks map[string]int
+	last    map[string]int64
+	// previous pcap statistics, cumulative since the capture started
+	received, dropped int
+}
+
+func newAnomalyDetector() *anomalyDetector {
+	return &anomalyDetector{streaks: map[string]int{}, last: map[string]int64{}}
+}
+
+// watchAnomalies evaluates the conditions at every anomaly-interval. It never returns.
+func watchAnomalies() {
+	d := newAnomalyDetector()
+	for {
+		time.Sleep(currentConfig().anomalyInterval)
+		d.evaluate()
+	}
+}
+
+func (d *anomalyDetector) evaluate() {
+	conf := currentConfig()
+	held := map[string]alertEvent{}
+
+	// packets dropped by the kernel or the interface before they were captured
+	if totalReceived, totalDropped, ok := captureCounts(); ok {
+		// the counts start again when the capture is reopened
+		if totalReceived < d.received || totalDropped < d.dropped {
+			d.received, d.dropped = 0, 0
+		}
+		received, lost := totalReceived-d.received, totalDropped-d.dropped
+		d.received, d.dropped = totalReceived, totalDropped
+		if lost > 0 && float64(lost)/float64(received+lost) > conf.anomalyDropRate {
+			held["packet_drops"] = alertEvent{
+				Kind:    "packet_drops",
+				Message: fmt.Sprintf("%d of %d packets dropped before capture in the last %s", lost, received+lost, conf.anomalyInterval),
+				Details: map[string]interface{}{"dropped": lost, "received": received},
+			}
+		}
+	}
+
+	// forwards that failed or timed out
+	values := stats.snapshot()
+	failed := d.delta(values, "forward_errors") + d.delta(values, "forward_timeouts")
+	forwarded := d.delta(values, "requests_forwarded")
+	if total := failed + forwarded; total >= anomalyMinForwards && float64(failed)/float64(total) > conf.anomalyErrorRate {
+		held["forward_errors"] = alertEvent{
+			Kind:    "forward_errors",
+			Message: fmt.Sprintf("%d of %d forwards failed in the last %s", failed, total, conf.anomalyInterval),
+			Details: map[string]interface{}{"failed": failed, "total": total},
+		}
+	}
+
+	// requests forwarded long after they were captured, e.g. behind a slow destination
+	if conf.anomalyMirrorLag > 0 {
+		if lag := takeMaxMirrorLag(); lag > conf.anomalyMirrorLag {
+			held["mirror_lag"] = alertEvent{
+				Kind:    "mirror_lag",
+				Message: fmt.Sprintf("requests forwarded up to %s after capture in the last %s", lag.Round(time.Millisecond), conf.anomalyInterval),
+				Details: map[string]interface{}{"max_lag_ms": lag.Milliseconds()},
+			}
+		}
+	}
+
+	// routes that matched no request, which usually means a stale route table
+	if conf.anomalyIdleRoutes {
+		hits := fwdRoutes.takeHits()
+		keys := make([]string, 0, len(hits))
+		for key := range hits {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if hits[key] == 0 {
+				held["idle_route "+key] = alertEvent{
+					Kind:    "idle_route",
+					Name:    key,
+					Message: fmt.Sprintf("route %s matched no request in the last %d intervals of %s", key, conf.anomalyWindows, conf.anomalyInterval),
+				}
+			}
+		}
+	}
+
+	// routes whose volume deviates from their baseline, e.g. after the mirror
+	// session or the routing upstream broke
+	if conf.anomalyVolumeFactor > 0 && fwdRouteVolume != nil {
+		for name, event := range fwdRouteVolume.evaluate(conf.anomalyInterval, conf.anomalyVolumeWindows, conf.anomalyVolumeFactor, conf.anomalyVolumeMinRate) {
+			held[name] = event
+		}
+	}
+
+	for name := range d.streaks {
+		if _, ok := held[name]; !ok {
+			delete(d.streaks, name)
+		}
+	}
+	for name, event := range held {
+		d.streaks[name]++
+		if d.streaks[name] == conf.anomalyWindows {
+			sendAlert(event)
+		}
+	}
+}
+
+// delta returns the increase of the counter name since the last evaluation.
+func (d *anomalyDetector) delta(values map[string]int64, name string) int64 {
+	delta := values[name] - d.last[name]
+	d.last[name] = values[name]
+	return delta
+}
@@ -0,0 +1,440 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveRecord is a captured request as stored in an archive file, one JSON
+// document per line. Records are written before sampling and filtering, so that
+// a replay runs them through the same pipeline as live traffic.
+type archiveRecord struct {
+	Time            time.Time   `json:"time"`
+	SourceIP        string      `json:"source_ip"`
+	SourcePort      string      `json:"source_port"`
+	DestinationIP   string      `json:"destination_ip"`
+	DestinationPort string      `json:"destination_port"`
+	ConnectionID    string      `json:"connection_id"`
+	RequestID       string      `json:"request_id,omitempty"`
+	Method          string      `json:"method"`
+	URI             string      `json:"uri"`
+	Proto           string      `json:"proto"`
+	Host            string      `json:"host"`
+	Headers         http.Header `json:"headers"`
+	Body            []byte      `json:"body"`
+	Trailers        http.Header `json:"trailers,omitempty"`
+	// ClientCert is the DER certificate of the client, on decrypted TLS connections
+	ClientCert []byte `json:"client_cert,omitempty"`
+	// JA3 is the fingerprint of the ClientHello of the TLS connection, with -ja3
+	JA3 string `json:"ja3,omitempty"`
+	// Pipeline is the pipeline that recorded the request, if any, and Sequence
+	// the order in which its requests were recorded, from 1. Records of archives
+	// written before sequences existed have none
+	Pipeline string `json:"pipeline,omitempty"`
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+func newArchiveRecord(req *http.Request, info captureInfo, body []byte) archiveRecord {
+	var clientCert []byte
+	if info.clientCert != nil {
+		clientCert = info.clientCert.Raw
+	}
+	return archiveRecord{
+		Time:            info.time,
+		SourceIP:        info.sourceIP,
+		SourcePort:      info.sourcePort,
+		DestinationIP:   info.destinationIP,
+		DestinationPort: info.destinationPort,
+		ConnectionID:    info.connectionID,
+		RequestID:       info.requestID,
+		Method:          req.Method,
+		URI:             req.RequestURI,
+		Proto:           req.Proto,
+		Host:            req.Host,
+		Headers:         req.Header,
+		Body:            body,
+		Trailers:        req.Trailer,
+		ClientCert:      clientCert,
+		JA3:             info.ja3,
+	}
+}
+
+// request rebuilds the captured request, as http.ReadRequest would have returned it.
+func (r archiveRecord) request() *http.Request {
+	req := &http.Request{
+		Method:     r.Method,
+		RequestURI: r.URI,
+		Proto:      r.Proto,
+		Host:       r.Host,
+		Header:     r.Headers,
+		Trailer:    r.Trailers,
+	}
+	req.ProtoMajor, req.ProtoMinor, _ = http.ParseHTTPVersion(r.Proto)
+	req.URL, _ = url.ParseRequestURI(r.URI)
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	return req
+}
+
+// captureInfo returns the capture metadata of the record. Records of archives
+// written before request IDs existed get a new ID.
+func (r archiveRecord) captureInfo() captureInfo {
+	info := captureInfo{
+		sourceIP:        r.SourceIP,
+		sourcePort:      r.SourcePort,
+		destinationIP:   r.DestinationIP,
+		destinationPort: r.DestinationPort,
+		time:            r.Time,
+		connectionID:    r.ConnectionID,
+		requestID:       r.RequestID,
+		ja3:             r.JA3,
+	}
+	if info.requestID == "" {
+		info.requestID = newRequestID()
+	}
+	if r.ClientCert != nil {
+		info.clientCert, _ = x509.ParseCertificate(r.ClientCert)
+	}
+	return info
+}
+
+// archiveWriter appends records to an archive file, numbering them.
+type archiveWriter struct {
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	enc      *json.Encoder
+	sequence uint64
+	// written counts the bytes of the file, and crypt encrypts them with
+	// archive-encryption
+	written *countingWriter
+	crypt   *archiveEncrypter
+	// with compression, the records are encoded to zw, in frames of
+	// frameRecords records indexed in index at the offsets of written
+	zw           *zstd.Encoder
+	index        *os.File
+	frameRecords int
+	closed       bool
+	// path is the file of the archive, and retention the rotated archives of
+	// record-max-disk-usage and record-max-age
+	path      string
+	retention *archiveRetention
+}
+
+var fwdArchive *archiveWriter
+
+// openArchiveWriter opens the archive path for appending. The sequence goes on
+// from the last record of an existing archive.
+func openArchiveWriter(path string) (*archiveWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a, err := newArchiveWriter(f, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func newArchiveWriter(f *os.File, path string) (*archiveWriter, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	head := make([]byte, len(archiveMagic))
+	encrypted := *archiveEncryption != ""
+	if size > 0 {
+		n, _ := f.ReadAt(head, 0)
+		if isEncryptedArchive(head[:n]) && !encrypted {
+			return nil, fmt.Errorf("Archive %s is encrypted: set archive-encryption to append to it.", path)
+		} else if !isEncryptedArchive(head[:n]) && encrypted {
+			return nil, fmt.Errorf("Archive %s is not encrypted: record the requests to a new archive to encrypt them.", path)
+		}
+	}
+	if encrypted && size == 0 {
+		if _, err := f.Write([]byte(archiveMagic)); err != nil {
+			return nil, err
+		}
+		size = int64(len(archiveMagic))
+	}
+
+	var sequence uint64
+	if isCompressedArchive(path) || encrypted {
+		sequence, err = lastReadableArchiveSequence(path)
+	} else {
+		sequence, err = lastArchiveSequence(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a := &archiveWriter{f: f, sequence: sequence, written: &countingWriter{w: f, n: size}, path: path}
+	var out io.Writer = a.written
+	if encrypted {
+		a.crypt = &archiveEncrypter{w: a.written}
+		out = a.crypt
+	}
+	a.w = bufio.NewWriter(out)
+	a.enc = json.NewEncoder(a.w)
+	if isCompressedArchive(path) {
+		if err := a.setupCompression(path); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// lastArchiveSequence returns the sequence of the last record of the archive
+// f, reading it from the end.
+func lastArchiveSequence(f *os.File) (uint64, error) {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, err
+	}
+	size := info.Size()
+	for window := int64(64 * 1024); ; window *= 2 {
+		if window > size {
+			window = size
+		}
+		data := make([]byte, window)
+		if _, err := f.ReadAt(data, size-window); err != nil {
+			return 0, err
+		}
+		for {
+			data = bytes.TrimRight(data, "\n")
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 && window < size {
+				// the record is longer than the window
+				break
+			}
+			var record struct {
+				Sequence uint64 `json:"sequence"`
+			}
+			// a last record cut short by a crash is skipped
+			if json.Unmarshal(data[i+1:], &record) == nil {
+				return record.Sequence, nil
+			}
+			if i < 0 {
+				return 0, nil
+			}
+			data = data[:i]
+		}
+	}
+}
+
+func (a *archiveWriter) write(record archiveRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return os.ErrClosed
+	}
+	if a.retention != nil && a.retention.stopped {
+		stats.inc("archive_records_dropped")
+		return nil
+	}
+	a.sequence++
+	record.Pipeline, record.Sequence = *pipelineName, a.sequence
+	var err error
+	if a.zw != nil {
+		err = a.writeCompressed(record)
+	} else if err = a.enc.Encode(record); err == nil {
+		err = a.flush()
+	}
+	if err != nil || a.retention == nil {
+		return err
+	}
+	return a.retain()
+}
+
+// flush writes the buffered records to the file, as a data chunk when the
+// archive is encrypted.
+func (a *archiveWriter) flush() error {
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+	if a.crypt != nil {
+		return a.crypt.seal()
+	}
+	return nil
+}
+
+// close ends the archive. The records written after are rejected.
+func (a *archiveWriter) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	if a.retention != nil && a.retention.stopped {
+		// the file was closed when recording stopped
+		return nil
+	}
+	return a.closeFile()
+}
+
+// closeFile ends the current frame of a compressed archive, and closes the
+// file and its index.
+func (a *archiveWriter) closeFile() error {
+	if a.zw != nil {
+		if a.frameRecords > 0 {
+			a.frameRecords = 0
+			a.zw.Close()
+			a.flush()
+		}
+		a.index.Close()
+	}
+	return a.f.Close()
+}
+
+// archiveReader reads records from an archive file.
+type archiveReader struct {
+	f   *os.File
+	dec *json.Decoder
+	// base is the offset of the file the decoder started at
+	base int64
+	// encrypted is set for archives encrypted with archive-encryption, which
+	// are read through a decrypter
+	encrypted bool
+	// with compression, zr decompresses the frames of the file from the offset
+	// frame, which are listed by index
+	zr    *zstd.Decoder
+	index []archiveIndexEntry
+	frame int64
+	// last is the sequence of the last record read, and the records before
+	// fromSequence and fromTime are skipped, see skipTo
+	last         uint64
+	fromSequence uint64
+	fromTime     time.Time
+}
+
+func openArchiveReader(path string) (*archiveReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, len(archiveMagic))
+	n, _ := io.ReadFull(f, head)
+	a := &archiveReader{f: f, encrypted: isEncryptedArchive(head[:n])}
+	if !a.encrypted {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	src := a.source()
+	if err == nil && isCompressedArchive(path) {
+		if a.index, err = readArchiveIndex(path); err == nil {
+			a.zr, err = zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+			src = a.zr
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a.dec = json.NewDecoder(src)
+	return a, nil
+}
+
+// source returns the reader of the bytes of the file from its current offset,
+// decrypted if needed.
+func (a *archiveReader) source() io.Reader {
+	if a.encrypted {
+		return &archiveDecrypter{r: bufio.NewReader(a.f)}
+	}
+	return bufio.NewReader(a.f)
+}
+
+// byOffset reports whether the archive can be positioned with seek, or only
+// with skipTo: the offsets of compressed or encrypted archives are not those of
+// their records.
+func (a *archiveReader) byOffset() bool {
+	return a.zr == nil && !a.encrypted
+}
+
+// lastReadableArchiveSequence returns the sequence of the last record of the
+// compressed or encrypted archive path, reading it from its last frame.
+func lastReadableArchiveSequence(path string) (uint64, error) {
+	a, err := openArchiveReader(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer a.close()
+	if n := len(a.index); n > 0 {
+		if err := a.seekFrame(a.index[n-1].Offset); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		if _, err := a.next(); err != nil {
+			return a.last, nil
+		}
+	}
+}
+
+// next returns the next record, or io.EOF at the end of the archive.
+func (a *archiveReader) next() (archiveRecord, error) {
+	for {
+		var record archiveRecord
+		err := a.dec.Decode(&record)
+		if err != nil && err != io.EOF && a.zr != nil && a.nextFrame() {
+			stats.inc("archive_frames_skipped")
+			continue
+		}
+		if err == io.ErrUnexpectedEOF && !a.byOffset() {
+			// the last frame or chunk of a capture that crashed
+			stats.inc("archive_frames_truncated")
+			err = io.EOF
+		}
+		if err != nil {
+			return record, err
+		}
+		a.last = record.Sequence
+		if record.Sequence < a.fromSequence || record.Time.Before(a.fromTime) {
+			continue
+		}
+		return record, nil
+	}
+}
+
+// offset returns the offset in the archive after the last record read, or 0
+// for the archives positioned with skipTo.
+func (a *archiveReader) offset() int64 {
+	if !a.byOffset() {
+		return 0
+	}
+	return a.base + a.dec.InputOffset()
+}
+
+// seek moves to offset, the start of a record.
+func (a *archiveReader) seek(offset int64) error {
+	if _, err := a.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	a.base, a.dec = offset, json.NewDecoder(bufio.NewReader(a.f))
+	return nil
+}
+
+func (a *archiveReader) close() error {
+	if a.zr != nil {
+		a.zr.Close()
+	}
+	return a.f.Close()
+}
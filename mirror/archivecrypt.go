@@ -0,0 +1,344 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// archiveMagic starts the encrypted archives. The rest of the file is made of
+// chunks: a type, a big endian length and the payload. Key chunks hold the
+// data key of the next data chunks, encrypted by the key encryption key; data
+// chunks hold a nonce and the bytes of the archive, encrypted with AES-GCM by
+// the data key.
+const archiveMagic = "HRM-ARCHIVE-1\n"
+
+const (
+	archiveChunkKey  = 'K'
+	archiveChunkData = 'D'
+	// archiveMaxChunk bounds the chunks read, against corrupted lengths
+	archiveMaxChunk = 256 << 20
+)
+
+// archiveKeyHeader is the payload of a key chunk.
+type archiveKeyHeader struct {
+	// Provider is kms or local, and KeyID the KMS key, or the fingerprint of
+	// the local key, that encrypted the data key
+	Provider   string `json:"provider"`
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// archiveKeyring creates and decrypts the data keys of encrypted archives.
+type archiveKeyring struct {
+	mu sync.Mutex
+	// local holds the keys of archive-key-file by fingerprint, the first one
+	// encrypting the new data keys
+	local   map[string][]byte
+	current string
+	// unwrapped caches the decrypted data keys by wrapped key, as the key
+	// chunk of a data key is repeated at every frame
+	unwrapped map[string]cipher.AEAD
+}
+
+var archiveKeys = &archiveKeyring{unwrapped: map[string]cipher.AEAD{}}
+
+// loadLocalKeys reads the keys of path, one base64 encoded 32 bytes key per
+// line. The first key encrypts, the others are kept to decrypt the archives
+// written before a rotation.
+func (k *archiveKeyring) loadLocalKeys(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.local, k.current = map[string][]byte{}, ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("Error reading %s: keys must be 32 bytes, base64 encoded.", path)
+		}
+		fingerprint := keyFingerprint(key)
+		k.local[fingerprint] = key
+		if k.current == "" {
+			k.current = fingerprint
+		}
+	}
+	if k.current == "" {
+		return fmt.Errorf("Error reading %s: no key.", path)
+	}
+	return nil
+}
+
+// keyFingerprint identifies a local key in the key chunks.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// newDataKey returns a new data key, with the header of its key chunk.
+func (k *archiveKeyring) newDataKey() (cipher.AEAD, archiveKeyHeader, error) {
+	var header archiveKeyHeader
+	var plain []byte
+	switch *archiveEncryption {
+	case "kms":
+		cfg, err := awsConfig()
+		if err != nil {
+			return nil, header, err
+		}
+		out, err := kms.NewFromConfig(cfg).GenerateDataKey(context.Background(), &kms.GenerateDataKeyInput{
+			KeyId:   aws.String(*archiveKMSKeyID),
+			KeySpec: kmstypes.DataKeySpecAes256,
+		})
+		if err != nil {
+			return nil, header, fmt.Errorf("Error generating a data key with KMS: %v", err)
+		}
+		plain = out.Plaintext
+		header = archiveKeyHeader{Provider: "kms", KeyID: aws.ToString(out.KeyId), WrappedKey: out.CiphertextBlob}
+	case "local":
+		plain = make([]byte, 32)
+		if _, err := rand.Read(plain); err != nil {
+			return nil, header, err
+		}
+		k.mu.Lock()
+		fingerprint, kek := k.current, k.local[k.current]
+		k.mu.Unlock()
+		wrapped, err := sealAESGCM(kek, plain)
+		if err != nil {
+			return nil, header, err
+		}
+		header = archiveKeyHeader{Provider: "local", KeyID: fingerprint, WrappedKey: wrapped}
+	}
+	aead, err := newAESGCM(plain)
+	return aead, header, err
+}
+
+// dataKey decrypts the data key of a key chunk.
+func (k *archiveKeyring) dataKey(header archiveKeyHeader) (cipher.AEAD, error) {
+	id := string(header.WrappedKey)
+	k.mu.Lock()
+	aead, ok := k.unwrapped[id]
+	k.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	var plain []byte
+	switch header.Provider {
+	case "kms":
+		cfg, err := awsConfig()
+		if err != nil {
+			return nil, err
+		}
+		out, err := kms.NewFromConfig(cfg).Decrypt(context.Background(), &kms.DecryptInput{
+			CiphertextBlob: header.WrappedKey,
+			KeyId:          aws.String(header.KeyID),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error decrypting the data key with KMS key %s: %v", header.KeyID, err)
+		}
+		plain = out.Plaintext
+	case "local":
+		k.mu.Lock()
+		kek, ok := k.local[header.KeyID]
+		k.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("The archive is encrypted with the local key %s, which is not in archive-key-file.", header.KeyID)
+		}
+		var err error
+		if plain, err = openAESGCM(kek, header.WrappedKey); err != nil {
+			return nil, fmt.Errorf("Error decrypting the data key with the local key %s: %v", header.KeyID, err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown key provider %s.", header.Provider)
+	}
+	aead, err := newAESGCM(plain)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	k.unwrapped[id] = aead
+	k.mu.Unlock()
+	return aead, nil
+}
+
+// sealAESGCM encrypts plain with key, prefixed by a random nonce.
+func sealAESGCM(key, plain []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return sealChunk(aead, plain)
+}
+
+func openAESGCM(key, sealed []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return openChunk(aead, sealed)
+}
+
+func sealChunk(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func openChunk(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted chunk too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// archiveEncrypter encrypts the bytes written to it, in a data chunk per call
+// to seal. The data key is replaced every archive-key-rotation.
+type archiveEncrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	created time.Time
+	buf     []byte
+}
+
+func (e *archiveEncrypter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	return len(p), nil
+}
+
+// seal writes the bytes written since the last call as a data chunk.
+func (e *archiveEncrypter) seal() error {
+	conf := currentConfig()
+	if len(e.buf) == 0 {
+		return nil
+	}
+	if e.aead == nil || conf.archiveKeyRotation > 0 && time.Since(e.created) >= conf.archiveKeyRotation {
+		if err := e.rotate(); err != nil {
+			return err
+		}
+	}
+	sealed, err := sealChunk(e.aead, e.buf)
+	if err != nil {
+		return err
+	}
+	e.buf = e.buf[:0]
+	return writeArchiveChunk(e.w, archiveChunkData, sealed)
+}
+
+// writeKey writes the key chunk of the data key, at the points a reader can
+// start at.
+func (e *archiveEncrypter) writeKey() error {
+	if e.aead == nil {
+		return e.rotate()
+	}
+	return writeArchiveChunk(e.w, archiveChunkKey, e.header)
+}
+
+// rotate replaces the data key, and writes its key chunk.
+func (e *archiveEncrypter) rotate() error {
+	aead, header, err := archiveKeys.newDataKey()
+	if err != nil {
+		return err
+	}
+	if e.header, err = json.Marshal(header); err != nil {
+		return err
+	}
+	if e.aead != nil {
+		stats.inc("archive_key_rotations")
+	}
+	e.aead, e.created = aead, time.Now()
+	return writeArchiveChunk(e.w, archiveChunkKey, e.header)
+}
+
+func writeArchiveChunk(w io.Writer, kind byte, payload []byte) error {
+	head := make([]byte, 5, 5+len(payload))
+	head[0] = kind
+	binary.BigEndian.PutUint32(head[1:], uint32(len(payload)))
+	_, err := w.Write(append(head, payload...))
+	return err
+}
+
+// archiveDecrypter returns the bytes of the data chunks read from r.
+type archiveDecrypter struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	pending []byte
+}
+
+func (d *archiveDecrypter) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		head := make([]byte, 5)
+		if _, err := io.ReadFull(d.r, head); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(head[1:])
+		if size > archiveMaxChunk {
+			return 0, fmt.Errorf("encrypted chunk of %d bytes", size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(d.r, payload); err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		switch head[0] {
+		case archiveChunkKey:
+			var header archiveKeyHeader
+			if err := json.Unmarshal(payload, &header); err != nil {
+				return 0, fmt.Errorf("invalid key chunk: %v", err)
+			}
+			aead, err := archiveKeys.dataKey(header)
+			if err != nil {
+				return 0, err
+			}
+			d.aead = aead
+		case archiveChunkData:
+			if d.aead == nil {
+				return 0, errors.New("encrypted chunk before its key")
+			}
+			plain, err := openChunk(d.aead, payload)
+			if err != nil {
+				return 0, fmt.Errorf("Error decrypting the archive: %v", err)
+			}
+			d.pending = plain
+		default:
+			return 0, fmt.Errorf("unknown chunk type %q", head[0])
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// isEncryptedArchive reports whether the archive starting with head is
+// encrypted.
+func isEncryptedArchive(head []byte) bool {
+	return string(head) == archiveMagic
+}
@@ -0,0 +1,226 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveRotationLayout is the time of the rotation in the names of rotated
+// archives.
+const archiveRotationLayout = "20060102T150405.000Z"
+
+// archiveRetention keeps the record archive and its rotated archives within
+// record-max-disk-usage and record-max-age, so that the recordings of an
+// incident do not fill the disk of the host.
+type archiveRetention struct {
+	// rotated lists the rotated archives, oldest first, and rotatedBytes their
+	// size with their index
+	rotated      []rotatedArchive
+	rotatedBytes int64
+	// started is when the current archive was started, and stopped is set once
+	// recording stopped with record-retention stop
+	started time.Time
+	stopped bool
+}
+
+type rotatedArchive struct {
+	path string
+	time time.Time
+	size int64
+}
+
+// rotatedArchivePath returns the path the archive path is rotated to at t. The
+// time goes before the extensions of the name, so that requests.jsonl.zst is
+// rotated to requests-20261014T120000.000Z.jsonl.zst, still compressed.
+func rotatedArchivePath(path string, t time.Time) string {
+	stem, ext := splitArchivePath(path)
+	return stem + "-" + t.UTC().Format(archiveRotationLayout) + ext
+}
+
+func splitArchivePath(path string) (string, string) {
+	dir, name := filepath.Split(path)
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return dir + name[:i], name[i:]
+	}
+	return path, ""
+}
+
+// indexSize returns the size of the index of the archive path, if it has one.
+func indexSize(path string) int64 {
+	if !isCompressedArchive(path) {
+		return 0
+	}
+	info, err := os.Stat(archiveIndexPath(path))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// listRotatedArchives returns the rotated archives of the archive path, oldest
+// first.
+func listRotatedArchives(path string) ([]rotatedArchive, error) {
+	stem, ext := splitArchivePath(path)
+	dir, prefix := filepath.Dir(path), filepath.Base(stem)+"-"
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var rotated []rotatedArchive
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || len(name) < len(prefix)+len(ext) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		t, err := time.Parse(archiveRotationLayout, name[len(prefix):len(name)-len(ext)])
+		if err != nil {
+			continue
+		}
+		archive := rotatedArchive{path: filepath.Join(dir, name), time: t}
+		archive.size = file.Size() + indexSize(archive.path)
+		rotated = append(rotated, archive)
+	}
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].time.Before(rotated[j].time) })
+	return rotated, nil
+}
+
+// lastRecordSequence returns the sequence of the last record of the archive
+// path.
+func lastRecordSequence(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	head := make([]byte, len(archiveMagic))
+	n, _ := f.ReadAt(head, 0)
+	if isCompressedArchive(path) || isEncryptedArchive(head[:n]) {
+		return lastReadableArchiveSequence(path)
+	}
+	return lastArchiveSequence(f)
+}
+
+// setupRetention applies record-max-disk-usage and record-max-age to the
+// archive, with the archives rotated by previous captures.
+func (a *archiveWriter) setupRetention() error {
+	rotated, err := listRotatedArchives(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r := &archiveRetention{started: time.Now()}
+	for _, archive := range rotated {
+		r.rotated = append(r.rotated, archive)
+		r.rotatedBytes += archive.size
+	}
+	if a.sequence == 0 && len(rotated) > 0 {
+		// the sequence goes on from the last rotated archive
+		if a.sequence, err = lastRecordSequence(rotated[len(rotated)-1].path); err != nil {
+			return err
+		}
+	}
+	a.retention = r
+	return a.retain()
+}
+
+// retain rotates the archive every record-rotate-interval, or when it reaches a
+// tenth of record-max-disk-usage. It then deletes the rotated archives older
+// than record-max-age, and the oldest ones while the archives use more than
+// record-max-disk-usage, or stops recording with record-retention stop. It is
+// called with the lock held, after each record.
+func (a *archiveWriter) retain() error {
+	r := a.retention
+	now := time.Now()
+	if a.written.n > 0 && (now.Sub(r.started) >= *recordRotateInterval || *recordMaxDiskUsage > 0 && a.written.n >= *recordMaxDiskUsage/10) {
+		if err := a.rotate(now); err != nil {
+			return err
+		}
+	}
+	for *recordMaxAge > 0 && len(r.rotated) > 0 && now.Sub(r.rotated[0].time) > *recordMaxAge {
+		r.removeOldest("age")
+	}
+	if *recordMaxDiskUsage > 0 && r.rotatedBytes+a.written.n > *recordMaxDiskUsage {
+		if *recordRetention == "stop" {
+			return a.stop()
+		}
+		for len(r.rotated) > 0 && r.rotatedBytes+a.written.n > *recordMaxDiskUsage {
+			r.removeOldest("disk_usage")
+		}
+	}
+	stats.set("archive_disk_usage", r.rotatedBytes+a.written.n)
+	return nil
+}
+
+// rotate moves the archive to its rotated path, and starts a new archive at its
+// path. The sequence goes on in the new archive.
+func (a *archiveWriter) rotate(now time.Time) error {
+	r := a.retention
+	size := a.written.n + indexSize(a.path)
+	if err := a.closeFile(); err != nil {
+		log.Println("Error closing archive", a.path, ":", err)
+	}
+	rotated := rotatedArchivePath(a.path, now)
+	err := os.Rename(a.path, rotated)
+	if err == nil {
+		r.rotated = append(r.rotated, rotatedArchive{path: rotated, time: now, size: size})
+		r.rotatedBytes += size
+		stats.inc("archive_rotations")
+		if isCompressedArchive(a.path) {
+			if err = os.Rename(archiveIndexPath(a.path), archiveIndexPath(rotated)); err != nil {
+				// the rotated archive is read from its start without its index
+				os.Remove(archiveIndexPath(a.path))
+			}
+		}
+	}
+	n, openErr := openArchiveWriter(a.path)
+	if openErr != nil {
+		// the file is closed, the next records are rejected
+		a.closed = true
+		return openErr
+	}
+	a.f, a.w, a.enc, a.written, a.crypt = n.f, n.w, n.enc, n.written, n.crypt
+	a.zw, a.index, a.frameRecords = n.zw, n.index, 0
+	r.started = now
+	return err
+}
+
+// removeOldest deletes the oldest rotated archive, for reason.
+func (r *archiveRetention) removeOldest(reason string) {
+	archive := r.rotated[0]
+	r.rotated = r.rotated[1:]
+	r.rotatedBytes -= archive.size
+	if err := os.Remove(archive.path); err != nil && !os.IsNotExist(err) {
+		log.Println("Error deleting archive", archive.path, ":", err)
+	}
+	if isCompressedArchive(archive.path) {
+		os.Remove(archiveIndexPath(archive.path))
+	}
+	stats.inc(labeled("archive_files_deleted", "reason", reason))
+}
+
+// stop closes the archive when the archives use more than
+// record-max-disk-usage with record-retention stop, and alerts. The next
+// records are only counted, until the capture restarts.
+func (a *archiveWriter) stop() error {
+	r := a.retention
+	r.stopped = true
+	usage := r.rotatedBytes + a.written.n
+	stats.set("archive_disk_usage", usage)
+	sendAlert(alertEvent{
+		Kind:    "recording_stopped",
+		Name:    a.path,
+		Message: fmt.Sprintf("the archives use %d bytes, more than record-max-disk-usage, recording stopped", usage),
+		Details: map[string]interface{}{"bytes": usage, "max_bytes": *recordMaxDiskUsage, "archives": len(r.rotated) + 1},
+	})
+	return a.closeFile()
+}
@@ -0,0 +1,171 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveIndexEntry is one line of the index of a compressed archive: a zstd
+// frame, with the sequence and capture time of its first record.
+type archiveIndexEntry struct {
+	Offset   int64     `json:"offset"`
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+}
+
+// isCompressedArchive reports whether the archive path is compressed with
+// zstd, which is given by its name.
+func isCompressedArchive(path string) bool {
+	return strings.HasSuffix(path, ".zst")
+}
+
+// archiveIndexPath returns the path of the index of the compressed archive path.
+func archiveIndexPath(path string) string {
+	return path + ".idx"
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// setupCompression makes a compress its records with zstd, in independent
+// frames of record-frame-records records, so that a replay can start at any
+// frame of the index.
+func (a *archiveWriter) setupCompression(path string) error {
+	index, err := os.OpenFile(archiveIndexPath(path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	a.zw, err = zstd.NewWriter(a.w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		index.Close()
+		return err
+	}
+	a.index, a.enc = index, json.NewEncoder(a.zw)
+	return nil
+}
+
+// writeCompressed writes record to the current frame, starting a new one at
+// the end of the file if there is none. Every record is flushed as a zstd
+// block, so that a crash loses at most the record being written.
+func (a *archiveWriter) writeCompressed(record archiveRecord) error {
+	if a.frameRecords == 0 {
+		a.zw.Reset(a.w)
+		offset := a.written.n
+		if a.crypt != nil {
+			// a reader starting at the frame needs its data key
+			if err := a.crypt.writeKey(); err != nil {
+				return err
+			}
+		}
+		entry, err := json.Marshal(archiveIndexEntry{Offset: offset, Sequence: record.Sequence, Time: record.Time})
+		if err != nil {
+			return err
+		}
+		if _, err := a.index.Write(append(entry, '\n')); err != nil {
+			return err
+		}
+	}
+	if err := a.enc.Encode(record); err != nil {
+		return err
+	}
+	a.frameRecords++
+	var err error
+	if a.frameRecords >= *recordFrameRecords {
+		a.frameRecords = 0
+		err = a.zw.Close()
+	} else {
+		err = a.zw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	return a.flush()
+}
+
+// readArchiveIndex reads the index of the compressed archive path. An archive
+// without index is read from its start.
+func readArchiveIndex(path string) ([]archiveIndexEntry, error) {
+	f, err := os.Open(archiveIndexPath(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var index []archiveIndexEntry
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var entry archiveIndexEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			return index, nil
+		} else if err != nil {
+			// an entry cut short by a crash ends the index
+			return index, nil
+		}
+		index = append(index, entry)
+	}
+}
+
+// seekFrame makes a read the frames of a compressed archive from offset.
+func (a *archiveReader) seekFrame(offset int64) error {
+	if _, err := a.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := a.zr.Reset(a.source()); err != nil {
+		return err
+	}
+	a.frame, a.dec = offset, json.NewDecoder(a.zr)
+	return nil
+}
+
+// nextFrame moves to the first frame of the index after the last record read,
+// after a frame that cannot be read, like the last frame of a capture that
+// crashed, followed by those of the next capture. It reports false if there is
+// none.
+func (a *archiveReader) nextFrame() bool {
+	for _, entry := range a.index {
+		if entry.Offset > a.frame && entry.Sequence > a.last {
+			return a.seekFrame(entry.Offset) == nil
+		}
+	}
+	return false
+}
+
+// skipTo makes the archive start at the first record with at least sequence,
+// captured at t or later, when they are not zero. The records are read from
+// the last frame of the index before them; those before them are skipped.
+func (a *archiveReader) skipTo(sequence uint64, t time.Time) error {
+	a.fromSequence, a.fromTime = sequence, t
+	if sequence == 0 && t.IsZero() {
+		return nil
+	}
+	offset := int64(-1)
+	for _, entry := range a.index {
+		if (sequence != 0 && entry.Sequence > sequence) || (!t.IsZero() && entry.Time.After(t)) {
+			break
+		}
+		offset = entry.Offset
+	}
+	if a.zr == nil || offset < 0 {
+		return nil
+	}
+	return a.seekFrame(offset)
+}
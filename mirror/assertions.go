@@ -0,0 +1,141 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// responseBodyLimit is the number of bytes of a response body read by the
+// body_contains assertions and the response diffs.
+const responseBodyLimit = 1 << 20
+
+// responseAssertion is a check on the responses of the destinations. Every set
+// condition must hold for a response to pass.
+type responseAssertion struct {
+	Name string `json:"name"`
+	// Host restricts the assertion to the requests with this Host header
+	Host         string   `json:"host,omitempty"`
+	Status       []int    `json:"status,omitempty"`
+	BodyContains string   `json:"body_contains,omitempty"`
+	MaxLatency   duration `json:"max_latency,omitempty"`
+	// the assertion alerts when, over a window, more than MaxFailureRate of the
+	// responses and at least MinFailures responses fail
+	MaxFailureRate float64 `json:"max_failure_rate,omitempty"`
+	MinFailures    int64   `json:"min_failures,omitempty"`
+
+	total, failed int64
+}
+
+// responseAssertions are the assertions of the assertions flag.
+type responseAssertions struct {
+	Window     duration            `json:"window"`
+	Assertions []responseAssertion `json:"assertions"`
+	needsBody  bool
+}
+
+func loadAssertions(path string) (*responseAssertions, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &responseAssertions{Window: duration(time.Minute)}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("Error parsing assertions %s: %v", path, err)
+	}
+	if a.Window <= 0 {
+		return nil, fmt.Errorf("Assertions window must be positive.")
+	}
+	for i := range a.Assertions {
+		rule := &a.Assertions[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("Assertion %d: name must be set.", i)
+		}
+		if rule.Status != nil && (len(rule.Status) != 2 || rule.Status[0] > rule.Status[1]) {
+			return nil, fmt.Errorf("Assertion %s: status must be a range like [200, 299].", rule.Name)
+		}
+		if rule.Status == nil && rule.BodyContains == "" && rule.MaxLatency <= 0 {
+			return nil, fmt.Errorf("Assertion %s: one of status, body_contains and max_latency must be set.", rule.Name)
+		}
+		if rule.MaxFailureRate < 0 || rule.MaxFailureRate >= 1 {
+			return nil, fmt.Errorf("Assertion %s: max_failure_rate must be between 0 and 1.", rule.Name)
+		}
+		if rule.MinFailures <= 0 {
+			rule.MinFailures = 1
+		}
+		if rule.BodyContains != "" {
+			a.needsBody = true
+		}
+	}
+	return a, nil
+}
+
+// check records the outcome of a forward of req: its response, with the first
+// responseBodyLimit bytes of its body if needsBody, and latency, or nil if the
+// forward failed, which fails every assertion of its host.
+func (a *responseAssertions) check(req *http.Request, resp *http.Response, body []byte, latency time.Duration) {
+	for i := range a.Assertions {
+		rule := &a.Assertions[i]
+		if rule.Host != "" && !strings.EqualFold(rule.Host, req.Host) {
+			continue
+		}
+		atomic.AddInt64(&rule.total, 1)
+		if !rule.passes(resp, body, latency) {
+			atomic.AddInt64(&rule.failed, 1)
+			stats.inc(labeled("assertion_failures", "assertion", rule.Name))
+		}
+	}
+}
+
+func (r *responseAssertion) passes(resp *http.Response, body []byte, latency time.Duration) bool {
+	if resp == nil {
+		return false
+	}
+	if r.Status != nil && (resp.StatusCode < r.Status[0] || resp.StatusCode > r.Status[1]) {
+		return false
+	}
+	if r.MaxLatency > 0 && latency > time.Duration(r.MaxLatency) {
+		return false
+	}
+	return r.BodyContains == "" || bytes.Contains(body, []byte(r.BodyContains))
+}
+
+// evaluate resets the counts of the window and alerts on the assertions failing
+// beyond their threshold.
+func (a *responseAssertions) evaluate() {
+	for i := range a.Assertions {
+		rule := &a.Assertions[i]
+		total, failed := atomic.SwapInt64(&rule.total, 0), atomic.SwapInt64(&rule.failed, 0)
+		if total == 0 || failed < rule.MinFailures || float64(failed)/float64(total) <= rule.MaxFailureRate {
+			continue
+		}
+		sendAlert(alertEvent{
+			Kind:    "assertion",
+			Name:    rule.Name,
+			Message: fmt.Sprintf("%d of %d responses failed assertion %s in the last %s", failed, total, rule.Name, time.Duration(a.Window)),
+			Details: map[string]interface{}{"failed": failed, "total": total, "window": a.Window},
+		})
+	}
+}
+
+// watchAssertions evaluates the assertions at the end of every window. The
+// assertions are re-read at every window, as a reload may replace them.
+func watchAssertions() {
+	for {
+		a := currentConfig().assertions
+		if a == nil {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(time.Duration(a.Window))
+		a.evaluate()
+	}
+}
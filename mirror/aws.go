@@ -0,0 +1,29 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+var awsCfg aws.Config
+var awsCfgErr error
+var awsCfgOnce sync.Once
+
+// awsConfig returns the AWS configuration shared by the AWS clients, loaded
+// from the environment, the shared config files or the instance role.
+func awsConfig() (aws.Config, error) {
+	awsCfgOnce.Do(func() {
+		awsCfg, awsCfgErr = config.LoadDefaultConfig(context.Background())
+	})
+	if awsCfgErr != nil {
+		return aws.Config{}, fmt.Errorf("Error loading AWS configuration: %v", awsCfgErr)
+	}
+	return awsCfg, nil
+}
@@ -0,0 +1,354 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// benchSequenceHeader carries the index of a synthetic request, for the local
+// server to measure its latency.
+const benchSequenceHeader = "X-Mirror-Bench-Sequence"
+
+// benchMSS is the size of the TCP segments of the synthetic connections.
+const benchMSS = 1448
+
+// benchResult is the report of the bench command, written to bench-output.
+type benchResult struct {
+	Mode              string  `json:"mode"`
+	Requests          int     `json:"requests"`
+	Captured          int64   `json:"captured"`
+	Received          int64   `json:"received"`
+	Seconds           float64 `json:"seconds"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Packets           int     `json:"packets,omitempty"`
+	PacketsPerSecond  float64 `json:"packets_per_second,omitempty"`
+	AllocsPerRequest  float64 `json:"allocs_per_request"`
+	BytesPerRequest   float64 `json:"bytes_per_request"`
+	LatencyP50Ms      float64 `json:"latency_p50_ms"`
+	LatencyP99Ms      float64 `json:"latency_p99_ms"`
+	LatencyMaxMs      float64 `json:"latency_max_ms"`
+}
+
+// benchLatencies records the latencies of the synthetic requests, from the
+// time they are handed to the pipeline until the local server receives them.
+type benchLatencies struct {
+	// sent holds the time each request was handed to the pipeline, in Unix
+	// nanoseconds, by sequence
+	sent     []int64
+	received int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+func (l *benchLatencies) start(seq int) {
+	atomic.StoreInt64(&l.sent[seq], time.Now().UnixNano())
+}
+
+func (l *benchLatencies) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(ioutil.Discard, r.Body)
+	atomic.AddInt64(&l.received, 1)
+	seq, err := strconv.Atoi(r.Header.Get(benchSequenceHeader))
+	if err != nil || seq < 0 || seq >= len(l.sent) {
+		return
+	}
+	if sent := atomic.LoadInt64(&l.sent[seq]); sent > 0 {
+		l.mu.Lock()
+		l.latencies = append(l.latencies, time.Duration(time.Now().UnixNano()-sent))
+		l.mu.Unlock()
+	}
+}
+
+// percentile returns the latency below which the fraction p of the latencies
+// fall.
+func (l *benchLatencies) percentile(p float64) time.Duration {
+	if len(l.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(l.latencies))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(l.latencies) {
+		i = len(l.latencies) - 1
+	}
+	return l.latencies[i]
+}
+
+// runBench implements the bench subcommand: it pushes synthetic requests for
+// every host of the route table through the pipeline and reports the
+// throughput, the allocations and the latencies. With bench-mode requests, the
+// requests are handed to the forwarding pipeline; with bench-mode packets, they
+// are generated as the packets of TCP connections, which go through the
+// decoding, the TCP assembly and the HTTP parsing like captured packets. Unless
+// bench-live is set, requests are forwarded to a local server that discards
+// them instead of the configured destinations.
+func runBench() error {
+	conf := currentConfig()
+	if *benchRequests < 1 || *benchConcurrency < 1 || *benchConnections < 1 {
+		return fmt.Errorf("Flags bench-requests, bench-concurrency and bench-connections must be at least 1.")
+	}
+	if *benchMode != "requests" && *benchMode != "packets" {
+		return fmt.Errorf("Flag bench-mode must be requests or packets. Value: %s.", *benchMode)
+	}
+	if *benchBodyBytes < 0 {
+		return fmt.Errorf("Flag bench-body-bytes must not be negative. Value: %d.", *benchBodyBytes)
+	}
+
+	fwdRoutes.mu.RLock()
+	var hosts []string
+	for host := range fwdRoutes.routes {
+		hosts = append(hosts, host)
+	}
+	fwdRoutes.mu.RUnlock()
+	if len(hosts) == 0 {
+		hosts = []string{"bench.local"}
+	}
+	sort.Strings(hosts)
+
+	latencies := &benchLatencies{sent: make([]int64, *benchRequests)}
+	if !*benchLive {
+		sink := httptest.NewServer(latencies)
+		defer sink.Close()
+		routes := map[string]route{}
+		for _, host := range hosts {
+			routes[host] = route{Destination: sink.URL}
+		}
+		fwdRoutes.set(routes)
+	}
+
+	result := benchResult{Mode: *benchMode, Requests: *benchRequests}
+	var packets [][]byte
+	var completes []int
+	if *benchMode == "packets" {
+		var err error
+		if packets, completes, err = benchPackets(hosts); err != nil {
+			return err
+		}
+		result.Packets = len(packets)
+		log.Println("Benchmarking", *benchRequests, "requests in", len(packets), "packets over", *benchConnections, "connections")
+	} else {
+		log.Println("Benchmarking", *benchRequests, "requests with concurrency", *benchConcurrency)
+	}
+
+	captured := stats.get("requests_captured")
+	capturedBefore := atomic.LoadInt64(captured)
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	if *benchMode == "packets" {
+		benchAssemble(packets, completes, latencies)
+		// the streams are parsed concurrently: wait for the last requests
+		deadline := time.Now().Add(conf.drainTimeout)
+		for atomic.LoadInt64(captured)-capturedBefore < int64(*benchRequests) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	} else {
+		benchForward(hosts, latencies)
+	}
+	drain(conf.drainTimeout)
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	result.Captured = atomic.LoadInt64(captured) - capturedBefore
+	result.Received = atomic.LoadInt64(&latencies.received)
+	result.Seconds = elapsed.Seconds()
+	result.RequestsPerSecond = float64(*benchRequests) / elapsed.Seconds()
+	result.PacketsPerSecond = float64(len(packets)) / elapsed.Seconds()
+	result.AllocsPerRequest = float64(after.Mallocs-before.Mallocs) / float64(*benchRequests)
+	result.BytesPerRequest = float64(after.TotalAlloc-before.TotalAlloc) / float64(*benchRequests)
+	latencies.mu.Lock()
+	sort.Slice(latencies.latencies, func(i, j int) bool { return latencies.latencies[i] < latencies.latencies[j] })
+	p50, p99, slowest := latencies.percentile(0.5), latencies.percentile(0.99), latencies.percentile(1)
+	latencies.mu.Unlock()
+	result.LatencyP50Ms = float64(p50) / float64(time.Millisecond)
+	result.LatencyP99Ms = float64(p99) / float64(time.Millisecond)
+	result.LatencyMaxMs = float64(slowest) / float64(time.Millisecond)
+
+	if *benchMode == "packets" {
+		log.Printf("Processed %d requests in %d packets in %s (%.0f requests/s, %.0f packets/s)", *benchRequests, len(packets), elapsed, result.RequestsPerSecond, result.PacketsPerSecond)
+		log.Printf("Captured %d requests", result.Captured)
+	} else {
+		log.Printf("Processed %d requests in %s (%.0f requests/s)", *benchRequests, elapsed, result.RequestsPerSecond)
+	}
+	log.Printf("Allocated %.0f times and %.0f bytes per request", result.AllocsPerRequest, result.BytesPerRequest)
+	if !*benchLive {
+		log.Printf("Received %d requests, latency p50 %s, p99 %s, max %s", result.Received, p50, p99, slowest)
+	}
+	log.Println("Counters:", stats.snapshot())
+
+	if *benchOutput != "" {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*benchOutput, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchForward hands the synthetic requests to forwardRequest, bench-concurrency
+// at a time.
+func benchForward(hosts []string, latencies *benchLatencies) {
+	body := bytes.Repeat([]byte("x"), *benchBodyBytes)
+	sem := make(chan struct{}, *benchConcurrency)
+	for i := 0; i < *benchRequests; i++ {
+		host := hosts[i%len(hosts)]
+		method := http.MethodGet
+		if len(body) > 0 {
+			method = http.MethodPost
+		}
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://%s/bench/%d", host, i), nil)
+		req.RequestURI = req.URL.RequestURI()
+		req.Header.Set("User-Agent", "http-requests-mirroring-bench")
+		req.Header.Set(benchSequenceHeader, strconv.Itoa(i))
+		if len(body) > 0 {
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.ContentLength = int64(len(body))
+		}
+		sem <- struct{}{}
+		atomic.AddInt64(&fwdInFlight, 1)
+		latencies.start(i)
+		go func() {
+			forwardRequest(req, captureInfo{sourceIP: "127.0.0.1", destinationPort: "80", time: time.Now()}, body)
+			<-sem
+		}()
+	}
+}
+
+// benchAssemble decodes the packets and hands them to the TCP assembler, like
+// the capture loop. completes gives, for each packet, the sequence of the
+// request it completes, or -1.
+func benchAssemble(packets [][]byte, completes []int, latencies *benchLatencies) {
+	factory := &httpStreamFactory{}
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(factory))
+	for i, data := range packets {
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		network, tcp, ok := decapsulate(packet)
+		if !ok {
+			log.Println("Unusable packet")
+			continue
+		}
+		if seq := completes[i]; seq >= 0 {
+			latencies.start(seq)
+		}
+		factory.segment = tcp
+		assembler.AssembleWithTimestamp(network.NetworkFlow(), tcp, time.Now())
+	}
+	assembler.FlushAll()
+}
+
+// benchRequest returns the bytes of the synthetic request seq.
+func benchRequest(host string, seq int) []byte {
+	var b bytes.Buffer
+	method := http.MethodGet
+	if *benchBodyBytes > 0 {
+		method = http.MethodPost
+	}
+	fmt.Fprintf(&b, "%s /bench/%d HTTP/1.1\r\nHost: %s\r\nUser-Agent: http-requests-mirroring-bench\r\n%s: %d\r\n", method, seq, host, benchSequenceHeader, seq)
+	if *benchBodyBytes > 0 {
+		fmt.Fprintf(&b, "Content-Type: application/octet-stream\r\nContent-Length: %d\r\n", *benchBodyBytes)
+	}
+	b.WriteString("\r\n")
+	b.Write(bytes.Repeat([]byte("x"), *benchBodyBytes))
+	return b.Bytes()
+}
+
+// benchPackets generates the Ethernet frames of bench-connections TCP
+// connections carrying the synthetic requests, the connections taking turns:
+// the SYNs, the requests in segments of benchMSS bytes, and the FINs. The
+// packets flow from the clients 10.1.0.0/16 to 10.0.0.1, on
+// filter-request-port. It also returns, for each packet, the sequence of the
+// request it completes, or -1.
+func benchPackets(hosts []string) ([][]byte, []int, error) {
+	type connection struct {
+		ip   net.IP
+		port layers.TCPPort
+		seq  uint32
+	}
+	connections := make([]*connection, *benchConnections)
+	for c := range connections {
+		connections[c] = &connection{
+			ip:   net.IPv4(10, 1, byte(c>>8), byte(c)),
+			port: layers.TCPPort(10000 + c%50000),
+			seq:  uint32(1000 + c),
+		}
+	}
+
+	var packets [][]byte
+	var completes []int
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	segment := func(conn *connection, tcp layers.TCP, payload []byte, seq int) error {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: conn.ip, DstIP: net.IPv4(10, 0, 0, 1)}
+		tcp.SrcPort, tcp.DstPort, tcp.Seq, tcp.Window = conn.port, layers.TCPPort(currentConfig().reqPort), conn.seq, 65535
+		tcp.SetNetworkLayerForChecksum(ip)
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, &tcp, gopacket.Payload(payload)); err != nil {
+			return err
+		}
+		packets = append(packets, append([]byte(nil), buf.Bytes()...))
+		completes = append(completes, seq)
+		conn.seq += uint32(len(payload))
+		if tcp.SYN || tcp.FIN {
+			conn.seq++
+		}
+		return nil
+	}
+
+	for _, conn := range connections {
+		if err := segment(conn, layers.TCP{SYN: true}, nil, -1); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i := 0; i < *benchRequests; i++ {
+		conn := connections[i%len(connections)]
+		data := benchRequest(hosts[i%len(hosts)], i)
+		for len(data) > 0 {
+			n := len(data)
+			if n > benchMSS {
+				n = benchMSS
+			}
+			seq := -1
+			if n == len(data) {
+				seq = i
+			}
+			if err := segment(conn, layers.TCP{ACK: true, PSH: n == len(data)}, data[:n], seq); err != nil {
+				return nil, nil, err
+			}
+			data = data[n:]
+		}
+	}
+	for _, conn := range connections {
+		if err := segment(conn, layers.TCP{ACK: true, FIN: true}, nil, -1); err != nil {
+			return nil, nil, err
+		}
+	}
+	return packets, completes, nil
+}
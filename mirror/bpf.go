@@ -0,0 +1,239 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ethernetTypeQinQLegacy is the outer tag of QinQ packets before 802.1ad, still
+// sent by some switches.
+const ethernetTypeQinQLegacy = 0x9100
+
+func init() {
+	// gopacket decodes the 802.1Q and 802.1ad tags, and the legacy tag like them
+	layers.EthernetTypeMetadata[ethernetTypeQinQLegacy] = layers.EthernetTypeMetadata[layers.EthernetTypeDot1Q]
+}
+
+// bpfFilter returns the BPF filter expression of captured packets. The flags are
+// validated by setupFlags.
+func bpfFilter() string {
+	expr, _ := buildBPFFilter()
+	return expr
+}
+
+// buildBPFFilter generates the BPF filter expression from the filter flags, so
+// that clearly excluded traffic is dropped in the kernel rather than copied to
+// the mirror. The bpf-filter flag replaces the generated expression.
+func buildBPFFilter() (string, error) {
+	if *bpfExpr != "" {
+		return *bpfExpr, nil
+	}
+
+	dir, err := portDirection()
+	if err != nil {
+		return "", err
+	}
+	ports := []string{fmt.Sprintf("%sport %d", dir, *reqPort)}
+	terms, err := portTerms(dir, "filter-ports", *filterPorts)
+	if err != nil {
+		return "", err
+	}
+	ports = append(ports, terms...)
+	expr := "tcp and " + orTerms(ports)
+	if *quicPorts != "" {
+		quic, err := portTerms(dir, "quic-ports", *quicPorts)
+		if err != nil {
+			return "", err
+		}
+		expr = fmt.Sprintf("((%s) or (udp and %s))", expr, orTerms(quic))
+	}
+
+	// the clients are the sources of the packets sent to the ports
+	clientDir, serverDir := "src ", "dst "
+	switch dir {
+	case "src ":
+		clientDir, serverDir = "dst ", "src "
+	case "":
+		clientDir, serverDir = "", ""
+	}
+
+	if *filterSourceCIDRs != "" {
+		nets, err := netTerms(clientDir, *filterSourceCIDRs)
+		if err != nil {
+			return "", fmt.Errorf("Flag filter-source-cidrs: %v", err)
+		}
+		expr += " and " + orTerms(nets)
+	}
+	if *filterExcludeSourceCIDRs != "" {
+		nets, err := netTerms(clientDir, *filterExcludeSourceCIDRs)
+		if err != nil {
+			return "", fmt.Errorf("Flag filter-exclude-source-cidrs: %v", err)
+		}
+		expr += " and not " + orTerms(nets)
+	}
+	if *filterDestinationCIDRs != "" {
+		nets, err := netTerms(serverDir, *filterDestinationCIDRs)
+		if err != nil {
+			return "", fmt.Errorf("Flag filter-destination-cidrs: %v", err)
+		}
+		expr += " and " + orTerms(nets)
+	}
+
+	if *filterVLAN {
+		// vlan shifts the offsets of the rest of the expression, so it comes
+		// last, and the second vlan matches the inner tag of QinQ packets
+		expr = fmt.Sprintf("(%s) or (vlan and ((%s) or (vlan and %s)))", expr, expr, expr)
+	}
+	switch *filterEncap {
+	case "":
+	case "vxlan", "geneve":
+		// the rest of the expression applies to the encapsulated packet
+		expr = fmt.Sprintf("%s and (%s)", *filterEncap, expr)
+	default:
+		return "", fmt.Errorf("Flag filter-encapsulation (%s) is not valid.", *filterEncap)
+	}
+	return expr, nil
+}
+
+// portDirection returns the BPF direction qualifier of the ports for the
+// filter-mode flag:
+//   - dst captures the packets sent to the ports, i.e. the requests
+//   - src captures the packets sent from the ports, for mirror sessions that
+//     deliver the requests with swapped orientation
+//   - either captures both directions
+func portDirection() (string, error) {
+	switch *filterMode {
+	case "dst":
+		return "dst ", nil
+	case "src":
+		return "src ", nil
+	case "either":
+		return "", nil
+	}
+	return "", fmt.Errorf("Flag filter-mode (%s) is not valid.", *filterMode)
+}
+
+// portRange is an inclusive range of captured ports.
+type portRange struct {
+	from, to int
+}
+
+// parsePorts parses a comma separated list of ports and port ranges like
+// 8000-8100, of the flag name.
+func parsePorts(name, list string) ([]portRange, error) {
+	var ranges []portRange
+	for _, p := range splitPatterns(list) {
+		bounds := strings.SplitN(p, "-", 2)
+		var values []int
+		for _, b := range bounds {
+			v, err := strconv.Atoi(b)
+			if err != nil || v < 1 || v > 65535 {
+				return nil, fmt.Errorf("Flag %s contains an invalid port (%s).", name, p)
+			}
+			values = append(values, v)
+		}
+		if len(values) == 1 {
+			values = append(values, values[0])
+		}
+		if values[0] > values[1] {
+			return nil, fmt.Errorf("Flag %s contains an invalid port range (%s).", name, p)
+		}
+		ranges = append(ranges, portRange{values[0], values[1]})
+	}
+	return ranges, nil
+}
+
+// portTerms returns the BPF terms of a comma separated list of ports and port
+// ranges, with the direction qualifier dir.
+func portTerms(dir, name, list string) ([]string, error) {
+	ranges, err := parsePorts(name, list)
+	if err != nil {
+		return nil, err
+	}
+	var terms []string
+	for _, r := range ranges {
+		if r.from == r.to {
+			terms = append(terms, fmt.Sprintf("%sport %d", dir, r.from))
+		} else {
+			terms = append(terms, fmt.Sprintf("%sportrange %d-%d", dir, r.from, r.to))
+		}
+	}
+	return terms, nil
+}
+
+// isRequestPort reports whether port is one of the captured server ports.
+func isRequestPort(conf *configSnapshot, port int) bool {
+	if port == conf.reqPort {
+		return true
+	}
+	ranges, _ := parsePorts("filter-ports", conf.filterPorts)
+	for _, r := range ranges {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// netTerms returns the BPF terms of a comma separated list of CIDRs or IPs,
+// with the direction qualifier dir.
+func netTerms(dir, list string) ([]string, error) {
+	var terms []string
+	for _, n := range splitPatterns(list) {
+		if ip := net.ParseIP(n); ip != nil {
+			terms = append(terms, fmt.Sprintf("%shost %s", dir, ip))
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, fmt.Sprintf("%snet %s", dir, ipNet))
+	}
+	return terms, nil
+}
+
+func orTerms(terms []string) string {
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	return "(" + strings.Join(terms, " or ") + ")"
+}
+
+// parseVLANIDs parses a comma separated list of VLAN IDs. It returns nil for an
+// empty list.
+func parseVLANIDs(list string) (map[uint16]bool, error) {
+	var ids map[uint16]bool
+	for _, v := range splitPatterns(list) {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 0 || id > 4095 {
+			return nil, fmt.Errorf("Flag filter-vlan-ids contains an invalid VLAN ID (%s).", v)
+		}
+		if ids == nil {
+			ids = map[uint16]bool{}
+		}
+		ids[uint16(id)] = true
+	}
+	return ids, nil
+}
+
+// capturedVLAN reports whether the outer VLAN tag of the packet has one of the
+// IDs of filter-vlan-ids. The IDs cannot be matched by the BPF filter, as every
+// vlan primitive shifts the offsets of the rest of the expression.
+func capturedVLAN(packet gopacket.Packet) bool {
+	ids := currentConfig().vlanIDs
+	if ids == nil {
+		return true
+	}
+	// Layer returns the first tag, which is the outer one
+	tag, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	return ok && ids[tag.VLANIdentifier]
+}
@@ -0,0 +1,69 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package mirror
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Capabilities of linux/capability.h needed by the capture.
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+// checkCaptureCapabilities checks that the process has the capabilities of the
+// capture: CAP_NET_RAW to open the packet socket, and CAP_NET_ADMIN for the
+// promiscuous mode and the XDP filter. It fails with how to grant them, rather
+// than with the libpcap error.
+func checkCaptureCapabilities() error {
+	effective, err := effectiveCapabilities()
+	if err != nil {
+		// the capture reports the errors itself
+		log.Println("Error reading the process capabilities", ":", err)
+		return nil
+	}
+	var missing []string
+	if effective&(1<<capNetRaw) == 0 {
+		missing = append(missing, "cap_net_raw")
+	}
+	if effective&(1<<capNetAdmin) == 0 {
+		if *xdpFilterEnabled {
+			missing = append(missing, "cap_net_admin")
+		} else if *promisc {
+			log.Println("Warning: the process lacks CAP_NET_ADMIN, the interface may not be set in promiscuous mode")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("The process lacks the capabilities %s needed to capture on interface %s. Run it as root, grant them to the binary with setcap %s+eip, or add them to the container (e.g. securityContext.capabilities.add: [NET_RAW, NET_ADMIN]).",
+			strings.ToUpper(strings.Join(missing, ", ")), *iface, strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// effectiveCapabilities returns the effective capability set of the process.
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value := strings.TrimPrefix(scanner.Text(), "CapEff:"); value != scanner.Text() {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no CapEff in /proc/self/status")
+}
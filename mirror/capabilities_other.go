@@ -0,0 +1,13 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package mirror
+
+// checkCaptureCapabilities does nothing: outside Linux, capture permissions are
+// not capabilities, e.g. the permissions of /dev/bpf, and the capture reports
+// them itself.
+func checkCaptureCapabilities() error {
+	return nil
+}
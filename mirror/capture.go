@@ -0,0 +1,320 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// captureOpenMaxBackoff caps the delay between two attempts to open the capture.
+const captureOpenMaxBackoff = 30 * time.Second
+
+// openWithRetry calls open until it succeeds, with an exponential backoff, for
+// up to retry, or forever if retry is negative, e.g. until the vxlan interface
+// of a traffic mirror session appears. Permission errors are not retried.
+func openWithRetry(open func() error, retry time.Duration) error {
+	deadline := time.Now().Add(retry)
+	backoff := time.Second
+	for {
+		err := openInterface(open)
+		if err == nil {
+			return nil
+		}
+		if isPermissionError(err) {
+			return fmt.Errorf("%v. See the capabilities or permissions of the process.", err)
+		}
+		if retry >= 0 && time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		log.Println("Error opening capture, retrying in", backoff, ":", err)
+		stats.inc("capture_open_retries")
+		sdNotify("STATUS=Waiting for interface " + *iface)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > captureOpenMaxBackoff {
+			backoff = captureOpenMaxBackoff
+		}
+	}
+}
+
+func openInterface(open func() error) error {
+	if _, err := net.InterfaceByName(*iface); err != nil {
+		return fmt.Errorf("Interface %s does not exist: %v", *iface, err)
+	}
+	if err := open(); err != nil {
+		return fmt.Errorf("Error opening capture on interface %s: %v", *iface, err)
+	}
+	return nil
+}
+
+// isPermissionError reports whether err is a libpcap or PF_RING error due to
+// missing privileges.
+func isPermissionError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "permission") || strings.Contains(msg, "not permitted")
+}
+
+// openCapture opens the capture interface with the snaplen and buffer size of
+// the capture settings, the immediate mode and promiscuous mode of the flags,
+// and sets the BPF filter.
+func openCapture() (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(*iface)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	settings := currentCaptureSettings()
+	if err := inactive.SetSnapLen(settings.snaplen); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetPromisc(*promisc); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetTimeout(pcap.BlockForever); err != nil {
+		return nil, err
+	}
+	if settings.bufferSize > 0 {
+		// the default buffer of libpcap (2MiB on Linux) overflows under bursts
+		if err := inactive.SetBufferSize(settings.bufferSize); err != nil {
+			return nil, err
+		}
+	}
+	if *immediateMode {
+		// packets are delivered as soon as they arrive rather than when the buffer is full
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return nil, err
+		}
+	}
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(bpfFilter()); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return handle, nil
+}
+
+// captureError is the error that ended the live capture, if any.
+var captureError error
+
+// livePackets opens the pcap capture and returns its packets. With the
+// capture-reopen flag, the capture is opened again when reading fails, e.g. when
+// the interface is deleted and created again by an update of the mirror session,
+// so that the streams, stats and the rest of the pipeline outlive the flap.
+// Otherwise, the channel is closed with captureError.
+func livePackets() (<-chan gopacket.Packet, error) {
+	handle, err := openPcapSource(*captureOpenRetry)
+	if err != nil {
+		return nil, err
+	}
+	packets := make(chan gopacket.Packet, 1000)
+	go func() {
+		settings := currentCaptureSettings()
+		for {
+			err := readPackets(handle, packets)
+			// the drop monitor and the reload no longer use the handle once closed
+			setCaptureSources()
+			handle.Close()
+			if err == errCaptureAdapted {
+				// the capture is reopened at once with the settings adapted to the
+				// drops, or else with those it had
+				atomic.StoreInt32(&captureAdapted, 0)
+				if handle, err = openPcapSource(0); err == nil {
+					settings = currentCaptureSettings()
+					stats.inc("capture_reopens")
+					continue
+				}
+				log.Println("Error reopening capture with the adapted settings", ":", err)
+				setCaptureSettings(settings)
+				if handle, err = openPcapSource(0); err == nil {
+					stats.inc("capture_reopens")
+					continue
+				}
+			} else {
+				stats.inc("capture_errors")
+			}
+			if !currentConfig().captureReopen {
+				captureError = fmt.Errorf("Error reading packets on interface %s: %v", *iface, err)
+				close(packets)
+				return
+			}
+			log.Println("Error reading packets, reopening the capture", ":", err)
+			// the interface may take a while to come back, so the capture waits for it
+			if handle, err = openPcapSource(-1); err != nil {
+				captureError = err
+				close(packets)
+				return
+			}
+			stats.inc("capture_reopens")
+			log.Printf("Reopened capture on interface %s", *iface)
+			reattachXDPFilter()
+			sdNotify("STATUS=Capturing on " + *iface)
+		}
+	}()
+	return packets, nil
+}
+
+// openPcapSource opens the pcap capture, retrying for retry, and makes it the
+// capture source.
+func openPcapSource(retry time.Duration) (*pcap.Handle, error) {
+	var handle *pcap.Handle
+	err := openWithRetry(func() error {
+		var err error
+		handle, err = openCapture()
+		return err
+	}, retry)
+	if err != nil {
+		return nil, err
+	}
+	setCaptureSources(pcapSource{handle})
+	return handle, nil
+}
+
+// readPackets sends the packets of handle until reading fails with an error
+// other than a timeout or an interrupted read, which it returns, or until the
+// capture settings are adapted.
+func readPackets(handle *pcap.Handle, packets chan<- gopacket.Packet) error {
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	for {
+		packet, err := source.NextPacket()
+		switch err {
+		case nil:
+			packets <- packet
+			if atomic.LoadInt32(&captureAdapted) == 1 {
+				return errCaptureAdapted
+			}
+		case pcap.NextErrorTimeoutExpired, syscall.EAGAIN, syscall.EINTR:
+		default:
+			return err
+		}
+	}
+}
+
+// captureSource is a live capture of the interface, whose BPF filter is updated
+// on reload: the pcap handle, or the rings of the pfring capture engine.
+type captureSource interface {
+	SetBPFFilter(expr string) error
+	// counts returns the packets received, and dropped by the kernel or the interface
+	counts() (received, dropped int, err error)
+}
+
+// captureMu guards the capture sources and the XDP filter, which the capture
+// replaces when it is reopened, while the reload and the metrics use them.
+var captureMu sync.Mutex
+
+var captureSources []captureSource
+
+// fwdXDP is the XDP filter of the live capture, whose maps are updated on reload.
+var fwdXDP *xdpFilter
+
+// setCaptureSources replaces the capture sources.
+func setCaptureSources(sources ...captureSource) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	captureSources = sources
+}
+
+func addCaptureSource(source captureSource) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	captureSources = append(captureSources, source)
+}
+
+// reattachXDPFilter attaches the XDP filter again after the capture was
+// reopened, as the XDP program went away with the interface.
+func reattachXDPFilter() {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if fwdXDP == nil {
+		return
+	}
+	fwdXDP.Close()
+	var err error
+	if fwdXDP, err = attachXDPFilter(*iface); err != nil {
+		log.Println("Error attaching XDP filter", ":", err)
+	}
+}
+
+// detachXDPFilter closes the XDP filter, if any.
+func detachXDPFilter() {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if fwdXDP != nil {
+		fwdXDP.Close()
+		fwdXDP = nil
+	}
+}
+
+// configureXDPFilter updates the maps of the XDP filter, if any.
+func configureXDPFilter() error {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if fwdXDP == nil {
+		return nil
+	}
+	return fwdXDP.configure()
+}
+
+// xdpDropped returns the packets dropped by the XDP filter. ok is false
+// without XDP filter.
+func xdpDropped() (dropped int64, ok bool) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if fwdXDP == nil {
+		return 0, false
+	}
+	return fwdXDP.dropped(), true
+}
+
+type pcapSource struct {
+	*pcap.Handle
+}
+
+func (s pcapSource) counts() (int, int, error) {
+	stats, err := s.Stats()
+	if err != nil {
+		return 0, 0, err
+	}
+	return stats.PacketsReceived, stats.PacketsDropped + stats.PacketsIfDropped, nil
+}
+
+// captureCounts sums the counts of the capture sources. ok is false without
+// capture source, or if a source has no counts.
+func captureCounts() (received, dropped int, ok bool) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	for _, source := range captureSources {
+		r, d, err := source.counts()
+		if err != nil {
+			return 0, 0, false
+		}
+		received, dropped = received+r, dropped+d
+	}
+	return received, dropped, len(captureSources) > 0
+}
+
+// setCaptureFilter sets the BPF filter of the capture sources.
+func setCaptureFilter(expr string) error {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	for _, source := range captureSources {
+		if err := source.SetBPFFilter(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !pfring
+
+package mirror
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+)
+
+// openPFRingCapture reports an error: the pfring capture engine requires the
+// PF_RING library, and a build with the pfring tag.
+func openPFRingCapture() (<-chan gopacket.Packet, error) {
+	return nil, fmt.Errorf("Flag capture-engine pfring requires a build with the pfring tag.")
+}
@@ -0,0 +1,77 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build pfring
+
+package mirror
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pfring"
+)
+
+// pfringSource is a ring of the pfring capture engine.
+type pfringSource struct {
+	*pfring.Ring
+}
+
+func (s pfringSource) counts() (int, int, error) {
+	stats, err := s.Stats()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(stats.Received), int(stats.Dropped), nil
+}
+
+// openPFRingCapture opens a PF_RING ring per receive queue of the capture
+// interface, or a single ring for the whole interface, with the snaplen,
+// promiscuous mode and BPF filter of the flags. The packets of the rings are
+// decoded in parallel and merged.
+func openPFRingCapture() (<-chan gopacket.Packet, error) {
+	device := *iface
+	if *pfringZC {
+		device = "zc:" + device
+	}
+	devices := []string{device}
+	if *pfringQueues > 0 {
+		devices = nil
+		for q := 0; q < *pfringQueues; q++ {
+			devices = append(devices, fmt.Sprintf("%s@%d", device, q))
+		}
+	}
+	flags := pfring.FlagTimestamp
+	if *promisc {
+		flags |= pfring.FlagPromisc
+	}
+
+	packets := make(chan gopacket.Packet, 1000)
+	for _, d := range devices {
+		ring, err := pfring.NewRing(d, uint32(*snaplen), flags)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening PF_RING %s: %v", d, err)
+		}
+		if err := ring.SetSocketMode(pfring.ReadOnly); err != nil {
+			return nil, err
+		}
+		if err := ring.SetDirection(pfring.ReceiveOnly); err != nil {
+			return nil, err
+		}
+		if err := ring.SetBPFFilter(bpfFilter()); err != nil {
+			return nil, err
+		}
+		if err := ring.Enable(); err != nil {
+			return nil, err
+		}
+		addCaptureSource(pfringSource{ring})
+		source := gopacket.NewPacketSource(ring, layers.LinkTypeEthernet)
+		go func() {
+			for packet := range source.Packets() {
+				packets <- packet
+			}
+		}()
+	}
+	return packets, nil
+}
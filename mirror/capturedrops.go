@@ -0,0 +1,133 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pcapDefaultBufferSize is the buffer of libpcap on Linux, which a
+// pcap-buffer-size of 0 leaves, and which capture-drop-adapt grows from.
+const pcapDefaultBufferSize = 2 << 20
+
+// captureSettings are the snaplen and the buffer size the pcap capture is
+// opened with.
+type captureSettings struct {
+	snaplen, bufferSize int
+}
+
+var (
+	captureSettingsMu sync.Mutex
+	// pcapSettings start as the flags, and are adapted to the drops
+	pcapSettings *captureSettings
+	// captureAdapted is set when the settings changed, for the capture to be
+	// reopened with them
+	captureAdapted int32
+)
+
+// errCaptureAdapted ends the reading of the capture to reopen it with the
+// adapted settings.
+var errCaptureAdapted = errors.New("capture settings adapted to packet drops")
+
+// currentCaptureSettings returns the settings of the next opening of the pcap
+// capture.
+func currentCaptureSettings() captureSettings {
+	captureSettingsMu.Lock()
+	defer captureSettingsMu.Unlock()
+	if pcapSettings == nil {
+		pcapSettings = &captureSettings{snaplen: *snaplen, bufferSize: *bufferSize}
+	}
+	return *pcapSettings
+}
+
+// setCaptureSettings replaces the settings of the next opening of the pcap
+// capture, and updates their gauges.
+func setCaptureSettings(s captureSettings) {
+	captureSettingsMu.Lock()
+	pcapSettings = &s
+	captureSettingsMu.Unlock()
+	stats.set("pcap_snaplen", int64(s.snaplen))
+	stats.set("pcap_buffer_size", int64(s.bufferSize))
+}
+
+// watchCaptureDrops polls the counts of the capture sources every interval, and
+// logs and counts the packets dropped by the kernel or the interface. With
+// capture-drop-adapt, an interval with more than capture-drop-threshold of its
+// packets dropped adapts the pcap capture. It never returns.
+func watchCaptureDrops(interval time.Duration) {
+	setCaptureSettings(currentCaptureSettings())
+	var received, dropped int
+	for {
+		time.Sleep(interval)
+		totalReceived, totalDropped, ok := captureCounts()
+		if !ok {
+			continue
+		}
+		// the counts start again when the capture is reopened
+		if totalReceived < received || totalDropped < dropped {
+			received, dropped = 0, 0
+		}
+		r, d := totalReceived-received, totalDropped-dropped
+		received, dropped = totalReceived, totalDropped
+		stats.add("capture_packets_received", int64(r))
+		if d == 0 {
+			continue
+		}
+		stats.add("capture_packets_dropped", int64(d))
+		rate := float64(d) / float64(r+d)
+		log.Printf("Packets dropped before capture: %d of %d (%.2f%%) in the last %s", d, r+d, 100*rate, interval)
+		if *captureDropAdapt != "" && rate > currentConfig().captureDropThreshold && atomic.LoadInt32(&captureAdapted) == 0 {
+			adaptCapture(*captureDropAdapt)
+		}
+	}
+}
+
+// adaptCapture changes the settings of the pcap capture by policy: buffer
+// doubles the buffer size up to capture-max-buffer-size, snaplen halves the
+// snaplen down to capture-min-snaplen, and both grows the buffer and then
+// reduces the snaplen. The capture is then reopened with the new settings.
+func adaptCapture(policy string) {
+	conf := currentConfig()
+	s := currentCaptureSettings()
+	next := s
+	if policy == "buffer" || policy == "both" {
+		size := s.bufferSize
+		if size == 0 {
+			size = pcapDefaultBufferSize
+		}
+		if size *= 2; size > conf.captureMaxBufferSize {
+			size = conf.captureMaxBufferSize
+		}
+		if size > s.bufferSize && size > pcapDefaultBufferSize {
+			next.bufferSize = size
+		}
+	}
+	if policy == "snaplen" || (policy == "both" && next == s) {
+		length := s.snaplen / 2
+		if length < conf.captureMinSnaplen {
+			length = conf.captureMinSnaplen
+		}
+		if length < s.snaplen {
+			next.snaplen = length
+		}
+	}
+	if next == s {
+		stats.inc("capture_adaptations_exhausted")
+		log.Printf("Packets still dropped before capture with a snaplen of %d and a buffer of %d bytes, the limits of capture-drop-adapt", s.snaplen, s.bufferSize)
+		return
+	}
+	if next.bufferSize != s.bufferSize {
+		stats.inc(labeled("capture_adaptations", "setting", "buffer_size"))
+	}
+	if next.snaplen != s.snaplen {
+		stats.inc(labeled("capture_adaptations", "setting", "snaplen"))
+	}
+	log.Printf("Reopening capture with a snaplen of %d and a buffer of %d bytes, from %d and %d, to reduce packet drops", next.snaplen, next.bufferSize, s.snaplen, s.bufferSize)
+	setCaptureSettings(next)
+	atomic.StoreInt32(&captureAdapted, 1)
+}
@@ -0,0 +1,147 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// replayCheckpoint is the progress of a replay, saved to replay-checkpoint so
+// that replay -resume goes on from it. The records of the source are numbered
+// from 0 in its order.
+type replayCheckpoint struct {
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+	// Records is the number of records from the start of the source that are
+	// all forwarded, Offset the offset in the archive after them and Sequence
+	// the sequence of the last of them
+	Records  int    `json:"records"`
+	Offset   int64  `json:"offset,omitempty"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	// Completed lists the records after Records already forwarded, which
+	// completed out of order with replay-concurrency
+	Completed []int `json:"completed,omitempty"`
+}
+
+// replayProgress tracks the records of a replay that were forwarded.
+type replayProgress struct {
+	mu         sync.Mutex
+	checkpoint replayCheckpoint
+	// done holds the completed records after checkpoint.Records, and position
+	// the offset and sequence after the started records not yet below it
+	done     map[int]bool
+	position map[int]replayPosition
+}
+
+type replayPosition struct {
+	offset   int64
+	sequence uint64
+}
+
+func newReplayProgress(checkpoint replayCheckpoint) *replayProgress {
+	p := &replayProgress{checkpoint: checkpoint, done: map[int]bool{}, position: map[int]replayPosition{}}
+	for _, i := range checkpoint.Completed {
+		p.done[i] = true
+	}
+	p.checkpoint.Completed = nil
+	return p
+}
+
+// loadReplayCheckpoint reads the checkpoint of a replay of source from path.
+func loadReplayCheckpoint(path, source string) (replayCheckpoint, error) {
+	var checkpoint replayCheckpoint
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return checkpoint, err
+	}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return checkpoint, fmt.Errorf("Error reading checkpoint %s: %v", path, err)
+	}
+	if checkpoint.Source != source {
+		return checkpoint, fmt.Errorf("Checkpoint %s is for %s, not %s.", path, checkpoint.Source, source)
+	}
+	return checkpoint, nil
+}
+
+// start records that the record i, after which the archive is at offset, is
+// being forwarded. It reports false if the record was already forwarded before
+// the replay was resumed, and is skipped.
+func (p *replayProgress) start(i int, offset int64, sequence uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.position[i] = replayPosition{offset: offset, sequence: sequence}
+	if p.done[i] {
+		p.advance()
+		return false
+	}
+	return true
+}
+
+// complete records that the record i was forwarded.
+func (p *replayProgress) complete(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done[i] = true
+	p.advance()
+}
+
+// advance moves the checkpoint past the records completed in order. It is
+// called with the lock held.
+func (p *replayProgress) advance() {
+	for {
+		i := p.checkpoint.Records
+		position, started := p.position[i]
+		if !started || !p.done[i] {
+			return
+		}
+		delete(p.done, i)
+		delete(p.position, i)
+		p.checkpoint.Records++
+		p.checkpoint.Offset, p.checkpoint.Sequence = position.offset, position.sequence
+	}
+}
+
+// save writes the checkpoint to path, replacing the previous one.
+func (p *replayProgress) save(path string) error {
+	p.mu.Lock()
+	checkpoint := p.checkpoint
+	for i := range p.done {
+		checkpoint.Completed = append(checkpoint.Completed, i)
+	}
+	p.mu.Unlock()
+	sort.Ints(checkpoint.Completed)
+	checkpoint.Time = time.Now()
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	// a crash while saving leaves the previous checkpoint
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// saveLoop saves the checkpoint to path every interval until stop is closed.
+func (p *replayProgress) saveLoop(path string, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.save(path); err != nil {
+				log.Println("Error saving replay checkpoint", ":", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
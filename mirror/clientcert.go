@@ -0,0 +1,96 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The handshake message carrying the certificate chain of the TLS client.
+const tlsHandshakeCertificate = 11
+
+// setClientCertHeaders sets the headers of client-cert-subject-header and
+// client-cert-san-header to the subject and the subject alternative names of
+// the certificate the client authenticated with. Without certificate, the
+// headers are removed, so that a shadow trusting them cannot be fooled by a
+// client sending them.
+func setClientCertHeaders(conf *configSnapshot, header http.Header, cert *x509.Certificate) {
+	for _, h := range []struct {
+		name  string
+		value func(*x509.Certificate) string
+	}{
+		{conf.clientCertSubjectHeader, func(c *x509.Certificate) string { return c.Subject.String() }},
+		{conf.clientCertSANHeader, certificateSANs},
+	} {
+		if h.name == "" {
+			continue
+		}
+		header.Del(h.name)
+		if cert != nil {
+			if value := h.value(cert); value != "" {
+				header.Set(h.name, value)
+			}
+		}
+	}
+	if cert != nil {
+		stats.inc("client_certs_forwarded")
+	}
+}
+
+// certificateSANs returns the subject alternative names of cert, like
+// "DNS:api.example.com, URI:spiffe://example.com/ns/default/sa/web".
+func certificateSANs(cert *x509.Certificate) string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, "DNS:"+name)
+	}
+	for _, name := range cert.EmailAddresses {
+		names = append(names, "email:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, "URI:"+uri.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// parseCertificateMessage returns the leaf certificate of a Certificate
+// handshake message of the client, header included, or nil if the client sent
+// none. TLS 1.3 messages start with a request context, and have extensions
+// after each certificate.
+func parseCertificateMessage(msg []byte, tls13 bool) (*x509.Certificate, error) {
+	if len(msg) < 4 || msg[0] != tlsHandshakeCertificate {
+		return nil, fmt.Errorf("not a Certificate message")
+	}
+	body := msg[4:]
+	if tls13 {
+		if len(body) < 1 || len(body) < 1+int(body[0]) {
+			return nil, fmt.Errorf("Certificate message is truncated")
+		}
+		body = body[1+int(body[0]):]
+	}
+	if len(body) < 3 {
+		return nil, fmt.Errorf("Certificate message is truncated")
+	}
+	list := body[3:]
+	if n := uint24(body); n > len(list) {
+		return nil, fmt.Errorf("Certificate message is truncated")
+	} else if n == 0 {
+		return nil, nil
+	}
+	if len(list) < 3 || uint24(list) > len(list)-3 {
+		return nil, fmt.Errorf("Certificate message is truncated")
+	}
+	return x509.ParseCertificate(list[3 : 3+uint24(list)])
+}
+
+func uint24(b []byte) int {
+	return int(b[0])<<16 | int(binary.BigEndian.Uint16(b[1:3]))
+}
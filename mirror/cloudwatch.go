@@ -0,0 +1,108 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// cloudWatchBatch is the number of metrics sent per PutMetricData call, well
+// below the API limits of 1000 metrics and 1MB per call.
+const cloudWatchBatch = 500
+
+// cloudWatchExporter publishes the metrics matching a list of patterns as
+// CloudWatch custom metrics: counters as their increments since the previous
+// flush, gauges as their values. The labels of a metric become dimensions, in
+// addition to the configured ones.
+type cloudWatchExporter struct {
+	namespace  string
+	dimensions []types.Dimension
+	patterns   []string
+}
+
+func newCloudWatchExporter(namespace, dimensions, metrics string) (*cloudWatchExporter, error) {
+	e := &cloudWatchExporter{namespace: namespace, patterns: splitPatterns(metrics)}
+	for _, d := range strings.Split(dimensions, ",") {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		kv := strings.SplitN(d, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("Flag cloudwatch-dimensions contains an invalid dimension (%s), must be like Name=Value.", d)
+		}
+		e.dimensions = append(e.dimensions, types.Dimension{Name: aws.String(kv[0]), Value: aws.String(kv[1])})
+	}
+	for _, p := range e.patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("Flag cloudwatch-metrics contains an invalid pattern (%s).", p)
+		}
+	}
+	return e, nil
+}
+
+// exported reports whether the metric name (without labels) matches one of the patterns.
+func (e *cloudWatchExporter) exported(name string) bool {
+	for _, p := range e.patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *cloudWatchExporter) export(values map[string]int64, deltas map[string]int64) error {
+	now := time.Now()
+	var data []types.MetricDatum
+	for _, metric := range sortedMetrics(values) {
+		name, labels := exportedMetric(metric)
+		if !e.exported(name) {
+			continue
+		}
+		value := deltas[metric]
+		if stats.isGauge(metric) {
+			value = values[metric]
+		}
+		dims := append([]types.Dimension(nil), e.dimensions...)
+		for i := 0; i+1 < len(labels); i += 2 {
+			dims = append(dims, types.Dimension{Name: aws.String(labels[i]), Value: aws.String(labels[i+1])})
+		}
+		data = append(data, types.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: dims,
+			Timestamp:  aws.Time(now),
+			Value:      aws.Float64(float64(value)),
+			Unit:       types.StandardUnitCount,
+		})
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	cfg, err := awsConfig()
+	if err != nil {
+		return err
+	}
+	client := cloudwatch.NewFromConfig(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for len(data) > 0 {
+		batch := data
+		if len(batch) > cloudWatchBatch {
+			batch = batch[:cloudWatchBatch]
+		}
+		data = data[len(batch):]
+		if _, err := client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{Namespace: aws.String(e.namespace), MetricData: batch}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// applyConfigFile reads a JSON object of flag names and values from path, and sets
+// the flags of fs:
+//
+//	{
+//	  "route-table-json": {"www.example.com": "http://172.0.0.1"},
+//	  "percentage": 10
+//	}
+//
+// String values are used as is, other values (numbers, booleans, objects) are
+// passed to the flag in their JSON encoding. Flags in explicit are not changed.
+func applyConfigFile(fs *flag.FlagSet, path string, explicit map[string]bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+	// the values of the pipeline take precedence over the top level ones
+	if raw, ok := values[pipelinesKey]; ok {
+		delete(values, pipelinesKey)
+		var pipelines map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &pipelines); err != nil {
+			return fmt.Errorf("Error parsing pipelines of config file %s: %v", path, err)
+		}
+		if *pipelineName != "" {
+			pipeline, ok := pipelines[*pipelineName]
+			if !ok {
+				return fmt.Errorf("Config file %s has no pipeline %s.", path, *pipelineName)
+			}
+			for name, value := range pipeline {
+				values[name] = value
+			}
+		}
+	}
+
+	for name, raw := range values {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("Config file %s sets unknown flag %s.", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		value := strings.TrimSpace(string(raw))
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			value = s
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("Config file %s sets invalid value for flag %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
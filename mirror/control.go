@@ -0,0 +1,135 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// pauseMode tells what happens to captured traffic while forwarding is paused.
+type pauseMode int32
+
+const (
+	// pauseNone forwards requests normally.
+	pauseNone pauseMode = iota
+	// pauseCount keeps capturing and parsing requests, and counts them without forwarding.
+	pauseCount
+	// pauseDrop discards captured packets before they are reassembled.
+	pauseDrop
+)
+
+func (m pauseMode) String() string {
+	switch m {
+	case pauseCount:
+		return "count"
+	case pauseDrop:
+		return "drop"
+	}
+	return "none"
+}
+
+func parsePauseMode(s string) (pauseMode, error) {
+	switch s {
+	case "", "count":
+		return pauseCount, nil
+	case "drop":
+		return pauseDrop, nil
+	}
+	return pauseNone, fmt.Errorf("pause mode (%s) is not valid. Valid values are: count, drop.", s)
+}
+
+// Runtime settings that can be changed through the admin API and signals.
+var fwdPause int32
+var fwdPercBits uint64
+var fwdDraining int32
+var fwdInFlight int64
+
+// fwdCtx is the parent context of all forwards, cancelled on shutdown.
+var fwdCtx, cancelForwards = context.WithCancel(context.Background())
+
+// captureStop is closed by stopCapture to end the capture loop.
+var captureStop = make(chan struct{})
+var captureStopOnce sync.Once
+
+func stopCapture() {
+	captureStopOnce.Do(func() { close(captureStop) })
+}
+
+func currentPauseMode() pauseMode {
+	return pauseMode(atomic.LoadInt32(&fwdPause))
+}
+
+func setPauseMode(mode pauseMode) {
+	atomic.StoreInt32(&fwdPause, int32(mode))
+}
+
+func samplingPercentage() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&fwdPercBits))
+}
+
+func setSamplingPercentage(percentage float64) {
+	atomic.StoreUint64(&fwdPercBits, math.Float64bits(percentage))
+}
+
+func draining() bool {
+	return atomic.LoadInt32(&fwdDraining) == 1
+}
+
+// undrain accepts new streams again after a drain.
+func undrain() {
+	if atomic.SwapInt32(&fwdDraining, 0) == 1 {
+		log.Println("Accepting new streams again after drain")
+	}
+}
+
+// drain stops accepting new streams and waits until in-flight forwards are done,
+// or until timeout. It reports whether all forwards completed.
+func drain(timeout time.Duration) bool {
+	atomic.StoreInt32(&fwdDraining, 1)
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&fwdInFlight) > 0 {
+		if time.Now().After(deadline) {
+			log.Println("Drain timed out with", atomic.LoadInt64(&fwdInFlight), "requests in flight")
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Println("Drained, no requests in flight")
+	return true
+}
+
+// discardStream is handed to the assembler for streams opened while draining.
+type discardStream struct{}
+
+func (discardStream) Reassembled([]tcpassembly.Reassembly) {}
+func (discardStream) ReassemblyComplete()                  {}
+
+// shutdown drains the in-flight forwards before the process exits, and cancels
+// them if they are not done within timeout.
+func shutdown(timeout time.Duration) {
+	sdNotify("STOPPING=1")
+	if !drain(timeout) {
+		cancelForwards()
+	}
+	// end the frame of a compressed archive
+	if a := fwdArchive; a != nil {
+		a.close()
+	}
+	saveFingerprintReport()
+	saveCoverageReport()
+	if f := fwdFlows; f != nil {
+		f.flush()
+	}
+	if e := fwdLeader; e != nil {
+		e.resign()
+	}
+}
@@ -0,0 +1,119 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cookieJarIdleTimeout is how long the cookies of a client are kept after its
+// last request.
+const cookieJarIdleTimeout = 30 * time.Minute
+
+// clientCookieJars emulates the cookie jar of each captured client: the
+// cookies set by the destinations are stored by client, and replace the
+// cookies of the same name sent by the client in its next requests. Without
+// it, destinations that set session cookies never see them back, as the
+// requests carry the cookies set by production.
+type clientCookieJars struct {
+	// by identifies the client: source-ip, or a tenant_by like header:<name> or cookie:<name>
+	by   string
+	mu   sync.Mutex
+	jars map[string]*clientJar
+}
+
+type clientJar struct {
+	jar      *cookiejar.Jar
+	lastUsed time.Time
+}
+
+var fwdCookieJars *clientCookieJars
+
+func newClientCookieJars(by string) *clientCookieJars {
+	j := &clientCookieJars{by: by, jars: map[string]*clientJar{}}
+	go j.expireLoop()
+	return j
+}
+
+func validCookieJarKey(by string) bool {
+	return by == "" || by == "source-ip" || validTenantBy(by)
+}
+
+// client returns the key of the client of req, or "" if it is unknown.
+func (j *clientCookieJars) client(req *http.Request, info captureInfo, body []byte) string {
+	if j.by == "source-ip" {
+		return info.sourceIP
+	}
+	return tenantValue(req, body, j.by)
+}
+
+func (j *clientCookieJars) jar(client string) *cookiejar.Jar {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c, ok := j.jars[client]
+	if !ok {
+		jar, _ := cookiejar.New(nil)
+		c = &clientJar{jar: jar}
+		j.jars[client] = c
+		stats.set("cookie_jar_clients", int64(len(j.jars)))
+	}
+	c.lastUsed = time.Now()
+	return c.jar
+}
+
+// apply replaces the cookies of the forwarded request with the cookies the
+// destination set for client, and adds the ones the request does not have.
+func (j *clientCookieJars) apply(client string, forwardReq *http.Request) {
+	stored := j.jar(client).Cookies(forwardReq.URL)
+	if len(stored) == 0 {
+		return
+	}
+	values := map[string]string{}
+	for _, c := range stored {
+		values[c.Name] = c.Value
+	}
+	var pairs []string
+	for _, c := range forwardReq.Cookies() {
+		if v, ok := values[c.Name]; ok {
+			c.Value = v
+			delete(values, c.Name)
+			stats.inc("cookies_substituted")
+		}
+		pairs = append(pairs, c.Name+"="+c.Value)
+	}
+	for _, c := range stored {
+		if _, ok := values[c.Name]; ok {
+			pairs = append(pairs, c.Name+"="+c.Value)
+		}
+	}
+	forwardReq.Header.Set("Cookie", strings.Join(pairs, "; "))
+}
+
+// store keeps the cookies set by the response to a request of client sent to u.
+func (j *clientCookieJars) store(client string, u *url.URL, resp *http.Response) {
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		j.jar(client).SetCookies(u, cookies)
+	}
+}
+
+// expireLoop forgets the cookies of the clients idle for cookieJarIdleTimeout.
+// It never returns.
+func (j *clientCookieJars) expireLoop() {
+	for {
+		time.Sleep(cookieJarIdleTimeout / 10)
+		j.mu.Lock()
+		for client, c := range j.jars {
+			if time.Since(c.lastUsed) > cookieJarIdleTimeout {
+				delete(j.jars, client)
+			}
+		}
+		stats.set("cookie_jar_clients", int64(len(j.jars)))
+		j.mu.Unlock()
+	}
+}
@@ -0,0 +1,213 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxUnmatchedPaths bounds the number of path templates of the requests that
+// match no operation of the spec; the others are counted under otherPath.
+const maxUnmatchedPaths = 1000
+
+// operationCoverage holds the requests of an operation of the OpenAPI spec.
+type operationCoverage struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	OperationID string `json:"operation_id,omitempty"`
+	Requests    int64  `json:"requests"`
+	Forwarded   int64  `json:"forwarded"`
+	Errors      int64  `json:"errors"`
+	// Violations counts the requests that violate the spec, with
+	// openapi-validation
+	Violations int64 `json:"violations,omitempty"`
+}
+
+// unmatchedPath counts the requests of a method and path template that match
+// no operation of the spec.
+type unmatchedPath struct {
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Requests int64  `json:"requests"`
+}
+
+// coverageReport is the document written to openapi-coverage-report.
+type coverageReport struct {
+	Time  time.Time `json:"time"`
+	Since time.Time `json:"since"`
+	// Covered is the number of operations with at least a forwarded request,
+	// and Coverage their ratio
+	Operations int     `json:"operations"`
+	Covered    int     `json:"covered"`
+	Coverage   float64 `json:"coverage"`
+	Requests   int64   `json:"requests"`
+	Unmatched  int64   `json:"unmatched"`
+	// Endpoints lists the operations by path, and UnmatchedPaths the paths not
+	// in the spec with the most requests first
+	Endpoints      []operationCoverage `json:"endpoints"`
+	UnmatchedPaths []unmatchedPath     `json:"unmatched_paths,omitempty"`
+}
+
+// apiCoverage matches the captured requests to the operations of an OpenAPI
+// spec, to measure which endpoints of the API receive shadow traffic.
+type apiCoverage struct {
+	mu         sync.Mutex
+	spec       *openAPISpec
+	since      time.Time
+	operations []operationCoverage
+	requests   int64
+	unmatched  map[string]*unmatchedPath
+}
+
+// newAPICoverage returns the coverage of spec. The counts of previous, the
+// coverage before a reload, are kept for the operations still in the spec.
+func newAPICoverage(spec *openAPISpec, previous *apiCoverage) *apiCoverage {
+	c := &apiCoverage{spec: spec, since: time.Now(), unmatched: map[string]*unmatchedPath{}}
+	for _, op := range spec.operations {
+		c.operations = append(c.operations, operationCoverage{Method: op.method, Path: op.path, OperationID: op.id})
+	}
+	if previous == nil {
+		return c
+	}
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	counts := map[string]operationCoverage{}
+	for _, o := range previous.operations {
+		counts[o.Method+" "+o.Path] = o
+	}
+	for i := range c.operations {
+		if o, ok := counts[c.operations[i].Method+" "+c.operations[i].Path]; ok {
+			c.operations[i].Requests, c.operations[i].Forwarded, c.operations[i].Errors = o.Requests, o.Forwarded, o.Errors
+			c.operations[i].Violations = o.Violations
+		}
+	}
+	for key, u := range previous.unmatched {
+		copied := *u
+		c.unmatched[key] = &copied
+	}
+	c.since, c.requests = previous.since, previous.requests
+	return c
+}
+
+// record counts a request, and returns its operation for the outcome of its
+// forward, or nil if it matches none.
+func (c *apiCoverage) record(req *http.Request, templates *pathTemplates) *apiOperation {
+	op := c.spec.match(req)
+	var template string
+	if op == nil {
+		template = templates.apply(requestPath(req))
+		stats.inc("openapi_requests_unmatched")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	if op != nil {
+		c.operations[op.index].Requests++
+		return op
+	}
+	key := req.Method + " " + template
+	u, ok := c.unmatched[key]
+	if !ok {
+		if len(c.unmatched) >= maxUnmatchedPaths {
+			key = otherPath
+		}
+		if u, ok = c.unmatched[key]; !ok {
+			u = &unmatchedPath{Method: req.Method, Path: template}
+			if key == otherPath {
+				u.Method, u.Path = "", otherPath
+			}
+			c.unmatched[key] = u
+		}
+	}
+	u.Requests++
+	return nil
+}
+
+// forwarded records the outcome of the forward of a request of op.
+func (c *apiCoverage) forwarded(op *apiOperation, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.operations[op.index].Forwarded++
+	} else {
+		c.operations[op.index].Errors++
+	}
+}
+
+// violation counts and logs a request of op that violates the spec.
+func (c *apiCoverage) violation(op *apiOperation, kind string, err error) {
+	label := op.id
+	if label == "" {
+		label = op.method + " " + op.path
+	}
+	stats.inc(labeled("openapi_violations", "operation", label, "kind", kind))
+	openAPIViolations.log(label, kind, err)
+	c.mu.Lock()
+	c.operations[op.index].Violations++
+	c.mu.Unlock()
+}
+
+// report returns the coverage of the operations since the start.
+func (c *apiCoverage) report() coverageReport {
+	c.mu.Lock()
+	r := coverageReport{Time: time.Now(), Since: c.since, Operations: len(c.operations), Requests: c.requests}
+	r.Endpoints = append([]operationCoverage(nil), c.operations...)
+	for _, u := range c.unmatched {
+		r.UnmatchedPaths = append(r.UnmatchedPaths, *u)
+		r.Unmatched += u.Requests
+	}
+	c.mu.Unlock()
+	for _, o := range r.Endpoints {
+		if o.Forwarded > 0 {
+			r.Covered++
+		}
+	}
+	if r.Operations > 0 {
+		r.Coverage = float64(r.Covered) / float64(r.Operations)
+	}
+	sort.Slice(r.UnmatchedPaths, func(i, j int) bool {
+		if r.UnmatchedPaths[i].Requests != r.UnmatchedPaths[j].Requests {
+			return r.UnmatchedPaths[i].Requests > r.UnmatchedPaths[j].Requests
+		}
+		return r.UnmatchedPaths[i].Method+" "+r.UnmatchedPaths[i].Path < r.UnmatchedPaths[j].Method+" "+r.UnmatchedPaths[j].Path
+	})
+	stats.set("openapi_operations", int64(r.Operations))
+	stats.set("openapi_operations_covered", int64(r.Covered))
+	return r
+}
+
+// coverageReportLoop logs the coverage every interval, and writes the report
+// to path if it is set. It never returns.
+func coverageReportLoop(path string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		// the coverage is replaced when the spec is reloaded
+		c := currentConfig().coverage
+		if c == nil {
+			continue
+		}
+		r := c.report()
+		log.Printf("API coverage: %d of %d operations (%.1f%%) received shadow traffic, %d of %d requests matched no operation", r.Covered, r.Operations, 100*r.Coverage, r.Unmatched, r.Requests)
+		if path == "" || !sinkEnabled("openapi-coverage-report") {
+			continue
+		}
+		if err := writeJSONReport(path, r); err != nil {
+			log.Println("Error writing API coverage report", ":", err)
+		}
+	}
+}
+
+// saveCoverageReport writes the last report of openapi-coverage-report when the
+// capture or the replay ends.
+func saveCoverageReport() {
+	if c := currentConfig().coverage; c != nil && *coverageReportFile != "" && sinkEnabled("openapi-coverage-report") {
+		if err := writeJSONReport(*coverageReportFile, c.report()); err != nil {
+			log.Println("Error writing API coverage report", ":", err)
+		}
+	}
+}
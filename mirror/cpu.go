@@ -0,0 +1,100 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// maxCPU bounds the CPU numbers of the CPU flags, like the CPU sets of Linux.
+const maxCPU = 1024
+
+// parseCPUList parses a comma separated list of CPUs and CPU ranges like
+// 2-7,10, of the flag name.
+func parseCPUList(name, list string) ([]int, error) {
+	var cpus []int
+	for _, c := range splitPatterns(list) {
+		bounds := strings.SplitN(c, "-", 2)
+		var values []int
+		for _, b := range bounds {
+			v, err := strconv.Atoi(b)
+			if err != nil || v < 0 || v >= maxCPU {
+				return nil, fmt.Errorf("Flag %s contains an invalid CPU (%s).", name, c)
+			}
+			values = append(values, v)
+		}
+		if len(values) == 1 {
+			values = append(values, values[0])
+		}
+		if values[0] > values[1] {
+			return nil, fmt.Errorf("Flag %s contains an invalid CPU range (%s).", name, c)
+		}
+		for v := values[0]; v <= values[1]; v++ {
+			cpus = append(cpus, v)
+		}
+	}
+	return cpus, nil
+}
+
+// validGOMAXPROCS reports whether the gomaxprocs flag is empty, auto or a
+// positive number.
+func validGOMAXPROCS(value string) bool {
+	if value == "" || value == "auto" {
+		return true
+	}
+	n, err := strconv.Atoi(value)
+	return err == nil && n > 0
+}
+
+// tuneCPUs applies worker-cpus and gomaxprocs at startup. The flags are
+// validated by setupFlags; capture-cpu is applied by the capture loop.
+func tuneCPUs() error {
+	var cpus []int
+	if *workerCPUs != "" {
+		cpus, _ = parseCPUList("worker-cpus", *workerCPUs)
+		if err := setWorkerAffinity(cpus); err != nil {
+			return err
+		}
+		log.Println("Running the workers on CPUs", *workerCPUs)
+	}
+
+	procs := 0
+	switch *gomaxprocs {
+	case "":
+	case "auto":
+		// the CPUs the process may run on, bounded by the quota of its cgroup
+		procs = runtime.NumCPU()
+		if cpus != nil {
+			procs = len(cpus)
+			if *captureCPU >= 0 && !containsCPU(cpus, *captureCPU) {
+				procs++
+			}
+		}
+		if limit := cgroupCPULimit(); limit > 0 && limit < float64(procs) {
+			procs = int(math.Ceil(limit))
+		}
+	default:
+		procs, _ = strconv.Atoi(*gomaxprocs)
+	}
+	if procs > 0 {
+		runtime.GOMAXPROCS(procs)
+		log.Println("GOMAXPROCS set to", procs)
+	}
+	stats.set("gomaxprocs", int64(runtime.GOMAXPROCS(0)))
+	return nil
+}
+
+func containsCPU(cpus []int, cpu int) bool {
+	for _, c := range cpus {
+		if c == cpu {
+			return true
+		}
+	}
+	return false
+}
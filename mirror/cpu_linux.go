@@ -0,0 +1,114 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package mirror
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpuAffinityInterval is the interval the affinity of worker-cpus is applied
+// again at, to the threads started by the capture thread since.
+const cpuAffinityInterval = 10 * time.Second
+
+// pinnedThread is the thread ID of the capture loop pinned to capture-cpu, or 0.
+var pinnedThread int32
+
+// setWorkerAffinity runs the threads of the process on cpus, but the pinned
+// capture thread. The threads the Go runtime starts later inherit the affinity
+// of the thread starting them, which can be the capture thread: the affinity
+// is applied again periodically.
+func setWorkerAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	if err := applyAffinity(&set); err != nil {
+		return fmt.Errorf("Error setting the CPU affinity of worker-cpus: %v", err)
+	}
+	go func() {
+		for range time.Tick(cpuAffinityInterval) {
+			if err := applyAffinity(&set); err != nil {
+				log.Println("Error setting the CPU affinity of worker-cpus", ":", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func applyAffinity(set *unix.CPUSet) error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	pinned := int(atomic.LoadInt32(&pinnedThread))
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil || tid == pinned {
+			continue
+		}
+		// the thread may have exited since the directory was read
+		if err := unix.SchedSetaffinity(tid, set); err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
+
+// pinCaptureThread locks the calling goroutine, the capture loop, to its
+// thread, and runs the thread on cpu only.
+func pinCaptureThread(cpu int) error {
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Set(cpu)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("Error pinning the capture loop to CPU %d: %v", cpu, err)
+	}
+	atomic.StoreInt32(&pinnedThread, int32(unix.Gettid()))
+	return nil
+}
+
+// cgroupCPULimit returns the CPU quota of the cgroup of the process in CPUs,
+// like 1.5, or 0 without quota. Containers see their own cgroup at the root.
+func cgroupCPULimit() float64 {
+	// cgroup v2: "<quota> <period>", or "max <period>"
+	if data, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0
+		}
+		quota, qErr := strconv.ParseFloat(fields[0], 64)
+		period, pErr := strconv.ParseFloat(fields[1], 64)
+		if qErr != nil || pErr != nil || period <= 0 {
+			return 0
+		}
+		return quota / period
+	}
+	// cgroup v1, whose quota is -1 without limit
+	quota, qErr := readCgroupValue("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	period, pErr := readCgroupValue("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if qErr != nil || pErr != nil || quota <= 0 || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+func readCgroupValue(path string) (float64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+}
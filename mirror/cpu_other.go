@@ -0,0 +1,20 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package mirror
+
+import "fmt"
+
+func setWorkerAffinity(cpus []int) error {
+	return fmt.Errorf("Flag worker-cpus is only supported on Linux.")
+}
+
+func pinCaptureThread(cpu int) error {
+	return fmt.Errorf("Flag capture-cpu is only supported on Linux.")
+}
+
+func cgroupCPULimit() float64 {
+	return 0
+}
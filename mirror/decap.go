@@ -0,0 +1,98 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// encapsulationNames are the names of the encapsulation layers in the
+// packets_decapsulated metric.
+var encapsulationNames = map[gopacket.LayerType]string{
+	layers.LayerTypeVXLAN:  "vxlan",
+	layers.LayerTypeGeneve: "geneve",
+	layers.LayerTypeGRE:    "gre",
+	layers.LayerTypeMPLS:   "mpls",
+}
+
+// decapsulate returns the innermost IP layer of the packet and the TCP layer it
+// carries. gopacket decodes the chain of encapsulations on its own, like
+// VXLAN in GRE or IP over MPLS labels: decapsulate skips them, and counts them
+// by type. Packets with more than decap-max-depth encapsulations are not
+// usable, like packets without TCP.
+func decapsulate(packet gopacket.Packet) (gopacket.NetworkLayer, *layers.TCP, bool) {
+	var network gopacket.NetworkLayer
+	var previous gopacket.LayerType
+	var encapsulations []string
+	for _, layer := range packet.Layers() {
+		if name, ok := encapsulationNames[layer.LayerType()]; ok {
+			encapsulations = append(encapsulations, name)
+		}
+		switch l := layer.(type) {
+		case gopacket.NetworkLayer:
+			if previous == layers.LayerTypeIPv4 || previous == layers.LayerTypeIPv6 {
+				// IP in IP, without encapsulation layer
+				encapsulations = append(encapsulations, "ip-in-ip")
+			}
+			network = l
+		case *layers.TCP:
+			if network == nil {
+				return nil, nil, false
+			}
+			if len(encapsulations) > currentConfig().decapMaxDepth {
+				stats.inc("packets_encapsulation_too_deep")
+				return nil, nil, false
+			}
+			for _, name := range encapsulations {
+				stats.inc(labeled("packets_decapsulated", "type", name))
+			}
+			return network, l, true
+		}
+		previous = layer.LayerType()
+	}
+	return nil, nil, false
+}
+
+// decapsulateUDP returns the innermost IP layer of a packet without TCP, and
+// the UDP datagram it carries, e.g. QUIC in VXLAN.
+func decapsulateUDP(packet gopacket.Packet) (gopacket.NetworkLayer, *layers.UDP, bool) {
+	var network, udpNetwork gopacket.NetworkLayer
+	var udp *layers.UDP
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case gopacket.NetworkLayer:
+			network = l
+		case *layers.UDP:
+			udpNetwork, udp = network, l
+		}
+	}
+	return udpNetwork, udp, udp != nil && udpNetwork != nil
+}
+
+// parseVXLANPorts parses the comma separated UDP ports of vxlan-ports.
+func parseVXLANPorts(list string) ([]int, error) {
+	var ports []int
+	for _, p := range splitPatterns(list) {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Flag vxlan-ports contains an invalid port (%s).", p)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// registerVXLANPorts makes gopacket decode the UDP packets of the ports of
+// vxlan-ports as VXLAN, in addition to the IANA port 4789. The flag is
+// validated by setupFlags.
+func registerVXLANPorts() {
+	ports, _ := parseVXLANPorts(*vxlanPorts)
+	for _, port := range ports {
+		layers.RegisterUDPPortLayerType(layers.UDPPort(port), layers.LayerTypeVXLAN)
+	}
+}
@@ -0,0 +1,430 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response diffing compares the responses of the destinations with the
+// responses of production, which are captured with filter-mode either. The
+// n-th response of a captured connection answers its n-th request, so both
+// are paired by connection and index.
+
+// diffPairTimeout is how long a response waits for the response it is compared with.
+const diffPairTimeout = 30 * time.Second
+
+// diffLogInterval is the minimum interval between two logs of differences.
+const diffLogInterval = time.Second
+
+// diffRules are the normalizations applied to the bodies before they are compared.
+type diffRules struct {
+	// IgnoreFields are JSON fields (dotted paths, * matches any key or index)
+	// removed before comparison, like timestamps and generated IDs
+	IgnoreFields []string `json:"ignore_fields,omitempty"`
+	// CanonicalJSON compares JSON bodies as values, ignoring key order and formatting
+	CanonicalJSON bool `json:"canonical_json"`
+	// HTMLWhitespace collapses the whitespace of HTML bodies
+	HTMLWhitespace bool `json:"html_whitespace"`
+	// two JSON numbers are equal if they differ by at most NumericTolerance, or
+	// by at most NumericRelativeTolerance of the larger one
+	NumericTolerance         float64 `json:"numeric_tolerance,omitempty"`
+	NumericRelativeTolerance float64 `json:"numeric_relative_tolerance,omitempty"`
+
+	ignore [][]string
+}
+
+func loadDiffRules(path string) (*diffRules, error) {
+	r := &diffRules{CanonicalJSON: true, HTMLWhitespace: true}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, r); err != nil {
+			return nil, fmt.Errorf("Error parsing diff rules %s: %v", path, err)
+		}
+	}
+	if r.NumericTolerance < 0 || r.NumericRelativeTolerance < 0 {
+		return nil, fmt.Errorf("Diff rules: numeric tolerances must not be negative.")
+	}
+	for _, f := range r.IgnoreFields {
+		if f == "" {
+			return nil, fmt.Errorf("Diff rules: ignore_fields contains an empty field.")
+		}
+		r.ignore = append(r.ignore, strings.Split(f, "."))
+	}
+	if len(r.ignore) > 0 || r.NumericTolerance > 0 || r.NumericRelativeTolerance > 0 {
+		// the fields and numbers are found in the decoded value
+		r.CanonicalJSON = true
+	}
+	return r, nil
+}
+
+// observedResponse is a response of production or of a destination.
+type observedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	// seen is when the response of production was captured
+	seen time.Time
+	// latency is the latency of the destination
+	latency time.Duration
+}
+
+func newObservedResponse(resp *http.Response, body []byte) *observedResponse {
+	return &observedResponse{status: resp.StatusCode, header: resp.Header, body: body}
+}
+
+// diffResult is the comparison of the responses of a request.
+type diffResult struct {
+	requestID string
+	method    string
+	path      string
+	// requestTime is the capture timestamp of the request
+	requestTime time.Time
+	production  *observedResponse
+	shadow      *observedResponse
+	// reason describes the first difference, or is empty if the responses match
+	reason string
+}
+
+// diffPair holds the responses of a request until both are known.
+type diffPair struct {
+	created    time.Time
+	production *observedResponse
+	result     *diffResult
+	// dropped is true if the request was not forwarded
+	dropped bool
+}
+
+// responseDiffs pairs and compares the responses.
+type responseDiffs struct {
+	mu      sync.Mutex
+	rules   *diffRules
+	pairs   map[string]*diffPair
+	summary *diffSummary
+
+	logMu      sync.Mutex
+	lastLog    time.Time
+	suppressed int
+}
+
+var fwdDiffs *responseDiffs
+
+func newResponseDiffs(rules *diffRules) *responseDiffs {
+	d := &responseDiffs{rules: rules, pairs: map[string]*diffPair{}, summary: newDiffSummary()}
+	go d.expireLoop()
+	return d
+}
+
+// setRules replaces the normalizations, on reload.
+func (d *responseDiffs) setRules(rules *diffRules) {
+	d.mu.Lock()
+	d.rules = rules
+	d.mu.Unlock()
+}
+
+func diffKey(connectionID string, index int) string {
+	return connectionID + "/" + strconv.Itoa(index)
+}
+
+// production records the response of production to the request index of a connection.
+func (d *responseDiffs) production(connectionID string, index int, resp *observedResponse) {
+	key := diffKey(connectionID, index)
+	d.mu.Lock()
+	p, ok := d.pairs[key]
+	if !ok {
+		d.pairs[key] = &diffPair{created: time.Now(), production: resp}
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pairs, key)
+	d.mu.Unlock()
+	if p.result != nil {
+		p.result.production = resp
+		d.compare(p.result)
+	}
+}
+
+// shadow records the response of the destination to a forwarded request.
+func (d *responseDiffs) shadow(info captureInfo, req *http.Request, resp *observedResponse) {
+	result := &diffResult{requestID: info.requestID, method: req.Method, path: requestPath(req), requestTime: info.time, shadow: resp}
+	key := diffKey(info.connectionID, info.index)
+	d.mu.Lock()
+	p, ok := d.pairs[key]
+	if !ok {
+		d.pairs[key] = &diffPair{created: time.Now(), result: result}
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pairs, key)
+	d.mu.Unlock()
+	result.production = p.production
+	d.compare(result)
+}
+
+// discard records that a request was not forwarded, so that the response of
+// production is not kept.
+func (d *responseDiffs) discard(info captureInfo) {
+	key := diffKey(info.connectionID, info.index)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.pairs[key]; ok {
+		delete(d.pairs, key)
+		return
+	}
+	d.pairs[key] = &diffPair{created: time.Now(), dropped: true}
+}
+
+// expireLoop forgets the responses not paired within diffPairTimeout. It never returns.
+func (d *responseDiffs) expireLoop() {
+	for {
+		time.Sleep(diffPairTimeout / 3)
+		d.mu.Lock()
+		for key, p := range d.pairs {
+			if time.Since(p.created) > diffPairTimeout {
+				if !p.dropped {
+					stats.inc("diff_unpaired")
+				}
+				delete(d.pairs, key)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+func (d *responseDiffs) compare(result *diffResult) {
+	d.mu.Lock()
+	rules := d.rules
+	d.mu.Unlock()
+	result.reason = rules.difference(result.production, result.shadow)
+	endpoint := diffEndpoint(result.method, result.path)
+	if scorecard := fwdScorecard; scorecard != nil {
+		scorecard.add(endpoint, result)
+	}
+	if result.reason == "" {
+		stats.inc("diff_matches")
+		d.summary.add(endpoint, nil)
+		return
+	}
+	stats.inc("diff_mismatches")
+	record := newDiffRecord(result)
+	d.summary.add(endpoint, &record)
+	if store := fwdDiffStore; store != nil {
+		store.store(record)
+	}
+	d.log(result)
+}
+
+func (d *responseDiffs) log(result *diffResult) {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+	if time.Since(d.lastLog) < diffLogInterval {
+		d.suppressed++
+		return
+	}
+	if d.suppressed > 0 {
+		log.Printf("Response of request %s %s %s differs: %s (%d similar messages suppressed)", result.requestID, result.method, result.path, result.reason, d.suppressed)
+	} else {
+		log.Printf("Response of request %s %s %s differs: %s", result.requestID, result.method, result.path, result.reason)
+	}
+	d.lastLog, d.suppressed = time.Now(), 0
+}
+
+// difference returns the first difference between the responses of production
+// and of the destination, after normalization, or "" if they match.
+func (r *diffRules) difference(production, shadow *observedResponse) string {
+	if production.status != shadow.status {
+		return fmt.Sprintf("status %d instead of %d", shadow.status, production.status)
+	}
+	prodBody, shadowBody := decodedBody(production), decodedBody(shadow)
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(production.header.Get("Content-Type"), ";", 2)[0]))
+
+	if r.CanonicalJSON && (strings.HasSuffix(mediaType, "json") || mediaType == "") {
+		prodValue, prodErr := decodeJSON(prodBody)
+		shadowValue, shadowErr := decodeJSON(shadowBody)
+		if prodErr == nil && shadowErr == nil {
+			for _, path := range r.ignore {
+				prodValue, shadowValue = removeField(prodValue, path), removeField(shadowValue, path)
+			}
+			return r.jsonDifference("$", prodValue, shadowValue)
+		}
+		if mediaType != "" && prodErr == nil {
+			return "body is not valid JSON"
+		}
+	}
+	if r.HTMLWhitespace && mediaType == "text/html" {
+		prodBody, shadowBody = collapseHTMLWhitespace(prodBody), collapseHTMLWhitespace(shadowBody)
+	}
+	if !bytes.Equal(prodBody, shadowBody) {
+		return fmt.Sprintf("body differs (%d bytes instead of %d)", len(shadowBody), len(prodBody))
+	}
+	return ""
+}
+
+// decodedBody returns the body of resp without its gzip Content-Encoding.
+func decodedBody(resp *observedResponse) []byte {
+	if !strings.EqualFold(resp.header.Get("Content-Encoding"), "gzip") {
+		return resp.body
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(resp.body))
+	if err != nil {
+		return resp.body
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(zr, responseBodyLimit))
+	if err != nil && len(body) == 0 {
+		return resp.body
+	}
+	return body
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// removeField removes the field at path from v, with * matching any key or index.
+func removeField(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return v
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for key, child := range t {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				delete(t, key)
+			} else {
+				t[key] = removeField(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range t {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				t[i] = removeField(child, path[1:])
+			}
+		}
+	}
+	return v
+}
+
+// jsonDifference returns the first difference between the JSON values a and
+// b at path, or "" if they are equal.
+func (r *diffRules) jsonDifference(path string, a, b interface{}) string {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return path + " is not an object"
+		}
+		for key, child := range av {
+			other, ok := bv[key]
+			if !ok {
+				return path + "." + key + " is missing"
+			}
+			if diff := r.jsonDifference(path+"."+key, child, other); diff != "" {
+				return diff
+			}
+		}
+		for key := range bv {
+			if _, ok := av[key]; !ok {
+				return path + "." + key + " is unexpected"
+			}
+		}
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			return path + " is not an array"
+		}
+		if len(av) != len(bv) {
+			return fmt.Sprintf("%s has %d elements instead of %d", path, len(bv), len(av))
+		}
+		for i := range av {
+			if diff := r.jsonDifference(fmt.Sprintf("%s[%d]", path, i), av[i], bv[i]); diff != "" {
+				return diff
+			}
+		}
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return path + " is not a number"
+		}
+		if av != bv && !r.closeNumbers(av, bv) {
+			return fmt.Sprintf("%s is %s instead of %s", path, bv, av)
+		}
+	default:
+		if a != b {
+			return fmt.Sprintf("%s is %v instead of %v", path, b, a)
+		}
+	}
+	return ""
+}
+
+func (r *diffRules) closeNumbers(a, b json.Number) bool {
+	x, errX := a.Float64()
+	y, errY := b.Float64()
+	if errX != nil || errY != nil {
+		return false
+	}
+	delta := math.Abs(x - y)
+	return delta <= r.NumericTolerance || delta <= r.NumericRelativeTolerance*math.Max(math.Abs(x), math.Abs(y))
+}
+
+var htmlWhitespace = regexp.MustCompile(`\s+`)
+var htmlWhitespaceBetweenTags = regexp.MustCompile(`>\s+<`)
+
+// collapseHTMLWhitespace removes the whitespace between tags and collapses the
+// other runs of whitespace into a space.
+func collapseHTMLWhitespace(body []byte) []byte {
+	body = htmlWhitespaceBetweenTags.ReplaceAll(body, []byte("><"))
+	return bytes.TrimSpace(htmlWhitespace.ReplaceAll(body, []byte(" ")))
+}
+
+// readResponses reads the responses of production from a response stream,
+// captured with filter-mode either, for the response diffs.
+func (h *httpStream) readResponses(buf *bufio.Reader, counter *recordingReader) {
+	// the flows of the request direction, which identify the connection
+	id := connectionID(h.net.Reverse(), h.transport.Reverse())
+	for index := 1; ; index++ {
+		start := counter.n - int64(buf.Buffered())
+		resp, err := http.ReadResponse(buf, nil)
+		if err != nil {
+			if err != io.EOF {
+				h.streamError(streamErrorMalformed, err)
+			}
+			return
+		}
+		body, bErr := ioutil.ReadAll(io.LimitReader(resp.Body, responseBodyLimit))
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		observed := newObservedResponse(resp, body)
+		observed.seen = h.r.seenAt(start)
+		fwdDiffs.production(id, index, observed)
+		if bErr != nil {
+			return
+		}
+	}
+}
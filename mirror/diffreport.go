@@ -0,0 +1,275 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	math_rand "math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// diffExampleBytes is the number of bytes of the bodies kept in diff records.
+const diffExampleBytes = 4 * 1024
+
+// diffExamplesPerEndpoint is the number of example diffs of an endpoint in summaries.
+const diffExamplesPerEndpoint = 3
+
+// diffS3FlushInterval is how often the diff records are uploaded to S3.
+const diffS3FlushInterval = time.Minute
+
+// diffRecord is a stored response diff, one JSON document per line.
+type diffRecord struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id"`
+	Method           string    `json:"method"`
+	Path             string    `json:"path"`
+	Endpoint         string    `json:"endpoint"`
+	ProductionStatus int       `json:"production_status"`
+	ShadowStatus     int       `json:"shadow_status"`
+	Reason           string    `json:"reason"`
+	ProductionBody   string    `json:"production_body,omitempty"`
+	ShadowBody       string    `json:"shadow_body,omitempty"`
+}
+
+func newDiffRecord(result *diffResult) diffRecord {
+	return diffRecord{
+		Time:             result.requestTime.UTC(),
+		RequestID:        result.requestID,
+		Method:           result.method,
+		Path:             result.path,
+		Endpoint:         diffEndpoint(result.method, result.path),
+		ProductionStatus: result.production.status,
+		ShadowStatus:     result.shadow.status,
+		Reason:           result.reason,
+		ProductionBody:   diffExample(decodedBody(result.production)),
+		ShadowBody:       diffExample(decodedBody(result.shadow)),
+	}
+}
+
+// diffEndpoint returns the endpoint of a request in summaries, like GET /users/:id.
+func diffEndpoint(method, path string) string {
+	return method + " " + currentConfig().pathTemplates.apply(path)
+}
+
+func diffExample(body []byte) string {
+	if len(body) > diffExampleBytes {
+		body = body[:diffExampleBytes]
+	}
+	return strings.ToValidUTF8(string(body), "�")
+}
+
+// endpointDiffs summarizes the diffs of an endpoint.
+type endpointDiffs struct {
+	Endpoint   string `json:"endpoint"`
+	Compared   int64  `json:"compared"`
+	Mismatches int64  `json:"mismatches"`
+	// StatusMismatches counts the mismatches by status codes, like "200 -> 500"
+	StatusMismatches map[string]int64 `json:"status_mismatches,omitempty"`
+	Examples         []diffRecord     `json:"examples,omitempty"`
+}
+
+// diffSummary aggregates the diffs by endpoint.
+type diffSummary struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointDiffs
+}
+
+func newDiffSummary() *diffSummary {
+	return &diffSummary{endpoints: map[string]*endpointDiffs{}}
+}
+
+// add counts a comparison, with its record if the responses differ.
+func (s *diffSummary) add(endpoint string, record *diffRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.endpoints[endpoint]
+	if !ok {
+		if len(s.endpoints) >= maxTrackedPaths {
+			endpoint = otherPath
+		}
+		if e, ok = s.endpoints[endpoint]; !ok {
+			e = &endpointDiffs{Endpoint: endpoint, StatusMismatches: map[string]int64{}}
+			s.endpoints[endpoint] = e
+		}
+	}
+	e.Compared++
+	if record == nil {
+		return
+	}
+	e.Mismatches++
+	if record.ProductionStatus != record.ShadowStatus {
+		e.StatusMismatches[fmt.Sprintf("%d -> %d", record.ProductionStatus, record.ShadowStatus)]++
+	}
+	if len(e.Examples) < diffExamplesPerEndpoint {
+		e.Examples = append(e.Examples, *record)
+	}
+}
+
+// report returns the endpoints, with the most mismatches first.
+func (s *diffSummary) report() []endpointDiffs {
+	s.mu.Lock()
+	report := make([]endpointDiffs, 0, len(s.endpoints))
+	for _, e := range s.endpoints {
+		copied := *e
+		copied.StatusMismatches = map[string]int64{}
+		for k, v := range e.StatusMismatches {
+			copied.StatusMismatches[k] = v
+		}
+		copied.Examples = append([]diffRecord(nil), e.Examples...)
+		report = append(report, copied)
+	}
+	s.mu.Unlock()
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Mismatches != report[j].Mismatches {
+			return report[i].Mismatches > report[j].Mismatches
+		}
+		return report[i].Endpoint < report[j].Endpoint
+	})
+	return report
+}
+
+// diffStore stores the mismatches, sampled and capped per minute, in a local
+// file or in S3 (s3://bucket/prefix), as JSON lines.
+type diffStore struct {
+	sample    float64
+	perMinute int
+
+	mu     sync.Mutex
+	minute time.Time
+	stored int
+	enc    *json.Encoder
+	// with S3, the records are buffered and uploaded every diffS3FlushInterval
+	bucket, prefix string
+	pending        bytes.Buffer
+}
+
+var fwdDiffStore *diffStore
+
+func openDiffStore(output string, sample float64, perMinute int) (*diffStore, error) {
+	s := &diffStore{sample: sample, perMinute: perMinute}
+	if strings.HasPrefix(output, "s3://") {
+		u, err := url.Parse(output)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Flag diff-output (%s) must be a path or like s3://bucket/prefix.", output)
+		}
+		s.bucket, s.prefix = u.Host, strings.Trim(u.Path, "/")
+		go s.uploadLoop()
+		return s, nil
+	}
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.enc = json.NewEncoder(f)
+	return s, nil
+}
+
+// store keeps record, unless it is not sampled or the cap of the minute is reached.
+func (s *diffStore) store(record diffRecord) {
+	if !sinkEnabled("diff-output") {
+		stats.inc("diffs_dropped_follower")
+		return
+	}
+	if s.sample < 1 && math_rand.Float64() >= s.sample {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if minute := time.Now().Truncate(time.Minute); minute != s.minute {
+		s.minute, s.stored = minute, 0
+	}
+	if s.perMinute > 0 && s.stored >= s.perMinute {
+		stats.inc("diffs_dropped_cap")
+		return
+	}
+	s.stored++
+	stats.inc("diffs_stored")
+	if s.enc != nil {
+		if err := s.enc.Encode(record); err != nil {
+			log.Println("Error writing diff", ":", err)
+		}
+		return
+	}
+	json.NewEncoder(&s.pending).Encode(record)
+}
+
+// uploadLoop uploads the pending records to S3 every diffS3FlushInterval. It never returns.
+func (s *diffStore) uploadLoop() {
+	for {
+		time.Sleep(diffS3FlushInterval)
+		s.mu.Lock()
+		data := append([]byte(nil), s.pending.Bytes()...)
+		s.pending.Reset()
+		s.mu.Unlock()
+		if len(data) == 0 {
+			continue
+		}
+		if err := s.upload(data); err != nil {
+			stats.inc("diff_upload_errors")
+			log.Println("Error uploading diffs to S3", ":", err)
+		}
+	}
+}
+
+func (s *diffStore) upload(data []byte) error {
+	cfg, err := awsConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	key := fmt.Sprintf("%s/%s-%s.jsonl", s.prefix, time.Now().UTC().Format("2006/01/02/150405"), newRequestID()[:8])
+	_, err = s3.NewFromConfig(cfg).PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(strings.TrimPrefix(key, "/")),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	return err
+}
+
+// runDiffReport implements the diff-report command, which summarizes stored
+// diff files by endpoint.
+func runDiffReport(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("Usage: diff-report file...")
+	}
+	summary := newDiffSummary()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bufio.NewReader(f))
+		for {
+			var record diffRecord
+			if err = dec.Decode(&record); err != nil {
+				break
+			}
+			summary.add(record.Endpoint, &record)
+		}
+		f.Close()
+		if err != io.EOF {
+			return fmt.Errorf("Error reading diffs %s: %v", path, err)
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(summary.report())
+}
@@ -0,0 +1,71 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// dryRunRecord is one line of the dry run output file.
+type dryRunRecord struct {
+	Time       time.Time   `json:"time"`
+	RequestID  string      `json:"request_id"`
+	SourceIP   string      `json:"source_ip"`
+	SourceName string      `json:"source_name,omitempty"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Headers    http.Header `json:"headers"`
+	BodySize   int         `json:"body_size"`
+	// Body is recorded by the stub mode only
+	Body []byte `json:"body,omitempty"`
+}
+
+// dryRunRecorder appends the requests that would have been forwarded to a file,
+// one JSON document per line.
+type dryRunRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+var dryRunOutput *dryRunRecorder
+
+func openDryRunRecorder(path string) (*dryRunRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &dryRunRecorder{enc: json.NewEncoder(f)}, nil
+}
+
+// recordDryRun logs the request that would have been forwarded instead of sending it.
+func recordDryRun(forwardReq *http.Request, info captureInfo, bodySize int) {
+	log.Println("Dry run, would forward", info.requestID, forwardReq.Method, forwardReq.URL)
+	if dryRunOutput == nil {
+		return
+	}
+	err := dryRunOutput.write(dryRunRecord{
+		Time:       time.Now(),
+		RequestID:  info.requestID,
+		SourceIP:   info.sourceIP,
+		SourceName: info.sourceName,
+		Method:     forwardReq.Method,
+		URL:        forwardReq.URL.String(),
+		Headers:    forwardReq.Header,
+		BodySize:   bodySize,
+	})
+	if err != nil {
+		log.Println("Error writing dry run output", ":", err)
+	}
+}
+
+func (r *dryRunRecorder) write(record dryRunRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(record)
+}
@@ -0,0 +1,133 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// ecsTask describes the ECS task a source IP belongs to.
+type ecsTask struct {
+	id      string
+	service string
+	family  string
+}
+
+// ecsAttribution resolves captured source IPs to the ECS tasks of a list of
+// clusters. The tasks are listed periodically through the ECS API; only tasks
+// with their own network interface (awsvpc network mode) can be told apart by IP.
+type ecsAttribution struct {
+	clusters []string
+	mu       sync.RWMutex
+	byIP     map[string]ecsTask
+}
+
+var fwdECS *ecsAttribution
+
+func newECSAttribution(clusters string) *ecsAttribution {
+	a := &ecsAttribution{byIP: map[string]ecsTask{}}
+	for _, c := range strings.Split(clusters, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			a.clusters = append(a.clusters, c)
+		}
+	}
+	return a
+}
+
+func (a *ecsAttribution) lookup(ip string) (ecsTask, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	task, ok := a.byIP[ip]
+	return task, ok
+}
+
+// refreshLoop lists the tasks immediately and then every interval.
+func (a *ecsAttribution) refreshLoop(interval time.Duration) {
+	for {
+		if err := a.refresh(); err != nil {
+			// keep the previous tasks until the next successful refresh
+			log.Println("Error listing ECS tasks", ":", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (a *ecsAttribution) refresh() error {
+	cfg, err := awsConfig()
+	if err != nil {
+		return err
+	}
+	client := ecs.NewFromConfig(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	byIP := map[string]ecsTask{}
+	for _, cluster := range a.clusters {
+		pages := ecs.NewListTasksPaginator(client, &ecs.ListTasksInput{Cluster: aws.String(cluster)})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			if len(page.TaskArns) == 0 {
+				continue
+			}
+			// a page has at most 100 tasks, the limit of DescribeTasks
+			out, err := client.DescribeTasks(ctx, &ecs.DescribeTasksInput{Cluster: aws.String(cluster), Tasks: page.TaskArns})
+			if err != nil {
+				return err
+			}
+			for _, t := range out.Tasks {
+				task := ecsTask{id: lastARNPart(aws.ToString(t.TaskArn))}
+				if group := aws.ToString(t.Group); strings.HasPrefix(group, "service:") {
+					task.service = strings.TrimPrefix(group, "service:")
+				}
+				// arn:aws:ecs:region:account:task-definition/family:revision
+				task.family = strings.SplitN(lastARNPart(aws.ToString(t.TaskDefinitionArn)), ":", 2)[0]
+				for _, c := range t.Containers {
+					for _, ni := range c.NetworkInterfaces {
+						if ip := aws.ToString(ni.PrivateIpv4Address); ip != "" {
+							byIP[ip] = task
+						}
+						if ip := aws.ToString(ni.Ipv6Address); ip != "" {
+							byIP[ip] = task
+						}
+					}
+				}
+			}
+		}
+	}
+
+	a.mu.Lock()
+	a.byIP = byIP
+	a.mu.Unlock()
+	return nil
+}
+
+func lastARNPart(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+// setECSHeaders adds the X-Mirror-Source-Task, X-Mirror-Source-Service and
+// X-Mirror-Source-Family headers, if the source IP belongs to a known task.
+func setECSHeaders(header http.Header, sourceIP string) {
+	task, ok := fwdECS.lookup(sourceIP)
+	if !ok {
+		stats.inc("ecs_attribution_misses")
+		return
+	}
+	header.Set("X-Mirror-Source-Task", task.id)
+	header.Set("X-Mirror-Source-Family", task.family)
+	if task.service != "" {
+		header.Set("X-Mirror-Source-Service", task.service)
+	}
+}
@@ -0,0 +1,113 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// codedBody is a request body decoded from its Content-Encoding, so that the
+// body rules, routes and hooks see its content.
+type codedBody struct {
+	// encodings are the content codings in the order they were applied
+	encodings []string
+	encoded   []byte
+	decoded   []byte
+}
+
+// decodeBody decodes a body with the codings of the Content-Encoding header. It
+// returns nil if the body is not encoded, or cannot be decoded within maxBytes;
+// the body is then inspected as captured.
+func decodeBody(contentEncoding string, body []byte, maxBytes int) *codedBody {
+	var encodings []string
+	for _, e := range strings.Split(contentEncoding, ",") {
+		if e = strings.ToLower(strings.TrimSpace(e)); e != "" && e != "identity" {
+			encodings = append(encodings, e)
+		}
+	}
+	if len(encodings) == 0 || len(body) == 0 {
+		return nil
+	}
+
+	// the codings are removed in the reverse order they were applied
+	decoded := body
+	for i := len(encodings) - 1; i >= 0; i-- {
+		r, err := decoder(encodings[i], decoded)
+		if err == errUnsupportedEncoding {
+			stats.inc(labeled("body_decode_unsupported", "encoding", encodings[i]))
+			return nil
+		}
+		if err == nil {
+			decoded, err = ioutil.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+		}
+		if err != nil {
+			stats.inc(labeled("body_decode_errors", "encoding", encodings[i]))
+			return nil
+		}
+		if len(decoded) > maxBytes {
+			stats.inc("body_decode_too_large")
+			return nil
+		}
+	}
+	for _, e := range encodings {
+		stats.inc(labeled("bodies_decoded", "encoding", e))
+	}
+	return &codedBody{encodings: encodings, encoded: body, decoded: decoded}
+}
+
+var errUnsupportedEncoding = fmt.Errorf("unsupported content encoding")
+
+func decoder(encoding string, body []byte) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate is zlib wrapped, but some clients send raw deflate data
+		if r, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			return r, nil
+		}
+		return flate.NewReader(bytes.NewReader(body)), nil
+	case "br":
+		return brotli.NewReader(bytes.NewReader(body)), nil
+	}
+	return nil, errUnsupportedEncoding
+}
+
+// encode applies the codings again to a body changed by the hooks. An unchanged
+// body is the captured one, byte for byte.
+func (c *codedBody) encode(body []byte) ([]byte, error) {
+	if bytes.Equal(body, c.decoded) {
+		return c.encoded, nil
+	}
+	for _, e := range c.encodings {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch e {
+		case "gzip", "x-gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "br":
+			w = brotli.NewWriter(&buf)
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+		stats.inc(labeled("bodies_reencoded", "encoding", e))
+	}
+	return body, nil
+}
@@ -0,0 +1,206 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A metrics exporter pushes the metrics registry every metrics-flush-interval,
+// for setups that do not scrape /metrics:
+//   - statsd sends counter increments and gauges over UDP, with the labels
+//     appended to the metric name (mirror.requests_forwarded_by_workload.default.web)
+//   - dogstatsd sends the labels as DogStatsD tags instead
+//   - remote-write sends the samples to a Prometheus remote write endpoint
+//   - cloudwatch publishes CloudWatch custom metrics, see cloudWatchExporter
+type metricsExporter interface {
+	export(values map[string]int64, deltas map[string]int64) error
+}
+
+// statsdMaxDatagram keeps the StatsD datagrams below the usual MTU.
+const statsdMaxDatagram = 1432
+
+func newMetricsExporter(kind, addr string) (metricsExporter, error) {
+	switch kind {
+	case "statsd", "dogstatsd":
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return &statsdExporter{conn: conn, tags: kind == "dogstatsd"}, nil
+	case "remote-write":
+		if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+			return nil, fmt.Errorf("Flag metrics-export-addr (%s) must be a remote write URL with the remote-write exporter.", addr)
+		}
+		return &remoteWriteExporter{url: addr, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case "cloudwatch":
+		return newCloudWatchExporter(*cloudWatchNamespace, *cloudWatchDimensions, *cloudWatchMetrics)
+	}
+	return nil, fmt.Errorf("Flag metrics-exporter (%s) is not valid.", kind)
+}
+
+func validMetricsExporter(kind string) bool {
+	switch kind {
+	case "", "statsd", "dogstatsd", "remote-write", "cloudwatch":
+		return true
+	}
+	return false
+}
+
+// exportMetrics pushes the metrics with exporter every interval. It never returns.
+func exportMetrics(exporter metricsExporter, interval time.Duration) {
+	last := map[string]int64{}
+	for {
+		time.Sleep(interval)
+		recordPipelineGauges()
+		values := stats.snapshot()
+		deltas := make(map[string]int64, len(values))
+		for name, v := range values {
+			deltas[name] = v - last[name]
+		}
+		if err := exporter.export(values, deltas); err != nil {
+			stats.inc("metrics_export_errors")
+			log.Println("Error exporting metrics", ":", err)
+			// the increments are sent again with the next flush
+			continue
+		}
+		last = values
+	}
+}
+
+type statsdExporter struct {
+	conn net.Conn
+	tags bool
+}
+
+func (e *statsdExporter) export(values map[string]int64, deltas map[string]int64) error {
+	var buf bytes.Buffer
+	for _, metric := range sortedMetrics(values) {
+		var line string
+		if stats.isGauge(metric) {
+			line = e.line(metric, values[metric], "g")
+		} else if deltas[metric] != 0 {
+			line = e.line(metric, deltas[metric], "c")
+		} else {
+			continue
+		}
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > statsdMaxDatagram {
+			if _, err := e.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err := e.conn.Write(buf.Bytes())
+	return err
+}
+
+func (e *statsdExporter) line(metric string, value int64, kind string) string {
+	name, labels := exportedMetric(metric)
+	name = "mirror." + name
+	var tags []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		if e.tags {
+			tags = append(tags, labels[i]+":"+statsdSafe(labels[i+1]))
+		} else {
+			name += "." + statsdSafe(labels[i+1])
+		}
+	}
+	line := fmt.Sprintf("%s:%d|%s", name, value, kind)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// statsdSafe replaces the characters of the StatsD syntax in a label value.
+func statsdSafe(value string) string {
+	return strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", ".", "_", "\n", "_").Replace(value)
+}
+
+type remoteWriteExporter struct {
+	url    string
+	client *http.Client
+}
+
+// export sends a snappy compressed WriteRequest protobuf message (see
+// prometheus/prompb/remote.proto), encoded by hand to avoid the dependency.
+func (e *remoteWriteExporter) export(values map[string]int64, deltas map[string]int64) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	var msg []byte
+	for _, metric := range sortedMetrics(values) {
+		name, labels := exportedMetric(metric)
+		pairs := [][2]string{{"__name__", "mirror_" + name}}
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, [2]string{labels[i], labels[i+1]})
+		}
+		// the labels of a series must be sorted by name
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+		var series []byte
+		for _, p := range pairs {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, p[0])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, p[1])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(float64(values[metric])))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(now))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, series)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(snappy.Encode(nil, msg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func sortedMetrics(values map[string]int64) []string {
+	metrics := make([]string, 0, len(values))
+	for metric := range values {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	return metrics
+}
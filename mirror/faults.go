@@ -0,0 +1,106 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	math_rand "math/rand"
+	"net/http"
+	"strings"
+)
+
+// requestFault deliberately corrupts a forwarded request, to test the
+// validation and the error handling of the shadow:
+//   - drop-header:<name> removes the header
+//   - truncate-body cuts the body at a random length
+//   - content-type:<value> replaces the Content-Type header
+type requestFault struct {
+	kind, arg string
+}
+
+// parseRequestFaults parses a comma separated list of faults.
+func parseRequestFaults(list string) ([]requestFault, error) {
+	var faults []requestFault
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, ":", 2)
+		f := requestFault{kind: parts[0]}
+		if len(parts) == 2 {
+			f.arg = strings.TrimSpace(parts[1])
+		}
+		switch {
+		case f.kind == "drop-header" && f.arg != "":
+			f.arg = http.CanonicalHeaderKey(f.arg)
+		case f.kind == "content-type" && f.arg != "":
+		case f.kind == "truncate-body" && len(parts) == 1:
+		default:
+			return nil, fmt.Errorf("Flag inject-faults contains an invalid fault (%s).", s)
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+func (f requestFault) String() string {
+	if f.arg == "" {
+		return f.kind
+	}
+	return f.kind + ":" + f.arg
+}
+
+// applies reports whether f changes req with body: a missing header is not
+// dropped, and an empty body not truncated.
+func (f requestFault) applies(req *http.Request, body []byte) bool {
+	switch f.kind {
+	case "drop-header":
+		_, ok := req.Header[f.arg]
+		return ok
+	case "truncate-body":
+		return len(body) > 0
+	}
+	return true
+}
+
+// pickFault returns a fault of conf that applies to req with body, for
+// fault-percentage of the requests.
+func pickFault(conf *configSnapshot, req *http.Request, body []byte) (requestFault, bool) {
+	if len(conf.faults) == 0 || math_rand.Float64()*100 >= conf.faultPercentage {
+		return requestFault{}, false
+	}
+	var applicable []requestFault
+	for _, f := range conf.faults {
+		if f.applies(req, body) {
+			applicable = append(applicable, f)
+		}
+	}
+	if len(applicable) == 0 {
+		return requestFault{}, false
+	}
+	return applicable[math_rand.Intn(len(applicable))], true
+}
+
+// body returns the body of the forward with the fault.
+func (f requestFault) body(body []byte) []byte {
+	if f.kind == "truncate-body" {
+		return body[:math_rand.Intn(len(body))]
+	}
+	return body
+}
+
+// header applies the fault to the headers of the forward, and marks it with
+// fault-header.
+func (f requestFault) header(conf *configSnapshot, header http.Header) {
+	switch f.kind {
+	case "drop-header":
+		header.Del(f.arg)
+	case "content-type":
+		header.Set("Content-Type", f.arg)
+	}
+	if conf.faultHeader != "" {
+		header.Set(conf.faultHeader, f.String())
+	}
+	stats.inc(labeled("requests_faulted", "fault", f.kind))
+}
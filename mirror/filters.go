@@ -0,0 +1,236 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// contentTypeFilter forwards requests by media type. Patterns are media types
+// like application/json, or wildcards like application/* and */*. The pattern
+// none matches requests without a Content-Type, which are otherwise forwarded
+// regardless of the include list.
+type contentTypeFilter struct {
+	include []string
+	exclude []string
+}
+
+func newContentTypeFilter(include, exclude string) *contentTypeFilter {
+	return &contentTypeFilter{include: splitPatterns(include), exclude: splitPatterns(exclude)}
+}
+
+func splitPatterns(list string) []string {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// allowed reports whether req is forwarded.
+func (f *contentTypeFilter) allowed(req *http.Request) bool {
+	mediaType := "none"
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		if parsed, _, err := mime.ParseMediaType(ct); err == nil {
+			mediaType = parsed
+		} else {
+			mediaType = strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+		}
+	}
+	for _, p := range f.exclude {
+		if matchMediaType(p, mediaType) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, p := range f.include {
+		if matchMediaType(p, mediaType) {
+			return true
+		}
+	}
+	return mediaType == "none" && !containsString(f.include, "none") && !containsString(f.exclude, "none")
+}
+
+func matchMediaType(pattern, mediaType string) bool {
+	if pattern == mediaType {
+		return true
+	}
+	if mediaType == "none" || !strings.HasSuffix(pattern, "/*") {
+		return false
+	}
+	prefix := strings.TrimSuffix(pattern, "*")
+	return pattern == "*/*" || strings.HasPrefix(mediaType, prefix)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyRule is a predicate on request bodies, loaded from the body-rules file:
+//
+//	[
+//	  {"action": "forward", "field": "customer.tenant_id", "equals": "X"},
+//	  {"action": "drop", "pattern": "\\b(?:\\d[ -]?){13,16}\\b"}
+//	]
+//
+// A rule matches if the JSON field (dot separated path, array elements by index)
+// equals the value, or if the body matches the regular expression. A request is
+// dropped if any drop rule matches, and, if there are forward rules, unless one
+// of them matches.
+type bodyRule struct {
+	Action  string  `json:"action"`
+	Field   string  `json:"field,omitempty"`
+	Equals  *string `json:"equals,omitempty"`
+	Pattern string  `json:"pattern,omitempty"`
+	re      *regexp.Regexp
+}
+
+type bodyRules struct {
+	rules []bodyRule
+	// fields are the JSON paths referenced by the rules
+	fields map[string]bool
+	// maxBytes caps how much of the body is inspected
+	maxBytes int
+}
+
+func loadBodyRules(path string, maxBytes int) (*bodyRules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &bodyRules{fields: map[string]bool{}, maxBytes: maxBytes}
+	if err := json.Unmarshal(data, &r.rules); err != nil {
+		return nil, fmt.Errorf("Error parsing body rules %s: %v", path, err)
+	}
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.Action != "forward" && rule.Action != "drop" {
+			return nil, fmt.Errorf("Body rule %d: action (%s) must be forward or drop.", i, rule.Action)
+		}
+		if (rule.Field == "") == (rule.Pattern == "") {
+			return nil, fmt.Errorf("Body rule %d: exactly one of field and pattern must be set.", i)
+		}
+		if rule.Field != "" {
+			if rule.Equals == nil {
+				return nil, fmt.Errorf("Body rule %d: field requires equals.", i)
+			}
+			r.fields[rule.Field] = true
+		} else if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("Body rule %d: %v", i, err)
+		}
+	}
+	return r, nil
+}
+
+// allowed reports whether a request with body is forwarded.
+func (r *bodyRules) allowed(body []byte) bool {
+	if len(body) > r.maxBytes {
+		body = body[:r.maxBytes]
+	}
+	var values map[string]string
+	if len(r.fields) > 0 {
+		values = jsonFields(body, r.fields)
+	}
+
+	hasForward, forward := false, false
+	for _, rule := range r.rules {
+		var match bool
+		if rule.re != nil {
+			match = rule.re.Match(body)
+		} else {
+			v, ok := values[rule.Field]
+			match = ok && v == *rule.Equals
+		}
+		if rule.Action == "drop" {
+			if match {
+				return false
+			}
+			continue
+		}
+		hasForward = true
+		forward = forward || match
+	}
+	return !hasForward || forward
+}
+
+// jsonFields streams through a JSON document and returns the scalar values at
+// the given paths, formatted as strings. It stops as soon as every path has been
+// found, and returns what was found so far if the document is invalid or
+// truncated.
+func jsonFields(data []byte, paths map[string]bool) map[string]string {
+	values := map[string]string{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	walkJSON(dec, "", func(path string, value interface{}) bool {
+		if paths[path] {
+			if value == nil {
+				values[path] = "null"
+			} else {
+				values[path] = fmt.Sprint(value)
+			}
+		}
+		return len(values) < len(paths)
+	})
+	return values
+}
+
+var errStopWalk = fmt.Errorf("stop")
+
+// walkJSON calls visit for every scalar value of the next JSON value of dec,
+// until visit returns false.
+func walkJSON(dec *json.Decoder, path string, visit func(path string, value interface{}) bool) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	child := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if err := walkJSON(dec, child(fmt.Sprint(key)), visit); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := walkJSON(dec, child(strconv.Itoa(i)), visit); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	}
+	if !visit(path, tok) {
+		return errStopWalk
+	}
+	return nil
+}
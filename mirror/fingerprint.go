@@ -0,0 +1,208 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedEndpoints bounds the number of request fingerprints tracked; the
+// requests of other fingerprints are counted under otherPath.
+const maxTrackedEndpoints = 10000
+
+// endpointStat holds the requests of a request fingerprint.
+type endpointStat struct {
+	Fingerprint string    `json:"fingerprint"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Params      []string  `json:"params,omitempty"`
+	Requests    int64     `json:"requests"`
+	Forwarded   int64     `json:"forwarded"`
+	Errors      int64     `json:"errors"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// fingerprintReport is the document written to fingerprint-report: the unique
+// endpoints seen since the start, with the most requested first.
+type fingerprintReport struct {
+	Time      time.Time `json:"time"`
+	Since     time.Time `json:"since"`
+	Endpoints int       `json:"endpoints"`
+	// New is the number of endpoints first seen since the previous report
+	New          int            `json:"new"`
+	Requests     int64          `json:"requests"`
+	Fingerprints []endpointStat `json:"fingerprints"`
+}
+
+// requestFingerprints tracks the requests by fingerprint, to list the endpoints
+// of the API the traffic covers, e.g. to build replay suites or to check that
+// the shadow receives all of them.
+type requestFingerprints struct {
+	mu        sync.Mutex
+	since     time.Time
+	endpoints map[string]*endpointStat
+	// ignored are the query parameters of fingerprint-ignore-params, and
+	// reported the number of endpoints of the previous report
+	ignored  map[string]bool
+	reported int
+}
+
+func newRequestFingerprints() *requestFingerprints {
+	return &requestFingerprints{since: time.Now(), endpoints: map[string]*endpointStat{}}
+}
+
+// setIgnoredParams sets the comma separated query parameters left out of the
+// fingerprints, like cache busters and campaign tags.
+func (f *requestFingerprints) setIgnoredParams(list string) {
+	ignored := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ignored[name] = true
+		}
+	}
+	f.mu.Lock()
+	f.ignored = ignored
+	f.mu.Unlock()
+}
+
+// fingerprint returns the normalized form of req: its method, its path
+// template (see Path templates) and the sorted names of its query parameters.
+// The values are left out, so that GET /orders/3?page=2 and GET
+// /orders/4?page=7 are the same endpoint, GET /orders/:id?page.
+func (f *requestFingerprints) fingerprint(req *http.Request, templates *pathTemplates) endpointStat {
+	f.mu.Lock()
+	ignored := f.ignored
+	f.mu.Unlock()
+	s := endpointStat{Method: req.Method, Path: templates.apply(requestPath(req))}
+	if req.URL != nil {
+		for name := range req.URL.Query() {
+			if !ignored[name] {
+				s.Params = append(s.Params, name)
+			}
+		}
+	}
+	sort.Strings(s.Params)
+	key := s.Method + " " + s.Path
+	if len(s.Params) > 0 {
+		key += "?" + strings.Join(s.Params, "&")
+	}
+	sum := sha256.Sum256([]byte(key))
+	s.Fingerprint = hex.EncodeToString(sum[:8])
+	return s
+}
+
+// record counts a request, and returns its fingerprint for the outcome of its
+// forward.
+func (f *requestFingerprints) record(req *http.Request, templates *pathTemplates) string {
+	s := f.fingerprint(req, templates)
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := s.Fingerprint
+	if _, ok := f.endpoints[key]; !ok && len(f.endpoints) >= maxTrackedEndpoints {
+		key = otherPath
+		s = endpointStat{Fingerprint: otherPath, Path: otherPath}
+	}
+	e, ok := f.endpoints[key]
+	if !ok {
+		e = &s
+		e.FirstSeen = now
+		f.endpoints[key] = e
+		stats.set("request_fingerprints", int64(len(f.endpoints)))
+	}
+	e.Requests++
+	e.LastSeen = now
+	return key
+}
+
+// forwarded records the outcome of the forward of a request of fingerprint.
+func (f *requestFingerprints) forwarded(fingerprint string, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := f.endpoints[fingerprint]
+	if e == nil {
+		return
+	}
+	if ok {
+		e.Forwarded++
+	} else {
+		e.Errors++
+	}
+}
+
+// report returns the endpoints seen since the start, or the n with the most
+// requests if n is positive.
+func (f *requestFingerprints) report(n int) fingerprintReport {
+	f.mu.Lock()
+	r := fingerprintReport{Time: time.Now(), Since: f.since, Endpoints: len(f.endpoints), New: len(f.endpoints) - f.reported}
+	r.Fingerprints = make([]endpointStat, 0, len(f.endpoints))
+	for _, e := range f.endpoints {
+		r.Fingerprints = append(r.Fingerprints, *e)
+		r.Requests += e.Requests
+	}
+	f.mu.Unlock()
+	sort.Slice(r.Fingerprints, func(i, j int) bool {
+		if r.Fingerprints[i].Requests != r.Fingerprints[j].Requests {
+			return r.Fingerprints[i].Requests > r.Fingerprints[j].Requests
+		}
+		return r.Fingerprints[i].Fingerprint < r.Fingerprints[j].Fingerprint
+	})
+	if n > 0 && len(r.Fingerprints) > n {
+		r.Fingerprints = r.Fingerprints[:n]
+	}
+	return r
+}
+
+// writeJSONReport writes the report r to path, replacing the previous one.
+func writeJSONReport(path string, r interface{}) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	// a crash while writing leaves the previous report
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// reportLoop logs the number of endpoints every interval, and writes the report
+// to path if it is set. It never returns.
+func (f *requestFingerprints) reportLoop(path string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		r := f.report(0)
+		f.mu.Lock()
+		f.reported = r.Endpoints
+		f.mu.Unlock()
+		log.Println("Request fingerprints:", r.Endpoints, "endpoints,", r.New, "new since the last report,", r.Requests, "requests since start")
+		if path == "" || !sinkEnabled("fingerprint-report") {
+			continue
+		}
+		if err := writeJSONReport(path, r); err != nil {
+			log.Println("Error writing fingerprint report", ":", err)
+		}
+	}
+}
+
+// saveFingerprintReport writes the last report of fingerprint-report when the
+// capture or the replay ends.
+func saveFingerprintReport() {
+	if f := currentConfig().fingerprints; f != nil && *fingerprintReportFile != "" && sinkEnabled("fingerprint-report") {
+		if err := writeJSONReport(*fingerprintReportFile, f.report(0)); err != nil {
+			log.Println("Error writing fingerprint report", ":", err)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fleetDedupPrefix prefixes the Redis keys of the requests claimed.
+const fleetDedupPrefix = "mirror:dedup:"
+
+// gossipMagic starts the datagrams of the gossip deduplicator.
+var gossipMagic = []byte("MDUP")
+
+// gossipResolveInterval is how often the peers of the gossip deduplicator are
+// resolved, e.g. the pods of a headless service.
+const gossipResolveInterval = 30 * time.Second
+
+// fleetDedupHeaders are the headers left out of the request hashes, which the
+// network paths of the copies of a request may set differently.
+var fleetDedupHeaders = map[string]bool{"X-Forwarded-For": true, "Forwarded": true, "X-Real-Ip": true, "Via": true}
+
+// A fleet deduplicator makes sure that a request seen by several mirror
+// instances, e.g. through the SNAT paths of the nodes of a DaemonSet, is
+// forwarded by one of them only:
+//   - redis claims the hash of each request with SET NX in a shared Redis,
+//     which expires after fleet-dedup-window
+//   - gossip announces the hashes to the peers over UDP, and the instance with
+//     the lowest random ID among those that saw a request forwards it
+type fleetDeduplicator interface {
+	// claim reports whether this instance forwards the request of hash, or
+	// another instance does
+	claim(hash string) (bool, error)
+}
+
+var fwdFleetDedup fleetDeduplicator
+
+func newFleetDeduplicator(kind string) (fleetDeduplicator, error) {
+	switch kind {
+	case "redis":
+		return newRedisDedup(*fleetDedupRedis, *fleetDedupWindow, *fleetDedupTimeout)
+	case "gossip":
+		return newGossipDedup(*fleetDedupListen, *fleetDedupPeers, *fleetDedupWindow, *fleetDedupDelay)
+	}
+	return nil, fmt.Errorf("Flag fleet-dedup (%s) is not valid.", kind)
+}
+
+// fleetDedupHash returns the hash of a request, the same on every instance
+// that sees it: by flow, the connection tuple and the position of the request
+// in the connection, or by request, for the copies whose addresses were
+// translated, the sequence number the connection starts at, the position in
+// the connection, method, host, URI, headers and body. The connections of
+// different clients start at random sequence numbers, so their identical
+// requests do not share the hash.
+func fleetDedupHash(req *http.Request, info captureInfo, body []byte, by string) string {
+	h := sha256.New()
+	if by == "flow" {
+		fmt.Fprintf(h, "%s\n%d\n", info.connectionID, info.index)
+	} else {
+		// repeated requests of a keep-alive connection are distinct
+		fmt.Fprintf(h, "%d\n%d\n%s\n%s\n%s\n", info.streamSeq, info.index, req.Method, req.Host, req.RequestURI)
+		names := make([]string, 0, len(req.Header))
+		for name := range req.Header {
+			if !fleetDedupHeaders[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(h, "%s: %s\n", name, strings.Join(req.Header[name], ", "))
+		}
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// isFleetDuplicate reports whether another instance of the fleet forwards req.
+// Errors are counted and logged, and the request is forwarded.
+func isFleetDuplicate(req *http.Request, info captureInfo, body []byte) bool {
+	claimed, err := fwdFleetDedup.claim(fleetDedupHash(req, info, body, *fleetDedupBy))
+	if err != nil {
+		stats.inc("fleet_dedup_errors")
+		log.Println("Error deduplicating request", info.requestID, ":", err)
+		return false
+	}
+	return !claimed
+}
+
+// redisDedup claims the requests in Redis, over a pool of connections.
+type redisDedup struct {
+	addr, password string
+	db             int
+	window         time.Duration
+	timeout        time.Duration
+	mu             sync.Mutex
+	idle           []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisDedup returns the deduplicator of the Redis of rawURL, like
+// redis://:password@host:6379/0.
+func newRedisDedup(rawURL string, window, timeout time.Duration) (*redisDedup, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("Flag fleet-dedup-redis (%s) must be like redis://[:password@]host:port[/db].", rawURL)
+	}
+	d := &redisDedup{addr: u.Host, window: window, timeout: timeout}
+	if !strings.Contains(d.addr, ":") {
+		d.addr += ":6379"
+	}
+	if u.User != nil {
+		d.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if d.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("Flag fleet-dedup-redis (%s) has an invalid database.", rawURL)
+		}
+	}
+	return d, nil
+}
+
+func (d *redisDedup) claim(hash string) (bool, error) {
+	c, err := d.get()
+	if err != nil {
+		return false, err
+	}
+	reply, err := c.do(d.timeout, "SET", fleetDedupPrefix+hash, "1", "NX", "PX", strconv.FormatInt(d.window.Milliseconds(), 10))
+	if err != nil {
+		c.conn.Close()
+		return false, err
+	}
+	d.put(c)
+	// the reply is OK if the key was set, and nil if another instance set it
+	return reply == "OK", nil
+}
+
+// get returns an idle connection, or a new one.
+func (d *redisDedup) get() (*redisConn, error) {
+	d.mu.Lock()
+	if n := len(d.idle); n > 0 {
+		c := d.idle[n-1]
+		d.idle = d.idle[:n-1]
+		d.mu.Unlock()
+		return c, nil
+	}
+	d.mu.Unlock()
+	conn, err := net.DialTimeout("tcp", d.addr, d.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if d.password != "" {
+		if _, err := c.do(d.timeout, "AUTH", d.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if d.db != 0 {
+		if _, err := c.do(d.timeout, "SELECT", strconv.Itoa(d.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (d *redisDedup) put(c *redisConn) {
+	d.mu.Lock()
+	d.idle = append(d.idle, c)
+	d.mu.Unlock()
+}
+
+// do sends a command and returns its simple, integer or bulk string reply,
+// empty for a nil reply.
+func (c *redisConn) do(timeout time.Duration, args ...string) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write(b.Bytes()); err != nil {
+		return "", err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("empty Redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("Redis error: %s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return "", err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return "", err
+		}
+		return string(data[:n]), nil
+	}
+	return "", fmt.Errorf("unexpected Redis reply %q", line)
+}
+
+// gossipDedup announces the hashes of the requests to the peers, and forwards
+// the requests no peer of a lower ID announced within fleet-dedup-delay.
+type gossipDedup struct {
+	id     uint64
+	conn   *net.UDPConn
+	window time.Duration
+	delay  time.Duration
+
+	mu    sync.Mutex
+	peers []*net.UDPAddr
+	// seen holds the lowest ID of the peers that announced each hash, and when
+	seen map[uint64]gossipClaim
+}
+
+type gossipClaim struct {
+	id   uint64
+	time time.Time
+}
+
+func newGossipDedup(listen, peers string, window, delay time.Duration) (*gossipDedup, error) {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var id [8]byte
+	if _, err := crypto_rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	d := &gossipDedup{id: binary.BigEndian.Uint64(id[:]), conn: conn, window: window, delay: delay, seen: map[uint64]gossipClaim{}}
+	d.resolve(peers)
+	go d.receive()
+	go func() {
+		for {
+			time.Sleep(gossipResolveInterval)
+			d.resolve(peers)
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(d.window)
+			d.expire(time.Now().Add(-d.window))
+		}
+	}()
+	log.Printf("Deduplicating requests with %d gossip peers as %016x", len(d.peers), d.id)
+	return d, nil
+}
+
+// resolve resolves the comma separated host:port of the peers to their
+// addresses.
+func (d *gossipDedup) resolve(list string) {
+	var addrs []*net.UDPAddr
+	for _, peer := range splitPatterns(list) {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			log.Println("Error resolving gossip peer", peer, ":", err)
+			continue
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			stats.inc("fleet_dedup_errors")
+			log.Println("Error resolving gossip peer", peer, ":", err)
+			continue
+		}
+		for _, ip := range ips {
+			if addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, port)); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	d.mu.Lock()
+	if len(addrs) > 0 || len(d.peers) == 0 {
+		d.peers = addrs
+	}
+	d.mu.Unlock()
+	stats.set("fleet_dedup_peers", int64(len(addrs)))
+}
+
+func (d *gossipDedup) claim(hash string) (bool, error) {
+	raw, err := hex.DecodeString(hash[:16])
+	if err != nil {
+		return false, err
+	}
+	h := binary.BigEndian.Uint64(raw)
+	datagram := make([]byte, 0, len(gossipMagic)+16)
+	datagram = append(datagram, gossipMagic...)
+	datagram = binary.BigEndian.AppendUint64(datagram, d.id)
+	datagram = binary.BigEndian.AppendUint64(datagram, h)
+	d.mu.Lock()
+	peers := d.peers
+	d.mu.Unlock()
+	for _, peer := range peers {
+		if _, err := d.conn.WriteToUDP(datagram, peer); err != nil {
+			stats.inc("fleet_dedup_errors")
+		}
+	}
+
+	// the peers that saw the request announce it meanwhile
+	time.Sleep(d.delay)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.seen[h]
+	return !ok || c.id > d.id || time.Since(c.time) > d.window, nil
+}
+
+// receive records the announcements of the peers. It never returns.
+func (d *gossipDedup) receive() {
+	buf := make([]byte, 64)
+	for {
+		n, _, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("Error reading gossip", ":", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if n != len(gossipMagic)+16 || !bytes.Equal(buf[:len(gossipMagic)], gossipMagic) {
+			stats.inc("fleet_dedup_invalid_datagrams")
+			continue
+		}
+		id := binary.BigEndian.Uint64(buf[len(gossipMagic):])
+		h := binary.BigEndian.Uint64(buf[len(gossipMagic)+8:])
+		if id == d.id {
+			continue
+		}
+		now := time.Now()
+		d.mu.Lock()
+		if c, ok := d.seen[h]; !ok || id < c.id || now.Sub(c.time) > d.window {
+			d.seen[h] = gossipClaim{id: id, time: now}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// expire forgets the announcements older than before.
+func (d *gossipDedup) expire(before time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for h, c := range d.seen {
+		if c.time.Before(before) {
+			delete(d.seen, h)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFleetDedupHash(t *testing.T) {
+	newRequest := func() *http.Request {
+		return &http.Request{
+			Method:     "POST",
+			Host:       "api.example.com",
+			RequestURI: "/orders?id=1",
+			Header:     http.Header{"Content-Type": {"application/json"}, "X-Forwarded-For": {"10.0.0.1"}},
+		}
+	}
+	base := captureInfo{connectionID: "0123456789abcdef", index: 1, streamSeq: 1000, sourceIP: "10.0.0.1"}
+	body := []byte(`{"item": 1}`)
+
+	tests := []struct {
+		name   string
+		by     string
+		change func(req *http.Request, info *captureInfo, body *[]byte)
+		same   bool
+	}{
+		{"request, identical copy", "request", func(*http.Request, *captureInfo, *[]byte) {}, true},
+		{"request, translated addresses", "request", func(_ *http.Request, info *captureInfo, _ *[]byte) {
+			info.connectionID, info.sourceIP = "fedcba9876543210", "192.168.0.1"
+		}, true},
+		{"request, forwarding headers", "request", func(req *http.Request, _ *captureInfo, _ *[]byte) {
+			req.Header.Set("X-Forwarded-For", "192.168.0.1")
+			req.Header.Set("Via", "1.1 proxy")
+		}, true},
+		{"request, other connection", "request", func(_ *http.Request, info *captureInfo, _ *[]byte) { info.streamSeq = 2000 }, false},
+		{"request, next request of the connection", "request", func(_ *http.Request, info *captureInfo, _ *[]byte) { info.index = 2 }, false},
+		{"request, other method", "request", func(req *http.Request, _ *captureInfo, _ *[]byte) { req.Method = "PUT" }, false},
+		{"request, other URI", "request", func(req *http.Request, _ *captureInfo, _ *[]byte) { req.RequestURI = "/orders?id=2" }, false},
+		{"request, other header", "request", func(req *http.Request, _ *captureInfo, _ *[]byte) { req.Header.Set("Content-Type", "text/plain") }, false},
+		{"request, other body", "request", func(_ *http.Request, _ *captureInfo, body *[]byte) { *body = []byte(`{"item": 2}`) }, false},
+		{"flow, identical copy", "flow", func(*http.Request, *captureInfo, *[]byte) {}, true},
+		{"flow, other request", "flow", func(req *http.Request, _ *captureInfo, body *[]byte) {
+			req.RequestURI, *body = "/other", nil
+		}, true},
+		{"flow, other connection", "flow", func(_ *http.Request, info *captureInfo, _ *[]byte) { info.connectionID = "fedcba9876543210" }, false},
+		{"flow, next request of the connection", "flow", func(_ *http.Request, info *captureInfo, _ *[]byte) { info.index = 2 }, false},
+	}
+	for _, tt := range tests {
+		want := fleetDedupHash(newRequest(), base, body, tt.by)
+		req, info, b := newRequest(), base, append([]byte(nil), body...)
+		tt.change(req, &info, &b)
+		if got := fleetDedupHash(req, info, b, tt.by); (got == want) != tt.same {
+			t.Errorf("%s: hashes %s and %s, want same %v", tt.name, want, got, tt.same)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxFlows bounds the number of flows of the flow table; the packets of new
+// flows are not tracked while it is full.
+const maxFlows = 100000
+
+// flowMaxDatagram keeps the datagrams of the flow exporter below the usual MTU.
+const flowMaxDatagram = 1400
+
+// flowTemplateInterval is how often the IPFIX templates are sent again, for
+// the collectors that started after the exporter, since UDP has no session.
+const flowTemplateInterval = time.Minute
+
+// the flowEndReason of IPFIX
+const (
+	flowEndIdle     = 1
+	flowEndActive   = 2
+	flowEndDetected = 3
+	flowEndForced   = 4
+)
+
+var flowEndReasons = map[uint8]string{flowEndIdle: "idle", flowEndActive: "active", flowEndDetected: "end", flowEndForced: "forced"}
+
+// the IPFIX template IDs of the flows of IPv4 and IPv6 addresses, and the
+// identifier of the requests in the enterprise of flow-export-pen
+const (
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateIPv6 = 257
+	ipfixRequests     = 1
+	ipfixDomain       = 1
+)
+
+// flowTuple is a flow of packets of a protocol in one direction, like NetFlow.
+type flowTuple struct {
+	net, transport gopacket.Flow
+	protocol       uint8
+}
+
+type flowEntry struct {
+	start, last    time.Time
+	packets, bytes int64
+	requests       int64
+	tcpFlags       uint16
+	ended          bool
+}
+
+// flowRecord is an exported flow, the document sent by the json format.
+type flowRecord struct {
+	SrcAddr   string    `json:"src_addr"`
+	DstAddr   string    `json:"dst_addr"`
+	SrcPort   string    `json:"src_port"`
+	DstPort   string    `json:"dst_port"`
+	Protocol  string    `json:"protocol"`
+	Packets   int64     `json:"packets"`
+	Bytes     int64     `json:"bytes"`
+	Requests  int64     `json:"requests"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	EndReason string    `json:"end_reason"`
+
+	key    flowTuple
+	flags  uint16
+	reason uint8
+}
+
+// flowTable counts the packets, bytes and requests of the captured flows, and
+// exports them to a collector when they end, go idle or have been active for a
+// while, in IPFIX or JSON over UDP, to give network teams the flows of the
+// same capture.
+type flowTable struct {
+	mu    sync.Mutex
+	flows map[flowTuple]*flowEntry
+	conn  net.Conn
+	// exportMu serializes the exports: ipfix is false for the json format,
+	// sequence counts the data records sent, and templateSent is when the
+	// templates were sent last
+	exportMu     sync.Mutex
+	ipfix        bool
+	pen          uint32
+	sequence     uint32
+	templateSent time.Time
+}
+
+var fwdFlows *flowTable
+
+// newFlowTable returns the flow table exporting to the collector at addr, a
+// host:port, in format, ipfix or json.
+func newFlowTable(addr, format string, pen uint32) (*flowTable, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &flowTable{flows: map[flowTuple]*flowEntry{}, conn: conn, ipfix: format == "ipfix", pen: pen}, nil
+}
+
+// packet counts a captured packet of network and tcp or udp.
+func (t *flowTable) packet(network gopacket.NetworkLayer, tcp *layers.TCP, udp *layers.UDP, seen time.Time) {
+	key := flowTuple{net: network.NetworkFlow(), protocol: uint8(layers.IPProtocolTCP)}
+	var flags uint16
+	if tcp != nil {
+		key.transport = tcp.TransportFlow()
+		flags = tcpFlags(tcp)
+	} else {
+		key.transport, key.protocol = udp.TransportFlow(), uint8(layers.IPProtocolUDP)
+	}
+	length := int64(len(network.LayerContents()) + len(network.LayerPayload()))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.flows[key]
+	if !ok {
+		if len(t.flows) >= maxFlows {
+			stats.inc("flows_dropped")
+			return
+		}
+		f = &flowEntry{start: seen}
+		t.flows[key] = f
+	}
+	f.last = seen
+	f.packets++
+	f.bytes += length
+	f.tcpFlags |= flags
+	if tcp != nil && (tcp.FIN || tcp.RST) {
+		f.ended = true
+	}
+}
+
+// request counts a request read from the stream of net and transport.
+func (t *flowTable) request(net, transport gopacket.Flow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := flowTuple{net: net, transport: transport, protocol: uint8(layers.IPProtocolTCP)}
+	f, ok := t.flows[key]
+	if !ok {
+		// the stream may have been oriented from the client to the server
+		key.net, key.transport = net.Reverse(), transport.Reverse()
+		if f, ok = t.flows[key]; !ok {
+			return
+		}
+	}
+	f.requests++
+}
+
+// tcpFlags returns the tcpControlBits of IPFIX of a TCP segment.
+func tcpFlags(tcp *layers.TCP) uint16 {
+	var flags uint16
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR, tcp.NS} {
+		if set {
+			flags |= 1 << uint(i)
+		}
+	}
+	return flags
+}
+
+// expire takes the flows that ended, have been idle for idle or active for
+// active at now, or all of them if force is set. The active flows go on with
+// new counts.
+func (t *flowTable) expire(now time.Time, idle, active time.Duration, force bool) []flowRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var records []flowRecord
+	for key, f := range t.flows {
+		var reason uint8
+		switch {
+		case force:
+			reason = flowEndForced
+		case f.ended:
+			reason = flowEndDetected
+		case now.Sub(f.last) >= idle:
+			reason = flowEndIdle
+		case now.Sub(f.start) >= active:
+			reason = flowEndActive
+		default:
+			continue
+		}
+		// a flow exported for the active timeout may have no packet since
+		if f.packets > 0 {
+			records = append(records, newFlowRecord(key, f, reason))
+		}
+		if reason == flowEndActive {
+			t.flows[key] = &flowEntry{start: now, last: f.last}
+		} else {
+			delete(t.flows, key)
+		}
+	}
+	stats.set("flows_active", int64(len(t.flows)))
+	return records
+}
+
+func newFlowRecord(key flowTuple, f *flowEntry, reason uint8) flowRecord {
+	r := flowRecord{
+		SrcAddr: key.net.Src().String(), DstAddr: key.net.Dst().String(),
+		SrcPort: key.transport.Src().String(), DstPort: key.transport.Dst().String(),
+		Protocol: "tcp", Packets: f.packets, Bytes: f.bytes, Requests: f.requests,
+		Start: f.start, End: f.last, EndReason: flowEndReasons[reason],
+		key: key, flags: f.tcpFlags, reason: reason,
+	}
+	if key.protocol == uint8(layers.IPProtocolUDP) {
+		r.Protocol = "udp"
+	}
+	return r
+}
+
+// exportLoop exports the expired flows every second, with the idle and active
+// timeouts. It never returns.
+func (t *flowTable) exportLoop(idle, active time.Duration) {
+	for {
+		time.Sleep(time.Second)
+		t.export(t.expire(time.Now(), idle, active, false))
+	}
+}
+
+// flush exports all the flows when the capture ends.
+func (t *flowTable) flush() {
+	t.export(t.expire(time.Now(), 0, 0, true))
+}
+
+// export sends records to the collector, in datagrams of at most
+// flowMaxDatagram bytes.
+func (t *flowTable) export(records []flowRecord) {
+	if !sinkEnabled("flow-export") {
+		return
+	}
+	t.exportMu.Lock()
+	defer t.exportMu.Unlock()
+	var datagrams [][]byte
+	if t.ipfix {
+		datagrams = t.encodeIPFIX(records, time.Now())
+	} else {
+		datagrams = encodeFlowsJSON(records)
+	}
+	for _, datagram := range datagrams {
+		if _, err := t.conn.Write(datagram); err != nil {
+			stats.inc("flow_export_errors")
+			log.Println("Error exporting flows", ":", err)
+			return
+		}
+	}
+	stats.add("flows_exported", int64(len(records)))
+}
+
+// encodeFlowsJSON returns a datagram of each record.
+func encodeFlowsJSON(records []flowRecord) [][]byte {
+	var datagrams [][]byte
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		datagrams = append(datagrams, data)
+	}
+	return datagrams
+}
+
+// ipfixField is a field specifier of an IPFIX template.
+type ipfixField struct {
+	id, length uint16
+}
+
+// ipfixFields returns the fields of the template of the records of IPv4 or
+// IPv6 addresses.
+func (t *flowTable) ipfixFields(ipv6 bool) []ipfixField {
+	// sourceIPv4Address and destinationIPv4Address, or their IPv6 versions
+	fields := []ipfixField{{8, 4}, {12, 4}}
+	if ipv6 {
+		fields = []ipfixField{{27, 16}, {28, 16}}
+	}
+	// sourceTransportPort, destinationTransportPort, protocolIdentifier,
+	// tcpControlBits, octetDeltaCount, packetDeltaCount,
+	// flowStartMilliseconds, flowEndMilliseconds and flowEndReason
+	fields = append(fields, ipfixField{7, 2}, ipfixField{11, 2}, ipfixField{4, 1}, ipfixField{6, 2},
+		ipfixField{1, 8}, ipfixField{2, 8}, ipfixField{152, 8}, ipfixField{153, 8}, ipfixField{136, 1})
+	if t.pen != 0 {
+		fields = append(fields, ipfixField{0x8000 | ipfixRequests, 8})
+	}
+	return fields
+}
+
+// encodeIPFIX returns the IPFIX messages of records, with a data set of each
+// template, preceded by the templates every flowTemplateInterval.
+func (t *flowTable) encodeIPFIX(records []flowRecord, now time.Time) [][]byte {
+	var templates []byte
+	if now.Sub(t.templateSent) >= flowTemplateInterval {
+		t.templateSent = now
+		var set bytes.Buffer
+		for _, template := range []uint16{ipfixTemplateIPv4, ipfixTemplateIPv6} {
+			fields := t.ipfixFields(template == ipfixTemplateIPv6)
+			binary.Write(&set, binary.BigEndian, []uint16{template, uint16(len(fields))})
+			for _, field := range fields {
+				binary.Write(&set, binary.BigEndian, []uint16{field.id, field.length})
+				if field.id&0x8000 != 0 {
+					binary.Write(&set, binary.BigEndian, t.pen)
+				}
+			}
+		}
+		templates = ipfixSet(2, set.Bytes())
+	}
+
+	var messages [][]byte
+	data := map[uint16]*bytes.Buffer{ipfixTemplateIPv4: {}, ipfixTemplateIPv6: {}}
+	// size is that of the message with the headers of the data sets
+	size, count := 16+len(templates)+8, uint32(0)
+	emit := func() {
+		var m bytes.Buffer
+		binary.Write(&m, binary.BigEndian, []uint16{10, 0})
+		binary.Write(&m, binary.BigEndian, []uint32{uint32(now.Unix()), t.sequence, ipfixDomain})
+		m.Write(templates)
+		for _, template := range []uint16{ipfixTemplateIPv4, ipfixTemplateIPv6} {
+			if data[template].Len() > 0 {
+				m.Write(ipfixSet(template, data[template].Bytes()))
+				data[template].Reset()
+			}
+		}
+		message := m.Bytes()
+		binary.BigEndian.PutUint16(message[2:], uint16(len(message)))
+		messages = append(messages, message)
+		t.sequence += count
+		templates, size, count = nil, 16+8, 0
+	}
+	for _, r := range records {
+		record := t.ipfixRecord(r)
+		if size+len(record) > flowMaxDatagram && count > 0 {
+			emit()
+		}
+		data[r.template()].Write(record)
+		size += len(record)
+		count++
+	}
+	if count > 0 || templates != nil {
+		emit()
+	}
+	return messages
+}
+
+// template returns the IPFIX template of r.
+func (r flowRecord) template() uint16 {
+	if len(r.key.net.Src().Raw()) == net.IPv6len {
+		return ipfixTemplateIPv6
+	}
+	return ipfixTemplateIPv4
+}
+
+// ipfixRecord returns the data record of r, in the fields of its template.
+func (t *flowTable) ipfixRecord(r flowRecord) []byte {
+	var b bytes.Buffer
+	b.Write(r.key.net.Src().Raw())
+	b.Write(r.key.net.Dst().Raw())
+	b.Write(r.key.transport.Src().Raw())
+	b.Write(r.key.transport.Dst().Raw())
+	b.WriteByte(r.key.protocol)
+	binary.Write(&b, binary.BigEndian, r.flags)
+	binary.Write(&b, binary.BigEndian, []int64{r.Bytes, r.Packets, r.Start.UnixNano() / 1e6, r.End.UnixNano() / 1e6})
+	b.WriteByte(r.reason)
+	if t.pen != 0 {
+		binary.Write(&b, binary.BigEndian, r.Requests)
+	}
+	return b.Bytes()
+}
+
+// ipfixSet returns the set of id with its header.
+func ipfixSet(id uint16, contents []byte) []byte {
+	set := make([]byte, 4, 4+len(contents))
+	binary.BigEndian.PutUint16(set, id)
+	binary.BigEndian.PutUint16(set[2:], uint16(4+len(contents)))
+	return append(set, contents...)
+}
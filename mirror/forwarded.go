@@ -0,0 +1,103 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// setForwardedHeaders updates the forwarding headers of a forwarded request
+// according to the forwarded-headers flag:
+//   - append keeps the headers of the captured request, appends the client to
+//     X-Forwarded-For (and Forwarded), and sets the other X-Forwarded-* headers
+//     only if the captured request has none;
+//   - overwrite replaces the headers with the values of the captured connection;
+//   - omit forwards the headers as captured.
+func setForwardedHeaders(conf *configSnapshot, header http.Header, reqSourceIP string, reqDestionationPort string, host string) {
+	switch conf.fwdHeaders {
+	case "omit":
+		return
+	case "overwrite":
+		header.Set("X-Forwarded-For", reqSourceIP)
+		header.Set("X-Forwarded-Port", reqDestionationPort)
+		header.Set("X-Forwarded-Proto", "http")
+		header.Set("X-Forwarded-Host", host)
+		if conf.fwdRFC7239 {
+			header.Set("Forwarded", forwardedElement(conf, reqSourceIP, host))
+		}
+		return
+	}
+
+	// Append to X-Forwarded-For the IP of the client or the IP of the latest proxy (if any proxies are in between)
+	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For
+	header.Add("X-Forwarded-For", reqSourceIP)
+	// The three following headers should contain 1 value only, i.e. the outermost port, protocol, and host
+	// https://tools.ietf.org/html/rfc7239#section-5.4
+	if header.Get("X-Forwarded-Port") == "" {
+		header.Set("X-Forwarded-Port", reqDestionationPort)
+	}
+	if header.Get("X-Forwarded-Proto") == "" {
+		header.Set("X-Forwarded-Proto", "http")
+	}
+	if header.Get("X-Forwarded-Host") == "" {
+		header.Set("X-Forwarded-Host", host)
+	}
+	if conf.fwdRFC7239 {
+		// https://tools.ietf.org/html/rfc7239#section-7.1
+		header.Add("Forwarded", forwardedElement(conf, reqSourceIP, host))
+	}
+}
+
+// forwardedElement returns the element of the Forwarded header describing the
+// hop from the captured client to the mirrored server.
+func forwardedElement(conf *configSnapshot, reqSourceIP string, host string) string {
+	pairs := []string{
+		"for=" + forwardedNode(reqSourceIP),
+		"proto=http",
+		"host=" + forwardedValue(host),
+	}
+	if conf.fwdBy7239 != "" {
+		pairs = append(pairs, "by="+forwardedNode(conf.fwdBy7239))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// forwardedNode formats a node identifier, which is quoted and bracketed for IPv6.
+// https://tools.ietf.org/html/rfc7239#section-6
+func forwardedNode(node string) string {
+	if ip := net.ParseIP(node); ip != nil && ip.To4() == nil {
+		return fmt.Sprintf("\"[%s]\"", node)
+	}
+	return forwardedValue(node)
+}
+
+// forwardedValue quotes value unless it is a token.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return fmt.Sprintf("%q", value)
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// setMirrorHeaders adds the metadata of the captured connection, for correlation
+// downstream.
+func setMirrorHeaders(header http.Header, info captureInfo) {
+	header.Set("X-Mirror-Source-Port", info.sourcePort)
+	header.Set("X-Mirror-Capture-Time", info.time.UTC().Format(time.RFC3339Nano))
+	header.Set("X-Mirror-Connection-ID", info.connectionID)
+	header.Set("X-Mirror-Request-Id", info.requestID)
+}
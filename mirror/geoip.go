@@ -0,0 +1,55 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoFilter looks up the country of captured source IPs in a MaxMind GeoLite2 (or
+// GeoIP2) Country or City database.
+type geoFilter struct {
+	db *geoip2.Reader
+	// countries are the ISO codes of the countries whose traffic is forwarded;
+	// the code EU stands for every member of the European Union. Empty means all.
+	countries map[string]bool
+}
+
+func openGeoFilter(path string, countries string) (*geoFilter, error) {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &geoFilter{db: db, countries: map[string]bool{}}
+	for _, code := range strings.Split(countries, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			g.countries[code] = true
+		}
+	}
+	return g, nil
+}
+
+// close closes the database, once no request uses the filter.
+func (g *geoFilter) close() error {
+	return g.db.Close()
+}
+
+// lookup returns the ISO code of the country of ip (empty if unknown), and
+// whether requests from ip are forwarded.
+func (g *geoFilter) lookup(ip string) (string, bool) {
+	var code string
+	var inEU bool
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if record, err := g.db.Country(parsed); err == nil {
+			code, inEU = record.Country.IsoCode, record.Country.IsInEuropeanUnion
+		}
+	}
+	if len(g.countries) == 0 {
+		return code, true
+	}
+	return code, (code != "" && g.countries[code]) || (inEU && g.countries["EU"])
+}
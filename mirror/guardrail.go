@@ -0,0 +1,128 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"log"
+	math_rand "math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// guardrailSlots is the number of slots of the guardrail window, which is
+// evaluated at the end of every slot.
+const guardrailSlots = 10
+
+// guardrailSamples is the number of latencies sampled per slot for the p99.
+const guardrailSamples = 500
+
+// guardrailSlot holds the forwards of a slot of the guardrail window.
+type guardrailSlot struct {
+	forwards, errors int64
+	latencies        []time.Duration
+}
+
+// errorBudgetGuardrail pauses forwarding when the shadow burns its error budget:
+// when the rate of 5xx responses and failed forwards, or the p99 latency, is
+// above its limit over the guardrail window. The guardrail pauses in count mode
+// and alerts; forwarding is resumed manually, through the admin API or SIGUSR2,
+// once the shadow is fixed.
+type errorBudgetGuardrail struct {
+	mu    sync.Mutex
+	slots [guardrailSlots]guardrailSlot
+	// current is the index of the slot being filled
+	current int
+	// tripped is the reason of the last pause, if forwarding is still paused
+	tripped string
+}
+
+var fwdGuardrail *errorBudgetGuardrail
+
+// record counts a forward, with status 0 for a failed forward.
+func (g *errorBudgetGuardrail) record(status int, latency time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	slot := &g.slots[g.current]
+	slot.forwards++
+	if status == 0 || status >= 500 {
+		slot.errors++
+	}
+	if len(slot.latencies) < guardrailSamples {
+		slot.latencies = append(slot.latencies, latency)
+	} else if i := math_rand.Int63n(slot.forwards); i < guardrailSamples {
+		slot.latencies[i] = latency
+	}
+}
+
+// watch evaluates the window at the end of every slot. It never returns.
+func (g *errorBudgetGuardrail) watch(window time.Duration) {
+	for {
+		time.Sleep(window / guardrailSlots)
+		g.evaluate()
+	}
+}
+
+func (g *errorBudgetGuardrail) evaluate() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.tripped != "" && currentPauseMode() == pauseNone {
+		log.Println("Guardrail cleared, forwarding was resumed")
+		g.tripped = ""
+	}
+
+	var forwards, errors int64
+	var latencies []time.Duration
+	for _, slot := range g.slots {
+		forwards += slot.forwards
+		errors += slot.errors
+		latencies = append(latencies, slot.latencies...)
+	}
+	g.current = (g.current + 1) % guardrailSlots
+	g.slots[g.current] = guardrailSlot{}
+	if forwards < int64(currentConfig().guardrailMinForwards) || currentPauseMode() != pauseNone {
+		return
+	}
+
+	var event alertEvent
+	errorRate := float64(errors) / float64(forwards)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[(len(latencies)-1)*99/100]
+	switch {
+	case *guardrailMaxErrorRate > 0 && errorRate > *guardrailMaxErrorRate:
+		event = alertEvent{
+			Kind:    "guardrail",
+			Name:    "error_rate",
+			Message: fmt.Sprintf("%d of %d forwards failed in the last %s, forwarding paused", errors, forwards, *guardrailWindow),
+		}
+	case *guardrailMaxP99 > 0 && p99 > *guardrailMaxP99:
+		event = alertEvent{
+			Kind:    "guardrail",
+			Name:    "p99",
+			Message: fmt.Sprintf("p99 latency of %s in the last %s, forwarding paused", p99.Round(time.Millisecond), *guardrailWindow),
+		}
+	default:
+		return
+	}
+	event.Details = map[string]interface{}{"forwards": forwards, "errors": errors, "error_rate": errorRate, "p99_ms": p99.Milliseconds()}
+
+	setPauseMode(pauseCount)
+	stats.inc(labeled("guardrail_trips", "reason", event.Name))
+	g.tripped = event.Name
+	// the window starts over when forwarding is resumed
+	g.slots = [guardrailSlots]guardrailSlot{}
+	sendAlert(event)
+}
+
+// state returns the reason forwarding was paused by the guardrail, if it is
+// still paused.
+func (g *errorBudgetGuardrail) state() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if currentPauseMode() == pauseNone {
+		return ""
+	}
+	return g.tripped
+}
@@ -0,0 +1,19 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import "net/http"
+
+// requestHook is implemented by user extensions (scripts, plugins) that inspect
+// and transform captured requests before they are forwarded.
+type requestHook interface {
+	run(req *http.Request, body []byte) (hookResult, error)
+}
+
+// hookResult holds what a hook decided about a request.
+type hookResult struct {
+	drop        bool
+	destination string
+	body        []byte
+}
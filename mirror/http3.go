@@ -0,0 +1,605 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// The HTTP/3 frame types read from the request streams.
+const (
+	http3FrameData    = 0x00
+	http3FrameHeaders = 0x01
+)
+
+// http3StreamEncoder is the type of the unidirectional stream of the QPACK
+// encoder instructions.
+const http3StreamEncoder = 0x02
+
+// http3MaxStreamBytes bounds the data of a request stream, which is parsed
+// once complete.
+const http3MaxStreamBytes = 16 << 20
+
+// errQPACKBlocked is returned for field sections referring to entries of the
+// dynamic table not inserted yet.
+var errQPACKBlocked = errors.New("QPACK field section is blocked")
+
+// streamFrame adds the data of a STREAM frame of the client. The requests of
+// the bidirectional streams are parsed once they are complete, and the
+// unidirectional stream of the QPACK encoder is read as it arrives.
+func (c *quicConnection) streamFrame(id, offset uint64, data []byte, fin bool, seen time.Time) {
+	if id&0x01 != 0 {
+		// streams of the server, like pushes
+		return
+	}
+	if c.streams == nil {
+		c.streams = map[uint64]*quicStream{}
+	}
+	s := c.streams[id]
+	if s == nil {
+		s = &quicStream{kind: -1, firstSeen: seen}
+		c.streams[id] = s
+	}
+	if s.done {
+		return
+	}
+	s.data = append(s.data, s.add(offset, data, fin)...)
+
+	if id&0x02 != 0 {
+		c.unidirectionalStream(s)
+		return
+	}
+	if len(s.data) > http3MaxStreamBytes {
+		s.done, s.data, s.pending = true, nil, nil
+		stats.inc("http3_requests_too_large")
+		return
+	}
+	if s.complete() {
+		s.done, s.pending = true, nil
+		c.request(id, s)
+	}
+}
+
+// unidirectionalStream reads the data received on a unidirectional stream,
+// whose type comes first.
+func (c *quicConnection) unidirectionalStream(s *quicStream) {
+	if s.kind < 0 {
+		r := &quicReader{b: s.data}
+		kind := r.varint()
+		if r.err {
+			return
+		}
+		s.kind, s.data = int64(kind), r.b
+	}
+	if s.kind != http3StreamEncoder {
+		// the control stream and the decoder stream are not needed
+		s.data = nil
+		return
+	}
+	n, err := c.qpack.encoderInstructions(s.data)
+	s.data = s.data[n:]
+	if err != nil {
+		log.Println("Error reading QPACK encoder stream of", c.net, c.transport, ":", err)
+		s.done, s.data = true, nil
+		return
+	}
+	if n > 0 && len(c.blocked) > 0 {
+		blocked := c.blocked
+		c.blocked = nil
+		for _, id := range blocked {
+			c.request(id, c.streams[id])
+		}
+	}
+}
+
+// request parses the request of a complete request stream and forwards it.
+func (c *quicConnection) request(id uint64, s *quicStream) {
+	req, body, err := c.parseRequest(s.data)
+	if err == errQPACKBlocked {
+		c.blocked = append(c.blocked, id)
+		return
+	}
+	s.data = nil
+	if err != nil {
+		stats.inc("http3_requests_invalid")
+		return
+	}
+
+	info := newCaptureInfo(c.net, c.transport, s.firstSeen)
+	info.ja3 = c.ja3
+	// client request streams are numbered 0, 4, 8...
+	info.index = int(id/4) + 1
+	stats.inc("requests_captured")
+	stats.inc("http3_requests")
+	if fwdArchive != nil {
+		if err := fwdArchive.write(newArchiveRecord(req, info, body)); err != nil {
+			log.Println("Error writing archive", ":", err)
+		}
+	}
+	if draining() {
+		stats.inc("requests_dropped_draining")
+		return
+	}
+	atomic.AddInt64(&fwdInFlight, 1)
+	go forwardRequest(req, info, body)
+}
+
+// parseRequest parses the HTTP/3 frames of a request stream into a request
+// like those of http.ReadRequest, and its body.
+func (c *quicConnection) parseRequest(data []byte) (*http.Request, []byte, error) {
+	var fields, trailers []qpackField
+	headers := false
+	var body []byte
+	r := &quicReader{b: data}
+	for len(r.b) > 0 {
+		typ := r.varint()
+		payload := r.bytes(r.varint())
+		if r.err {
+			return nil, nil, errors.New("HTTP/3 frame is truncated")
+		}
+		var err error
+		switch {
+		case typ == http3FrameHeaders && !headers:
+			fields, err = c.qpack.decode(payload)
+			headers = true
+		case typ == http3FrameHeaders:
+			trailers, err = c.qpack.decode(payload)
+		case typ == http3FrameData:
+			body = append(body, payload...)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if !headers {
+		return nil, nil, errors.New("HTTP/3 request has no HEADERS frame")
+	}
+
+	req := &http.Request{
+		Proto:      "HTTP/3.0",
+		ProtoMajor: 3,
+		Header:     http.Header{},
+	}
+	var cookies []string
+	for _, f := range fields {
+		switch f.name {
+		case ":method":
+			req.Method = f.value
+		case ":path":
+			req.RequestURI = f.value
+		case ":authority":
+			req.Host = f.value
+		case ":scheme", ":protocol":
+		case "cookie":
+			// the cookies can be split in several fields (RFC 9114, 4.2.1)
+			cookies = append(cookies, f.value)
+		default:
+			if strings.HasPrefix(f.name, ":") {
+				return nil, nil, fmt.Errorf("HTTP/3 request has an unknown pseudo-header %s", f.name)
+			}
+			req.Header.Add(f.name, f.value)
+		}
+	}
+	if len(cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+	req.Header.Del("Host")
+	if req.Method == "" || req.RequestURI == "" {
+		return nil, nil, errors.New("HTTP/3 request has no :method or :path")
+	}
+	u, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.URL = u
+	if len(trailers) > 0 {
+		req.Trailer = http.Header{}
+		for _, f := range trailers {
+			req.Trailer.Add(f.name, f.value)
+		}
+	}
+	req.ContentLength = int64(len(body))
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	body, err = readBody(currentConfig(), req)
+	return req, body, err
+}
+
+// qpackField is a field line of a QPACK field section.
+type qpackField struct {
+	name, value string
+}
+
+// qpackDecoder decodes the field sections of a connection with the dynamic
+// table built by the instructions of its encoder stream (RFC 9204).
+type qpackDecoder struct {
+	// entries holds the dynamic table, oldest first, and dropped the number of
+	// entries evicted, the absolute index of entries[0]
+	entries        []qpackField
+	dropped        uint64
+	size, capacity int
+	// maxCapacity is the largest capacity set by the encoder. It stands for
+	// the maximum capacity the server advertised, which encodes the Required
+	// Insert Count of the field sections.
+	maxCapacity int
+}
+
+func (d *qpackDecoder) inserted() uint64 {
+	return d.dropped + uint64(len(d.entries))
+}
+
+func (d *qpackDecoder) setCapacity(capacity int) {
+	d.capacity = capacity
+	if capacity > d.maxCapacity {
+		d.maxCapacity = capacity
+	}
+	d.evict(0)
+}
+
+// evict evicts the oldest entries until an entry of size fits.
+func (d *qpackDecoder) evict(size int) {
+	for len(d.entries) > 0 && d.size+size > d.capacity {
+		d.size -= len(d.entries[0].name) + len(d.entries[0].value) + 32
+		d.entries = d.entries[1:]
+		d.dropped++
+	}
+}
+
+func (d *qpackDecoder) insert(f qpackField) error {
+	size := len(f.name) + len(f.value) + 32
+	if size > d.capacity {
+		return fmt.Errorf("QPACK entry of %d bytes exceeds the table capacity", size)
+	}
+	d.evict(size)
+	d.entries = append(d.entries, f)
+	d.size += size
+	return nil
+}
+
+// entry returns the entry of the dynamic table of absolute index i.
+func (d *qpackDecoder) entry(i uint64) (qpackField, error) {
+	if i < d.dropped || i >= d.inserted() {
+		return qpackField{}, fmt.Errorf("QPACK dynamic table has no entry %d", i)
+	}
+	return d.entries[i-d.dropped], nil
+}
+
+func qpackStatic(i uint64) (qpackField, error) {
+	if i >= uint64(len(qpackStaticTable)) {
+		return qpackField{}, fmt.Errorf("QPACK static table has no entry %d", i)
+	}
+	return qpackStaticTable[i], nil
+}
+
+// encoderInstructions applies the complete instructions at the start of data,
+// and returns their length.
+func (d *qpackDecoder) encoderInstructions(data []byte) (int, error) {
+	consumed := 0
+	for len(data) > consumed {
+		b := data[consumed:]
+		var rest []byte
+		var ok bool
+		var err error
+		switch {
+		case b[0]&0x80 != 0:
+			// Insert with Name Reference
+			var index uint64
+			index, rest, ok = qpackInt(b, 6)
+			var value string
+			if ok {
+				value, rest, ok, err = qpackString(rest, 7)
+			}
+			if !ok || err != nil {
+				break
+			}
+			var name qpackField
+			if b[0]&0x40 != 0 {
+				name, err = qpackStatic(index)
+			} else {
+				name, err = d.entry(d.inserted() - 1 - index)
+			}
+			if err == nil {
+				err = d.insert(qpackField{name.name, value})
+			}
+		case b[0]&0x40 != 0:
+			// Insert with Literal Name
+			var name, value string
+			name, rest, ok, err = qpackString(b, 5)
+			if ok && err == nil {
+				value, rest, ok, err = qpackString(rest, 7)
+			}
+			if ok && err == nil {
+				err = d.insert(qpackField{name, value})
+			}
+		case b[0]&0x20 != 0:
+			// Set Dynamic Table Capacity
+			var capacity uint64
+			if capacity, rest, ok = qpackInt(b, 5); ok {
+				d.setCapacity(int(capacity))
+			}
+		default:
+			// Duplicate
+			var index uint64
+			if index, rest, ok = qpackInt(b, 5); ok {
+				var f qpackField
+				if f, err = d.entry(d.inserted() - 1 - index); err == nil {
+					err = d.insert(f)
+				}
+			}
+		}
+		if err != nil {
+			return consumed, err
+		}
+		if !ok {
+			// the rest of the instruction was not received yet
+			return consumed, nil
+		}
+		consumed = len(data) - len(rest)
+	}
+	return consumed, nil
+}
+
+// decode decodes a field section, or returns errQPACKBlocked if it refers to
+// entries not inserted yet.
+func (d *qpackDecoder) decode(section []byte) ([]qpackField, error) {
+	errTruncated := errors.New("QPACK field section is truncated")
+	encoded, rest, ok := qpackInt(section, 8)
+	if !ok || len(rest) == 0 {
+		return nil, errTruncated
+	}
+	sign := rest[0]&0x80 != 0
+	delta, rest, ok := qpackInt(rest, 7)
+	if !ok {
+		return nil, errTruncated
+	}
+	required, err := d.requiredInsertCount(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if required > d.inserted() {
+		return nil, errQPACKBlocked
+	}
+	base := required + delta
+	if sign {
+		base = required - delta - 1
+	}
+
+	var fields []qpackField
+	for len(rest) > 0 {
+		b := rest[0]
+		var f qpackField
+		var index uint64
+		switch {
+		case b&0x80 != 0:
+			// Indexed Field Line
+			if index, rest, ok = qpackInt(rest, 6); ok {
+				if b&0x40 != 0 {
+					f, err = qpackStatic(index)
+				} else {
+					f, err = d.entry(base - 1 - index)
+				}
+			}
+		case b&0x40 != 0:
+			// Literal Field Line with Name Reference
+			if index, rest, ok = qpackInt(rest, 4); ok {
+				if b&0x10 != 0 {
+					f, err = qpackStatic(index)
+				} else {
+					f, err = d.entry(base - 1 - index)
+				}
+				if err == nil {
+					f.value, rest, ok, err = qpackString(rest, 7)
+				}
+			}
+		case b&0x20 != 0:
+			// Literal Field Line with Literal Name
+			if f.name, rest, ok, err = qpackString(rest, 3); ok && err == nil {
+				f.value, rest, ok, err = qpackString(rest, 7)
+			}
+		case b&0x10 != 0:
+			// Indexed Field Line with Post-Base Index
+			if index, rest, ok = qpackInt(rest, 4); ok {
+				f, err = d.entry(base + index)
+			}
+		default:
+			// Literal Field Line with Post-Base Name Reference
+			if index, rest, ok = qpackInt(rest, 3); ok {
+				if f, err = d.entry(base + index); err == nil {
+					f.value, rest, ok, err = qpackString(rest, 7)
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errTruncated
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// requiredInsertCount decodes the Required Insert Count of a field section
+// (RFC 9204, 4.5.1.1).
+func (d *qpackDecoder) requiredInsertCount(encoded uint64) (uint64, error) {
+	if encoded == 0 {
+		return 0, nil
+	}
+	maxEntries := uint64(d.maxCapacity / 32)
+	fullRange := 2 * maxEntries
+	if encoded > fullRange {
+		return 0, fmt.Errorf("QPACK Required Insert Count %d is not valid", encoded)
+	}
+	maxValue := d.inserted() + maxEntries
+	required := maxValue/fullRange*fullRange + encoded - 1
+	if required > maxValue {
+		if required <= fullRange {
+			return 0, fmt.Errorf("QPACK Required Insert Count %d is not valid", encoded)
+		}
+		required -= fullRange
+	}
+	if required == 0 {
+		return 0, fmt.Errorf("QPACK Required Insert Count %d is not valid", encoded)
+	}
+	return required, nil
+}
+
+// qpackInt decodes an integer with an n-bit prefix. ok is false if b ends
+// within the integer.
+func qpackInt(b []byte, n uint) (uint64, []byte, bool) {
+	if len(b) == 0 {
+		return 0, nil, false
+	}
+	max := uint64(1)<<n - 1
+	v := uint64(b[0]) & max
+	b = b[1:]
+	if v < max {
+		return v, b, true
+	}
+	for shift := uint(0); len(b) > 0 && shift < 63; shift += 7 {
+		c := b[0]
+		b = b[1:]
+		v += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return v, b, true
+		}
+	}
+	return 0, nil, false
+}
+
+// qpackString decodes a string literal whose length has an n-bit prefix,
+// preceded by its Huffman flag.
+func qpackString(b []byte, n uint) (string, []byte, bool, error) {
+	if len(b) == 0 {
+		return "", nil, false, nil
+	}
+	huffman := b[0]&(1<<n) != 0
+	length, rest, ok := qpackInt(b, n)
+	if !ok || uint64(len(rest)) < length {
+		return "", nil, false, nil
+	}
+	s, rest := rest[:length], rest[length:]
+	if !huffman {
+		return string(s), rest, true, nil
+	}
+	decoded, err := hpack.HuffmanDecodeToString(s)
+	return decoded, rest, true, err
+}
+
+// qpackStaticTable is the static table of QPACK (RFC 9204, appendix A).
+var qpackStaticTable = []qpackField{
+	{":authority", ""},
+	{":path", "/"},
+	{"age", "0"},
+	{"content-disposition", ""},
+	{"content-length", "0"},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"referer", ""},
+	{"set-cookie", ""},
+	{":method", "CONNECT"},
+	{":method", "DELETE"},
+	{":method", "GET"},
+	{":method", "HEAD"},
+	{":method", "OPTIONS"},
+	{":method", "POST"},
+	{":method", "PUT"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "103"},
+	{":status", "200"},
+	{":status", "304"},
+	{":status", "404"},
+	{":status", "503"},
+	{"accept", "*/*"},
+	{"accept", "application/dns-message"},
+	{"accept-encoding", "gzip, deflate, br"},
+	{"accept-ranges", "bytes"},
+	{"access-control-allow-headers", "cache-control"},
+	{"access-control-allow-headers", "content-type"},
+	{"access-control-allow-origin", "*"},
+	{"cache-control", "max-age=0"},
+	{"cache-control", "max-age=2592000"},
+	{"cache-control", "max-age=604800"},
+	{"cache-control", "no-cache"},
+	{"cache-control", "no-store"},
+	{"cache-control", "public, max-age=31536000"},
+	{"content-encoding", "br"},
+	{"content-encoding", "gzip"},
+	{"content-type", "application/dns-message"},
+	{"content-type", "application/javascript"},
+	{"content-type", "application/json"},
+	{"content-type", "application/x-www-form-urlencoded"},
+	{"content-type", "image/gif"},
+	{"content-type", "image/jpeg"},
+	{"content-type", "image/png"},
+	{"content-type", "text/css"},
+	{"content-type", "text/html; charset=utf-8"},
+	{"content-type", "text/plain"},
+	{"content-type", "text/plain;charset=utf-8"},
+	{"range", "bytes=0-"},
+	{"strict-transport-security", "max-age=31536000"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains; preload"},
+	{"vary", "accept-encoding"},
+	{"vary", "origin"},
+	{"x-content-type-options", "nosniff"},
+	{"x-xss-protection", "1; mode=block"},
+	{":status", "100"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "302"},
+	{":status", "400"},
+	{":status", "403"},
+	{":status", "421"},
+	{":status", "425"},
+	{":status", "500"},
+	{"accept-language", ""},
+	{"access-control-allow-credentials", "FALSE"},
+	{"access-control-allow-credentials", "TRUE"},
+	{"access-control-allow-headers", "*"},
+	{"access-control-allow-methods", "get"},
+	{"access-control-allow-methods", "get, post, options"},
+	{"access-control-allow-methods", "options"},
+	{"access-control-expose-headers", "content-length"},
+	{"access-control-request-headers", "content-type"},
+	{"access-control-request-method", "get"},
+	{"access-control-request-method", "post"},
+	{"alt-svc", "clear"},
+	{"authorization", ""},
+	{"content-security-policy", "script-src 'none'; object-src 'none'; base-uri 'none'"},
+	{"early-data", "1"},
+	{"expect-ct", ""},
+	{"forwarded", ""},
+	{"if-range", ""},
+	{"origin", ""},
+	{"purpose", "prefetch"},
+	{"server", ""},
+	{"timing-allow-origin", "*"},
+	{"upgrade-insecure-requests", "1"},
+	{"user-agent", ""},
+	{"x-forwarded-for", ""},
+	{"x-frame-options", "deny"},
+	{"x-frame-options", "sameorigin"},
+}
@@ -0,0 +1,126 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runHTTPIngest implements the capture subcommand with the http capture engine:
+// instead of capturing packets, the replay handler receives the requests
+// duplicated by a proxy, like the request mirroring of Envoy, and forwards them
+// through the same pipeline. The proxy is answered as soon as the request is
+// read, so the mirror never slows it down.
+func runHTTPIngest() error {
+	listener, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		return err
+	}
+	if err := startHealthListener(); err != nil {
+		listener.Close()
+		return err
+	}
+	server := &http.Server{
+		Handler:           http.HandlerFunc(ingestRequest),
+		ReadHeaderTimeout: time.Minute,
+	}
+	go func() {
+		<-captureStop
+		server.Close()
+	}()
+	log.Println("Listening for mirrored requests on", listener.Addr())
+	sdNotify("READY=1\nSTATUS=Listening on " + *listenAddr)
+	go func() {
+		// the watchdog pings systemd as long as the listener runs, even without traffic
+		for range time.Tick(time.Second) {
+			beatCapture()
+		}
+	}()
+	go watchdog()
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func ingestRequest(w http.ResponseWriter, req *http.Request) {
+	info := ingestInfo(req)
+	body, err := readBody(currentConfig(), req)
+	if err != nil {
+		// the proxy closed the connection within the body: the request is still
+		// forwarded, with the part of the body that was received
+		stats.inc("stream_errors_truncated")
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	// the rest of the pipeline outlives the request of the proxy
+	req = req.WithContext(context.Background())
+	req.Host = stripShadowSuffix(req.Host)
+	stats.inc("requests_captured")
+	if fwdArchive != nil {
+		if err := fwdArchive.write(newArchiveRecord(req, info, body)); err != nil {
+			log.Println("Error writing archive", ":", err)
+		}
+	}
+	if draining() {
+		stats.inc("requests_dropped_draining")
+		return
+	}
+	atomic.AddInt64(&fwdInFlight, 1)
+	go forwardRequest(req, info, body)
+}
+
+// ingestInfo returns the capture info of a request received by the listener.
+// The source is the client in the listen-source-ip-header header, if any, and
+// the proxy otherwise.
+func ingestInfo(req *http.Request) captureInfo {
+	conf := currentConfig()
+	sourceIP, sourcePort, _ := net.SplitHostPort(req.RemoteAddr)
+	destinationIP, destinationPort := "", ""
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		destinationIP, destinationPort, _ = net.SplitHostPort(addr.String())
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s-%s", req.RemoteAddr, destinationIP+":"+destinationPort)
+	info := captureInfo{
+		sourceIP:        sourceIP,
+		sourcePort:      sourcePort,
+		destinationIP:   destinationIP,
+		destinationPort: destinationPort,
+		time:            time.Now(),
+		connectionID:    fmt.Sprintf("%016x", h.Sum64()),
+		requestID:       newRequestID(),
+	}
+	if conf.listenSourceIPHeader != "" {
+		// the client is the first address of X-Forwarded-For like lists
+		value := strings.TrimSpace(strings.Split(req.Header.Get(conf.listenSourceIPHeader), ",")[0])
+		if ip := net.ParseIP(value); ip != nil {
+			info.sourceIP = ip.String()
+		}
+	}
+	return info
+}
+
+// stripShadowSuffix removes the listen-host-suffix from the host name, which
+// proxies like Envoy add to mirrored requests (api.example.com-shadow:8080).
+func stripShadowSuffix(host string) string {
+	conf := currentConfig()
+	if conf.listenHostSuffix == "" {
+		return host
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(host, conf.listenHostSuffix)
+	}
+	return net.JoinHostPort(strings.TrimSuffix(name, conf.listenHostSuffix), port)
+}
@@ -0,0 +1,189 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxTrackedFingerprints bounds the number of JA3 fingerprints tracked; the
+// connections of other fingerprints are counted under otherFingerprint.
+const maxTrackedFingerprints = 10000
+
+const otherFingerprint = "(other)"
+
+// ja3Stat holds the connections of a JA3 fingerprint.
+type ja3Stat struct {
+	Fingerprint string `json:"fingerprint"`
+	Connections int64  `json:"connections"`
+	// ServerName is the SNI of the first connection with the fingerprint
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// ja3Statistics tracks the JA3 fingerprints of the ClientHellos of the captured
+// connections, which identify the TLS libraries of the clients.
+type ja3Statistics struct {
+	mu           sync.Mutex
+	fingerprints map[string]*ja3Stat
+}
+
+func newJA3Statistics() *ja3Statistics {
+	return &ja3Statistics{fingerprints: map[string]*ja3Stat{}}
+}
+
+// record returns the fingerprint of the ClientHello message msg, header
+// included, and counts its connection.
+func (j *ja3Statistics) record(msg []byte) string {
+	fingerprint, serverName, err := ja3Fingerprint(msg)
+	if err != nil {
+		stats.inc("tls_client_hellos_invalid")
+		return ""
+	}
+	stats.inc("tls_client_hellos")
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	key := fingerprint
+	if _, ok := j.fingerprints[key]; !ok && len(j.fingerprints) >= maxTrackedFingerprints {
+		key = otherFingerprint
+	}
+	s, ok := j.fingerprints[key]
+	if !ok {
+		s = &ja3Stat{Fingerprint: key, ServerName: serverName}
+		j.fingerprints[key] = s
+	}
+	s.Connections++
+	return fingerprint
+}
+
+// top returns the n fingerprints with the most connections.
+func (j *ja3Statistics) top(n int) []ja3Stat {
+	j.mu.Lock()
+	all := make([]ja3Stat, 0, len(j.fingerprints))
+	for _, s := range j.fingerprints {
+		all = append(all, *s)
+	}
+	j.mu.Unlock()
+	sort.Slice(all, func(a, b int) bool {
+		if all[a].Connections != all[b].Connections {
+			return all[a].Connections > all[b].Connections
+		}
+		return all[a].Fingerprint < all[b].Fingerprint
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// isGREASE reports whether v is one of the values clients add at random to
+// their ClientHellos (RFC 8701), which JA3 ignores.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ja3Fingerprint returns the JA3 fingerprint of a ClientHello message, the MD5
+// of "version,ciphers,extensions,curves,point formats", and its server name.
+func ja3Fingerprint(msg []byte) (string, string, error) {
+	errTruncated := errors.New("ClientHello is truncated")
+	if len(msg) < 4 || msg[0] != tlsHandshakeClientHello {
+		return "", "", fmt.Errorf("not a ClientHello message")
+	}
+	body := msg[4:]
+	if len(body) < 35 {
+		return "", "", errTruncated
+	}
+	version := binary.BigEndian.Uint16(body[0:2])
+	if len(body) < 35+int(body[34]) {
+		return "", "", errTruncated
+	}
+	body = body[35+int(body[34]):]
+	if len(body) < 2 || len(body) < 2+int(binary.BigEndian.Uint16(body)) {
+		return "", "", errTruncated
+	}
+	suites := body[2 : 2+int(binary.BigEndian.Uint16(body))]
+	body = body[2+len(suites):]
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return "", "", errTruncated
+	}
+	body = body[1+int(body[0]):]
+
+	fields := [5][]string{{strconv.Itoa(int(version))}}
+	for i := 0; i+2 <= len(suites); i += 2 {
+		if v := binary.BigEndian.Uint16(suites[i:]); !isGREASE(v) {
+			fields[1] = append(fields[1], strconv.Itoa(int(v)))
+		}
+	}
+	serverName := ""
+	if len(body) >= 2 {
+		extensions := body[2:]
+		for len(extensions) >= 4 {
+			kind, n := binary.BigEndian.Uint16(extensions[0:2]), int(binary.BigEndian.Uint16(extensions[2:4]))
+			if len(extensions) < 4+n {
+				return "", "", errTruncated
+			}
+			data := extensions[4 : 4+n]
+			extensions = extensions[4+n:]
+			if isGREASE(kind) {
+				continue
+			}
+			fields[2] = append(fields[2], strconv.Itoa(int(kind)))
+			switch {
+			case kind == 0 && n >= 5 && data[2] == 0:
+				// server_name, of type host_name
+				if l := int(binary.BigEndian.Uint16(data[3:5])); 5+l <= n {
+					serverName = string(data[5 : 5+l])
+				}
+			case kind == 10 && n >= 2:
+				// supported_groups
+				for i := 2; i+2 <= n; i += 2 {
+					if v := binary.BigEndian.Uint16(data[i:]); !isGREASE(v) {
+						fields[3] = append(fields[3], strconv.Itoa(int(v)))
+					}
+				}
+			case kind == 11 && n >= 1:
+				// ec_point_formats
+				for _, v := range data[1:] {
+					fields[4] = append(fields[4], strconv.Itoa(int(v)))
+				}
+			}
+		}
+	}
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = strings.Join(f, "-")
+	}
+	sum := md5.Sum([]byte(strings.Join(parts, ",")))
+	return hex.EncodeToString(sum[:]), serverName, nil
+}
+
+// fingerprintTLS counts the JA3 fingerprint of the ClientHello a TLS
+// connection starts with, when it is not decrypted.
+func (h *httpStream) fingerprintTLS(buf *bufio.Reader) {
+	var handshake handshakeBuffer
+	for {
+		header, fragment, err := readTLSRecord(buf)
+		if err != nil || header[0] != tlsRecordHandshake {
+			return
+		}
+		handshake.data = append(handshake.data, fragment...)
+		if msg := handshake.next(); msg != nil {
+			// the server side starts with a ServerHello
+			// ja3 may have been disabled by a reload meanwhile
+			if ja3 := currentConfig().ja3; ja3 != nil && msg[0] == tlsHandshakeClientHello {
+				ja3.record(msg)
+			}
+			return
+		}
+	}
+}
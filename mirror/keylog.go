@@ -0,0 +1,141 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyLogMaxSessions bounds the sessions kept from the key log, the oldest
+// being forgotten first.
+const keyLogMaxSessions = 100000
+
+// keyLogPollInterval is the interval the key log is checked for new lines at.
+const keyLogPollInterval = 100 * time.Millisecond
+
+// keyLog holds the secrets of an NSS key log file (SSLKEYLOGFILE), exported by
+// the proxy or the application terminating TLS. The file is read as it is
+// appended to, so that the sessions can be decrypted as they are captured.
+type keyLog struct {
+	path string
+
+	mu sync.Mutex
+	// secrets holds the secrets of the sessions by client random, then by
+	// label (CLIENT_RANDOM, CLIENT_TRAFFIC_SECRET_0...)
+	secrets map[string]map[string][]byte
+	// randoms are the client randoms of secrets, in the order they were read
+	randoms []string
+	// offset is the size of the file already read, and partial the last line
+	// read if it was not complete
+	offset  int64
+	partial []byte
+}
+
+var fwdKeyLog *keyLog
+
+func openKeyLog(path string) (*keyLog, error) {
+	k := &keyLog{path: path, secrets: map[string]map[string][]byte{}}
+	if err := k.read(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(keyLogPollInterval) {
+			if err := k.read(); err != nil {
+				log.Println("Error reading TLS key log", k.path, ":", err)
+			}
+		}
+	}()
+	return k, nil
+}
+
+// read reads the lines appended to the file since the last read. A file
+// smaller than what was read was rotated, and is read from the start.
+func (k *keyLog) read() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < k.offset {
+		k.offset, k.partial = 0, nil
+	}
+	if info.Size() == k.offset {
+		return nil
+	}
+	if _, err := f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, info.Size()-k.offset))
+	if err != nil {
+		return err
+	}
+	k.offset += int64(len(data))
+	data = append(k.partial, data...)
+	end := bytes.LastIndexByte(data, '\n')
+	k.partial = append([]byte(nil), data[end+1:]...)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, line := range strings.Split(string(data[:end+1]), "\n") {
+		k.add(line)
+	}
+	stats.set("tls_keylog_sessions", int64(len(k.secrets)))
+	return nil
+}
+
+// add parses a line like "CLIENT_RANDOM <client random> <secret>", in hex.
+func (k *keyLog) add(line string) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+		return
+	}
+	random, err := hex.DecodeString(fields[1])
+	if err != nil || len(random) != 32 {
+		stats.inc("tls_keylog_lines_invalid")
+		return
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil {
+		stats.inc("tls_keylog_lines_invalid")
+		return
+	}
+	session, ok := k.secrets[string(random)]
+	if !ok {
+		if len(k.randoms) >= keyLogMaxSessions {
+			delete(k.secrets, k.randoms[0])
+			k.randoms = k.randoms[1:]
+		}
+		session = map[string][]byte{}
+		k.secrets[string(random)] = session
+		k.randoms = append(k.randoms, string(random))
+	}
+	session[fields[0]] = secret
+}
+
+// secret returns the secret of label for the session of clientRandom, waiting
+// up to wait for the proxy to log it, or nil.
+func (k *keyLog) secret(clientRandom []byte, label string, wait time.Duration) []byte {
+	deadline := time.Now().Add(wait)
+	for {
+		k.mu.Lock()
+		secret := k.secrets[string(clientRandom)][label]
+		k.mu.Unlock()
+		if secret != nil || time.Now().After(deadline) {
+			return secret
+		}
+		time.Sleep(keyLogPollInterval)
+	}
+}
@@ -0,0 +1,397 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal client of the Kubernetes API, authenticated with the
+// service account of the pod the mirror runs in.
+type kubeClient struct {
+	host   string
+	client *http.Client
+}
+
+var kubeAPI *kubeClient
+var kubeAPIErr error
+var kubeAPIOnce sync.Once
+
+// inClusterKubeClient returns the shared Kubernetes API client.
+func inClusterKubeClient() (*kubeClient, error) {
+	kubeAPIOnce.Do(func() {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			kubeAPIErr = fmt.Errorf("not running in a Kubernetes cluster (KUBERNETES_SERVICE_HOST is not set)")
+			return
+		}
+		ca, err := ioutil.ReadFile(kubeServiceAccountDir + "/ca.crt")
+		if err != nil {
+			kubeAPIErr = err
+			return
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		kubeAPI = &kubeClient{
+			host:   "https://" + net.JoinHostPort(host, port),
+			client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+		}
+	})
+	return kubeAPI, kubeAPIErr
+}
+
+// do sends a request to the API. The token is read on every request, because
+// projected service account tokens are rotated by the kubelet.
+func (c *kubeClient) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	token, err := ioutil.ReadFile(kubeServiceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.client.Do(req)
+}
+
+// get decodes the JSON document at path into v.
+func (c *kubeClient) get(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// send sends body to path and decodes the response into v if it is
+// successful. It returns the status, for the callers to tell conflicts and
+// missing objects apart.
+func (c *kubeClient) send(ctx context.Context, method, path string, body, v interface{}) (int, error) {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+	if v == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+type kubeEndpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+}
+
+// kubeServiceWatch follows the EndpointSlices of a Service referenced by a route
+// table destination like k8s://namespace/service:port, where port is the name of
+// the Service port or the target port number.
+type kubeServiceWatch struct {
+	dest      string
+	scheme    string
+	namespace string
+	service   string
+	port      string
+	slices    map[string]kubeEndpointSlice
+	// ctx is cancelled once the routes no longer reference dest
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newKubeServiceWatch(dest string) (*kubeServiceWatch, error) {
+	w := &kubeServiceWatch{dest: dest, scheme: "http", slices: map[string]kubeEndpointSlice{}}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	if strings.HasPrefix(dest, "k8s+https://") {
+		w.scheme = "https"
+	}
+	ref := dest[strings.Index(dest, "://")+3:]
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || !strings.Contains(parts[1], ":") {
+		return nil, fmt.Errorf("Kubernetes destination (%s) must be like k8s://namespace/service:port", dest)
+	}
+	w.namespace = parts[0]
+	w.service = parts[1][:strings.LastIndex(parts[1], ":")]
+	w.port = parts[1][strings.LastIndex(parts[1], ":")+1:]
+	return w, nil
+}
+
+// run keeps the endpoints of w.dest in t up to date, until w is stopped.
+func (w *kubeServiceWatch) run(t *routeTable) {
+	for {
+		if err := w.watch(t); err != nil && w.ctx.Err() == nil {
+			log.Println("Error watching endpoints of", w.dest, ":", err)
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// stop ends the watch, and its request to the Kubernetes API.
+func (w *kubeServiceWatch) stop() {
+	w.cancel()
+}
+
+func (w *kubeServiceWatch) watch(t *routeTable) error {
+	c, err := inClusterKubeClient()
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?labelSelector=%s",
+		w.namespace, url.QueryEscape("kubernetes.io/service-name="+w.service))
+
+	// list, then watch from the returned resource version
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []kubeEndpointSlice `json:"items"`
+	}
+	if err := c.get(w.ctx, path, &list); err != nil {
+		return err
+	}
+	w.slices = map[string]kubeEndpointSlice{}
+	for _, slice := range list.Items {
+		w.slices[slice.Metadata.Name] = slice
+	}
+	w.publish(t)
+
+	resp, err := c.do(w.ctx, http.MethodGet, path+"&watch=true&resourceVersion="+list.Metadata.ResourceVersion, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string            `json:"type"`
+			Object kubeEndpointSlice `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			w.slices[event.Object.Metadata.Name] = event.Object
+		case "DELETED":
+			delete(w.slices, event.Object.Metadata.Name)
+		case "ERROR":
+			// typically 410 Gone: the resource version is too old, list again
+			return fmt.Errorf("watch error event")
+		}
+		w.publish(t)
+	}
+}
+
+// publish replaces the endpoints of w.dest with the ready addresses of all slices.
+func (w *kubeServiceWatch) publish(t *routeTable) {
+	var endpoints []string
+	for _, slice := range w.slices {
+		port := 0
+		for _, p := range slice.Ports {
+			if p.Name == w.port || strconv.Itoa(p.Port) == w.port {
+				port = p.Port
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// a nil ready condition must be interpreted as ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				endpoints = append(endpoints, fmt.Sprintf("%s://%s", w.scheme, net.JoinHostPort(address, strconv.Itoa(port))))
+			}
+		}
+	}
+	t.mu.Lock()
+	// a stopped watch may still be reading
+	if t.kubeWatches[w.dest] == w {
+		t.endpoints[w.dest] = endpoints
+	}
+	t.mu.Unlock()
+}
+
+// kubePod describes the pod a source IP belongs to.
+type kubePod struct {
+	name      string
+	namespace string
+	// workload is the controller of the pod, like Deployment/web, or the pod itself
+	workload string
+	expires  time.Time
+}
+
+// kubePodAttribution resolves captured source IPs to pods through the Kubernetes
+// API, with a cache. Misses are cached too, for IPs outside the cluster.
+type kubePodAttribution struct {
+	mu   sync.Mutex
+	pods map[string]*kubePodLookup
+}
+
+// kubePodLookup is a cache entry; done is closed once pod is set.
+type kubePodLookup struct {
+	done chan struct{}
+	pod  *kubePod
+}
+
+const kubePodTTL = 5 * time.Minute
+const kubePodMissTTL = time.Minute
+
+var fwdKubePods *kubePodAttribution
+
+func newKubePodAttribution() *kubePodAttribution {
+	return &kubePodAttribution{pods: map[string]*kubePodLookup{}}
+}
+
+// lookup returns the pod of ip, or nil. Concurrent lookups of the same IP share
+// a single API request.
+func (a *kubePodAttribution) lookup(ip string) *kubePod {
+	a.mu.Lock()
+	l, ok := a.pods[ip]
+	if ok {
+		select {
+		case <-l.done:
+			if time.Now().After(l.pod.expires) {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		l = &kubePodLookup{done: make(chan struct{})}
+		a.pods[ip] = l
+		go a.resolve(ip, l)
+	}
+	a.mu.Unlock()
+
+	<-l.done
+	if l.pod.name == "" {
+		return nil
+	}
+	return l.pod
+}
+
+func (a *kubePodAttribution) resolve(ip string, l *kubePodLookup) {
+	pod, err := findPodByIP(ip)
+	if err != nil {
+		log.Println("Error looking up pod of", ip, ":", err)
+	}
+	if pod == nil {
+		pod = &kubePod{expires: time.Now().Add(kubePodMissTTL)}
+	}
+	l.pod = pod
+	close(l.done)
+}
+
+func findPodByIP(ip string) (*kubePod, error) {
+	c, err := inClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name            string            `json:"name"`
+				Namespace       string            `json:"namespace"`
+				Labels          map[string]string `json:"labels"`
+				OwnerReferences []struct {
+					Kind       string `json:"kind"`
+					Name       string `json:"name"`
+					Controller bool   `json:"controller"`
+				} `json:"ownerReferences"`
+			} `json:"metadata"`
+			Spec struct {
+				HostNetwork bool `json:"hostNetwork"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	path := "/api/v1/pods?fieldSelector=" + url.QueryEscape("status.podIP="+ip)
+	if err := c.get(ctx, path, &list); err != nil {
+		return nil, err
+	}
+	for _, item := range list.Items {
+		// pods on the host network share the IP of the node
+		if item.Spec.HostNetwork {
+			continue
+		}
+		pod := &kubePod{
+			name:      item.Metadata.Name,
+			namespace: item.Metadata.Namespace,
+			workload:  "Pod/" + item.Metadata.Name,
+			expires:   time.Now().Add(kubePodTTL),
+		}
+		for _, owner := range item.Metadata.OwnerReferences {
+			if !owner.Controller {
+				continue
+			}
+			pod.workload = owner.Kind + "/" + owner.Name
+			// ReplicaSets of Deployments are named <deployment>-<pod-template-hash>
+			if hash := item.Metadata.Labels["pod-template-hash"]; owner.Kind == "ReplicaSet" && strings.HasSuffix(owner.Name, "-"+hash) {
+				pod.workload = "Deployment/" + strings.TrimSuffix(owner.Name, "-"+hash)
+			}
+		}
+		return pod, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,132 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	math_rand "math/rand"
+	"strings"
+	"time"
+)
+
+// latencyDistribution is the artificial delay of forwards, to test how the
+// shadow behaves when the requests arrive late or spread out:
+//   - a duration like 200ms is a fixed delay
+//   - uniform:50ms-500ms is drawn uniformly between the two
+//   - normal:200ms,50ms is drawn from a normal distribution of that mean and
+//     standard deviation, negative draws being no delay
+//   - exponential:100ms is drawn from an exponential distribution of that
+//     mean, with a long tail
+type latencyDistribution struct {
+	spec string
+	kind string
+	a, b time.Duration
+}
+
+// parseLatencyDistribution parses the spec of a latency distribution.
+func parseLatencyDistribution(spec string) (*latencyDistribution, error) {
+	d := &latencyDistribution{spec: spec, kind: "fixed"}
+	params := spec
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		d.kind, params = spec[:i], spec[i+1:]
+	}
+	var values []string
+	switch d.kind {
+	case "fixed", "exponential":
+		values = []string{params}
+	case "uniform":
+		values = strings.SplitN(params, "-", 2)
+	case "normal":
+		values = strings.SplitN(params, ",", 2)
+	default:
+		return nil, fmt.Errorf("latency %s must be a duration, uniform:<min>-<max>, normal:<mean>,<stddev> or exponential:<mean>", spec)
+	}
+	var durations []time.Duration
+	for _, v := range values {
+		duration, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("latency %s has an invalid duration (%s)", spec, v)
+		}
+		durations = append(durations, duration)
+	}
+	if (d.kind == "uniform" || d.kind == "normal") && len(durations) != 2 {
+		return nil, fmt.Errorf("latency %s must have two durations", spec)
+	}
+	d.a = durations[0]
+	if len(durations) > 1 {
+		d.b = durations[1]
+	}
+	if d.kind == "uniform" && d.a > d.b {
+		return nil, fmt.Errorf("latency %s must have min <= max", spec)
+	}
+	return d, nil
+}
+
+// sample returns a delay of the distribution, at most limit.
+func (d *latencyDistribution) sample(limit time.Duration) time.Duration {
+	var delay float64
+	switch d.kind {
+	case "fixed":
+		delay = float64(d.a)
+	case "uniform":
+		delay = float64(d.a) + math_rand.Float64()*float64(d.b-d.a)
+	case "normal":
+		delay = math.Max(0, float64(d.a)+math_rand.NormFloat64()*float64(d.b))
+	case "exponential":
+		delay = math_rand.ExpFloat64() * float64(d.a)
+	}
+	if delay > float64(limit) {
+		return limit
+	}
+	return time.Duration(delay)
+}
+
+func (d *latencyDistribution) UnmarshalJSON(data []byte) error {
+	var spec string
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	parsed, err := parseLatencyDistribution(spec)
+	if err != nil {
+		return err
+	}
+	*d = *parsed
+	return nil
+}
+
+func (d *latencyDistribution) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.spec)
+}
+
+// injectLatency delays the forward of a request of rt: with the latency of the
+// route, or else of latency-injection, for the latency percentage of the
+// requests. It reports false if the forwards are cancelled meanwhile.
+func injectLatency(conf *configSnapshot, rt route) bool {
+	latency, percentage := conf.latency, conf.latencyPercentage
+	if rt.Latency != nil {
+		latency = rt.Latency
+		if rt.LatencyPercentage > 0 {
+			percentage = rt.LatencyPercentage
+		}
+	}
+	if latency == nil || math_rand.Float64()*100 >= percentage {
+		return true
+	}
+	delay := latency.sample(conf.latencyMax)
+	stats.inc("requests_delayed")
+	stats.observe("injected_latency_ms", delay.Milliseconds(), lagBuckets)
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-fwdCtx.Done():
+		return false
+	}
+}
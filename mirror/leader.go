@@ -0,0 +1,339 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// leaderSinkNames are the sinks that can be restricted to the leader, by the
+// name of their flag.
+var leaderSinkNames = []string{"diff-output", "scorecard-output", "fingerprint-report", "openapi-coverage-report", "flow-export"}
+
+// leaderLock is a lock held by one instance of the fleet at a time, for a
+// duration after it was last acquired.
+type leaderLock interface {
+	// acquire takes the lock, or extends it if identity holds it, and reports
+	// whether identity holds it.
+	acquire(ctx context.Context, identity string, duration time.Duration) (bool, error)
+	// release gives the lock up if identity holds it.
+	release(ctx context.Context, identity string) error
+}
+
+// leaderElection keeps the lock while the instance runs, so that the sinks of
+// leader-sinks are written by one instance of the fleet, while all of them
+// capture and forward.
+type leaderElection struct {
+	lock     leaderLock
+	identity string
+	duration time.Duration
+	sinks    map[string]bool
+	leading  int32
+	// renewed is when the last successful acquire started
+	renewed time.Time
+}
+
+var fwdLeader *leaderElection
+
+// newLeaderElection returns the election of kind on lock. The identity of the
+// instance is its hostname, the name of the pod in Kubernetes, and its PID.
+func newLeaderElection(kind, lock string, duration time.Duration, sinks string) (*leaderElection, error) {
+	e := &leaderElection{duration: duration, sinks: map[string]bool{}}
+	for _, s := range strings.Split(sinks, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		valid := false
+		for _, name := range leaderSinkNames {
+			valid = valid || s == name
+		}
+		if !valid {
+			return nil, fmt.Errorf("Flag leader-sinks contains an invalid sink (%s). Valid values are: %s.", s, strings.Join(leaderSinkNames, ", "))
+		}
+		e.sinks[s] = true
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	e.identity = hostname + "-" + strconv.Itoa(os.Getpid())
+	switch kind {
+	case "kubernetes":
+		e.lock, err = newKubeLeaseLock(lock)
+	case "dynamodb":
+		e.lock, err = newDynamoDBLock(lock)
+	default:
+		err = fmt.Errorf("Flag leader-election (%s) is not valid.", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// sinkEnabled reports whether the instance writes to sink: always without
+// leader election or when sink is not one of leader-sinks, else only while it
+// is the leader.
+func sinkEnabled(sink string) bool {
+	e := fwdLeader
+	return e == nil || !e.sinks[sink] || atomic.LoadInt32(&e.leading) == 1
+}
+
+// run acquires the lock every third of its duration. It never returns.
+func (e *leaderElection) run() {
+	stats.set("leader", 0)
+	for {
+		e.elect()
+		time.Sleep(e.duration / 3)
+	}
+}
+
+func (e *leaderElection) elect() {
+	ctx, cancel := context.WithTimeout(context.Background(), e.duration/3)
+	defer cancel()
+	start := time.Now()
+	leading, err := e.lock.acquire(ctx, e.identity, e.duration)
+	if err != nil {
+		stats.inc("leader_election_errors")
+		log.Println("Error acquiring the leader lock", ":", err)
+		// a leader that cannot renew the lock steps down before it expires, and
+		// another instance may take it over
+		leading = atomic.LoadInt32(&e.leading) == 1 && time.Since(e.renewed) < e.duration*2/3
+	} else if leading {
+		e.renewed = start
+	}
+	e.setLeading(leading)
+}
+
+func (e *leaderElection) setLeading(leading bool) {
+	value := int32(0)
+	if leading {
+		value = 1
+	}
+	if atomic.SwapInt32(&e.leading, value) == value {
+		return
+	}
+	stats.set("leader", int64(value))
+	stats.inc("leader_transitions")
+	if leading {
+		log.Println("Became the leader, as", e.identity)
+	} else {
+		log.Println("No longer the leader")
+	}
+}
+
+// resign releases the lock when the process ends, so that another instance
+// takes it over without waiting for it to expire.
+func (e *leaderElection) resign() {
+	if atomic.LoadInt32(&e.leading) == 0 {
+		return
+	}
+	e.setLeading(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.lock.release(ctx, e.identity); err != nil {
+		log.Println("Error releasing the leader lock", ":", err)
+	}
+}
+
+// kubeLeaseTimeFormat is the format of the MicroTime fields of a Lease.
+const kubeLeaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+type kubeLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// kubeLeaseLock is a coordination.k8s.io Lease, updated with the resource
+// version it was read at so that two instances cannot both take it.
+type kubeLeaseLock struct {
+	namespace, name string
+}
+
+// newKubeLeaseLock returns the lock of the Lease [namespace/]name, in the
+// namespace of the pod by default.
+func newKubeLeaseLock(lock string) (*kubeLeaseLock, error) {
+	l := &kubeLeaseLock{name: lock}
+	if i := strings.IndexByte(lock, '/'); i >= 0 {
+		l.namespace, l.name = lock[:i], lock[i+1:]
+	} else {
+		namespace, err := ioutil.ReadFile(kubeServiceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("Flag leader-lock has no namespace, and the namespace of the pod is unknown: %v", err)
+		}
+		l.namespace = strings.TrimSpace(string(namespace))
+	}
+	if l.namespace == "" || l.name == "" {
+		return nil, fmt.Errorf("Flag leader-lock (%s) must be like [namespace/]name.", lock)
+	}
+	return l, nil
+}
+
+func (l *kubeLeaseLock) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + l.namespace + "/leases/" + l.name
+}
+
+func (l *kubeLeaseLock) acquire(ctx context.Context, identity string, duration time.Duration) (bool, error) {
+	c, err := inClusterKubeClient()
+	if err != nil {
+		return false, err
+	}
+	var lease kubeLease
+	status, err := c.send(ctx, http.MethodGet, l.path(), nil, &lease)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name, lease.Metadata.Namespace = l.name, l.namespace
+	default:
+		return false, fmt.Errorf("GET %s: unexpected status %d", l.path(), status)
+	}
+
+	holder := lease.Spec.HolderIdentity
+	if holder != "" && holder != identity {
+		renewed, err := time.Parse(time.RFC3339, lease.Spec.RenewTime)
+		expires := renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+		if err == nil && now.Before(expires) {
+			return false, nil
+		}
+	}
+	if holder != identity {
+		lease.Spec.HolderIdentity = identity
+		lease.Spec.AcquireTime = now.UTC().Format(kubeLeaseTimeFormat)
+		if holder != "" {
+			lease.Spec.LeaseTransitions++
+		}
+	}
+	lease.Spec.LeaseDurationSeconds = int((duration + time.Second - 1) / time.Second)
+	lease.Spec.RenewTime = now.UTC().Format(kubeLeaseTimeFormat)
+
+	method, path := http.MethodPut, l.path()
+	if status == http.StatusNotFound {
+		method, path = http.MethodPost, path[:strings.LastIndexByte(path, '/')]
+	}
+	status, err = c.send(ctx, method, path, lease, nil)
+	switch {
+	case err != nil:
+		return false, err
+	case status == http.StatusOK || status == http.StatusCreated:
+		return true, nil
+	case status == http.StatusConflict:
+		// another instance updated or created the Lease since it was read
+		return false, nil
+	}
+	return false, fmt.Errorf("%s %s: unexpected status %d", method, path, status)
+}
+
+func (l *kubeLeaseLock) release(ctx context.Context, identity string) error {
+	c, err := inClusterKubeClient()
+	if err != nil {
+		return err
+	}
+	var lease kubeLease
+	if err := c.get(ctx, l.path(), &lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != identity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	status, err := c.send(ctx, http.MethodPut, l.path(), lease, nil)
+	if err == nil && status != http.StatusOK && status != http.StatusConflict {
+		err = fmt.Errorf("PUT %s: unexpected status %d", l.path(), status)
+	}
+	return err
+}
+
+// dynamoDBLock is an item of a DynamoDB table with a string partition key
+// named id, written with a condition that it is free, expired or held by the
+// instance already. The expiry is the expires attribute, in Unix milliseconds.
+type dynamoDBLock struct {
+	table, name string
+	client      *dynamodb.Client
+}
+
+// newDynamoDBLock returns the lock of the item name of table, given as
+// table/name.
+func newDynamoDBLock(lock string) (*dynamoDBLock, error) {
+	parts := strings.SplitN(lock, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Flag leader-lock (%s) must be like table/name.", lock)
+	}
+	cfg, err := awsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &dynamoDBLock{table: parts[0], name: parts[1], client: dynamodb.NewFromConfig(cfg)}, nil
+}
+
+func (l *dynamoDBLock) acquire(ctx context.Context, identity string, duration time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := l.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.table),
+		Item: map[string]types.AttributeValue{
+			"id":      &types.AttributeValueMemberS{Value: l.name},
+			"holder":  &types.AttributeValueMemberS{Value: identity},
+			"expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(duration).UnixNano()/int64(time.Millisecond), 10)},
+		},
+		// the names of the attributes may be reserved words of the expressions
+		ConditionExpression:      aws.String("attribute_not_exists(#id) OR #holder = :identity OR #expires < :now"),
+		ExpressionAttributeNames: map[string]string{"#id": "id", "#holder": "holder", "#expires": "expires"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":identity": &types.AttributeValueMemberS{Value: identity},
+			":now":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)},
+		},
+	})
+	var held *types.ConditionalCheckFailedException
+	if errors.As(err, &held) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *dynamoDBLock) release(ctx context.Context, identity string) error {
+	_, err := l.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(l.table),
+		Key:                      map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: l.name}},
+		ConditionExpression:      aws.String("#holder = :identity"),
+		ExpressionAttributeNames: map[string]string{"#holder": "holder"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":identity": &types.AttributeValueMemberS{Value: identity},
+		},
+	})
+	var held *types.ConditionalCheckFailedException
+	if errors.As(err, &held) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// destinationLimiter caps the number of in-flight forwarded requests per
+// destination host, so that a small target can't be overwhelmed while others
+// still receive full traffic.
+type destinationLimiter struct {
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+var fwdLimiter = &destinationLimiter{sems: map[string]chan struct{}{}}
+
+// tryAcquire takes a slot for host, allowing at most limit requests in flight.
+// It reports false, without blocking, if all slots are taken. On success, the
+// returned function must be called when the request is done.
+func (l *destinationLimiter) tryAcquire(host string, limit int) (func(), bool) {
+	if limit <= 0 {
+		return func() {}, true
+	}
+	// the limit is part of the key, so that changing it takes effect immediately
+	key := fmt.Sprintf("%s/%d", host, limit)
+	l.mu.Lock()
+	sem, ok := l.sems[key]
+	if !ok {
+		sem = make(chan struct{}, limit)
+		l.sems[key] = sem
+	}
+	l.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true
+	default:
+		return nil, false
+	}
+}
+
+// byteRateLimiter is a token bucket of bytes per second, which shapes forwarded
+// bodies so that bursts of large uploads don't saturate the network.
+type byteRateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newByteRateLimiter allows rate bytes per second, with bursts of up to one second.
+func newByteRateLimiter(rate int64) *byteRateLimiter {
+	return &byteRateLimiter{rate: float64(rate), burst: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller must
+// wait before sending them. If the wait would be longer than maxWait, nothing is
+// taken and false is returned.
+func (l *byteRateLimiter) reserve(n int, maxWait time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	// the bucket may go negative, so that bodies larger than the burst can pass
+	wait := time.Duration(0)
+	if remaining := l.tokens - float64(n); remaining < 0 {
+		wait = time.Duration(-remaining / l.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+	l.tokens -= float64(n)
+	return wait, true
+}
@@ -0,0 +1,1803 @@
+// Original Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+)
+
+// flags are the flags of the command, and the configuration of an embedded
+// Mirror. They are not registered on flag.CommandLine, so that they do not
+// clash with the flags of the program embedding the mirror.
+var flags = flag.NewFlagSet("http-requests-mirroring", flag.ExitOnError)
+
+var cpuProfile = flags.String("cpuprofile", "", "Where to write CPU profile")
+var routeTableJson = flags.String("route-table-json", "", "Map of source ip and destination ip.")
+var fwdPerc = flags.Float64("percentage", 100, "Must be between 0 and 100.")
+var fwdBy = flags.String("percentage-by", "", "Can be empty. Otherwise, valid values are: header, remoteaddr, cookie:<name>, jwt-claim:<claim>.")
+var fwdHeader = flags.String("percentage-by-header", "", "If percentage-by is header, then specify the header here.")
+var fwdSalt = flags.String("percentage-salt", "", "Can be empty. Otherwise, salt of the percentage-by hash, so that deployments with different salts pick different cohorts.")
+var reqPort = flags.Int("filter-request-port", 80, "Must be between 0 and 65535.")
+var snaplen = flags.Int("snaplen", 8951, "Maximum number of bytes captured per packet. Must be at least the MTU of the interface, e.g. 9001 for jumbo frames.")
+var captureOpenRetry = flags.Duration("capture-open-retry", 0, "Can be empty. Otherwise, how long to retry opening the capture, e.g. until the interface of the mirror session appears.")
+var captureReopen = flags.Bool("capture-reopen", true, "Whether to reopen the capture when reading fails, e.g. when the interface is deleted and created again, rather than exit.")
+var bufferSize = flags.Int("pcap-buffer-size", 0, "Size of the pcap buffer in bytes. 0 means the libpcap default.")
+var immediateMode = flags.Bool("pcap-immediate-mode", false, "Whether packets are delivered as soon as they are captured, instead of in batches.")
+var promisc = flags.Bool("promisc", true, "Whether the interface is put into promiscuous mode.")
+var captureDropInterval = flags.Duration("capture-drop-interval", 10*time.Second, "How often the packets dropped by the kernel or the interface before capture are polled, logged and counted. 0 disables it.")
+var captureDropAdapt = flags.String("capture-drop-adapt", "", "Can be empty. Otherwise, how the pcap capture is adapted when more than capture-drop-threshold of the packets of an interval were dropped. Valid values are: buffer (double the buffer size), snaplen (halve the snaplen), both (the buffer size, then the snaplen).")
+var captureDropThreshold = flags.Float64("capture-drop-threshold", 0.001, "Fraction of the packets of an interval dropped before capture above which capture-drop-adapt adapts the capture.")
+var captureMaxBufferSize = flags.Int("capture-max-buffer-size", 256<<20, "Size in bytes up to which capture-drop-adapt grows the pcap buffer.")
+var captureMinSnaplen = flags.Int("capture-min-snaplen", 1600, "Snaplen down to which capture-drop-adapt reduces the snaplen. Longer packets are truncated, which breaks their requests.")
+var filterPorts = flags.String("filter-ports", "", "Can be empty. Otherwise, comma separated ports and port ranges (8000-8100) captured in addition to filter-request-port.")
+var filterMode = flags.String("filter-mode", "dst", "Which packets of the captured ports are read. Valid values are: dst (sent to the ports), src (sent from the ports, for mirror sessions with swapped orientation), either.")
+var filterSourceCIDRs = flags.String("filter-source-cidrs", "", "Can be empty. Otherwise, comma separated CIDRs or IPs of the clients whose requests are captured.")
+var filterExcludeSourceCIDRs = flags.String("filter-exclude-source-cidrs", "", "Can be empty. Otherwise, comma separated CIDRs or IPs of the clients whose requests are not captured, e.g. health checkers.")
+var filterDestinationCIDRs = flags.String("filter-destination-cidrs", "", "Can be empty. Otherwise, comma separated CIDRs or IPs of the servers whose requests are captured.")
+var filterVLAN = flags.Bool("filter-vlan", false, "Whether captured packets may be VLAN tagged, with a single tag or two (QinQ).")
+var filterVLANIDs = flags.String("filter-vlan-ids", "", "Can be empty. Otherwise, comma separated VLAN IDs of the outer tag of the captured packets. Requires filter-vlan.")
+var filterEncap = flags.String("filter-encapsulation", "", "Can be empty. Otherwise, encapsulation of the captured packets. Valid values are: vxlan, geneve.")
+var xdpFilterEnabled = flags.Bool("xdp-filter", false, "Whether an XDP program drops the packets the filter flags do not capture before the kernel processes them, Linux only. The interface must be dedicated to the mirror.")
+var xdpObject = flags.String("xdp-object", "xdp_filter.o", "Path of the compiled XDP program of xdp-filter, see bpf/xdp_filter.c.")
+var xdpMode = flags.String("xdp-mode", "generic", "How the XDP program of xdp-filter is attached. Valid values are: generic (any interface, e.g. vxlan), native (in the driver, on supported NICs).")
+var multipartFiles = flags.String("multipart-files", "keep", "What happens to the file parts of multipart/form-data requests. Valid values are: keep, drop, truncate (to multipart-file-max-bytes).")
+var multipartFileMaxBytes = flags.Int64("multipart-file-max-bytes", 1024, "With multipart-files truncate, size file parts are truncated to.")
+var stripTrailers = flags.Bool("strip-trailers", false, "Whether the trailers of chunked requests are dropped rather than forwarded. Routes can also drop them with strip_trailers.")
+var maxHeaderBytes = flags.Int("max-header-bytes", 1<<20, "Maximum size of the head of a captured request, approximately like the MaxHeaderBytes of net/http servers. Larger requests are rejected.")
+var maxURILength = flags.Int("max-uri-length", 65536, "Maximum length of the URI of a captured request, 0 for no limit. Longer requests are rejected.")
+var maxHeaderCount = flags.Int("max-header-count", 1000, "Maximum number of header fields of a captured request, 0 for no limit. Requests with more fields are rejected.")
+var quarantineFile = flags.String("quarantine-output", "", "Can be empty. Otherwise, file the malformed and rejected requests are appended to, with the raw bytes of their stream, as JSON lines.")
+var quarantineMaxBytes = flags.Int("quarantine-max-bytes", 65536, "Maximum number of raw bytes of the stream kept for each request of quarantine-output.")
+var quarantineMaxSize = flags.Int64("quarantine-max-size", 100<<20, "Size in bytes at which quarantine-output stops growing. The requests rejected after are only counted.")
+var dedupRetransmissions = flags.Bool("dedup-retransmissions", false, "Whether TCP data already seen in a flow is dropped before reassembly, so that retransmissions after a stream is closed are not parsed as new requests.")
+var dedupWindow = flags.Duration("dedup-window", 2*time.Minute, "With dedup-retransmissions, how long a flow is remembered after its last packet.")
+var decapMaxDepth = flags.Int("decap-max-depth", 4, "Maximum number of encapsulations (VXLAN, Geneve, GRE, MPLS, IP in IP) stripped from captured packets.")
+var captureCPU = flags.Int("capture-cpu", -1, "CPU the thread of the capture loop is pinned to, Linux only, so that it does not share its caches with the forwarding workers. -1 leaves it to the scheduler.")
+var workerCPUs = flags.String("worker-cpus", "", "Can be empty. Otherwise, comma separated CPUs and CPU ranges (2-7) the other threads of the process, which parse and forward the requests, run on, Linux only.")
+var gomaxprocs = flags.String("gomaxprocs", "", "Can be empty to keep the default of the Go runtime. Otherwise, GOMAXPROCS, or auto for the CPU quota of the container, bounded by worker-cpus and capture-cpu.")
+var gogc = flags.String("gogc", "", "Can be empty to keep GOGC or the default of the Go runtime. Otherwise, the GC percent, or off to collect only at memory-limit.")
+var memoryLimit = flags.Int64("memory-limit", 0, "Can be empty to keep GOMEMLIMIT. Otherwise, soft limit in bytes of the memory of the Go runtime, above which the GC runs more often.")
+var memoryBallastSize = flags.Int64("memory-ballast", 0, "Can be empty. Otherwise, size in bytes of a heap ballast, allocated but never used, which makes the GC run less often at the cost of virtual memory.")
+var vxlanPorts = flags.String("vxlan-ports", "", "Can be empty. Otherwise, comma separated UDP ports decoded as VXLAN in addition to 4789, e.g. 8472.")
+var bpfExpr = flags.String("bpf-filter", "", "Can be empty. Otherwise, BPF filter expression used instead of the one generated from the filter flags.")
+var scriptFile = flags.String("script", "", "Can be empty. Otherwise, path to a Lua script run for every request before forwarding.")
+var scriptTimeout = flags.Duration("script-timeout", 100*time.Millisecond, "How long the script may run for a request before it is stopped and the request is dropped.")
+var wasmPlugins = flags.String("wasm-plugins", "", "Can be empty. Otherwise, comma separated paths of WebAssembly plugins run for every request before forwarding.")
+var wasmPluginTimeout = flags.Duration("wasm-plugin-timeout", 100*time.Millisecond, "How long a plugin may run for a request before it is stopped and the request is dropped.")
+var routeSource = flags.String("route-table-source", "", "Can be empty. Otherwise, consul://host:port/prefix or etcd://host:port/key to load and watch the route table from.")
+var adminAddr = flags.String("admin-addr", "", "Can be empty. Otherwise, address the admin API listens on, e.g. 127.0.0.1:9090.")
+var pauseModeFlag = flags.String("pause-mode", "count", "What SIGUSR1 does while paused. Valid values are: count (keep capturing and counting requests), drop (discard packets).")
+var drainTimeout = flags.Duration("drain-timeout", 30*time.Second, "How long a drain (on SIGTERM or through the admin API) waits for in-flight forwards.")
+var dryRun = flags.Bool("dry-run", false, "Run the full pipeline but only log the requests that would be forwarded.")
+var dryRunFile = flags.String("dry-run-output", "", "Can be empty. Otherwise, file the dry run appends the requests that would be forwarded to, as JSON lines.")
+var amplify = flags.Int("amplify", 1, "Number of times each sampled request is forwarded, to load the destination above production traffic.")
+var amplifyJitter = flags.Duration("amplify-jitter", 0, "With amplify, maximum random delay of the copies of a request.")
+var stubMode = flags.Bool("stub", false, "Run the full pipeline but answer the requests with a synthetic response instead of forwarding them.")
+var stubStatus = flags.Int("stub-status", http.StatusOK, "Status code of the synthetic responses of the stub mode.")
+var stubBody = flags.String("stub-body", "", "Body of the synthetic responses of the stub mode.")
+var stubLatency = flags.Duration("stub-latency", 0, "Latency of the synthetic responses of the stub mode.")
+var stubFile = flags.String("stub-output", "", "Can be empty. Otherwise, file the stub mode appends the requests that would be sent to, with their bodies, as JSON lines.")
+var iface = flags.String("interface", "vxlan0", "Interface packets are captured on.")
+var captureEngine = flags.String("capture-engine", "pcap", "How requests are captured. Valid values are: pcap (packets of the interface), pfring (packets of the interface with PF_RING, in builds with the pfring tag), uds (data written to Unix domain sockets, with eBPF, Linux only), tls (plaintext of TLS connections, with eBPF uprobes, Linux only), http (requests sent to listen-addr by a mirroring proxy).")
+var listenAddr = flags.String("listen-addr", "", "Can be empty. Otherwise, with capture-engine http, address the mirrored requests are received on, e.g. :8080.")
+var listenSourceIPHeader = flags.String("listen-source-ip-header", "", "Can be empty. Otherwise, with capture-engine http, header of the client IP set by the proxy, e.g. X-Forwarded-For.")
+var listenHostSuffix = flags.String("listen-host-suffix", "-shadow", "Can be empty. Otherwise, with capture-engine http, suffix removed from the host name of the requests, added by proxies like Envoy.")
+var pfringQueues = flags.Int("pfring-queues", 0, "Number of receive queues of the interface the pfring engine opens a ring for. 0 means a single ring for the whole interface.")
+var pfringZC = flags.Bool("pfring-zc", false, "Whether the pfring engine opens the interface in zero copy (ZC) mode, with the hugepages configured for the ZC driver.")
+var udsPaths = flags.String("uds-paths", "", "Can be empty. Otherwise, comma separated paths of the Unix domain sockets the uds capture engine captures the requests to.")
+var ebpfObject = flags.String("ebpf-object", "uds_capture.o", "Path of the compiled eBPF program of the uds capture engine, see bpf/uds_capture.c.")
+var tlsKeyLog = flags.String("tls-keylog", "", "Can be empty. Otherwise, NSS key log file (SSLKEYLOGFILE) of the TLS sessions of the captured connections, read as it is appended to, to decrypt them.")
+var tlsKeyLogWait = flags.Duration("tls-keylog-wait", 5*time.Second, "How long the decryption of a TLS connection waits for its secrets to be appended to tls-keylog, and for its server hello.")
+var quicPorts = flags.String("quic-ports", "", "Can be empty. Otherwise, comma separated UDP ports and port ranges of QUIC traffic, whose packets and connections are counted, and whose HTTP/3 requests are captured with tls-keylog.")
+var flowExport = flags.String("flow-export", "", "Can be empty. Otherwise, host:port of the collector the captured flows are exported to over UDP.")
+var flowExportFormat = flags.String("flow-export-format", "ipfix", "Format of the flows of flow-export. Valid values are: ipfix, json (a JSON document per datagram).")
+var flowExportPEN = flags.Uint64("flow-export-pen", 0, "Can be 0. Otherwise, IANA private enterprise number of the request counts of the IPFIX flows, which are left out without it.")
+var flowIdleTimeout = flags.Duration("flow-idle-timeout", 15*time.Second, "How long a flow without packets lasts before it is exported.")
+var flowActiveTimeout = flags.Duration("flow-active-timeout", time.Minute, "How long a flow lasts before it is exported, going on with new counts.")
+var tlsTargets = flags.String("tls-targets", "", "Can be empty. Otherwise, comma separated paths of the OpenSSL libraries (libssl.so) and Go binaries whose TLS connections the tls capture engine captures.")
+var tlsPID = flags.Int("tls-pid", 0, "Can be 0. Otherwise, the process whose TLS connections the tls capture engine captures, rather than every process using tls-targets.")
+var tlsSide = flags.String("tls-side", "server", "Which data of the TLS connections the tls capture engine captures: server (the data read, i.e. the requests received by the processes) or client (the data written, i.e. the requests they send).")
+var tlsEBPFObject = flags.String("tls-ebpf-object", "tls_capture.o", "Path of the compiled eBPF program of the tls capture engine, see bpf/tls_capture.c.")
+var pipelineName = flags.String("pipeline", "", "Can be empty. Otherwise, name of the pipeline of the config file to run. Set by the capture command for each pipeline.")
+var configFile = flags.String("config", "", "Can be empty. Otherwise, path to a JSON file of flag values. Flags given on the command line take precedence.")
+var recordFile = flags.String("record", "", "Can be empty. Otherwise, archive file captured requests are appended to, for the replay command. Archives named .zst are compressed with zstd.")
+var archiveEncryption = flags.String("archive-encryption", "", "Can be empty. Otherwise, how archives are encrypted: local (with the key of archive-key-file) or kms (with data keys of archive-kms-key-id).")
+var archiveKeyFile = flags.String("archive-key-file", "", "File of the local keys of encrypted archives, one base64 encoded 32 bytes key per line, the first one encrypting.")
+var archiveKMSKeyID = flags.String("archive-kms-key-id", "", "With archive-encryption kms, ID, ARN or alias of the KMS key that encrypts the data keys of archives.")
+var archiveKeyRotation = flags.Duration("archive-key-rotation", 24*time.Hour, "How often the data key of encrypted archives is replaced, 0 to keep it until the capture restarts.")
+var recordMaxDiskUsage = flags.Int64("record-max-disk-usage", 0, "Maximum size in bytes of the record archive and its rotated archives. 0 means no limit.")
+var recordMaxAge = flags.Duration("record-max-age", 0, "Age at which rotated record archives are deleted. 0 means they are kept.")
+var recordRetention = flags.String("record-retention", "rotate", "What happens when the archives exceed record-max-disk-usage. Valid values are: rotate (the oldest archives are deleted), stop (recording stops, with an alert).")
+var recordRotateInterval = flags.Duration("record-rotate-interval", time.Hour, "With record-max-disk-usage or record-max-age, how often the record archive is rotated to a new one.")
+var recordFrameRecords = flags.Int("record-frame-records", 1000, "Number of requests of each zstd frame of compressed archives, which replays can start at.")
+var replayArchive = flags.String("archive", "", "Archive file the replay command reads requests from.")
+var accessLog = flags.String("access-log", "", "Access logs the replay command reads requests from instead of an archive: a file (gzip compressed if named .gz), s3://bucket/prefix or kinesis://stream.")
+var accessLogFormat = flags.String("access-log-format", "alb", "Format of the access logs of access-log: alb, cloudfront or nginx-json.")
+var accessLogKinesisStart = flags.String("access-log-kinesis-start", "latest", "Where the shards of a Kinesis access-log are read from: latest or trim-horizon.")
+var replayConcurrency = flags.Int("replay-concurrency", 16, "Maximum number of requests the replay command forwards at the same time.")
+var replayOrdering = flags.String("replay-ordering", "parallel", "How the replay command orders the requests: parallel (up to replay-concurrency at a time) or strict (one after the other, in the order of the archive).")
+var replayFromSequence = flags.Uint64("replay-from-sequence", 0, "Can be 0. Otherwise, sequence of the first request of the archive the replay command forwards.")
+var replayFromTime = flags.String("replay-from-time", "", "Can be empty. Otherwise, RFC 3339 time the replay command forwards the requests of the archive captured from.")
+var replayCheckpointFile = flags.String("replay-checkpoint", "", "Can be empty. Otherwise, file the replay command saves its progress to, for -resume.")
+var replayCheckpointInterval = flags.Duration("replay-checkpoint-interval", 10*time.Second, "How often the replay command saves its progress to replay-checkpoint.")
+var replayResume = flags.Bool("resume", false, "Whether the replay command goes on from the progress saved in replay-checkpoint, skipping the requests already forwarded.")
+var benchRequests = flags.Int("bench-requests", 10000, "Number of synthetic requests sent by the bench command.")
+var benchConcurrency = flags.Int("bench-concurrency", 64, "Maximum number of synthetic requests the bench command forwards at the same time.")
+var benchLive = flags.Bool("bench-live", false, "Whether the bench command forwards to the route table destinations instead of a local server.")
+var benchMode = flags.String("bench-mode", "requests", "What the bench command generates: requests, handed to the forwarding pipeline, or packets of TCP connections, which also go through the TCP assembly and the HTTP parsing.")
+var benchConnections = flags.Int("bench-connections", 100, "Number of synthetic TCP connections the requests are spread over with bench-mode packets.")
+var benchBodyBytes = flags.Int("bench-body-bytes", 0, "Size of the bodies of the synthetic requests, sent as POST requests when positive.")
+var benchOutput = flags.String("bench-output", "", "File the bench command writes its results to, as JSON, for comparisons between runs.")
+var fwdHeaders = flags.String("forwarded-headers", "append", "How forwarding headers are set. Valid values are: append, overwrite, omit.")
+var fwdRFC7239 = flags.Bool("forwarded-header-rfc7239", false, "Whether to also set the standard Forwarded header (RFC 7239).")
+var fwdBy7239 = flags.String("forwarded-by", "", "Can be empty. Otherwise, the by= parameter of the Forwarded header.")
+var mirrorHeaders = flags.Bool("mirror-headers", false, "Whether to add X-Mirror-Source-Port, X-Mirror-Capture-Time, X-Mirror-Connection-ID and X-Mirror-Request-Id headers.")
+var traceContext = flags.String("trace-context", "propagate", "How the W3C traceparent and tracestate headers are forwarded. Valid values are: propagate (unchanged), reparent (new span ID in the same trace), strip.")
+var traceSynthesize = flags.Bool("trace-context-synthesize", false, "Whether to start a new trace for requests without a valid traceparent header.")
+var pacing = flags.Bool("pacing", false, "Whether to forward requests at the pace they were captured, rather than as soon as they are parsed.")
+var pacingSpeedup = flags.Float64("pacing-speedup", 1, "With pacing, how much faster than captured requests are forwarded, e.g. 2 halves the intervals.")
+var pacingDelay = flags.Duration("pacing-delay", time.Second, "With pacing, how long after their capture requests are forwarded (divided by the speedup for the following requests).")
+var latencyInjection = flags.String("latency-injection", "", "Can be empty. Otherwise, artificial delay of the forwards: a duration like 200ms, uniform:<min>-<max>, normal:<mean>,<stddev> or exponential:<mean>.")
+var latencyPercentage = flags.Float64("latency-percentage", 100, "Percentage of the requests delayed by latency-injection or the latency of their route.")
+var latencyMax = flags.Duration("latency-max", 10*time.Second, "Maximum delay drawn from the latency distributions.")
+var injectFaults = flags.String("inject-faults", "", "Can be empty. Otherwise, comma separated faults injected into fault-percentage of the forwards: drop-header:<name>, truncate-body, content-type:<value>.")
+var faultPercentage = flags.Float64("fault-percentage", 1, "Percentage of the forwards corrupted with one of the inject-faults.")
+var faultHeader = flags.String("fault-header", "", "Can be empty. Otherwise, header set to the fault injected into a forward, e.g. X-Mirror-Fault.")
+var fleetDedup = flags.String("fleet-dedup", "", "Can be empty. Otherwise, how the instances of a fleet make sure a request seen by several of them is forwarded once. Valid values are: redis (claims in the Redis of fleet-dedup-redis), gossip (announcements to fleet-dedup-peers over UDP).")
+var fleetDedupBy = flags.String("fleet-dedup-by", "request", "What identifies the copies of a request across instances. Valid values are: request (the TCP sequence number its connection starts at, its position in the connection, method, host, URI, headers and body), flow (its connection tuple and position in the connection).")
+var fleetDedupWindow = flags.Duration("fleet-dedup-window", 2*time.Second, "How long a request forwarded by an instance is a duplicate for the others.")
+var fleetDedupRedis = flags.String("fleet-dedup-redis", "", "With the redis fleet-dedup, URL of the Redis, like redis://[:password@]host:port[/db].")
+var fleetDedupTimeout = flags.Duration("fleet-dedup-timeout", 50*time.Millisecond, "With the redis fleet-dedup, how long a claim waits for Redis before the request is forwarded anyway.")
+var fleetDedupListen = flags.String("fleet-dedup-listen", ":7946", "With the gossip fleet-dedup, UDP address the announcements of the peers are received on.")
+var fleetDedupPeers = flags.String("fleet-dedup-peers", "", "With the gossip fleet-dedup, comma separated host:port of the peers, a host resolving to all of them, like a headless service, being enough.")
+var fleetDedupDelay = flags.Duration("fleet-dedup-delay", 20*time.Millisecond, "With the gossip fleet-dedup, how long a request waits for the announcements of the peers before it is forwarded.")
+var leaderElectionKind = flags.String("leader-election", "", "Can be empty. Otherwise, how the instances of a fleet elect the one that writes the sinks of leader-sinks, all of them capturing and forwarding. Valid values are: kubernetes (a Lease), dynamodb (an item of a DynamoDB table).")
+var leaderLockName = flags.String("leader-lock", "", "With leader-election kubernetes, [namespace/]name of the Lease, in the namespace of the pod by default. With dynamodb, table/name of the lock item, the table having a string partition key named id.")
+var leaderLeaseDuration = flags.Duration("leader-lease-duration", 15*time.Second, "With leader-election, how long the lock is held after it was last renewed, every third of it.")
+var leaderSinks = flags.String("leader-sinks", "diff-output", "With leader-election, comma separated sinks only the leader writes. Valid values are: diff-output, scorecard-output, fingerprint-report, openapi-coverage-report, flow-export.")
+var shard = flags.String("shard", "", "Can be empty. Otherwise, comma separated buckets and ranges of buckets, like 0-32767, of the 65536 buckets the connections are hashed to: only the connections of these buckets are forwarded, so that instances seeing the same traffic with shards partitioning the buckets forward it once.")
+var smoothingWindow = flags.Duration("smoothing-window", 0, "Can be empty. Otherwise, each forward is delayed by a random duration up to this window, which spreads bursts of requests.")
+var fwdTimeout = flags.Duration("forward-timeout", 30*time.Second, "Timeout of forwarded requests, unless the route sets its own. 0 means no timeout.")
+var maxInFlightPerDest = flags.Int("max-in-flight-per-destination", 0, "Maximum number of in-flight forwarded requests per destination host, unless the route sets its own. 0 means no limit.")
+var scheduleSpec = flags.String("schedule", "", "Can be empty. Otherwise, weekly windows forwarding is enabled in, like: Mon-Fri 09:00-18:00; Sat 10:00-12:00.")
+var scheduleFrom = flags.String("schedule-from", "", "Can be empty. Otherwise, RFC 3339 timestamp forwarding is enabled from.")
+var scheduleUntil = flags.String("schedule-until", "", "Can be empty. Otherwise, RFC 3339 timestamp forwarding is enabled until.")
+var scheduleTZ = flags.String("schedule-timezone", "", "Can be empty (local time). Otherwise, IANA time zone of the schedule windows, e.g. Europe/Paris.")
+var maxBytesPerSec = flags.Int64("max-forward-bytes-per-second", 0, "Maximum bandwidth of forwarded bodies in bytes per second. 0 means no limit.")
+var maxShapingDelay = flags.Duration("max-shaping-delay", time.Second, "How long a request may wait for the bandwidth limit before it is dropped.")
+var geoDatabase = flags.String("geoip-database", "", "Can be empty. Otherwise, path to a MaxMind GeoLite2 Country or City database to look up source IPs in.")
+var geoCountries = flags.String("geoip-countries", "", "Can be empty (all countries). Otherwise, comma separated ISO codes of the countries whose requests are forwarded. EU stands for the European Union.")
+var geoHeader = flags.Bool("geoip-header", false, "Whether to add the X-Mirror-Geo header with the country of the source IP.")
+var contentTypeInclude = flags.String("content-type-include", "", "Can be empty. Otherwise, comma separated media types of forwarded requests, wildcards like application/* allowed.")
+var contentTypeExclude = flags.String("content-type-exclude", "", "Can be empty. Otherwise, comma separated media types of requests that are not forwarded, e.g. multipart/form-data.")
+var bodyRulesFile = flags.String("body-rules", "", "Can be empty. Otherwise, path to a JSON file of rules on request bodies (JSON field values, regular expressions).")
+var bodyRulesMaxBytes = flags.Int("body-rules-max-bytes", 64*1024, "Maximum number of bytes of a body inspected by the body rules.")
+var clientCertSubjectHeader = flags.String("client-cert-subject-header", "X-Mirror-Client-Cert-Subject", "Can be empty. Otherwise, header set to the subject of the client certificate of decrypted TLS connections.")
+var clientCertSANHeader = flags.String("client-cert-san-header", "X-Mirror-Client-Cert-SAN", "Can be empty. Otherwise, header set to the subject alternative names of the client certificate of decrypted TLS connections.")
+var idempotencyKeyHeader = flags.String("idempotency-key-header", "", "Can be empty. Otherwise, header set to the mirror request ID on requests other than GET, HEAD, OPTIONS and TRACE, like Idempotency-Key.")
+var setBodyFieldsList = flags.String("set-body-fields", "", "Can be empty. Otherwise, comma separated list of fields set in JSON bodies, like dry_run=true,meta.source=mirror.")
+var decodeBodies = flags.String("decode-bodies", "off", "Decoding of gzip, deflate and br encoded bodies for the body rules, routes and hooks. Valid values are: off, inspect (forwarded encoded), decoded (forwarded decoded).")
+var decodeMaxBytes = flags.Int("decode-max-bytes", 10*1024*1024, "Maximum size of a decoded body. Larger bodies are inspected and forwarded encoded.")
+var ecsClusters = flags.String("ecs-clusters", "", "Can be empty. Otherwise, comma separated ECS clusters whose tasks source IPs are attributed to, in X-Mirror-Source-* headers.")
+var kubeAttribution = flags.Bool("kube-attribution", false, "Whether to attribute source IPs to Kubernetes pods, in X-Mirror-Source-* headers and workload metrics.")
+var ecsRefresh = flags.Duration("ecs-refresh-interval", time.Minute, "How often the tasks of the ecs-clusters are listed.")
+var sourceNames = flags.String("source-names", "", "Can be empty. Otherwise, how the source IPs of captured requests are resolved to names, for the dry run and stub outputs, source name metrics and source-name-header. Valid values are: rdns (reverse DNS), ec2 (the EC2 network interfaces of the IPs).")
+var sourceNameHeader = flags.String("source-name-header", "", "Can be empty. Otherwise, with source-names, header of forwarded requests set to the name of their source IP, e.g. X-Mirror-Source-Name.")
+var sourceNameTimeout = flags.Duration("source-name-timeout", 200*time.Millisecond, "How long a request waits for the name of its source IP before being forwarded without it, the lookup going on for the next requests.")
+var sourceNameTTL = flags.Duration("source-name-ttl", 10*time.Minute, "How long the names of source IPs, and failed lookups, are cached.")
+var sourceNameCacheSize = flags.Int("source-name-cache-size", 10000, "Maximum number of source IPs whose names are cached, the least recently used being evicted first.")
+var routeRefresh = flags.Duration("route-refresh-interval", 30*time.Second, "How often srv:// and cloudmap:// destinations of the route table are resolved at least, and sooner once the TTL of their records expires.")
+var assertionsFile = flags.String("assertions", "", "Can be empty. Otherwise, path to a JSON file of assertions on the responses of the destinations, which alert when they fail.")
+var alertWebhook = flags.String("alert-webhook", "", "Can be empty. Otherwise, URL the alerts are posted to as JSON.")
+var alertSNSTopic = flags.String("alert-sns-topic", "", "Can be empty. Otherwise, ARN of the SNS topic the alerts are published to.")
+var alertWebhookFormat = flags.String("alert-webhook-format", "json", "Payload of the alert-webhook: json (the alert event) or slack (a Slack compatible message).")
+var anomalies = flags.Bool("anomalies", false, "Whether to alert on anomalies of the pipeline: sustained packet drops, forward errors, idle routes and route volume changes.")
+var anomalyInterval = flags.Duration("anomaly-interval", time.Minute, "How often the anomalies are evaluated.")
+var anomalyWindows = flags.Int("anomaly-windows", 3, "Number of consecutive intervals an anomaly must last before it alerts.")
+var anomalyDropRate = flags.Float64("anomaly-drop-rate", 0.01, "Fraction of packets dropped before capture above which an interval is anomalous.")
+var anomalyErrorRate = flags.Float64("anomaly-error-rate", 0.1, "Fraction of failed forwards above which an interval is anomalous.")
+var anomalyMirrorLag = flags.Duration("anomaly-mirror-lag", 0, "Can be empty. Otherwise, with anomalies, mirror lag above which an interval is anomalous.")
+var maxClockSkew = flags.Duration("max-clock-skew", 10*time.Second, "Maximum difference between the capture timestamp of a packet and the time it is read, above which the timestamp is from another clock and is replaced.")
+var guardrailMaxErrorRate = flags.Float64("guardrail-max-error-rate", 0, "Can be empty. Otherwise, rate of 5xx responses and failed forwards over the guardrail window above which forwarding is paused, e.g. 0.1.")
+var guardrailMaxP99 = flags.Duration("guardrail-max-p99", 0, "Can be empty. Otherwise, p99 latency of the destination over the guardrail window above which forwarding is paused.")
+var guardrailWindow = flags.Duration("guardrail-window", 5*time.Minute, "Window of the guardrail error rate and p99 latency.")
+var guardrailMinForwards = flags.Int("guardrail-min-forwards", 100, "Minimum number of forwards in the guardrail window for the guardrail to pause forwarding.")
+var anomalyIdleRoutes = flags.Bool("anomaly-idle-routes", true, "With anomalies, whether routes that match no request are anomalous.")
+var anomalyVolumeFactor = flags.Float64("anomaly-volume-factor", 0, "Can be empty. Otherwise, with anomalies, factor by which the requests per minute of a host and path template must exceed or fall below its baseline for an interval to be anomalous, e.g. 3.")
+var anomalyVolumeWindows = flags.Int("anomaly-volume-windows", 30, "Number of previous intervals averaged into the baseline of anomaly-volume-factor.")
+var anomalyVolumeMinRate = flags.Float64("anomaly-volume-min-rate", 10, "Requests per minute of the baseline of a host and path template below which its volume is not evaluated.")
+var metricsExporterKind = flags.String("metrics-exporter", "", "Can be empty. Otherwise, statsd, dogstatsd or remote-write, to push the metrics to metrics-export-addr, or cloudwatch.")
+var metricsExportAddr = flags.String("metrics-export-addr", "", "Address the metrics are pushed to: host:port of the StatsD agent, or URL of the Prometheus remote write endpoint.")
+var metricsFlush = flags.Duration("metrics-flush-interval", 10*time.Second, "How often the metrics are pushed by the metrics-exporter.")
+var cloudWatchNamespace = flags.String("cloudwatch-namespace", "HTTPRequestsMirroring", "Namespace of the CloudWatch metrics of the cloudwatch metrics-exporter.")
+var cloudWatchDimensions = flags.String("cloudwatch-dimensions", "", "Can be empty. Otherwise, comma separated Name=Value dimensions added to the CloudWatch metrics.")
+var cloudWatchMetrics = flags.String("cloudwatch-metrics", "requests_*,forward_*,forwards_in_flight,pcap_packets_dropped", "Comma separated metrics published to CloudWatch, wildcards like requests_* allowed.")
+var ja3Enabled = flags.Bool("ja3", false, "Whether to compute the JA3 fingerprints of the ClientHellos of the captured TLS connections, for the admin API and the requests of decrypted connections.")
+var ja3Header = flags.String("ja3-header", "X-Mirror-JA3", "Can be empty. Otherwise, with ja3, header set to the JA3 fingerprint of the connection of decrypted requests.")
+var pathStatsEnabled = flags.Bool("path-stats", false, "Whether to track the forwarded requests by path, for the top paths report and the admin API.")
+var pathReportInterval = flags.Duration("path-report-interval", 5*time.Minute, "With path-stats, how often the top paths are logged. 0 disables the log.")
+var pathReportTop = flags.Int("path-report-top", 20, "Number of paths of the top paths report.")
+var fingerprintsEnabled = flags.Bool("fingerprints", false, "Whether to track the captured requests by fingerprint (method, path template and query parameter names), for the endpoints report and the admin API.")
+var fingerprintIgnoreParams = flags.String("fingerprint-ignore-params", "_,utm_source,utm_medium,utm_campaign,utm_term,utm_content", "Comma separated query parameters left out of the request fingerprints.")
+var fingerprintReportFile = flags.String("fingerprint-report", "", "Can be empty. Otherwise, with fingerprints, JSON file the endpoints report is written to every fingerprint-report-interval and when the process ends.")
+var fingerprintReportInterval = flags.Duration("fingerprint-report-interval", 5*time.Minute, "With fingerprints, how often the endpoints report is logged and written. 0 disables it.")
+var openAPISpecFile = flags.String("openapi-spec", "", "Can be empty. Otherwise, OpenAPI 3 or Swagger 2 document (YAML or JSON) the captured requests are matched to, for the API coverage report.")
+var coverageReportFile = flags.String("openapi-coverage-report", "", "Can be empty. Otherwise, with openapi-spec, JSON file the API coverage report is written to every openapi-coverage-interval and when the process ends.")
+var coverageReportInterval = flags.Duration("openapi-coverage-interval", 5*time.Minute, "With openapi-spec, how often the API coverage is logged and written. 0 disables it.")
+var openAPIValidation = flags.String("openapi-validation", "", "Can be empty. Otherwise, with openapi-spec, whether the parameters and JSON bodies of the captured requests are validated against the spec: report (the violations are counted and logged) or drop (the requests are also not forwarded).")
+var pathTemplatesFlag = flags.String("path-templates", "", "Can be empty. Otherwise, comma separated path templates of the path statistics, like /users/{user}/repos/{repo} or /static/**.")
+var rawForwarding = flags.Bool("raw-forwarding", false, "Whether to forward requests with the order and casing of their captured headers, over connections managed by the replay handler rather than net/http.")
+var rawTCP = flags.Bool("raw-tcp", false, "Whether to forward the captured bytes of the requests as is, over one destination connection per captured connection.")
+var ordering = flags.String("ordering", "none", "Order of the forwards of the requests of a captured connection. Valid values are: none (in parallel), connection (one after the other, in the order of the capture).")
+var orderingQueue = flags.Int("ordering-queue", 64, "With ordering connection, maximum number of requests of a connection waiting for the previous ones. The next requests are dropped.")
+var affinity = flags.Bool("connection-affinity", false, "Whether to forward the requests of each captured connection over their own persistent connection to the destination.")
+var affinityKey = flags.String("affinity-key", "", "Can be empty. Otherwise, header:<name> or cookie:<name> set to the ID of the captured connection, for sticky load balancers.")
+var cookieJarBy = flags.String("cookie-jar", "", "Can be empty. Otherwise, source-ip, header:<name> or cookie:<name>, the client key of the cookie jars storing the cookies set by the destinations.")
+var diffEnabled = flags.Bool("diff", false, "Whether to compare the responses of the destinations with the responses of production, captured with filter-mode either.")
+var diffRulesFile = flags.String("diff-rules", "", "Can be empty. Otherwise, path to a JSON file of the normalizations of the response diffs.")
+var diffOutput = flags.String("diff-output", "", "Can be empty. Otherwise, file or s3://bucket/prefix the response diffs are stored to, as JSON lines.")
+var diffSample = flags.Float64("diff-sample", 1, "Fraction of the response diffs that are stored.")
+var diffMaxPerMinute = flags.Int("diff-max-per-minute", 100, "Maximum number of response diffs stored per minute. 0 means no limit.")
+var scorecardInterval = flags.Duration("scorecard-interval", 0, "Can be empty. Otherwise, with diff, how often the scorecard of the endpoints is emitted.")
+var scorecardOutput = flags.String("scorecard-output", "", "Can be empty. Otherwise, file the scorecards are appended to, as JSON lines.")
+var scorecardMinMatch = flags.Float64("scorecard-min-match", 99, "Minimum percentage of matching responses of an endpoint for a go.")
+var scorecardMaxP95Delta = flags.Duration("scorecard-max-p95-delta", 0, "Can be empty. Otherwise, maximum increase of the p95 latency of an endpoint for a go.")
+var scorecardMaxErrorDelta = flags.Float64("scorecard-max-error-delta", 0.01, "Maximum increase of the 5xx rate of an endpoint for a go.")
+
+// Build a simple HTTP request parser using tcpassembly.StreamFactory and tcpassembly.Stream interfaces
+
+// httpStreamFactory implements tcpassembly.StreamFactory
+type httpStreamFactory struct {
+	// segment is the TCP segment being assembled, the first of the streams New
+	// returns
+	segment *layers.TCP
+}
+
+// httpStream will handle the actual decoding of http requests.
+type httpStream struct {
+	net, transport gopacket.Flow
+	r              timedStream
+	// clientCert is the certificate of the client, once the TLS handshake of
+	// the connection is decrypted
+	clientCert *x509.Certificate
+	// ja3 is the JA3 fingerprint of the ClientHello of the connection, with ja3
+	ja3 string
+	// errors counts the errors of the stream by class
+	errors map[string]int
+	// seq is the TCP sequence number the stream starts at, or 0 if unknown
+	seq uint32
+}
+
+// streamError counts an error of the stream, and logs the first error of each class.
+func (h *httpStream) streamError(class string, err error) {
+	stats.inc("stream_errors")
+	stats.inc("stream_errors_" + class)
+	if h.errors == nil {
+		h.errors = map[string]int{}
+	}
+	h.errors[class]++
+	if h.errors[class] == 1 {
+		log.Printf("Error reading stream %v %v (%s): %v", h.net, h.transport, class, err)
+	}
+}
+
+// logErrorSummary logs the number of errors of the classes that occurred more than once.
+func (h *httpStream) logErrorSummary() {
+	for class, n := range h.errors {
+		if n > 1 {
+			log.Println(n, class, "errors on stream", h.net, h.transport)
+		}
+	}
+}
+
+func (h *httpStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	// while draining, new streams are not read at all
+	if draining() {
+		return discardStream{}
+	}
+	if currentConfig().filterMode == "src" {
+		// the packets were captured with swapped orientation: the client is the destination
+		net, transport = net.Reverse(), transport.Reverse()
+	}
+	hstream := &httpStream{
+		net:       net,
+		transport: transport,
+		r:         timedStream{ReaderStream: tcpreader.NewReaderStream()},
+	}
+	if tcp := h.segment; tcp != nil {
+		// the data starts after the SYN, whether the SYN was captured or not
+		hstream.seq = tcp.Seq
+		if tcp.SYN {
+			hstream.seq++
+		}
+	}
+	go hstream.run() // Important... we must guarantee that data from the reader stream is read.
+
+	// timedStream implements tcpassembly.Stream, so we can return a pointer to it.
+	return &hstream.r
+}
+
+func (h *httpStream) run() {
+	conf := currentConfig()
+	counter := &recordingReader{countingReader: countingReader{r: &h.r}, record: conf.rawForwarding || fwdRawSink != nil || fwdQuarantine != nil}
+	limited := &headLimitReader{r: counter}
+	buf := bufio.NewReader(limited)
+	// We must read until we see an EOF... very important!
+	defer io.Copy(ioutil.Discard, buf)
+	defer h.logErrorSummary()
+	// parsed counts the requests of the connection, forwarded those handed to
+	// forwardRequest, see rawTCPSink
+	parsed, forwarded := 0, 0
+	if sink := fwdRawSink; sink != nil {
+		id := connectionID(h.net, h.transport)
+		defer func() { sink.closeConnection(id, forwarded) }()
+	}
+	if fwdKeyLog == nil && conf.ja3 != nil && looksLikeTLS(buf) {
+		h.fingerprintTLS(buf)
+		stats.inc("tls_streams_skipped")
+		return
+	}
+	if fwdKeyLog != nil && looksLikeTLS(buf) {
+		// the requests are read from the plaintext; the server side of the
+		// connection only gives the parameters of the session. The capture
+		// times are those of the plaintext offsets, a little early
+		plain, ok := h.decryptTLS(buf)
+		if !ok {
+			return
+		}
+		counter = &recordingReader{countingReader: countingReader{r: plain}, record: counter.record}
+		limited = &headLimitReader{r: counter}
+		buf = bufio.NewReader(limited)
+	}
+	if conf.filterMode == "either" {
+		// both directions of the connections are captured: skip the responses,
+		// and orient the requests from the client to the server
+		if looksLikeResponse(buf) {
+			if fwdDiffs != nil {
+				h.readResponses(buf, counter)
+				return
+			}
+			stats.inc("response_streams_skipped")
+			return
+		}
+		if !isRequestPort(conf, flowPort(h.transport.Dst())) && isRequestPort(conf, flowPort(h.transport.Src())) {
+			h.net, h.transport = h.net.Reverse(), h.transport.Reverse()
+		}
+	}
+	var ordered *orderedForwarder
+	if conf.ordering == "connection" {
+		ordered = newOrderedForwarder(conf.orderingQueue)
+		defer ordered.close()
+	}
+	for requests := 0; ; requests++ {
+		// the offset of the first byte of the next request in the stream
+		start := counter.n - int64(buf.Buffered())
+		counter.forget(start)
+		if !looksLikeRequest(buf) {
+			h.streamError(streamErrorNotHTTP, fmt.Errorf("data does not start with a request line"))
+			// a connection that does not start with HTTP (TLS, probes) is not HTTP at all
+			if requests == 0 || resyncRequest(buf) != nil {
+				break
+			}
+			continue
+		}
+		limited.limit(conf.maxHeaderBytes)
+		req, err := http.ReadRequest(buf)
+		if err != nil && limited.exceeded {
+			err = errHeaderTooLarge
+		}
+		limited.limit(0)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			// the connection ended within the headers of a request, e.g. after a reset
+			h.streamError(streamErrorTruncated, err)
+			break
+		} else if errors.Is(err, errHeaderTooLarge) {
+			h.rejectRequest(conf, limitHeaderBytes, err, counter, start)
+			if resyncRequest(buf) != nil {
+				break
+			}
+			continue
+		} else if err != nil {
+			h.streamError(streamErrorMalformed, err)
+			h.quarantine(conf, streamErrorMalformed, err, counter, start)
+			// skip to the next request line, so that the requests pipelined after
+			// a malformed request (or a gap in the capture) are not lost
+			if resyncRequest(buf) != nil {
+				break
+			}
+			continue
+		}
+		if limit, lErr := exceededLimit(conf, req); limit != "" {
+			h.rejectRequest(conf, limit, lErr, counter, start)
+			// the framing of the request is known: only its body is skipped
+			io.Copy(ioutil.Discard, req.Body)
+			req.Body.Close()
+			continue
+		}
+
+		info := newCaptureInfo(h.net, h.transport, h.r.seenAt(start))
+		info.clientCert, info.ja3 = h.clientCert, h.ja3
+		parsed++
+		info.index, info.streamSeq = parsed, h.seq
+		if conf.rawForwarding {
+			info.headerOrder = headerNames(counter.bytes(start, counter.n-int64(buf.Buffered())))
+		}
+		body, bErr := readBody(conf, req)
+		req.Body.Close()
+		if fwdRawSink != nil {
+			info.raw = counter.bytes(start, counter.n-int64(buf.Buffered()))
+			info.sequence = forwarded
+		}
+		if bErr != nil {
+			// the connection ended within the body: the request is still forwarded,
+			// with the part of the body that was captured
+			h.streamError(streamErrorTruncated, bErr)
+		}
+		stats.inc("requests_captured")
+		if fwdFlows != nil {
+			fwdFlows.request(h.net, h.transport)
+		}
+		if fwdArchive != nil {
+			if err := fwdArchive.write(newArchiveRecord(req, info, body)); err != nil {
+				log.Println("Error writing archive", ":", err)
+			}
+		}
+		if draining() {
+			stats.inc("requests_dropped_draining")
+		} else if ordered != nil && ordered.full() {
+			stats.inc("requests_dropped_ordering")
+		} else if ordered != nil {
+			atomic.AddInt64(&fwdInFlight, 1)
+			forwarded++
+			ordered.forward(req, info, body)
+		} else {
+			atomic.AddInt64(&fwdInFlight, 1)
+			forwarded++
+			go forwardRequest(req, info, body)
+		}
+		if bErr != nil {
+			break
+		}
+	}
+}
+
+func forwardRequest(req *http.Request, info captureInfo, body []byte) {
+	conf := acquireConfig()
+	defer conf.release()
+	defer atomic.AddInt64(&fwdInFlight, -1)
+
+	// with the raw TCP sink, every captured request reports to the sink, with its
+	// bytes if it is forwarded
+	var raw rawSinkItem
+	if sink := fwdRawSink; sink != nil && info.raw != nil {
+		defer func() { sink.complete(info.connectionID, info.sequence, raw) }()
+	}
+	// with response diffs, the response of production is kept until the response
+	// of the destination is known, or the request is not forwarded
+	diffs := fwdDiffs
+	diffed := false
+	if diffs != nil && info.index > 0 {
+		defer func() {
+			if !diffed {
+				diffs.discard(info)
+			}
+		}()
+	} else {
+		diffs = nil
+	}
+
+	// the connections of the other shards are left to other instances; the
+	// captured packets are sharded already, not the ingested or replayed requests
+	if fwdShard != nil && info.amplified == 0 && !fwdShard.request(info) {
+		stats.inc("requests_dropped_shard")
+		return
+	}
+
+	// the endpoints are those of the captured traffic, forwarded or not
+	fingerprints, fingerprint := conf.fingerprints, ""
+	if fingerprints != nil && info.amplified == 0 {
+		fingerprint = fingerprints.record(req, conf.pathTemplates)
+	}
+	var operation *apiOperation
+	coverage := conf.coverage
+	if coverage != nil && info.amplified == 0 {
+		operation = coverage.record(req, conf.pathTemplates)
+	}
+	if volume := fwdRouteVolume; volume != nil && info.amplified == 0 {
+		volume.record(req, conf.pathTemplates)
+	}
+
+	// forwarding can be paused through the admin API or signals
+	if currentPauseMode() != pauseNone {
+		stats.inc("requests_dropped_paused")
+		return
+	}
+
+	// forwarding is enabled only during the windows of the schedule, if any
+	if conf.schedule != nil && !conf.schedule.active(time.Now()) {
+		stats.inc("requests_dropped_schedule")
+		return
+	}
+
+	// the copies of the request seen by other instances of the fleet are
+	// forwarded by one of them, before sampling so that it samples them once
+	if fwdFleetDedup != nil && info.amplified == 0 && isFleetDuplicate(req, info, body) {
+		stats.inc(labeled("requests_dropped_fleet_duplicate", "by", *fleetDedupBy))
+		return
+	}
+
+	// if percentage is not 100, then a percentage of requests is skipped; the
+	// copies of amplified requests were sampled already
+	fwdPerc := samplingPercentage()
+	if fwdPerc != 100 && info.amplified == 0 {
+		randomPercent, err := samplingBucket(conf, req, info)
+		if err != nil {
+			log.Println("Error generating crypto random unit for seed of request", info.requestID, ":", err)
+			return
+		}
+		// skip a percentage of requests
+		if randomPercent > fwdPerc {
+			stats.inc("requests_dropped_sampling")
+			return
+		}
+	}
+
+	if info.amplified == 0 && conf.amplify > 1 {
+		amplifyRequest(conf, req, info, body)
+	}
+
+	// excluding health checker and resource files.
+	if isExcludedRequest(req) {
+		stats.inc("requests_dropped_filter")
+		return
+	}
+
+	// filtering by content type
+	if conf.contentTypes != nil && !conf.contentTypes.allowed(req) {
+		stats.inc("requests_dropped_content_type")
+		return
+	}
+
+	// encoded bodies are decoded for the body rules, hooks and routes
+	var coded *codedBody
+	if conf.decodeBodies != "off" {
+		if coded = decodeBody(req.Header.Get("Content-Encoding"), body, conf.decodeMaxBytes); coded != nil {
+			body = coded.decoded
+		}
+	}
+
+	// validating against the OpenAPI spec
+	if operation != nil && conf.openAPIValidation != "" {
+		encoded := req.Header.Get("Content-Encoding") != "" && coded == nil
+		if kind, err := coverage.spec.validate(operation, req, body, encoded); err != nil {
+			coverage.violation(operation, kind, err)
+			if conf.openAPIValidation == "drop" {
+				stats.inc("requests_dropped_openapi")
+				return
+			}
+		}
+	}
+
+	// filtering by body rules
+	if conf.bodyRules != nil && !conf.bodyRules.allowed(body) {
+		stats.inc("requests_dropped_body_rule")
+		return
+	}
+
+	// filtering by the country of the source IP
+	var country string
+	if conf.geo != nil {
+		var allowed bool
+		if country, allowed = conf.geo.lookup(info.sourceIP); !allowed {
+			stats.inc("requests_dropped_geo")
+			return
+		}
+	}
+
+	// run the user script and plugins, which may modify, reroute or drop the request
+	var rerouted string
+	for _, hook := range conf.hooks {
+		result, err := hook.run(req, body)
+		if err != nil {
+			stats.inc("hook_errors")
+			log.Println("Error running request hook on request", info.requestID, ":", err)
+			return
+		}
+		if result.drop {
+			stats.inc("requests_dropped_filter")
+			return
+		}
+		body = result.body
+		if result.destination != "" {
+			rerouted = result.destination
+		}
+	}
+
+	// replayed writes are made safe for the shadow
+	if len(conf.bodyFieldSets) > 0 && len(body) > 0 {
+		body = setBodyFields(req, body, conf.bodyFieldSets)
+	}
+
+	// the body is forwarded as captured unless it was changed, or decoded
+	if coded != nil && conf.decodeBodies == "inspect" {
+		encoded, err := coded.encode(body)
+		if err != nil {
+			stats.inc("forward_errors")
+			log.Println("Error encoding body of request", info.requestID, ":", err)
+			return
+		}
+		body = encoded
+	}
+
+	// with pacing, wait until the request is due according to its capture time
+	// then spread bursts over the smoothing window
+	if (conf.pacer != nil && !conf.pacer.wait(info.time)) || !smooth(conf) {
+		stats.inc("forward_cancelled")
+		return
+	}
+
+	// create a new url from the raw RequestURI sent by the client
+	rt, ok := fwdRoutes.lookup(conf, req, info, body)
+	if rerouted != "" {
+		rt.Destination, ok = rerouted, true
+	}
+	if !ok {
+		stats.inc("requests_dropped_unrouted")
+		fwdUnrouted.log(req.Host)
+		return
+	}
+	if fwdRawSink != nil && info.raw != nil && !conf.dryRun && fwdStub == nil {
+		raw = rawSinkItem{dest: rt.Destination, data: info.raw}
+		return
+	}
+
+	// with latency injection, the forward waits for an artificial delay
+	if !injectLatency(conf, rt) {
+		stats.inc("forward_cancelled")
+		return
+	}
+
+	// with fault injection, a fraction of the forwards is corrupted
+	fault, faulted := pickFault(conf, req, body)
+	if faulted {
+		body = fault.body(body)
+	}
+	target, authority, err := forwardURL(rt.Destination, req.Method, req.RequestURI)
+	if err != nil {
+		stats.inc("forward_errors")
+		log.Println("Error building forward URL of request", info.requestID, ":", err)
+		return
+	}
+	log.Println(info.requestID, target)
+
+	// the forward is cancelled after the route (or global) timeout, or on shutdown
+	timeout := conf.fwdTimeout
+	if rt.Timeout > 0 {
+		timeout = time.Duration(rt.Timeout)
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(fwdCtx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(fwdCtx)
+	}
+	defer cancel()
+
+	// create a new HTTP request
+	forwardReq, err := http.NewRequestWithContext(ctx, req.Method, rt.Destination, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	forwardReq.URL = target
+	if authority != "" {
+		// CONNECT requests are sent with the authority as the request target
+		forwardReq.Host = authority
+	}
+
+	// requests above the concurrency limit of the destination are dropped
+	limit := conf.maxInFlightPerDest
+	if rt.MaxInFlight > 0 {
+		limit = rt.MaxInFlight
+	}
+	release, ok := fwdLimiter.tryAcquire(forwardReq.URL.Host, limit)
+	if !ok {
+		stats.inc("requests_dropped_concurrency")
+		return
+	}
+	defer release()
+
+	// bodies are shaped to the bandwidth limit, and dropped if they would wait too long
+	if conf.bandwidth != nil && len(body) > 0 {
+		wait, ok := conf.bandwidth.reserve(len(body), conf.maxShapingDelay)
+		if !ok {
+			stats.inc("requests_dropped_bandwidth")
+			return
+		}
+		time.Sleep(wait)
+	}
+
+	// add headers to the new HTTP request
+	for header, values := range req.Header {
+		for _, value := range values {
+			forwardReq.Header.Add(header, value)
+		}
+	}
+
+	if coded != nil && conf.decodeBodies == "decoded" {
+		// the length of the decoded body is set from the body
+		forwardReq.Header.Del("Content-Encoding")
+	}
+
+	// trailers are sent after the body, which is then chunked
+	if len(req.Trailer) > 0 {
+		if conf.stripTrailers || rt.StripTrailers {
+			stats.inc("trailers_stripped")
+		} else {
+			forwardReq.Trailer = req.Trailer.Clone()
+			forwardReq.ContentLength = -1
+			forwardReq.TransferEncoding = []string{"chunked"}
+			stats.inc("trailers_forwarded")
+		}
+	}
+
+	// set X-Forwarded-* and Forwarded headers
+	setForwardedHeaders(conf, forwardReq.Header, info.sourceIP, info.destinationPort, req.Host)
+	if conf.mirrorHeaders {
+		setMirrorHeaders(forwardReq.Header, info)
+	}
+	setTraceContext(conf, forwardReq.Header)
+	setClientCertHeaders(conf, forwardReq.Header, info.clientCert)
+	if conf.ja3Header != "" && info.ja3 != "" {
+		forwardReq.Header.Set(conf.ja3Header, info.ja3)
+	}
+	if rt.slice != "" {
+		forwardReq.Header.Set("X-Mirror-Slice", rt.slice)
+		stats.inc(labeled("requests_by_slice", "slice", rt.slice))
+	}
+	if conf.idempotencyKeyHeader != "" {
+		setIdempotencyKey(conf, forwardReq.Header, req.Method, info.requestID)
+	}
+	if fwdECS != nil {
+		setECSHeaders(forwardReq.Header, info.sourceIP)
+	}
+	if fwdSourceNames != nil {
+		info.sourceName = fwdSourceNames.name(info.sourceIP)
+		if conf.sourceNameHeader != "" {
+			// a header of the client cannot pass for the name
+			forwardReq.Header.Del(conf.sourceNameHeader)
+			if info.sourceName != "" {
+				forwardReq.Header.Set(conf.sourceNameHeader, info.sourceName)
+			}
+		}
+	}
+	var pod *kubePod
+	if fwdKubePods != nil {
+		if pod = fwdKubePods.lookup(info.sourceIP); pod != nil {
+			forwardReq.Header.Set("X-Mirror-Source-Pod", pod.name)
+			forwardReq.Header.Set("X-Mirror-Source-Namespace", pod.namespace)
+			forwardReq.Header.Set("X-Mirror-Source-Workload", pod.workload)
+		} else {
+			stats.inc("kube_attribution_misses")
+		}
+	}
+	if conf.geoHeader && country != "" {
+		forwardReq.Header.Set("X-Mirror-Geo", country)
+	}
+	if conf.affinityKey != "" {
+		setAffinityKey(forwardReq.Header, conf.affinityKey, info.connectionID)
+	}
+	// the cookies set by the destination replace those set by production
+	jars := fwdCookieJars
+	var client string
+	if jars != nil {
+		if client = jars.client(req, info, body); client != "" {
+			jars.apply(client, forwardReq)
+		}
+	}
+	if faulted {
+		fault.header(conf, forwardReq.Header)
+	}
+
+	// in dry run mode, only log the request that would have been forwarded
+	if conf.dryRun {
+		recordDryRun(forwardReq, info, len(body))
+		stats.inc("requests_dry_run")
+		return
+	}
+
+	// Execute the new HTTP request
+	httpClient := &http.Client{}
+	if affinity := fwdAffinity; affinity != nil {
+		httpClient = affinity.client(info.connectionID)
+	}
+	sent := time.Now()
+	var resp *http.Response
+	var rErr error
+	if fwdStub != nil {
+		resp, rErr = fwdStub.roundTrip(forwardReq, info, body)
+	} else if conf.rawForwarding && info.headerOrder != nil {
+		pool := ""
+		if fwdAffinity != nil {
+			pool = info.connectionID
+		}
+		resp, rErr = fwdRawTransport.roundTrip(forwardReq, pool, info.headerOrder, body)
+	} else {
+		resp, rErr = httpClient.Do(forwardReq)
+	}
+	latency := time.Since(sent)
+	if info.index > 0 {
+		// replays have the capture time of the archive
+		recordMirrorLag(time.Since(info.time))
+	}
+	assertions, paths := conf.assertions, conf.paths
+	if g := fwdGuardrail; g != nil && !errors.Is(rErr, context.Canceled) {
+		status := 0
+		if rErr == nil {
+			status = resp.StatusCode
+		}
+		g.record(status, latency)
+	}
+	if rErr != nil {
+		// log.Println("Forward request error", ":", err)
+		if errors.Is(rErr, context.DeadlineExceeded) {
+			stats.inc("forward_timeouts")
+		} else if errors.Is(rErr, context.Canceled) {
+			stats.inc("forward_cancelled")
+			return
+		} else {
+			stats.inc("forward_errors")
+		}
+		if fingerprint != "" {
+			fingerprints.forwarded(fingerprint, false)
+		}
+		if operation != nil {
+			coverage.forwarded(operation, false)
+		}
+		if assertions != nil {
+			assertions.check(req, nil, nil, latency)
+		}
+		if paths != nil {
+			paths.record(conf.pathTemplates.apply(requestPath(req)), int64(len(body)), 0, -1)
+		}
+		return
+	}
+	stats.inc("requests_forwarded")
+	if fingerprint != "" {
+		fingerprints.forwarded(fingerprint, true)
+	}
+	if operation != nil {
+		coverage.forwarded(operation, true)
+	}
+	if pod != nil {
+		stats.inc(labeled("requests_forwarded_by_workload", "namespace", pod.namespace, "workload", pod.workload))
+	}
+	if info.sourceName != "" {
+		stats.inc(labeled("requests_forwarded_by_source_name", "name", fwdSourceNames.label(info.sourceName)))
+	}
+
+	defer resp.Body.Close()
+	if client != "" {
+		jars.store(client, forwardReq.URL, resp)
+	}
+	if paths != nil {
+		// count the bytes of the response, including those read below
+		counted := &countingReader{r: resp.Body}
+		resp.Body = ioutil.NopCloser(counted)
+		defer func() {
+			size := resp.ContentLength
+			if size < 0 {
+				io.Copy(ioutil.Discard, io.LimitReader(counted, pathStatsDrainLimit))
+				size = counted.n
+			}
+			paths.record(conf.pathTemplates.apply(requestPath(req)), int64(len(body)), size, latency)
+		}()
+	}
+	var respBody []byte
+	if (assertions != nil && assertions.needsBody) || diffs != nil {
+		respBody, _ = ioutil.ReadAll(io.LimitReader(resp.Body, responseBodyLimit))
+	}
+	if assertions != nil {
+		assertions.check(req, resp, respBody, latency)
+	}
+	// the responses to faulted forwards differ from production by design
+	if diffs != nil && !faulted {
+		observed := newObservedResponse(resp, respBody)
+		observed.latency = latency
+		diffs.shadow(info, req, observed)
+		diffed = true
+	}
+}
+
+// resourceExtensions are the extensions of resource files, which are not forwarded.
+var resourceExtensions = []string{".html", ".txt", ".js", ".css", ".gif", ".png", ".jpeg", ".jpg", ".svg", ".webp"}
+
+func isExcludedRequest(req *http.Request) bool {
+	// excluding health checker.
+	if strings.Contains(req.UserAgent(), "ELB-HealthChecker") {
+		return true
+	}
+	// excluding resource files.
+	for _, ext := range resourceExtensions {
+		if strings.Contains(req.RequestURI, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// healthCheck tells whether the capture opens the NLB health check listener;
+// a Mirror embedded in another program opens it only with WithHealthCheck.
+var healthCheck = true
+
+// tuneRuntime tells whether loadConfig applies the flags tuning the process;
+// a Mirror embedded in another program applies them only with WithRuntimeTuning.
+var tuneRuntime = true
+
+// startHealthListener opens the NLB health check listener, and accepts its
+// connections in the background. The pipelines of a config file share the
+// listener of the capture command running them, and do not open their own.
+func startHealthListener() error {
+	if !healthCheck || *pipelineName != "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", ":4789")
+	if err != nil {
+		// without the listener, the NLB health checks would fail
+		return fmt.Errorf("Error listening on TCP 4789 for health checks: %v", err)
+	}
+	log.Println("Listening on TCP 4789")
+	go func() {
+		// the health checks fail once the capture is stopped
+		<-captureStop
+		ln.Close()
+	}()
+	go acceptHealthChecks(ln)
+	return nil
+}
+
+// Listen for incoming connections.
+func acceptHealthChecks(ln net.Listener) {
+	for {
+		// Listen for an incoming connection and close it immediately.
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Println("Error accepting health check", ":", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+// setupFlags validates the flags and loads the route table, script and plugins
+// they refer to. It returns the route table source, if any.
+func setupFlags() (*url.URL, error) {
+	var routeSourceURL *url.URL
+	var err error
+
+	//labels validation
+	if err = validateSamplingFlags(); err != nil {
+		// the sampling flags are also checked alone by the bucket command
+	} else if *reqPort > 65535 || *reqPort < 0 {
+		err = fmt.Errorf("Flag filter-request-port is not between 0 and 65535. Value: %d.", *reqPort)
+	} else if *fwdTimeout < 0 {
+		err = fmt.Errorf("Flag forward-timeout must not be negative. Value: %s.", *fwdTimeout)
+	} else if *maxInFlightPerDest < 0 {
+		err = fmt.Errorf("Flag max-in-flight-per-destination must not be negative. Value: %d.", *maxInFlightPerDest)
+	} else if *maxBytesPerSec < 0 {
+		err = fmt.Errorf("Flag max-forward-bytes-per-second must not be negative. Value: %d.", *maxBytesPerSec)
+	} else if *bodyRulesMaxBytes <= 0 {
+		err = fmt.Errorf("Flag body-rules-max-bytes must be positive. Value: %d.", *bodyRulesMaxBytes)
+	} else if *amplify < 1 {
+		err = fmt.Errorf("Flag amplify must be at least 1. Value: %d.", *amplify)
+	} else if *amplifyJitter < 0 {
+		err = fmt.Errorf("Flag amplify-jitter must not be negative. Value: %s.", *amplifyJitter)
+	} else if *stubMode && *dryRun {
+		err = fmt.Errorf("Flags stub and dry-run cannot be used together.")
+	} else if *stubStatus < 100 || *stubStatus > 599 {
+		err = fmt.Errorf("Flag stub-status must be between 100 and 599. Value: %d.", *stubStatus)
+	} else if *stubLatency < 0 {
+		err = fmt.Errorf("Flag stub-latency must not be negative. Value: %s.", *stubLatency)
+	} else if *decodeBodies != "off" && *decodeBodies != "inspect" && *decodeBodies != "decoded" {
+		err = fmt.Errorf("Flag decode-bodies (%s) is not valid.", *decodeBodies)
+	} else if *decodeMaxBytes <= 0 {
+		err = fmt.Errorf("Flag decode-max-bytes must be positive. Value: %d.", *decodeMaxBytes)
+	} else if *ecsRefresh <= 0 {
+		err = fmt.Errorf("Flag ecs-refresh-interval must be positive. Value: %s.", *ecsRefresh)
+	} else if *sourceNames != "" && *sourceNames != "rdns" && *sourceNames != "ec2" {
+		err = fmt.Errorf("Flag source-names (%s) is not valid.", *sourceNames)
+	} else if *sourceNameTimeout <= 0 {
+		err = fmt.Errorf("Flag source-name-timeout must be positive. Value: %s.", *sourceNameTimeout)
+	} else if *sourceNameTTL <= 0 {
+		err = fmt.Errorf("Flag source-name-ttl must be positive. Value: %s.", *sourceNameTTL)
+	} else if *sourceNameCacheSize < 1 {
+		err = fmt.Errorf("Flag source-name-cache-size must be at least 1. Value: %d.", *sourceNameCacheSize)
+	} else if *routeRefresh <= 0 {
+		err = fmt.Errorf("Flag route-refresh-interval must be positive. Value: %s.", *routeRefresh)
+	} else if *fwdHeaders != "append" && *fwdHeaders != "overwrite" && *fwdHeaders != "omit" {
+		err = fmt.Errorf("Flag forwarded-headers (%s) is not valid.", *fwdHeaders)
+	} else if *snaplen < 64 || *snaplen > 262144 {
+		err = fmt.Errorf("Flag snaplen is not between 64 and 262144. Value: %d.", *snaplen)
+	} else if *bufferSize < 0 {
+		err = fmt.Errorf("Flag pcap-buffer-size must not be negative. Value: %d.", *bufferSize)
+	} else if *flowExportFormat != "ipfix" && *flowExportFormat != "json" {
+		err = fmt.Errorf("Flag flow-export-format (%s) is not valid.", *flowExportFormat)
+	} else if *flowExportPEN > 1<<32-1 {
+		err = fmt.Errorf("Flag flow-export-pen is not a 32 bit number. Value: %d.", *flowExportPEN)
+	} else if *flowIdleTimeout <= 0 || *flowActiveTimeout <= 0 {
+		err = fmt.Errorf("Flags flow-idle-timeout and flow-active-timeout must be positive.")
+	} else if *captureDropInterval < 0 {
+		err = fmt.Errorf("Flag capture-drop-interval must not be negative. Value: %s.", *captureDropInterval)
+	} else if *captureDropAdapt != "" && *captureDropAdapt != "buffer" && *captureDropAdapt != "snaplen" && *captureDropAdapt != "both" {
+		err = fmt.Errorf("Flag capture-drop-adapt (%s) is not valid.", *captureDropAdapt)
+	} else if *captureDropAdapt != "" && (*captureEngine != "pcap" || *captureDropInterval == 0) {
+		err = fmt.Errorf("Flag capture-drop-adapt requires the pcap capture-engine and a capture-drop-interval.")
+	} else if *captureDropThreshold < 0 || *captureDropThreshold >= 1 {
+		err = fmt.Errorf("Flag capture-drop-threshold is not between 0 and 1. Value: %f.", *captureDropThreshold)
+	} else if *captureMaxBufferSize <= 0 {
+		err = fmt.Errorf("Flag capture-max-buffer-size must be positive. Value: %d.", *captureMaxBufferSize)
+	} else if *captureMinSnaplen < 64 || *captureMinSnaplen > 262144 {
+		err = fmt.Errorf("Flag capture-min-snaplen is not between 64 and 262144. Value: %d.", *captureMinSnaplen)
+	} else if _, err = buildBPFFilter(); err != nil {
+	} else if *guardrailMaxErrorRate < 0 || *guardrailMaxErrorRate > 1 {
+		err = fmt.Errorf("Flag guardrail-max-error-rate must be between 0 and 1. Value: %f.", *guardrailMaxErrorRate)
+	} else if *guardrailMaxP99 < 0 {
+		err = fmt.Errorf("Flag guardrail-max-p99 must not be negative. Value: %s.", *guardrailMaxP99)
+	} else if *guardrailWindow < guardrailSlots*time.Second {
+		err = fmt.Errorf("Flag guardrail-window must be at least %ds. Value: %s.", guardrailSlots, *guardrailWindow)
+	} else if *guardrailMinForwards < 1 {
+		err = fmt.Errorf("Flag guardrail-min-forwards must be positive. Value: %d.", *guardrailMinForwards)
+	} else if *captureOpenRetry < 0 {
+		err = fmt.Errorf("Flag capture-open-retry must not be negative. Value: %s.", *captureOpenRetry)
+	} else if *anomalyMirrorLag < 0 {
+		err = fmt.Errorf("Flag anomaly-mirror-lag must not be negative. Value: %s.", *anomalyMirrorLag)
+	} else if *multipartFiles != "keep" && *multipartFiles != "drop" && *multipartFiles != "truncate" {
+		err = fmt.Errorf("Flag multipart-files (%s) is not valid.", *multipartFiles)
+	} else if *multipartFileMaxBytes < 0 {
+		err = fmt.Errorf("Flag multipart-file-max-bytes must not be negative. Value: %d.", *multipartFileMaxBytes)
+	} else if *ordering != "none" && *ordering != "connection" {
+		err = fmt.Errorf("Flag ordering (%s) is not valid.", *ordering)
+	} else if *orderingQueue < 1 {
+		err = fmt.Errorf("Flag ordering-queue must be at least 1. Value: %d.", *orderingQueue)
+	} else if *maxHeaderBytes <= 0 {
+		err = fmt.Errorf("Flag max-header-bytes must be positive. Value: %d.", *maxHeaderBytes)
+	} else if *maxURILength < 0 || *maxHeaderCount < 0 {
+		err = fmt.Errorf("Flags max-uri-length and max-header-count must not be negative.")
+	} else if *quarantineMaxBytes <= 0 || *quarantineMaxSize <= 0 {
+		err = fmt.Errorf("Flags quarantine-max-bytes and quarantine-max-size must be positive.")
+	} else if *archiveEncryption != "" && *archiveEncryption != "local" && *archiveEncryption != "kms" {
+		err = fmt.Errorf("Flag archive-encryption (%s) is not valid.", *archiveEncryption)
+	} else if *archiveEncryption == "local" && *archiveKeyFile == "" {
+		err = fmt.Errorf("Flag archive-encryption local requires archive-key-file.")
+	} else if *archiveEncryption == "kms" && *archiveKMSKeyID == "" {
+		err = fmt.Errorf("Flag archive-encryption kms requires archive-kms-key-id.")
+	} else if *archiveKeyRotation < 0 {
+		err = fmt.Errorf("Flag archive-key-rotation must not be negative. Value: %s.", *archiveKeyRotation)
+	} else if *recordMaxDiskUsage < 0 || *recordMaxAge < 0 {
+		err = fmt.Errorf("Flags record-max-disk-usage and record-max-age must not be negative.")
+	} else if *recordRetention != "rotate" && *recordRetention != "stop" {
+		err = fmt.Errorf("Flag record-retention (%s) is not valid.", *recordRetention)
+	} else if *recordRotateInterval <= 0 {
+		err = fmt.Errorf("Flag record-rotate-interval must be positive. Value: %s.", *recordRotateInterval)
+	} else if *recordFrameRecords < 1 {
+		err = fmt.Errorf("Flag record-frame-records must be at least 1. Value: %d.", *recordFrameRecords)
+	} else if *dedupWindow <= 0 {
+		err = fmt.Errorf("Flag dedup-window must be positive. Value: %s.", *dedupWindow)
+	} else if *maxClockSkew <= 0 {
+		err = fmt.Errorf("Flag max-clock-skew must be positive. Value: %s.", *maxClockSkew)
+	} else if *captureCPU < -1 || *captureCPU >= maxCPU {
+		err = fmt.Errorf("Flag capture-cpu is not between -1 and %d. Value: %d.", maxCPU-1, *captureCPU)
+	} else if _, err = parseCPUList("worker-cpus", *workerCPUs); err != nil {
+	} else if !validGOMAXPROCS(*gomaxprocs) {
+		err = fmt.Errorf("Flag gomaxprocs (%s) must be auto or a positive number.", *gomaxprocs)
+	} else if !validGOGC(*gogc) {
+		err = fmt.Errorf("Flag gogc (%s) must be off or a positive number.", *gogc)
+	} else if *memoryLimit < 0 {
+		err = fmt.Errorf("Flag memory-limit must not be negative. Value: %d.", *memoryLimit)
+	} else if *memoryBallastSize < 0 {
+		err = fmt.Errorf("Flag memory-ballast must not be negative. Value: %d.", *memoryBallastSize)
+	} else if *gogc == "off" && *memoryLimit == 0 {
+		err = fmt.Errorf("Flag gogc off requires a memory-limit.")
+	} else if *decapMaxDepth < 0 {
+		err = fmt.Errorf("Flag decap-max-depth must not be negative. Value: %d.", *decapMaxDepth)
+	} else if _, err = parseVXLANPorts(*vxlanPorts); err != nil {
+	} else if *filterVLANIDs != "" && !*filterVLAN {
+		err = fmt.Errorf("Flag filter-vlan-ids requires filter-vlan.")
+	} else if *latencyPercentage < 0 || *latencyPercentage > 100 {
+		err = fmt.Errorf("Flag latency-percentage is not between 0 and 100. Value: %f.", *latencyPercentage)
+	} else if *faultPercentage < 0 || *faultPercentage > 100 {
+		err = fmt.Errorf("Flag fault-percentage is not between 0 and 100. Value: %f.", *faultPercentage)
+	} else if *fleetDedup != "" && *fleetDedup != "redis" && *fleetDedup != "gossip" {
+		err = fmt.Errorf("Flag fleet-dedup (%s) is not valid.", *fleetDedup)
+	} else if *fleetDedupBy != "request" && *fleetDedupBy != "flow" {
+		err = fmt.Errorf("Flag fleet-dedup-by (%s) is not valid.", *fleetDedupBy)
+	} else if *fleetDedup == "redis" && *fleetDedupRedis == "" {
+		err = fmt.Errorf("Flag fleet-dedup redis requires fleet-dedup-redis.")
+	} else if *fleetDedup == "gossip" && *fleetDedupPeers == "" {
+		err = fmt.Errorf("Flag fleet-dedup gossip requires fleet-dedup-peers.")
+	} else if *fleetDedupWindow <= 0 || *fleetDedupTimeout <= 0 || *fleetDedupDelay < 0 {
+		err = fmt.Errorf("Flags fleet-dedup-window and fleet-dedup-timeout must be positive, and fleet-dedup-delay not negative.")
+	} else if *leaderElectionKind != "" && *leaderElectionKind != "kubernetes" && *leaderElectionKind != "dynamodb" {
+		err = fmt.Errorf("Flag leader-election (%s) is not valid.", *leaderElectionKind)
+	} else if *leaderElectionKind != "" && *leaderLockName == "" {
+		err = fmt.Errorf("Flag leader-election requires leader-lock.")
+	} else if *leaderLeaseDuration < 3*time.Second {
+		err = fmt.Errorf("Flag leader-lease-duration must be at least 3s. Value: %s.", *leaderLeaseDuration)
+	} else if *scriptTimeout <= 0 {
+		err = fmt.Errorf("Flag script-timeout must be positive. Value: %s.", *scriptTimeout)
+	} else if *wasmPluginTimeout <= 0 {
+		err = fmt.Errorf("Flag wasm-plugin-timeout must be positive. Value: %s.", *wasmPluginTimeout)
+	} else if *latencyMax <= 0 {
+		err = fmt.Errorf("Flag latency-max must be positive. Value: %s.", *latencyMax)
+	} else if *pacingSpeedup <= 0 {
+		err = fmt.Errorf("Flag pacing-speedup must be positive. Value: %f.", *pacingSpeedup)
+	} else if *pacingDelay < 0 {
+		err = fmt.Errorf("Flag pacing-delay must not be negative. Value: %s.", *pacingDelay)
+	} else if *smoothingWindow < 0 {
+		err = fmt.Errorf("Flag smoothing-window must not be negative. Value: %s.", *smoothingWindow)
+	} else if *alertWebhookFormat != "json" && *alertWebhookFormat != "slack" {
+		err = fmt.Errorf("Flag alert-webhook-format (%s) is not valid.", *alertWebhookFormat)
+	} else if *anomalyInterval <= 0 {
+		err = fmt.Errorf("Flag anomaly-interval must be positive. Value: %s.", *anomalyInterval)
+	} else if *anomalyWindows < 1 {
+		err = fmt.Errorf("Flag anomaly-windows must be at least 1. Value: %d.", *anomalyWindows)
+	} else if *anomalyDropRate < 0 || *anomalyDropRate >= 1 || *anomalyErrorRate < 0 || *anomalyErrorRate >= 1 {
+		err = fmt.Errorf("Flags anomaly-drop-rate and anomaly-error-rate must be between 0 and 1.")
+	} else if *anomalyVolumeFactor != 0 && *anomalyVolumeFactor <= 1 {
+		err = fmt.Errorf("Flag anomaly-volume-factor must be greater than 1. Value: %f.", *anomalyVolumeFactor)
+	} else if *anomalyVolumeWindows < 1 {
+		err = fmt.Errorf("Flag anomaly-volume-windows must be at least 1. Value: %d.", *anomalyVolumeWindows)
+	} else if *anomalyVolumeMinRate < 0 {
+		err = fmt.Errorf("Flag anomaly-volume-min-rate must not be negative. Value: %f.", *anomalyVolumeMinRate)
+	} else if *pathReportInterval < 0 {
+		err = fmt.Errorf("Flag path-report-interval must not be negative. Value: %s.", *pathReportInterval)
+	} else if *fingerprintReportInterval < 0 {
+		err = fmt.Errorf("Flag fingerprint-report-interval must not be negative. Value: %s.", *fingerprintReportInterval)
+	} else if *fingerprintReportFile != "" && !*fingerprintsEnabled {
+		err = fmt.Errorf("Flag fingerprint-report requires fingerprints.")
+	} else if *coverageReportInterval < 0 {
+		err = fmt.Errorf("Flag openapi-coverage-interval must not be negative. Value: %s.", *coverageReportInterval)
+	} else if *openAPIValidation != "" && *openAPIValidation != "report" && *openAPIValidation != "drop" {
+		err = fmt.Errorf("Flag openapi-validation (%s) is not valid.", *openAPIValidation)
+	} else if (*coverageReportFile != "" || *openAPIValidation != "") && *openAPISpecFile == "" {
+		err = fmt.Errorf("Flags openapi-coverage-report and openapi-validation require openapi-spec.")
+	} else if *pathReportTop < 1 {
+		err = fmt.Errorf("Flag path-report-top must be at least 1. Value: %d.", *pathReportTop)
+	} else if !validAffinityKey(*affinityKey) {
+		err = fmt.Errorf("Flag affinity-key (%s) must be like header:<name> or cookie:<name>.", *affinityKey)
+	} else if !validCookieJarKey(*cookieJarBy) {
+		err = fmt.Errorf("Flag cookie-jar (%s) must be source-ip, header:<name> or cookie:<name>.", *cookieJarBy)
+	} else if *xdpFilterEnabled && (*bpfExpr != "" || *filterEncap != "") {
+		err = fmt.Errorf("Flag xdp-filter implements the filter flags, so it cannot be used with bpf-filter or filter-encapsulation.")
+	} else if *xdpFilterEnabled && *quicPorts != "" {
+		err = fmt.Errorf("Flag xdp-filter captures TCP only, so it cannot be used with quic-ports.")
+	} else if *xdpMode != "generic" && *xdpMode != "native" {
+		err = fmt.Errorf("Flag xdp-mode (%s) is not valid.", *xdpMode)
+	} else if *captureEngine != "pcap" && *captureEngine != "pfring" && *captureEngine != "uds" && *captureEngine != "tls" && *captureEngine != "http" {
+		err = fmt.Errorf("Flag capture-engine (%s) is not valid.", *captureEngine)
+	} else if *pfringQueues < 0 {
+		err = fmt.Errorf("Flag pfring-queues must not be negative. Value: %d.", *pfringQueues)
+	} else if *captureEngine == "http" && *listenAddr == "" {
+		err = fmt.Errorf("Flag capture-engine http requires listen-addr.")
+	} else if *captureEngine == "uds" && *udsPaths == "" {
+		err = fmt.Errorf("Flag capture-engine uds requires uds-paths.")
+	} else if *captureEngine == "uds" && *filterMode != "dst" {
+		err = fmt.Errorf("Flag capture-engine uds captures the requests only, so filter-mode must be dst.")
+	} else if *captureEngine == "tls" && *tlsTargets == "" {
+		err = fmt.Errorf("Flag capture-engine tls requires tls-targets.")
+	} else if *captureEngine == "tls" && *filterMode != "dst" {
+		err = fmt.Errorf("Flag capture-engine tls captures the requests only, so filter-mode must be dst.")
+	} else if *tlsSide != "server" && *tlsSide != "client" {
+		err = fmt.Errorf("Flag tls-side (%s) is not valid.", *tlsSide)
+	} else if *tlsKeyLog != "" && *filterMode != "either" {
+		err = fmt.Errorf("Flag tls-keylog requires filter-mode either, to capture the server hello of the connections.")
+	} else if *tlsKeyLogWait <= 0 {
+		err = fmt.Errorf("Flag tls-keylog-wait must be positive. Value: %s.", *tlsKeyLogWait)
+	} else if *tlsPID < 0 {
+		err = fmt.Errorf("Flag tls-pid must not be negative. Value: %d.", *tlsPID)
+	} else if *diffEnabled && *filterMode != "either" {
+		err = fmt.Errorf("Flag diff requires filter-mode either, to capture the responses of production.")
+	} else if *diffSample < 0 || *diffSample > 1 {
+		err = fmt.Errorf("Flag diff-sample is not between 0 and 1. Value: %f.", *diffSample)
+	} else if *diffMaxPerMinute < 0 {
+		err = fmt.Errorf("Flag diff-max-per-minute must not be negative. Value: %d.", *diffMaxPerMinute)
+	} else if *scorecardInterval < 0 {
+		err = fmt.Errorf("Flag scorecard-interval must not be negative. Value: %s.", *scorecardInterval)
+	} else if *scorecardInterval > 0 && !*diffEnabled {
+		err = fmt.Errorf("Flag scorecard-interval requires diff.")
+	} else if *scorecardMinMatch < 0 || *scorecardMinMatch > 100 {
+		err = fmt.Errorf("Flag scorecard-min-match is not between 0 and 100. Value: %f.", *scorecardMinMatch)
+	} else if !validMetricsExporter(*metricsExporterKind) {
+		err = fmt.Errorf("Flag metrics-exporter (%s) is not valid.", *metricsExporterKind)
+	} else if *metricsExporterKind != "" && *metricsExporterKind != "cloudwatch" && *metricsExportAddr == "" {
+		err = fmt.Errorf("Flag metrics-exporter requires metrics-export-addr.")
+	} else if *metricsFlush <= 0 {
+		err = fmt.Errorf("Flag metrics-flush-interval must be positive. Value: %s.", *metricsFlush)
+	} else if *traceContext != "propagate" && *traceContext != "reparent" && *traceContext != "strip" {
+		err = fmt.Errorf("Flag trace-context (%s) is not valid.", *traceContext)
+	} else if *traceContext == "strip" && *traceSynthesize {
+		err = fmt.Errorf("Flag trace-context-synthesize cannot be used with trace-context strip.")
+	} else if _, err = parsePauseMode(*pauseModeFlag); err != nil {
+		err = fmt.Errorf("Flag %v", err)
+	} else if *routeTableJson == "" && *routeSource == "" {
+		err = fmt.Errorf("One of the flags route-table-json and route-table-source must be set.")
+	} else if *routeSource != "" {
+		routeSourceURL, err = parseRouteSource(*routeSource)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// everything is loaded first, and applied only if the whole configuration is
+	// valid, so that a reload either applies completely or not at all
+	var routes map[string]route
+	if *routeTableJson != "" {
+		// with a route table source, the JSON flag is only the initial route table
+		if err = json.Unmarshal([]byte(*routeTableJson), &routes); err == nil {
+			err = validateRoutes(routes)
+		}
+	}
+	// the GeoIP database and the plugins are closed if the configuration is
+	// not published, or once it is replaced
+	current, conf := currentConfig(), newConfigSnapshot()
+	if err == nil && (*contentTypeInclude != "" || *contentTypeExclude != "") {
+		conf.contentTypes = newContentTypeFilter(*contentTypeInclude, *contentTypeExclude)
+	}
+	if err == nil && *bodyRulesFile != "" {
+		conf.bodyRules, err = loadBodyRules(*bodyRulesFile, *bodyRulesMaxBytes)
+	}
+	if err == nil && *geoDatabase != "" {
+		conf.geo, err = openGeoFilter(*geoDatabase, *geoCountries)
+	} else if err == nil && (*geoCountries != "" || *geoHeader) {
+		err = fmt.Errorf("Flags geoip-countries and geoip-header require geoip-database.")
+	}
+	if err == nil && *maxBytesPerSec > 0 {
+		conf.bandwidth = newByteRateLimiter(*maxBytesPerSec)
+	}
+	if err == nil && *latencyInjection != "" {
+		if conf.latency, err = parseLatencyDistribution(*latencyInjection); err != nil {
+			err = fmt.Errorf("Flag latency-injection is not valid: %v.", err)
+		}
+	}
+	if err == nil && *injectFaults != "" {
+		conf.faults, err = parseRequestFaults(*injectFaults)
+	}
+	if err == nil && (*scheduleSpec != "" || *scheduleFrom != "" || *scheduleUntil != "") {
+		conf.schedule, err = parseSchedule(*scheduleSpec, *scheduleFrom, *scheduleUntil, *scheduleTZ)
+	}
+	if err == nil && *assertionsFile != "" {
+		conf.assertions, err = loadAssertions(*assertionsFile)
+	}
+	if *pathStatsEnabled {
+		// keep the statistics since the start across reloads
+		if conf.paths = current.paths; conf.paths == nil {
+			conf.paths = newPathStatistics()
+		}
+	}
+	if *fingerprintsEnabled {
+		if conf.fingerprints = current.fingerprints; conf.fingerprints == nil {
+			conf.fingerprints = newRequestFingerprints()
+		}
+	}
+	if err == nil && *openAPISpecFile != "" {
+		var spec *openAPISpec
+		if spec, err = loadOpenAPISpec(*openAPISpecFile); err == nil {
+			conf.coverage = newAPICoverage(spec, current.coverage)
+		}
+	}
+	if *ja3Enabled {
+		if conf.ja3 = current.ja3; conf.ja3 == nil {
+			conf.ja3 = newJA3Statistics()
+		}
+	}
+	if err == nil {
+		conf.pathTemplates, err = parsePathTemplates(*pathTemplatesFlag)
+	}
+	if err == nil {
+		conf.bodyFieldSets, err = parseBodyFieldSets(*setBodyFieldsList)
+	}
+	if *multipartFiles != "keep" {
+		conf.multipart = &multipartStripper{mode: *multipartFiles, maxBytes: *multipartFileMaxBytes}
+	}
+	if err == nil {
+		conf.vlanIDs, err = parseVLANIDs(*filterVLANIDs)
+	}
+	var diffRules *diffRules
+	if err == nil && *diffEnabled {
+		diffRules, err = loadDiffRules(*diffRulesFile)
+	}
+	if err == nil && *scriptFile != "" {
+		var script *requestScript
+		if script, err = loadRequestScript(*scriptFile, *scriptTimeout); err == nil {
+			conf.hooks = append(conf.hooks, script)
+		}
+	}
+	if err == nil && *wasmPlugins != "" {
+		for _, path := range strings.Split(*wasmPlugins, ",") {
+			var plugin *wasmPlugin
+			if plugin, err = loadWasmPlugin(strings.TrimSpace(path), *wasmPluginTimeout); err != nil {
+				break
+			}
+			conf.hooks = append(conf.hooks, plugin)
+		}
+	}
+	if *pacing && current.pacer != nil && current.pacer.speedup == *pacingSpeedup && current.pacer.delay == *pacingDelay {
+		conf.pacer = current.pacer
+	} else if *pacing {
+		conf.pacer = newRequestPacer(*pacingSpeedup, *pacingDelay)
+	}
+	if err != nil {
+		conf.close(nil)
+		return nil, err
+	}
+
+	if conf.fingerprints != nil {
+		// the statistics are shared with the current configuration
+		conf.fingerprints.setIgnoredParams(*fingerprintIgnoreParams)
+	}
+	if (*guardrailMaxErrorRate > 0 || *guardrailMaxP99 > 0) && fwdGuardrail == nil {
+		fwdGuardrail = &errorBudgetGuardrail{}
+	}
+	if *ecsClusters != "" && fwdECS == nil {
+		fwdECS = newECSAttribution(*ecsClusters)
+	}
+	if *sourceNames != "" && fwdSourceNames == nil {
+		fwdSourceNames = newSourceNameResolver(*sourceNames, *sourceNameCacheSize)
+	}
+	if diffRules != nil && fwdDiffs == nil {
+		fwdDiffs = newResponseDiffs(diffRules)
+		if *diffOutput != "" {
+			if fwdDiffStore, err = openDiffStore(*diffOutput, *diffSample, *diffMaxPerMinute); err != nil {
+				conf.close(nil)
+				return nil, err
+			}
+		}
+		if *scorecardInterval > 0 {
+			if fwdScorecard, err = newShadowScorecard(*scorecardOutput); err != nil {
+				conf.close(nil)
+				return nil, err
+			}
+		}
+	} else if diffRules != nil {
+		fwdDiffs.setRules(diffRules)
+	}
+	if *cookieJarBy != "" && fwdCookieJars == nil {
+		fwdCookieJars = newClientCookieJars(*cookieJarBy)
+	}
+	if *affinity && fwdAffinity == nil {
+		fwdAffinity = newConnectionAffinity()
+	}
+	if *rawTCP && fwdRawSink == nil {
+		fwdRawSink = newRawTCPSink()
+	}
+	if *kubeAttribution && fwdKubePods == nil {
+		fwdKubePods = newKubePodAttribution()
+	}
+	// the routes are replaced along with the configuration, once nothing failed
+	if routes != nil && (routeSourceURL == nil || !reloading) {
+		fwdRoutes.set(routes)
+	}
+	publishConfig(conf)
+	return routeSourceURL, err
+}
+
+// Main runs the command with the arguments of os.Args. It dispatches to the
+// subcommands, which share the same flags and config loader:
+//
+//	capture   captures and forwards requests (the default)
+//	replay    forwards the requests of an archive recorded by capture -record,
+//	          or of access logs
+//	validate  checks the configuration and exits
+//	bench     pushes synthetic requests or packets through the pipeline
+//	bucket    prints the sampling bucket of header values or remote addresses
+//	diff-report  summarizes the response diffs stored with -diff-output
+//	service   installs or uninstalls the Windows service
+func Main() {
+	command, args := "capture", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	// a new slice: appending to os.Args[:1] would overwrite args, which shares its array
+	os.Args = append([]string{os.Args[0]}, args...)
+	flags.Parse(args)
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
+	}
+
+	if command == "validate" {
+		os.Exit(runValidate())
+	}
+	if command == "diff-report" {
+		if err := runDiffReport(flags.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if command == "service" {
+		if err := runServiceCommand(flags.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if command == "bucket" {
+		if err := runBucket(flags.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// a config file with pipelines runs a capture process per pipeline
+	if command == "capture" && *configFile != "" && *pipelineName == "" {
+		pipelines, err := configPipelines(*configFile)
+		if err == nil && len(pipelines) > 0 {
+			err = runPipelines(pipelines)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(pipelines) > 0 {
+			return
+		}
+	}
+	if *pipelineName != "" {
+		log.SetPrefix("[" + *pipelineName + "] ")
+	}
+
+	routeSourceURL, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch command {
+	case "capture":
+		var isService bool
+		capture := func() error {
+			pauseOnSignal, _ := parsePauseMode(*pauseModeFlag)
+			go handleSignals(pauseOnSignal)
+			return runCapture(routeSourceURL)
+		}
+		if isService, err = runService(capture); !isService && err == nil {
+			err = capture()
+		}
+	case "replay":
+		if err = startServices(routeSourceURL); err == nil {
+			err = runReplay()
+		}
+	case "bench":
+		err = runBench()
+	default:
+		err = fmt.Errorf("Unknown command %s. Valid commands are: capture, replay, validate, bench, bucket, diff-report, service.", command)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadConfig applies the config file, if any, and sets up the flags.
+func loadConfig() (*url.URL, error) {
+	recordCommandLineFlags()
+	if *configFile != "" {
+		if err := applyConfigFile(flags, *configFile, commandLineFlags); err != nil {
+			return nil, err
+		}
+	}
+	routeSourceURL, err := setupFlags()
+	if err == nil && *dryRunFile != "" {
+		dryRunOutput, err = openDryRunRecorder(*dryRunFile)
+	}
+	if err == nil && *quarantineFile != "" {
+		fwdQuarantine, err = openQuarantineSink(*quarantineFile, *quarantineMaxSize)
+	}
+	if err == nil && *stubMode {
+		fwdStub, err = newStubSink(*stubStatus, *stubBody, *stubLatency, *stubFile)
+	}
+	if err == nil && *archiveKeyFile != "" {
+		err = archiveKeys.loadLocalKeys(*archiveKeyFile)
+	}
+	if err == nil && *tlsKeyLog != "" {
+		fwdKeyLog, err = openKeyLog(*tlsKeyLog)
+	}
+	if err == nil && *fleetDedup != "" {
+		fwdFleetDedup, err = newFleetDeduplicator(*fleetDedup)
+	}
+	if err == nil && *leaderElectionKind != "" {
+		fwdLeader, err = newLeaderElection(*leaderElectionKind, *leaderLockName, *leaderLeaseDuration, *leaderSinks)
+	}
+	if err == nil && *shard != "" {
+		if fwdShard, err = parseHashShard(*shard); err == nil {
+			stats.set("shard_buckets", int64(fwdShard.count))
+			log.Println("Forwarding", fwdShard.count, "of the", shardBuckets, "buckets of the connections")
+		}
+	}
+	if err == nil && *flowExport != "" {
+		fwdFlows, err = newFlowTable(*flowExport, *flowExportFormat, uint32(*flowExportPEN))
+	}
+	if err == nil && tuneRuntime {
+		err = tuneCPUs()
+	}
+	if err == nil && tuneRuntime {
+		tuneMemory()
+	}
+	if err != nil {
+		return nil, err
+	}
+	setSamplingPercentage(*fwdPerc)
+	return routeSourceURL, nil
+}
+
+// startServices starts the background services shared by capture and replay.
+// It returns an error if the admin API cannot listen.
+func startServices(routeSourceURL *url.URL) error {
+	// Resolve service discovery destinations of the route table
+	go fwdRoutes.refreshLoop(*routeRefresh)
+	if routeSourceURL != nil {
+		go watchRouteSource(fwdRoutes, routeSourceURL)
+	}
+
+	// Attribute source IPs to ECS tasks
+	if fwdECS != nil {
+		go fwdECS.refreshLoop(*ecsRefresh)
+	}
+
+	// Follow the mirroring schedule
+	go watchSchedule()
+
+	// Export the captured flows
+	if fwdFlows != nil {
+		go fwdFlows.exportLoop(*flowIdleTimeout, *flowActiveTimeout)
+	}
+
+	// Watch the packets dropped before capture
+	if *captureDropInterval > 0 {
+		go watchCaptureDrops(*captureDropInterval)
+	}
+
+	// Alert on the response assertions and the anomalies of the pipeline
+	go watchAssertions()
+	if *anomalies {
+		fwdRouteVolume = newRouteVolume()
+		go watchAnomalies()
+	}
+
+	// Pause forwarding when the shadow burns its error budget
+	if fwdGuardrail != nil {
+		go fwdGuardrail.watch(*guardrailWindow)
+	}
+
+	// Elect the instance that writes the leader sinks
+	if fwdLeader != nil {
+		go fwdLeader.run()
+	}
+
+	// Emit the shadow scorecards
+	if fwdScorecard != nil {
+		go fwdScorecard.emitLoop(*scorecardInterval)
+	}
+
+	// Report the top paths
+	// the statistics are kept across reloads
+	if paths := currentConfig().paths; paths != nil && *pathReportInterval > 0 {
+		go paths.reportLoop(*pathReportInterval, *pathReportTop)
+	}
+
+	// Report the endpoints seen
+	if fingerprints := currentConfig().fingerprints; fingerprints != nil && *fingerprintReportInterval > 0 {
+		go fingerprints.reportLoop(*fingerprintReportFile, *fingerprintReportInterval)
+	}
+
+	// Report the coverage of the OpenAPI spec
+	if *openAPISpecFile != "" && *coverageReportInterval > 0 {
+		go coverageReportLoop(*coverageReportFile, *coverageReportInterval)
+	}
+
+	// Push the metrics, for setups that do not scrape /metrics
+	if *metricsExporterKind != "" {
+		exporter, err := newMetricsExporter(*metricsExporterKind, *metricsExportAddr)
+		if err != nil {
+			log.Println("Error starting metrics exporter", ":", err)
+		} else {
+			go exportMetrics(exporter, *metricsFlush)
+		}
+	}
+
+	// Serve the admin API for runtime control
+	if *adminAddr != "" {
+		return serveAdmin(*adminAddr)
+	}
+	return nil
+}
+
+// runCapture implements the capture subcommand.
+func runCapture(routeSourceURL *url.URL) error {
+	var packets <-chan gopacket.Packet
+	var err error
+
+	if *recordFile != "" {
+		if fwdArchive, err = openArchiveWriter(*recordFile); err != nil {
+			return err
+		}
+		defer fwdArchive.close()
+		if *recordMaxDiskUsage > 0 || *recordMaxAge > 0 {
+			if err = fwdArchive.setupRetention(); err != nil {
+				return err
+			}
+		}
+	}
+	if err = startServices(routeSourceURL); err != nil {
+		return err
+	}
+
+	if *captureEngine == "http" {
+		return runHTTPIngest()
+	}
+	if *captureEngine == "uds" {
+		return runUDSCapture()
+	}
+	if *captureEngine == "tls" {
+		return runTLSCapture()
+	}
+
+	registerVXLANPorts()
+
+	// Set up pcap packet capture with the BPF filter
+	log.Printf("Starting capture on interface %s", *iface)
+	log.Println("Using BPF filter", bpfFilter())
+	if err = checkCaptureCapabilities(); err != nil {
+		return err
+	}
+	if *captureEngine == "pfring" {
+		err = openWithRetry(func() error {
+			packets, err = openPFRingCapture()
+			return err
+		}, *captureOpenRetry)
+	} else {
+		packets, err = livePackets()
+	}
+	if err != nil {
+		return err
+	}
+	if *xdpFilterEnabled {
+		xdp, err := attachXDPFilter(*iface)
+		if err != nil {
+			return err
+		}
+		captureMu.Lock()
+		fwdXDP = xdp
+		captureMu.Unlock()
+		defer detachXDPFilter()
+		log.Printf("Attached XDP filter to interface %s", *iface)
+	}
+	//Open a TCP Client, for NLB Health Checks only
+	if err := startHealthListener(); err != nil {
+		return err
+	}
+	beatCapture()
+	sdNotify("READY=1\nSTATUS=Capturing on " + *iface)
+	go watchdog()
+
+	// Set up assembly
+	streamFactory := &httpStreamFactory{}
+	streamPool := tcpassembly.NewStreamPool(streamFactory)
+	assembler := tcpassembly.NewAssembler(streamPool)
+
+	var dedup *retransmissionFilter
+	if *dedupRetransmissions {
+		dedup = newRetransmissionFilter()
+	}
+	var quic *quicTracker
+	if *quicPorts != "" {
+		quic = newQUICTracker(*quicPorts)
+	}
+
+	if *captureCPU >= 0 {
+		if err := pinCaptureThread(*captureCPU); err != nil {
+			return err
+		}
+		log.Println("Pinned the capture loop to CPU", *captureCPU)
+	}
+
+	log.Println("reading in packets")
+	// Read in packets, pass to assembler.
+	ticker := time.Tick(time.Minute)
+	liveness := time.Tick(time.Second)
+
+	for {
+		select {
+		case packet := <-packets:
+			// A nil packet indicates the end of the capture.
+			if packet == nil {
+				return captureError
+			}
+			network, tcp, ok := decapsulate(packet)
+			var udp *layers.UDP
+			if !ok && quic != nil {
+				network, udp, ok = decapsulateUDP(packet)
+			}
+			if !ok {
+				log.Println("Unusable packet")
+				continue
+			}
+			if !capturedVLAN(packet) {
+				stats.inc("packets_filtered_vlan")
+				continue
+			}
+			if currentPauseMode() == pauseDrop {
+				stats.inc("packets_dropped_paused")
+				continue
+			}
+			if fwdShard != nil && !fwdShard.packet(network, tcp, udp) {
+				stats.inc("packets_dropped_shard")
+				continue
+			}
+			seen := captureTime(packet.Metadata().Timestamp)
+			if fwdFlows != nil {
+				fwdFlows.packet(network, tcp, udp, seen)
+			}
+			if udp != nil {
+				quic.handle(network.NetworkFlow(), udp, seen)
+				continue
+			}
+			if dedup != nil && !dedup.filter(network.NetworkFlow(), tcp, seen) {
+				continue
+			}
+			streamFactory.segment = tcp
+			assembler.AssembleWithTimestamp(network.NetworkFlow(), tcp, seen)
+
+		case <-ticker:
+			// Every minute, flush connections that haven't seen activity in the past 1 minute.
+			assembler.FlushOlderThan(time.Now().Add(time.Minute * -1))
+			if dedup != nil {
+				dedup.expire(time.Now().Add(-currentConfig().dedupWindow))
+			}
+			if quic != nil {
+				quic.expire(time.Now().Add(time.Minute * -1))
+			}
+
+		case <-liveness:
+			// the watchdog pings systemd as long as the loop runs, even without traffic
+			beatCapture()
+
+		case <-captureStop:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+)
+
+// memoryBallast is allocated once and never touched, so that it counts in the
+// heap the GC paces itself on without being resident.
+var memoryBallast []byte
+
+// validGOGC reports whether the gogc flag is empty, off or a positive number.
+func validGOGC(value string) bool {
+	if value == "" || value == "off" {
+		return true
+	}
+	n, err := strconv.Atoi(value)
+	return err == nil && n > 0
+}
+
+// tuneMemory applies gogc, memory-limit and memory-ballast at startup. The
+// flags are validated by setupFlags; without them, the GOGC and GOMEMLIMIT
+// environment variables apply.
+func tuneMemory() {
+	switch *gogc {
+	case "":
+	case "off":
+		debug.SetGCPercent(-1)
+		log.Println("GC disabled until the memory limit")
+	default:
+		percent, _ := strconv.Atoi(*gogc)
+		debug.SetGCPercent(percent)
+		log.Println("GOGC set to", percent)
+	}
+	if *memoryLimit > 0 {
+		debug.SetMemoryLimit(*memoryLimit)
+		log.Println("GOMEMLIMIT set to", *memoryLimit, "bytes")
+	}
+	if *memoryBallastSize > 0 {
+		memoryBallast = make([]byte, *memoryBallastSize)
+		log.Println("Allocated a heap ballast of", *memoryBallastSize, "bytes")
+	}
+	// SetGCPercent is the only way to read the percent in use
+	percent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(percent)
+	stats.set("gc_percent", int64(percent))
+}
+
+// recordMemoryGauges sets the gauges of the heap and of the pauses of the
+// last GC cycles, at most 256, in microseconds.
+func recordMemoryGauges() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats.set("heap_alloc_bytes", int64(m.HeapAlloc))
+	stats.set("heap_inuse_bytes", int64(m.HeapInuse))
+	stats.set("heap_sys_bytes", int64(m.HeapSys))
+	stats.set("heap_objects", int64(m.HeapObjects))
+	stats.set("gc_next_bytes", int64(m.NextGC))
+	stats.set("gc_cycles", int64(m.NumGC))
+	stats.set("gc_cpu_fraction_ppm", int64(m.GCCPUFraction*1e6))
+
+	cycles := int(m.NumGC)
+	if cycles > len(m.PauseNs) {
+		cycles = len(m.PauseNs)
+	}
+	if cycles == 0 {
+		return
+	}
+	// PauseNs is a circular buffer, full after as many cycles as its length
+	pauses := append([]uint64(nil), m.PauseNs[:cycles]...)
+	sort.Slice(pauses, func(i, j int) bool { return pauses[i] < pauses[j] })
+	for _, q := range []struct {
+		name     string
+		quantile float64
+	}{{"gc_pause_p50_us", 0.5}, {"gc_pause_p90_us", 0.9}, {"gc_pause_p99_us", 0.99}, {"gc_pause_max_us", 1}} {
+		i := int(q.quantile*float64(cycles)+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= cycles {
+			i = cycles - 1
+		}
+		stats.set(q.name, int64(pauses[i]/1000))
+	}
+}
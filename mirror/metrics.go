@@ -0,0 +1,238 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metricsRegistry holds the counters and gauges of the mirroring pipeline, keyed by name.
+type metricsRegistry struct {
+	mu       sync.RWMutex
+	counters map[string]*int64
+	// gauges holds the names of the metrics set rather than incremented
+	gauges map[string]bool
+	// histograms holds the names of the histograms, see observe
+	histograms map[string]bool
+}
+
+var stats = &metricsRegistry{counters: map[string]*int64{}, gauges: map[string]bool{}, histograms: map[string]bool{}}
+
+// sizeBuckets are the upper bounds of the size histograms, in bytes.
+var sizeBuckets = []int64{128, 1024, 8 * 1024, 64 * 1024, 512 * 1024, 4 * 1024 * 1024}
+
+// get returns the counter name, creating it if needed.
+func (r *metricsRegistry) get(name string) *int64 {
+	r.mu.RLock()
+	c, ok := r.counters[name]
+	r.mu.RUnlock()
+	if !ok {
+		r.mu.Lock()
+		if c, ok = r.counters[name]; !ok {
+			c = new(int64)
+			r.counters[name] = c
+		}
+		r.mu.Unlock()
+	}
+	return c
+}
+
+// add increments the counter name by delta.
+func (r *metricsRegistry) add(name string, delta int64) {
+	atomic.AddInt64(r.get(name), delta)
+}
+
+// set sets name to value, for metrics that are gauges rather than counters.
+func (r *metricsRegistry) set(name string, value int64) {
+	c := r.get(name)
+	r.mu.RLock()
+	gauge := r.gauges[name]
+	r.mu.RUnlock()
+	if !gauge {
+		r.mu.Lock()
+		r.gauges[name] = true
+		r.mu.Unlock()
+	}
+	atomic.StoreInt64(c, value)
+}
+
+// observe records value in the histogram name, made of the counters
+// name_bucket{le="<bound>"} (cumulative, like Prometheus histograms), name_sum
+// and name_count.
+func (r *metricsRegistry) observe(name string, value int64, buckets []int64) {
+	r.mu.RLock()
+	known := r.histograms[name]
+	r.mu.RUnlock()
+	if !known {
+		r.mu.Lock()
+		r.histograms[name] = true
+		r.mu.Unlock()
+	}
+	for _, b := range buckets {
+		if value <= b {
+			r.inc(labeled(name+"_bucket", "le", strconv.FormatInt(b, 10)))
+		}
+	}
+	r.inc(labeled(name+"_bucket", "le", "+Inf"))
+	r.add(name+"_sum", value)
+	r.inc(name + "_count")
+}
+
+// histogramOf returns the histogram the metric name (without labels) is part of.
+func (r *metricsRegistry) histogramOf(name string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if base := strings.TrimSuffix(name, suffix); base != name && r.histograms[base] {
+			return base, true
+		}
+	}
+	return "", false
+}
+
+// isGauge reports whether name is a gauge.
+func (r *metricsRegistry) isGauge(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.gauges[name]
+}
+
+func (r *metricsRegistry) inc(name string) {
+	r.add(name, 1)
+}
+
+// snapshot returns the current value of every counter.
+func (r *metricsRegistry) snapshot() map[string]int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	values := make(map[string]int64, len(r.counters))
+	for name, c := range r.counters {
+		values[name] = atomic.LoadInt64(c)
+	}
+	return values
+}
+
+// labeled returns the name of the metric name with labels, given as key and
+// value pairs, like requests_forwarded{namespace="default",workload="web"}.
+func labeled(name string, labels ...string) string {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// parseLabeled splits a metric name built by labeled into its base name and
+// its labels, as key and value pairs.
+func parseLabeled(metric string) (string, []string) {
+	i := strings.IndexByte(metric, '{')
+	if i < 0 || !strings.HasSuffix(metric, "}") {
+		return metric, nil
+	}
+	name, rest := metric[:i], metric[i+1:len(metric)-1]
+	var labels []string
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		quoted, err := strconv.QuotedPrefix(rest[eq+1:])
+		if err != nil {
+			break
+		}
+		value, _ := strconv.Unquote(quoted)
+		labels = append(labels, rest[:eq], value)
+		rest = strings.TrimPrefix(rest[eq+1+len(quoted):], ",")
+	}
+	return name, labels
+}
+
+// exportedMetric returns the name and the labels metric is exported with: those
+// given to labeled, and in a pipeline, the pipeline label, so that the series
+// of the pipelines of a config file, which share the exporters, stay apart.
+func exportedMetric(metric string) (string, []string) {
+	name, labels := parseLabeled(metric)
+	if *pipelineName != "" {
+		labels = append(labels, "pipeline", *pipelineName)
+	}
+	return name, labels
+}
+
+// writePrometheus writes the metrics in the Prometheus text exposition format,
+// with the mirror_ prefix.
+func (r *metricsRegistry) writePrometheus(w io.Writer) {
+	values := r.snapshot()
+	families := map[string][]string{}
+	for metric := range values {
+		name, _ := parseLabeled(metric)
+		if base, ok := r.histogramOf(name); ok {
+			name = base
+		}
+		families[name] = append(families[name], metric)
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		metrics := families[name]
+		sort.Slice(metrics, func(i, j int) bool { return histogramOrder(metrics[i], metrics[j]) })
+		kind := "counter"
+		if r.isGauge(metrics[0]) {
+			kind = "gauge"
+		} else if _, ok := r.histogramOf(strings.SplitN(metrics[0], "{", 2)[0]); ok {
+			kind = "histogram"
+		}
+		fmt.Fprintf(w, "# TYPE mirror_%s %s\n", name, kind)
+		for _, metric := range metrics {
+			exported := metric
+			if *pipelineName != "" {
+				name, labels := exportedMetric(metric)
+				exported = labeled(name, labels...)
+			}
+			fmt.Fprintf(w, "mirror_%s %d\n", exported, values[metric])
+		}
+	}
+}
+
+// histogramOrder sorts the metrics by name, with the buckets of histograms in
+// increasing order of their bounds and before the sum and the count.
+func histogramOrder(a, b string) bool {
+	nameA, labelsA := parseLabeled(a)
+	nameB, labelsB := parseLabeled(b)
+	if nameA != nameB || len(labelsA) != 2 || len(labelsB) != 2 || labelsA[0] != "le" || labelsB[0] != "le" {
+		return a < b
+	}
+	if labelsA[1] == "+Inf" || labelsB[1] == "+Inf" {
+		return labelsB[1] == "+Inf" && labelsA[1] != "+Inf"
+	}
+	boundA, _ := strconv.ParseInt(labelsA[1], 10, 64)
+	boundB, _ := strconv.ParseInt(labelsB[1], 10, 64)
+	return boundA < boundB
+}
+
+// recordPipelineGauges sets the gauges that are sampled rather than updated as
+// they change: the forwards in flight, the requests waiting for the previous
+// ones of their connection, the packets dropped by the capture and by the
+// XDP filter, and the heap and GC pauses.
+func recordPipelineGauges() {
+	recordMemoryGauges()
+	stats.set("forwards_in_flight", atomic.LoadInt64(&fwdInFlight))
+	if currentConfig().ordering == "connection" {
+		stats.set("ordering_queued", atomic.LoadInt64(&fwdOrderingQueued))
+	}
+	if _, dropped, ok := captureCounts(); ok {
+		stats.set("pcap_packets_dropped", int64(dropped))
+	}
+	if dropped, ok := xdpDropped(); ok {
+		stats.set("xdp_packets_dropped", dropped)
+	}
+}
@@ -0,0 +1,136 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package mirror captures HTTP requests on a network interface, usually the
+// VXLAN interface of a traffic mirror session, and forwards them to shadow
+// destinations. The http-requests-mirroring command runs it with Main; other Go
+// programs embed it with a Mirror.
+package mirror
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Mirror is a request mirror embedded in another Go program. It is configured
+// with the flags of the command, e.g.
+//
+//	m, err := mirror.New([]string{"-interface", "eth0", "-route-table-json", `{"*": "http://shadow"}`})
+//
+// The mirror keeps its configuration in package state, like the command: the
+// flags, the published configuration snapshot, the route table, the sinks and
+// the stats. So a process has at most one Mirror, and New fails the second time
+// it is called. A stopped Mirror cannot be started again, its capture being
+// stopped for the life of the process. The capture, reassembly, parsing,
+// filtering and sinks are internal to this package rather than packages of
+// their own: programs embed the whole pipeline through Mirror.
+type Mirror struct {
+	routeSourceURL *url.URL
+	started        bool
+	done           chan struct{}
+	err            error
+}
+
+var mirrorCreated int32
+
+// Option changes how New sets up the mirror within the program.
+type Option func()
+
+// WithHealthCheck opens the NLB health check listener on TCP 4789 while the
+// mirror captures, like the command.
+func WithHealthCheck() Option {
+	return func() { healthCheck = true }
+}
+
+// WithRuntimeTuning applies the flags that tune the whole process, like the
+// command: gomaxprocs, worker-cpus, gogc, memory-limit and memory-ballast.
+func WithRuntimeTuning() Option {
+	return func() { tuneRuntime = true }
+}
+
+// New configures the mirror from the flags in args, and the config file of the
+// config flag, if any. Unlike the command, the mirror does not open the health
+// check listener, nor tune the Go runtime of the program, unless options ask.
+func New(args []string, options ...Option) (*Mirror, error) {
+	if !atomic.CompareAndSwapInt32(&mirrorCreated, 0, 1) {
+		return nil, fmt.Errorf("A process has at most one Mirror.")
+	}
+	healthCheck, tuneRuntime = false, false
+	for _, option := range options {
+		option()
+	}
+	// an invalid flag is an error rather than an exit
+	flags.Init(flags.Name(), flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments %v.", flags.Args())
+	}
+	routeSourceURL, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{routeSourceURL: routeSourceURL, done: make(chan struct{})}, nil
+}
+
+// Start captures and forwards requests in the background, with the services of
+// the configuration, like the admin API. Unlike the command, the mirror does not
+// handle signals: the program stops it with Stop, and reloads it with
+// UpdateConfig. Start is called once. If the admin API or the health check
+// listener cannot listen, the capture ends with the error, see Done and Err.
+func (m *Mirror) Start() {
+	m.started = true
+	go func() {
+		m.err = runCapture(m.routeSourceURL)
+		close(m.done)
+	}()
+}
+
+// Stop stops the capture, then waits up to timeout for the forwards in flight,
+// and cancels them past it. It returns the error that ended the capture, if any.
+// The mirror cannot be started again after Stop.
+func (m *Mirror) Stop(timeout time.Duration) error {
+	stopCapture()
+	shutdown(timeout)
+	if !m.started {
+		return nil
+	}
+	<-m.done
+	return m.err
+}
+
+// Done is closed when the capture ends, on Stop or on error, see Err.
+func (m *Mirror) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns the error that ended the capture, once Done is closed.
+func (m *Mirror) Err() error {
+	return m.err
+}
+
+// UpdateConfig sets the flags in args over the current configuration, like a
+// reload of the config file: if the new configuration is invalid, or changes
+// flags that require a restart, nothing is changed.
+func (m *Mirror) UpdateConfig(args []string) error {
+	return reloadFlags(func(fs *flag.FlagSet) error {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		// reloads of the config file keep these flags, like command line flags
+		fs.Visit(func(f *flag.Flag) {
+			commandLineFlags[f.Name] = true
+		})
+		return nil
+	}, "UpdateConfig")
+}
+
+// Stats returns the counters and gauges of the pipeline, like GET /stats of the
+// admin API.
+func (m *Mirror) Stats() map[string]int64 {
+	return stats.snapshot()
+}
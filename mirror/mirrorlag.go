@@ -0,0 +1,48 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// lagBuckets are the upper bounds of the mirror_lag_ms histogram, in milliseconds.
+var lagBuckets = []int64{1, 5, 10, 50, 100, 500, 1000, 5000, 30000}
+
+// mirrorLagMax is the longest mirror lag since the last takeMaxMirrorLag, in nanoseconds.
+var mirrorLagMax int64
+
+// captureTime returns the capture timestamp of a packet read now, on the clock
+// of the process. The timestamps of the kernel or the NIC may come from
+// another clock than the process: a timestamp in the future or older than
+// max-clock-skew is replaced by the time the packet is read. The returned time
+// keeps the monotonic reading of now, so the mirror lag is not affected by
+// later steps of the wall clock.
+func captureTime(ts time.Time) time.Time {
+	now := time.Now()
+	d := now.Sub(ts)
+	if d < 0 || d > currentConfig().maxClockSkew {
+		stats.inc("capture_clock_skew")
+		return now
+	}
+	return now.Add(-d)
+}
+
+// recordMirrorLag records the time between the capture of a request and the
+// completion of its forward.
+func recordMirrorLag(lag time.Duration) {
+	stats.observe("mirror_lag_ms", lag.Milliseconds(), lagBuckets)
+	for {
+		max := atomic.LoadInt64(&mirrorLagMax)
+		if int64(lag) <= max || atomic.CompareAndSwapInt64(&mirrorLagMax, max, int64(lag)) {
+			return
+		}
+	}
+}
+
+// takeMaxMirrorLag returns the longest mirror lag since the previous call.
+func takeMaxMirrorLag() time.Duration {
+	return time.Duration(atomic.SwapInt64(&mirrorLagMax, 0))
+}
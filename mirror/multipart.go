@@ -0,0 +1,114 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+)
+
+// multipartStripper rewrites multipart/form-data bodies as they are read from
+// the capture: the form fields are kept, and the file parts are dropped or
+// truncated, so that large uploads are never held in memory. The body is
+// re-encoded with the boundary of the request, so its Content-Type is still
+// valid, and forwarded with its new length.
+type multipartStripper struct {
+	// mode is drop or truncate
+	mode string
+	// maxBytes is the size file parts are truncated to
+	maxBytes int64
+}
+
+// readBody reads the body of a captured request, through the multipart stripper
+// if the body is a multipart form.
+func readBody(conf *configSnapshot, req *http.Request) ([]byte, error) {
+	s := conf.multipart
+	if s == nil {
+		return ioutil.ReadAll(req.Body)
+	}
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return ioutil.ReadAll(req.Body)
+	}
+	return s.rewrite(req.Body, params["boundary"])
+}
+
+// errorRecorder remembers the error of the reader under the multipart reader,
+// which are the errors of the capture rather than of the multipart encoding.
+type errorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+func (s *multipartStripper) rewrite(body io.Reader, boundary string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if w.SetBoundary(boundary) != nil {
+		// the boundary cannot be written back: the body is forwarded as is
+		return ioutil.ReadAll(body)
+	}
+	src := &errorRecorder{r: body}
+	r := multipart.NewReader(src, boundary)
+	for {
+		// raw parts keep their Content-Transfer-Encoding
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = s.copyPart(w, part)
+		}
+		if src.err != nil {
+			// the capture ended within the body, like ioutil.ReadAll
+			w.Close()
+			return buf.Bytes(), src.err
+		}
+		if err != nil {
+			// the parts before the malformed one are forwarded
+			stats.inc("multipart_errors")
+			break
+		}
+	}
+	w.Close()
+	// the rest of the body, like the epilogue, is read to reach the next request
+	_, err := io.Copy(ioutil.Discard, src)
+	return buf.Bytes(), err
+}
+
+func (s *multipartStripper) copyPart(w *multipart.Writer, part *multipart.Part) error {
+	defer part.Close()
+	if part.FileName() != "" && s.mode == "drop" {
+		stats.inc("multipart_files_dropped")
+		_, err := io.Copy(ioutil.Discard, part)
+		return err
+	}
+	pw, err := w.CreatePart(part.Header)
+	if err != nil {
+		return err
+	}
+	if part.FileName() == "" {
+		_, err = io.Copy(pw, part)
+		return err
+	}
+	if _, err := io.CopyN(pw, part, s.maxBytes); err != nil && err != io.EOF {
+		return err
+	}
+	n, err := io.Copy(ioutil.Discard, part)
+	if n > 0 {
+		stats.inc("multipart_files_truncated")
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// setIdempotencyKey sets the idempotency key header of unsafe requests to the
+// mirror request ID, which replays of an archive keep, so that a shadow which
+// honors the header applies every captured write at most once.
+func setIdempotencyKey(conf *configSnapshot, header http.Header, method, requestID string) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return
+	}
+	header.Set(conf.idempotencyKeyHeader, requestID)
+	stats.inc("idempotency_keys_set")
+}
+
+// bodyFieldSet overwrites a field of JSON request bodies, e.g. dry_run=true.
+type bodyFieldSet struct {
+	// path is the dot separated path of the field, array elements by index
+	path  []string
+	value interface{}
+}
+
+// parseBodyFieldSets parses a comma separated list of field=value assignments.
+// Values are JSON scalars, or strings if they are not valid JSON.
+func parseBodyFieldSets(list string) ([]bodyFieldSet, error) {
+	var sets []bodyFieldSet
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Flag set-body-fields contains an invalid assignment (%s).", s)
+		}
+		set := bodyFieldSet{path: strings.Split(parts[0], ".")}
+		dec := json.NewDecoder(strings.NewReader(parts[1]))
+		dec.UseNumber()
+		if dec.Decode(&set.value) != nil || dec.More() {
+			set.value = parts[1]
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// setBodyFields applies the assignments to a JSON body, and returns the body
+// unchanged if it is not a JSON document.
+func setBodyFields(req *http.Request, body []byte, sets []bodyFieldSet) []byte {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return body
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	// numbers are kept as written
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		stats.inc("body_field_set_errors")
+		return body
+	}
+	for _, set := range sets {
+		if !setJSONField(&doc, set.path, set.value) {
+			stats.inc("body_field_set_errors")
+			return body
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		stats.inc("body_field_set_errors")
+		return body
+	}
+	stats.inc("body_fields_set")
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// setJSONField sets the value at path, creating the missing objects on the way.
+// It fails if the path goes through a scalar or a missing array element.
+func setJSONField(node *interface{}, path []string, value interface{}) bool {
+	if len(path) == 0 {
+		*node = value
+		return true
+	}
+	if *node == nil {
+		*node = map[string]interface{}{}
+	}
+	switch v := (*node).(type) {
+	case map[string]interface{}:
+		child := v[path[0]]
+		if !setJSONField(&child, path[1:], value) {
+			return false
+		}
+		v[path[0]] = child
+		return true
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(v) {
+			return false
+		}
+		return setJSONField(&v[i], path[1:], value)
+	}
+	return false
+}
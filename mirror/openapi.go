@@ -0,0 +1,232 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// openAPIDocument is the part of an OpenAPI 3 or Swagger 2 document used to
+// match the requests to its operations and to validate them. JSON documents
+// are read as YAML.
+type openAPIDocument struct {
+	Swagger    string                     `yaml:"swagger"`
+	OpenAPI    string                     `yaml:"openapi"`
+	BasePath   string                     `yaml:"basePath"`
+	Servers    []openAPIServer            `yaml:"servers"`
+	Paths      map[string]openAPIPathItem `yaml:"paths"`
+	Components openAPIComponents          `yaml:"components"`
+	// the components of Swagger 2 documents
+	Definitions map[string]*openAPISchema    `yaml:"definitions"`
+	Parameters  map[string]*openAPIParameter `yaml:"parameters"`
+}
+
+type openAPIComponents struct {
+	Schemas       map[string]*openAPISchema      `yaml:"schemas"`
+	Parameters    map[string]*openAPIParameter   `yaml:"parameters"`
+	RequestBodies map[string]*openAPIRequestBody `yaml:"requestBodies"`
+}
+
+type openAPIServer struct {
+	URL string `yaml:"url"`
+}
+
+type openAPIPathItem struct {
+	Get     *openAPIOperation `yaml:"get"`
+	Put     *openAPIOperation `yaml:"put"`
+	Post    *openAPIOperation `yaml:"post"`
+	Delete  *openAPIOperation `yaml:"delete"`
+	Options *openAPIOperation `yaml:"options"`
+	Head    *openAPIOperation `yaml:"head"`
+	Patch   *openAPIOperation `yaml:"patch"`
+	Trace   *openAPIOperation `yaml:"trace"`
+	// Parameters are those of all the operations of the path
+	Parameters []*openAPIParameter `yaml:"parameters"`
+}
+
+type openAPIOperation struct {
+	OperationID string              `yaml:"operationId"`
+	Parameters  []*openAPIParameter `yaml:"parameters"`
+	RequestBody *openAPIRequestBody `yaml:"requestBody"`
+}
+
+// operations returns the operations of the path item by method.
+func (p openAPIPathItem) operations() map[string]*openAPIOperation {
+	all := map[string]*openAPIOperation{
+		http.MethodGet: p.Get, http.MethodPut: p.Put, http.MethodPost: p.Post, http.MethodDelete: p.Delete,
+		http.MethodOptions: p.Options, http.MethodHead: p.Head, http.MethodPatch: p.Patch, http.MethodTrace: p.Trace,
+	}
+	for method, operation := range all {
+		if operation == nil {
+			delete(all, method)
+		}
+	}
+	return all
+}
+
+// apiOperation is an operation of the spec, matched by the method and the path
+// of the requests.
+type apiOperation struct {
+	index  int
+	method string
+	path   string
+	id     string
+	// patterns match the path after each server of the spec, capturing the
+	// path parameters of names, and params and literal rank the paths:
+	// /users/me is matched before /users/{id}
+	patterns []*regexp.Regexp
+	names    [][]string
+	params   int
+	literal  int
+	// parameters and body are those the requests are validated against
+	parameters []*openAPIParameter
+	body       *openAPIRequestBody
+}
+
+// openAPISpec holds the operations of an OpenAPI document.
+type openAPISpec struct {
+	doc        openAPIDocument
+	operations []*apiOperation
+	// byMethod lists the operations of each method, the most specific paths
+	// first, and patterns caches the compiled patterns of the schemas
+	byMethod map[string][]*apiOperation
+	patterns sync.Map
+}
+
+var openAPIPathParam = regexp.MustCompile(`\{[^{}/]+\}`)
+
+// loadOpenAPISpec reads the OpenAPI 3 or Swagger 2 document path, in YAML or
+// JSON.
+func loadOpenAPISpec(path string) (*openAPISpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc openAPIDocument
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Error reading OpenAPI document %s: %v", path, err)
+	}
+	if doc.OpenAPI == "" && doc.Swagger == "" {
+		return nil, fmt.Errorf("Error reading OpenAPI document %s: no openapi or swagger version.", path)
+	}
+
+	// the paths of the operations are relative to the servers
+	prefixes := []string{doc.BasePath}
+	if len(doc.Servers) > 0 {
+		prefixes = nil
+		for _, server := range doc.Servers {
+			prefixes = append(prefixes, serverPath(server.URL))
+		}
+	}
+	spec := &openAPISpec{doc: doc, byMethod: map[string][]*apiOperation{}}
+	for template, item := range doc.Paths {
+		if !strings.HasPrefix(template, "/") {
+			return nil, fmt.Errorf("Error reading OpenAPI document %s: path %s does not start with /.", path, template)
+		}
+		for method, operation := range item.operations() {
+			op := &apiOperation{method: method, path: template, id: operation.OperationID}
+			for _, prefix := range prefixes {
+				pattern, names, literal := compileOpenAPIPath(strings.TrimSuffix(prefix, "/") + template)
+				op.patterns, op.names = append(op.patterns, pattern), append(op.names, names)
+				op.params, op.literal = len(names), literal
+			}
+			if err := spec.setupValidation(op, item, operation); err != nil {
+				return nil, fmt.Errorf("Error reading OpenAPI document %s: %s %s: %v", path, method, template, err)
+			}
+			spec.operations = append(spec.operations, op)
+		}
+	}
+	sort.Slice(spec.operations, func(i, j int) bool {
+		a, b := spec.operations[i], spec.operations[j]
+		if a.path != b.path {
+			return a.path < b.path
+		}
+		return a.method < b.method
+	})
+	for i, op := range spec.operations {
+		op.index = i
+		spec.byMethod[op.method] = append(spec.byMethod[op.method], op)
+	}
+	for _, ops := range spec.byMethod {
+		sort.SliceStable(ops, func(i, j int) bool {
+			if ops[i].params != ops[j].params {
+				return ops[i].params < ops[j].params
+			}
+			return ops[i].literal > ops[j].literal
+		})
+	}
+	return spec, nil
+}
+
+// serverPath returns the path of the URL of a server, which may be relative
+// and have {variables}.
+func serverPath(u string) string {
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+		if j := strings.IndexByte(u, '/'); j >= 0 {
+			return u[j:]
+		}
+		return ""
+	}
+	return u
+}
+
+// compileOpenAPIPath returns the pattern of a path template, in which each
+// {param} matches a non empty segment or part of a segment, with the names of
+// the params and the number of literal characters.
+func compileOpenAPIPath(template string) (*regexp.Regexp, []string, int) {
+	var b strings.Builder
+	b.WriteString("^")
+	var names []string
+	last, literal := 0, 0
+	for _, loc := range openAPIPathParam.FindAllStringIndex(template, -1) {
+		b.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		b.WriteString("([^/]+)")
+		names = append(names, template[loc[0]+1:loc[1]-1])
+		literal += loc[0] - last
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(template[last:]))
+	b.WriteString("$")
+	literal += len(template) - last
+	return regexp.MustCompile(b.String()), names, literal
+}
+
+// match returns the operation of req, or nil if no operation of the spec has
+// its method and path.
+func (s *openAPISpec) match(req *http.Request) *apiOperation {
+	path := requestPath(req)
+	for _, op := range s.byMethod[req.Method] {
+		for _, pattern := range op.patterns {
+			if pattern.MatchString(path) {
+				return op
+			}
+		}
+	}
+	return nil
+}
+
+// pathParams returns the values of the path parameters of op in the path of
+// req.
+func (op *apiOperation) pathParams(req *http.Request) map[string]string {
+	path := requestPath(req)
+	for i, pattern := range op.patterns {
+		if m := pattern.FindStringSubmatch(path); m != nil {
+			values := map[string]string{}
+			for j, name := range op.names[i] {
+				values[name] = m[j+1]
+			}
+			return values
+		}
+	}
+	return nil
+}
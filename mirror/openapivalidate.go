@@ -0,0 +1,552 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The kinds of violations of the OpenAPI spec, reported as the kind label of
+// openapi_violations.
+const (
+	violationParameter   = "parameter"
+	violationContentType = "content_type"
+	violationBody        = "body"
+)
+
+// openAPIMaxDepth bounds the references followed and the nesting of the values
+// validated, against recursive schemas.
+const openAPIMaxDepth = 32
+
+type openAPIParameter struct {
+	Ref      string         `yaml:"$ref"`
+	Name     string         `yaml:"name"`
+	In       string         `yaml:"in"`
+	Required bool           `yaml:"required"`
+	Schema   *openAPISchema `yaml:"schema"`
+	// Swagger 2 parameters other than the body have their schema inline
+	Type      openAPITypes   `yaml:"type"`
+	Items     *openAPISchema `yaml:"items"`
+	Enum      []interface{}  `yaml:"enum"`
+	Minimum   *float64       `yaml:"minimum"`
+	Maximum   *float64       `yaml:"maximum"`
+	MinLength *int           `yaml:"minLength"`
+	MaxLength *int           `yaml:"maxLength"`
+	Pattern   string         `yaml:"pattern"`
+}
+
+type openAPIRequestBody struct {
+	Ref      string                      `yaml:"$ref"`
+	Required bool                        `yaml:"required"`
+	Content  map[string]openAPIMediaType `yaml:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `yaml:"schema"`
+}
+
+// openAPISchema is the part of a schema object that is validated. The other
+// keywords, like format, are ignored.
+type openAPISchema struct {
+	Ref                  string                    `yaml:"$ref"`
+	Type                 openAPITypes              `yaml:"type"`
+	Nullable             bool                      `yaml:"nullable"`
+	Enum                 []interface{}             `yaml:"enum"`
+	Required             []string                  `yaml:"required"`
+	Properties           map[string]*openAPISchema `yaml:"properties"`
+	AdditionalProperties *openAPIAdditional        `yaml:"additionalProperties"`
+	Items                *openAPISchema            `yaml:"items"`
+	AllOf                []*openAPISchema          `yaml:"allOf"`
+	AnyOf                []*openAPISchema          `yaml:"anyOf"`
+	OneOf                []*openAPISchema          `yaml:"oneOf"`
+	MinLength            *int                      `yaml:"minLength"`
+	MaxLength            *int                      `yaml:"maxLength"`
+	Pattern              string                    `yaml:"pattern"`
+	Minimum              *float64                  `yaml:"minimum"`
+	Maximum              *float64                  `yaml:"maximum"`
+	MinItems             *int                      `yaml:"minItems"`
+	MaxItems             *int                      `yaml:"maxItems"`
+}
+
+// openAPITypes is the type of a schema: a name, or a list of names in OpenAPI
+// 3.1.
+type openAPITypes []string
+
+func (t *openAPITypes) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = openAPITypes{value.Value}
+		return nil
+	}
+	var names []string
+	if err := value.Decode(&names); err != nil {
+		return err
+	}
+	*t = names
+	return nil
+}
+
+func (t openAPITypes) has(name string) bool {
+	for _, n := range t {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// openAPIAdditional is the additionalProperties of a schema: false, or the
+// schema of the properties not in properties.
+type openAPIAdditional struct {
+	allowed bool
+	schema  *openAPISchema
+}
+
+func (a *openAPIAdditional) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&a.allowed)
+	}
+	a.allowed = true
+	return value.Decode(&a.schema)
+}
+
+// openAPIRefName returns the name of the component of ref, a local reference
+// under one of prefixes.
+func openAPIRefName(ref string, prefixes ...string) (string, bool) {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.NewReplacer("~1", "/", "~0", "~").Replace(ref[len(prefix):]), true
+		}
+	}
+	return "", false
+}
+
+// setupValidation sets the parameters and the body of op from the path item
+// and the operation of the document, with their references resolved.
+func (s *openAPISpec) setupValidation(op *apiOperation, item openAPIPathItem, operation *openAPIOperation) error {
+	// the parameters of the operation override those of the path
+	params := map[string]*openAPIParameter{}
+	var keys []string
+	for _, list := range [][]*openAPIParameter{item.Parameters, operation.Parameters} {
+		for _, p := range list {
+			for i := 0; p != nil && p.Ref != ""; i++ {
+				name, ok := openAPIRefName(p.Ref, "#/components/parameters/", "#/parameters/")
+				if !ok || i == openAPIMaxDepth {
+					return fmt.Errorf("unsupported parameter reference %s", p.Ref)
+				}
+				if p = s.doc.Components.Parameters[name]; p == nil {
+					p = s.doc.Parameters[name]
+				}
+			}
+			if p == nil {
+				return errors.New("missing parameter")
+			}
+			key := p.In + " " + p.Name
+			if params[key] == nil {
+				keys = append(keys, key)
+			}
+			params[key] = p
+		}
+	}
+	for _, key := range keys {
+		if p := params[key]; p.In == "body" {
+			// the body of Swagger 2 documents, of any of the consumes types
+			op.body = &openAPIRequestBody{Required: p.Required, Content: map[string]openAPIMediaType{"*/*": {Schema: p.Schema}}}
+		} else {
+			op.parameters = append(op.parameters, p)
+		}
+	}
+	if body := operation.RequestBody; body != nil {
+		for i := 0; body != nil && body.Ref != ""; i++ {
+			name, ok := openAPIRefName(body.Ref, "#/components/requestBodies/")
+			if !ok || i == openAPIMaxDepth {
+				return fmt.Errorf("unsupported request body reference %s", body.Ref)
+			}
+			body = s.doc.Components.RequestBodies[name]
+		}
+		if body == nil {
+			return errors.New("missing request body")
+		}
+		op.body = body
+	}
+	return nil
+}
+
+// schema returns sc with its references resolved, or nil if any value is valid.
+// The references to other documents are not followed.
+func (s *openAPISpec) schema(sc *openAPISchema) *openAPISchema {
+	for i := 0; sc != nil && sc.Ref != ""; i++ {
+		name, ok := openAPIRefName(sc.Ref, "#/components/schemas/", "#/definitions/")
+		if !ok || i == openAPIMaxDepth {
+			return nil
+		}
+		if sc = s.doc.Components.Schemas[name]; sc == nil {
+			sc = s.doc.Definitions[name]
+		}
+	}
+	return sc
+}
+
+// compiledPattern returns the compiled pattern of a schema, or nil if it is
+// not a valid regular expression.
+func (s *openAPISpec) compiledPattern(pattern string) *regexp.Regexp {
+	if re, ok := s.patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		re = nil
+	}
+	s.patterns.Store(pattern, re)
+	return re
+}
+
+// validate returns the kind and the description of the first violation of the
+// spec by req, a request of op with the body body, or "" if it is valid. The
+// body is not validated if it is still encoded.
+func (s *openAPISpec) validate(op *apiOperation, req *http.Request, body []byte, encoded bool) (string, error) {
+	path := op.pathParams(req)
+	var query map[string][]string
+	if req.URL != nil {
+		query = req.URL.Query()
+	}
+	for _, p := range op.parameters {
+		var values []string
+		switch p.In {
+		case "path":
+			if v, ok := path[p.Name]; ok {
+				values = []string{v}
+			}
+		case "query":
+			values = query[p.Name]
+		case "header":
+			// these headers are described by other fields of the spec
+			if name := http.CanonicalHeaderKey(p.Name); name == "Accept" || name == "Content-Type" || name == "Authorization" {
+				continue
+			}
+			values = req.Header.Values(p.Name)
+		case "cookie":
+			if c, err := req.Cookie(p.Name); err == nil {
+				values = []string{c.Value}
+			}
+		default:
+			continue
+		}
+		if len(values) == 0 {
+			if p.Required {
+				return violationParameter, fmt.Errorf("missing required %s parameter %s", p.In, p.Name)
+			}
+			continue
+		}
+		if err := s.validateParameter(p, values); err != nil {
+			return violationParameter, fmt.Errorf("%s parameter %s: %v", p.In, p.Name, err)
+		}
+	}
+
+	if op.body == nil {
+		return "", nil
+	}
+	if len(body) == 0 {
+		if op.body.Required {
+			return violationBody, errors.New("missing required body")
+		}
+		return "", nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	content, ok := op.body.media(mediaType)
+	if !ok {
+		return violationContentType, fmt.Errorf("content type %q not accepted by the operation", mediaType)
+	}
+	if encoded || content.Schema == nil || !isJSONMediaType(mediaType) {
+		return "", nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return violationBody, fmt.Errorf("invalid JSON body: %v", err)
+	}
+	if err := s.validateValue(content.Schema, v, "body", 0); err != nil {
+		return violationBody, err
+	}
+	return "", nil
+}
+
+// media returns the media type of the request body for the content type of a
+// request, or any content type if the body has none.
+func (b *openAPIRequestBody) media(mediaType string) (openAPIMediaType, bool) {
+	if len(b.Content) == 0 {
+		return openAPIMediaType{}, true
+	}
+	var wildcard, all openAPIMediaType
+	var hasWildcard, hasAll bool
+	for key, content := range b.Content {
+		key, _, _ = mime.ParseMediaType(key)
+		switch {
+		case key == mediaType:
+			return content, true
+		case key == "*/*":
+			all, hasAll = content, true
+		case strings.HasSuffix(key, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(key, "*")):
+			wildcard, hasWildcard = content, true
+		}
+	}
+	if hasWildcard {
+		return wildcard, true
+	}
+	return all, hasAll
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// validateParameter validates the values of a parameter, which are strings
+// converted to the type of its schema. Arrays are the repeated values of the
+// parameter, or a comma separated list.
+func (s *openAPISpec) validateParameter(p *openAPIParameter, values []string) error {
+	sc := p.Schema
+	if sc == nil {
+		sc = &openAPISchema{Type: p.Type, Items: p.Items, Enum: p.Enum, Minimum: p.Minimum, Maximum: p.Maximum, MinLength: p.MinLength, MaxLength: p.MaxLength, Pattern: p.Pattern}
+	}
+	if sc = s.schema(sc); sc == nil {
+		return nil
+	}
+	if !sc.Type.has("array") {
+		return s.validateValue(sc, parameterValue(s.schema(sc), values[0]), "value", 0)
+	}
+	if len(values) == 1 {
+		values = strings.Split(values[0], ",")
+	}
+	items := make([]interface{}, len(values))
+	for i, v := range values {
+		items[i] = parameterValue(s.schema(sc.Items), v)
+	}
+	return s.validateValue(sc, items, "value", 0)
+}
+
+// parameterValue converts the string v to the type of sc, if it is valid, like
+// a value decoded from JSON.
+func parameterValue(sc *openAPISchema, v string) interface{} {
+	if sc == nil {
+		return v
+	}
+	if (sc.Type.has("integer") || sc.Type.has("number")) && !sc.Type.has("string") {
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return json.Number(v)
+		}
+	}
+	if sc.Type.has("boolean") && (v == "true" || v == "false") {
+		return v == "true"
+	}
+	return v
+}
+
+// validateValue validates v, a value decoded from JSON, against sc. at is the
+// location of v in the errors, like body.items[2].price.
+func (s *openAPISpec) validateValue(sc *openAPISchema, v interface{}, at string, depth int) error {
+	if sc = s.schema(sc); sc == nil || depth > openAPIMaxDepth {
+		return nil
+	}
+	if v == nil {
+		if len(sc.Type) == 0 || sc.Nullable || sc.Type.has("null") {
+			return nil
+		}
+		return fmt.Errorf("%s: null instead of %s", at, strings.Join(sc.Type, " or "))
+	}
+	if len(sc.Type) > 0 {
+		matches := false
+		for _, t := range sc.Type {
+			if jsonTypeMatches(t, v) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return fmt.Errorf("%s: %s instead of %s", at, jsonTypeName(v), strings.Join(sc.Type, " or "))
+		}
+	}
+	if len(sc.Enum) > 0 && !enumContains(sc.Enum, v) {
+		return fmt.Errorf("%s: %v is not one of the values of the enum", at, v)
+	}
+
+	switch v := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if sc.MinLength != nil && n < *sc.MinLength {
+			return fmt.Errorf("%s: %d characters, fewer than minLength %d", at, n, *sc.MinLength)
+		}
+		if sc.MaxLength != nil && n > *sc.MaxLength {
+			return fmt.Errorf("%s: %d characters, more than maxLength %d", at, n, *sc.MaxLength)
+		}
+		if sc.Pattern != "" {
+			if re := s.compiledPattern(sc.Pattern); re != nil && !re.MatchString(v) {
+				return fmt.Errorf("%s: does not match the pattern %s", at, sc.Pattern)
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if sc.Minimum != nil && f < *sc.Minimum {
+			return fmt.Errorf("%s: %s is less than the minimum %v", at, v, *sc.Minimum)
+		}
+		if sc.Maximum != nil && f > *sc.Maximum {
+			return fmt.Errorf("%s: %s is more than the maximum %v", at, v, *sc.Maximum)
+		}
+	case []interface{}:
+		if sc.MinItems != nil && len(v) < *sc.MinItems {
+			return fmt.Errorf("%s: %d items, fewer than minItems %d", at, len(v), *sc.MinItems)
+		}
+		if sc.MaxItems != nil && len(v) > *sc.MaxItems {
+			return fmt.Errorf("%s: %d items, more than maxItems %d", at, len(v), *sc.MaxItems)
+		}
+		for i, item := range v {
+			if err := s.validateValue(sc.Items, item, fmt.Sprintf("%s[%d]", at, i), depth+1); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range sc.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %s", at, name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := sc.Properties[name]
+			if !ok && sc.AdditionalProperties != nil {
+				if !sc.AdditionalProperties.allowed {
+					return fmt.Errorf("%s: unexpected property %s", at, name)
+				}
+				property = sc.AdditionalProperties.schema
+			}
+			if err := s.validateValue(property, v[name], at+"."+name, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, sub := range sc.AllOf {
+		if err := s.validateValue(sub, v, at, depth+1); err != nil {
+			return err
+		}
+	}
+	// oneOf is validated like anyOf: a value matching several schemas is valid
+	alternatives := append(append([]*openAPISchema(nil), sc.AnyOf...), sc.OneOf...)
+	if len(alternatives) == 0 {
+		return nil
+	}
+	var first error
+	for _, sub := range alternatives {
+		err := s.validateValue(sub, v, at, depth+1)
+		if err == nil {
+			return nil
+		} else if first == nil {
+			first = err
+		}
+	}
+	return fmt.Errorf("matches none of the schemas of anyOf or oneOf, %v", first)
+}
+
+func jsonTypeMatches(t string, v interface{}) bool {
+	switch t {
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "null":
+		return v == nil
+	}
+	return true
+}
+
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "null"
+}
+
+// enumContains reports whether v is one of the values of enum, which are
+// decoded from YAML.
+func enumContains(enum []interface{}, v interface{}) bool {
+	_, isString := v.(string)
+	for _, e := range enum {
+		if _, ok := e.(string); ok == isString && fmt.Sprint(e) == fmt.Sprint(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// violationLog logs the violations of each operation and kind at most once a
+// minute, with the number of violations not logged since.
+type violationLog struct {
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+var openAPIViolations = &violationLog{last: map[string]time.Time{}, suppressed: map[string]int{}}
+
+func (l *violationLog) log(operation, kind string, err error) {
+	key := operation + " " + kind
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.last[key]) < time.Minute {
+		l.suppressed[key]++
+		return
+	}
+	if n := l.suppressed[key]; n > 0 {
+		log.Println("OpenAPI violation of", operation, ":", err, fmt.Sprintf("(and %d more since the last one logged)", n))
+	} else {
+		log.Println("OpenAPI violation of", operation, ":", err)
+	}
+	l.last[key], l.suppressed[key] = time.Now(), 0
+}
@@ -0,0 +1,61 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// fwdOrderingQueued counts the requests waiting in the queues of the ordered
+// forwarders, sampled as the ordering_queued gauge.
+var fwdOrderingQueued int64
+
+// orderedRequest is a request waiting for the forwards before it on its
+// connection.
+type orderedRequest struct {
+	req  *http.Request
+	info captureInfo
+	body []byte
+}
+
+// orderedForwarder forwards the requests of a captured connection one after
+// the other, in the order they were captured, so that stateful flows (a login
+// then the requests that use its session) reach the destination in order. The
+// connections are still forwarded in parallel.
+type orderedForwarder struct {
+	queue chan orderedRequest
+}
+
+func newOrderedForwarder(size int) *orderedForwarder {
+	f := &orderedForwarder{queue: make(chan orderedRequest, size)}
+	go f.run()
+	return f
+}
+
+func (f *orderedForwarder) run() {
+	for r := range f.queue {
+		atomic.AddInt64(&fwdOrderingQueued, -1)
+		forwardRequest(r.req, r.info, r.body)
+	}
+}
+
+// full reports whether ordering-queue requests of the connection are already
+// waiting. The capture must not wait for the destination, so the next request
+// is dropped instead.
+func (f *orderedForwarder) full() bool {
+	return len(f.queue) == cap(f.queue)
+}
+
+// forward queues the request after the previous ones of the connection. It
+// must not be called when the queue is full.
+func (f *orderedForwarder) forward(req *http.Request, info captureInfo, body []byte) {
+	atomic.AddInt64(&fwdOrderingQueued, 1)
+	f.queue <- orderedRequest{req: req, info: info, body: body}
+}
+
+// close ends the forwarder once the queued requests are forwarded.
+func (f *orderedForwarder) close() {
+	close(f.queue)
+}
@@ -0,0 +1,75 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	math_rand "math/rand"
+	"sync"
+	"time"
+)
+
+// requestPacer delays forwards to reproduce the intervals between the capture
+// timestamps of the requests, divided by a speedup factor. Requests captured in
+// a burst because of buffering (pcap batches, assembler flushes) are sent at
+// the pace they were originally sent by the clients.
+type requestPacer struct {
+	speedup float64
+	// delay shifts the schedule, so that out of order requests can be sent in order
+	delay time.Duration
+
+	mu           sync.Mutex
+	started      bool
+	firstCapture time.Time
+	firstSend    time.Time
+}
+
+func newRequestPacer(speedup float64, delay time.Duration) *requestPacer {
+	return &requestPacer{speedup: speedup, delay: delay}
+}
+
+// wait blocks until the time the request captured at captured is due, or until
+// the forwards are cancelled. It reports false in the latter case.
+func (p *requestPacer) wait(captured time.Time) bool {
+	p.mu.Lock()
+	if !p.started {
+		p.started = true
+		p.firstCapture, p.firstSend = captured, time.Now().Add(p.delay)
+	}
+	due := p.firstSend.Add(time.Duration(float64(captured.Sub(p.firstCapture)) / p.speedup))
+	p.mu.Unlock()
+
+	wait := time.Until(due)
+	if wait <= 0 {
+		if wait < -time.Second {
+			// the forwards cannot keep up with the pace
+			stats.inc("pacing_late")
+		}
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-fwdCtx.Done():
+		return false
+	}
+}
+
+// smooth delays a forward by a random duration up to the smoothing-window flag,
+// so that a burst of requests is spread over the window instead of hitting the
+// destination at once. It reports false if the forwards are cancelled meanwhile.
+func smooth(conf *configSnapshot) bool {
+	if conf.smoothingWindow <= 0 {
+		return true
+	}
+	timer := time.NewTimer(time.Duration(math_rand.Int63n(int64(conf.smoothingWindow))))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-fwdCtx.Done():
+		return false
+	}
+}
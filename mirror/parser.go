@@ -0,0 +1,167 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The limits of the request parser, reported as the reason of
+// requests_rejected and of the quarantine records.
+const (
+	limitHeaderBytes = "header_bytes"
+	limitURILength   = "uri_length"
+	limitHeaderCount = "header_count"
+)
+
+var errHeaderTooLarge = errors.New("request head larger than max-header-bytes")
+
+// headLimitReader limits the bytes read for the head of a request, like the
+// MaxHeaderBytes of net/http servers: the limit applies to the data read beyond
+// what the bufio.Reader above it already buffered.
+type headLimitReader struct {
+	r         io.Reader
+	limited   bool
+	remaining int64
+	// exceeded tells that a read failed on the limit. The parser may report
+	// another error, e.g. for the header line the limit cut short.
+	exceeded bool
+}
+
+func (l *headLimitReader) Read(p []byte) (int, error) {
+	if !l.limited {
+		return l.r.Read(p)
+	}
+	if l.remaining <= 0 {
+		l.exceeded = true
+		return 0, errHeaderTooLarge
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// limit allows n more bytes to be read, or any number if n is 0.
+func (l *headLimitReader) limit(n int) {
+	l.limited, l.remaining, l.exceeded = n > 0, int64(n), false
+}
+
+// exceededLimit returns the limit of max-uri-length and max-header-count the
+// parsed request exceeds, with an error describing it, or "".
+func exceededLimit(conf *configSnapshot, req *http.Request) (string, error) {
+	if conf.maxURILength > 0 && len(req.RequestURI) > conf.maxURILength {
+		return limitURILength, fmt.Errorf("request URI of %d bytes longer than max-uri-length", len(req.RequestURI))
+	}
+	if conf.maxHeaderCount > 0 {
+		count := 0
+		for _, values := range req.Header {
+			count += len(values)
+		}
+		if count > conf.maxHeaderCount {
+			return limitHeaderCount, fmt.Errorf("request with %d header fields, more than max-header-count", count)
+		}
+	}
+	return "", nil
+}
+
+// quarantineRecord is one line of the quarantine file: the raw bytes of a
+// stream from the start of a request the parser rejected.
+type quarantineRecord struct {
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Reason      string    `json:"reason"`
+	Error       string    `json:"error"`
+	Raw         []byte    `json:"raw"`
+	Truncated   bool      `json:"truncated,omitempty"`
+}
+
+// quarantineSink appends the rejected requests to a file, one JSON document per
+// line, until the file reaches quarantine-max-size.
+type quarantineSink struct {
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	maxSize int64
+}
+
+var fwdQuarantine *quarantineSink
+
+func openQuarantineSink(path string, maxSize int64) (*quarantineSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &quarantineSink{f: f, size: info.Size(), maxSize: maxSize}, nil
+}
+
+func (s *quarantineSink) write(record quarantineRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size+int64(len(data)) > s.maxSize {
+		stats.inc("quarantine_dropped")
+		return nil
+	}
+	n, err := s.f.Write(data)
+	s.size += int64(n)
+	if err == nil {
+		stats.inc("quarantine_records")
+	}
+	return err
+}
+
+// rejectRequest counts a request that exceeds a limit of the parser, and
+// quarantines it.
+func (h *httpStream) rejectRequest(conf *configSnapshot, limit string, err error, counter *recordingReader, start int64) {
+	stats.inc(labeled("requests_rejected", "reason", limit))
+	h.streamError(streamErrorRejected, err)
+	h.quarantine(conf, limit, err, counter, start)
+}
+
+// quarantine archives the bytes read from the stream from the offset start, the
+// first byte of a rejected request, up to quarantine-max-bytes.
+func (h *httpStream) quarantine(conf *configSnapshot, reason string, err error, counter *recordingReader, start int64) {
+	q := fwdQuarantine
+	if q == nil || !counter.record {
+		return
+	}
+	end, truncated := counter.n, false
+	if end-start > int64(conf.quarantineMaxBytes) {
+		end, truncated = start+int64(conf.quarantineMaxBytes), true
+	}
+	werr := q.write(quarantineRecord{
+		Time:        time.Now(),
+		Source:      net.JoinHostPort(h.net.Src().String(), h.transport.Src().String()),
+		Destination: net.JoinHostPort(h.net.Dst().String(), h.transport.Dst().String()),
+		Reason:      reason,
+		Error:       err.Error(),
+		Raw:         counter.bytes(start, end),
+		Truncated:   truncated,
+	})
+	if werr != nil {
+		log.Println("Error writing quarantine", ":", werr)
+	}
+}
@@ -0,0 +1,80 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHeadLimitReader(t *testing.T) {
+	head := "POST /orders HTTP/1.1\r\nHost: a\r\nContent-Length: 500\r\n\r\n"
+	body := strings.Repeat("b", 500)
+	tests := []struct {
+		name     string
+		limit    int
+		head     string
+		exceeded bool
+	}{
+		{"within the limit", 100, head, false},
+		{"at the limit", len(head), head, false},
+		{"no limit", 0, head, false},
+		// the parser fails on the header line the limit cuts short
+		{"head over the limit", 40, head, true},
+		{"request line over the limit", 10, head, true},
+		{"long header over the limit", 100, "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("c", 200) + "\r\n\r\n", true},
+	}
+	for _, tt := range tests {
+		limited := &headLimitReader{r: strings.NewReader(tt.head + body)}
+		buf := bufio.NewReader(limited)
+		limited.limit(tt.limit)
+		req, err := http.ReadRequest(buf)
+		if exceeded := err != nil && limited.exceeded; exceeded != tt.exceeded {
+			t.Errorf("%s: ReadRequest = %v, exceeded %v, want exceeded %v", tt.name, err, limited.exceeded, tt.exceeded)
+		}
+		limited.limit(0)
+		if limited.exceeded {
+			t.Errorf("%s: the limit is still exceeded once lifted", tt.name)
+		}
+		if tt.exceeded {
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ReadRequest: %v", tt.name, err)
+			continue
+		}
+		// the body is read past the limit of the head
+		if b, err := ioutil.ReadAll(req.Body); err != nil || string(b) != body {
+			t.Errorf("%s: read a body of %d bytes, %v, want %d bytes", tt.name, len(b), err, len(body))
+		}
+	}
+}
+
+func TestExceededLimit(t *testing.T) {
+	header := http.Header{"Host": {"a"}, "Cookie": {"a=1", "b=2"}, "Accept": {"*/*"}}
+	tests := []struct {
+		name  string
+		conf  configSnapshot
+		uri   string
+		limit string
+	}{
+		{"no limits", configSnapshot{}, "/" + strings.Repeat("u", 100), ""},
+		{"within the limits", configSnapshot{maxURILength: 10, maxHeaderCount: 4}, "/orders", ""},
+		{"URI at the limit", configSnapshot{maxURILength: 7}, "/orders", ""},
+		{"URI over the limit", configSnapshot{maxURILength: 6}, "/orders", limitURILength},
+		// the repeated fields count once per value
+		{"header count over the limit", configSnapshot{maxHeaderCount: 3}, "/orders", limitHeaderCount},
+		{"URI checked first", configSnapshot{maxURILength: 6, maxHeaderCount: 3}, "/orders", limitURILength},
+	}
+	for _, tt := range tests {
+		req := &http.Request{RequestURI: tt.uri, Header: header}
+		limit, err := exceededLimit(&tt.conf, req)
+		if limit != tt.limit || (err != nil) != (tt.limit != "") {
+			t.Errorf("%s: exceededLimit = %q, %v, want %q", tt.name, limit, err, tt.limit)
+		}
+	}
+}
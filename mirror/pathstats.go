@@ -0,0 +1,137 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTrackedPaths bounds the number of path templates tracked; the requests of
+// other paths are counted under otherPath.
+const maxTrackedPaths = 10000
+
+const otherPath = "(other)"
+
+// maxLabeledPaths bounds the number of path templates with their own
+// requests_by_path metric; the others are labeled otherPath.
+const maxLabeledPaths = 200
+
+// pathStatsDrainLimit is the number of bytes of a response without
+// Content-Length read to measure its size.
+const pathStatsDrainLimit = 16 << 20
+
+// pathStat holds the statistics of a path template.
+type pathStat struct {
+	Path          string  `json:"path"`
+	Requests      int64   `json:"requests"`
+	RequestBytes  int64   `json:"request_bytes"`
+	ResponseBytes int64   `json:"response_bytes"`
+	Responses     int64   `json:"responses"`
+	AvgLatencyMs  float64 `json:"avg_latency_ms"`
+	MaxLatencyMs  float64 `json:"max_latency_ms"`
+
+	latency time.Duration
+	label   string
+}
+
+// pathStatistics tracks the forwarded requests by path template, to check that
+// the shape of the mirrored traffic matches production.
+type pathStatistics struct {
+	mu    sync.Mutex
+	paths map[string]*pathStat
+}
+
+func newPathStatistics() *pathStatistics {
+	return &pathStatistics{paths: map[string]*pathStat{}}
+}
+
+// record adds a forward of a request to the path template with a body of
+// requestBytes. A negative latency means the forward had no response.
+func (p *pathStatistics) record(template string, requestBytes, responseBytes int64, latency time.Duration) {
+	stats.observe("request_body_bytes", requestBytes, sizeBuckets)
+	if latency >= 0 {
+		stats.observe("response_body_bytes", responseBytes, sizeBuckets)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.paths[template]
+	if !ok {
+		if len(p.paths) >= maxTrackedPaths {
+			template = otherPath
+		}
+		if s, ok = p.paths[template]; !ok {
+			s = &pathStat{Path: template, label: template}
+			if len(p.paths) >= maxLabeledPaths {
+				s.label = otherPath
+			}
+			p.paths[template] = s
+		}
+	}
+	stats.inc(labeled("requests_by_path", "path", s.label))
+	s.Requests++
+	s.RequestBytes += requestBytes
+	if latency >= 0 {
+		s.Responses++
+		s.ResponseBytes += responseBytes
+		s.latency += latency
+		if ms := float64(latency) / float64(time.Millisecond); ms > s.MaxLatencyMs {
+			s.MaxLatencyMs = ms
+		}
+	}
+}
+
+// top returns the n paths with the most requests.
+func (p *pathStatistics) top(n int) []pathStat {
+	p.mu.Lock()
+	all := make([]pathStat, 0, len(p.paths))
+	for _, s := range p.paths {
+		all = append(all, *s)
+	}
+	p.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Requests != all[j].Requests {
+			return all[i].Requests > all[j].Requests
+		}
+		return all[i].Path < all[j].Path
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	for i := range all {
+		if all[i].Responses > 0 {
+			all[i].AvgLatencyMs = float64(all[i].latency) / float64(all[i].Responses) / float64(time.Millisecond)
+		}
+	}
+	return all
+}
+
+// reportLoop logs the top paths every interval. It never returns.
+func (p *pathStatistics) reportLoop(interval time.Duration, n int) {
+	for {
+		time.Sleep(interval)
+		top := p.top(n)
+		if len(top) == 0 {
+			continue
+		}
+		log.Println("Top", len(top), "paths since start:")
+		for _, s := range top {
+			log.Printf("  %s: %d requests, %d request bytes, %d response bytes, %.1fms average latency", s.Path, s.Requests, s.RequestBytes, s.ResponseBytes, s.AvgLatencyMs)
+		}
+	}
+}
+
+// requestPath returns the path of a captured request, or its target if it has
+// no path (CONNECT and OPTIONS *).
+func requestPath(req *http.Request) string {
+	if req.URL != nil && req.URL.Path != "" {
+		return req.URL.Path
+	}
+	return req.RequestURI
+}
@@ -0,0 +1,104 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// pathTemplates normalizes request paths into templates with a bounded number
+// of values, for metric labels and the path statistics. A path is matched
+// against the user templates first, in order:
+//   - a {name} segment matches any segment and is kept as {name}
+//   - a trailing ** matches the rest of the path
+//   - other segments match themselves
+//
+// The segments of a path without matching template are replaced by:
+//   - :uuid for UUIDs
+//   - :id for numbers
+//   - :hash for hexadecimal strings of 16 characters or more
+//   - :token for strings of 24 characters or more mixing letters and digits,
+//     like base64 keys
+type pathTemplates struct {
+	templates [][]string
+}
+
+var (
+	uuidSegment  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hashSegment  = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	tokenSegment = regexp.MustCompile(`^[A-Za-z0-9_\-+=.~]{24,}$`)
+)
+
+// parsePathTemplates parses a comma separated list of templates like
+// /users/{user}/repos/{repo}.
+func parsePathTemplates(list string) (*pathTemplates, error) {
+	t := &pathTemplates{}
+	for _, tmpl := range strings.Split(list, ",") {
+		if tmpl = strings.TrimSpace(tmpl); tmpl == "" {
+			continue
+		}
+		if !strings.HasPrefix(tmpl, "/") {
+			return nil, fmt.Errorf("Flag path-templates contains an invalid template (%s), it must start with /.", tmpl)
+		}
+		segments := strings.Split(tmpl, "/")
+		for i, s := range segments {
+			if s == "**" && i != len(segments)-1 {
+				return nil, fmt.Errorf("Flag path-templates contains an invalid template (%s), ** must be the last segment.", tmpl)
+			}
+		}
+		t.templates = append(t.templates, segments)
+	}
+	return t, nil
+}
+
+// apply returns the template of path.
+func (t *pathTemplates) apply(path string) string {
+	segments := strings.Split(path, "/")
+	for _, tmpl := range t.templates {
+		if matchTemplate(tmpl, segments) {
+			return strings.Join(tmpl, "/")
+		}
+	}
+	for i, s := range segments {
+		segments[i] = templateSegment(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func matchTemplate(tmpl, segments []string) bool {
+	for i, s := range tmpl {
+		if s == "**" {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if !(strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}")) && s != segments[i] {
+			return false
+		}
+	}
+	return len(tmpl) == len(segments)
+}
+
+func templateSegment(s string) string {
+	switch {
+	case s == "":
+		return s
+	case strings.Trim(s, "0123456789") == "":
+		return ":id"
+	case uuidSegment.MatchString(s):
+		return ":uuid"
+	case hashSegment.MatchString(s):
+		return ":hash"
+	case tokenSegment.MatchString(s) && strings.ContainsAny(s, "0123456789") && strings.IndexFunc(s, isLetter) >= 0:
+		return ":token"
+	}
+	return s
+}
+
+func isLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
@@ -0,0 +1,309 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// pipelinesKey is the key of the config file that defines named pipelines:
+//
+//	{
+//	  "percentage": 10,
+//	  "pipelines": {
+//	    "team-a": {"interface": "vxlan0", "route-table-json": {...}, "admin-addr": "127.0.0.1:9091"},
+//	    "team-b": {"interface": "vxlan1", "route-table-json": {...}, "admin-addr": "127.0.0.1:9092"}
+//	  }
+//	}
+//
+// Each pipeline is a capture with the top level flags overridden by its own.
+// The pipelines are run as child processes of the capture command rather than
+// in-process: the flags, the published configuration, the route table, the
+// sinks and the metrics registry are package state, of which a process has one,
+// and a pipeline whose capture fails or exits is restarted without stopping
+// the others. The metrics they export are labeled with the pipeline name, see
+// exportedMetric.
+const pipelinesKey = "pipelines"
+
+// configPipelines returns the sorted names of the pipelines of the config file.
+func configPipelines(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Pipelines map[string]map[string]json.RawMessage `json:"pipelines"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+	var names []string
+	adminAddrs := map[string]string{}
+	for name, pipeline := range config.Pipelines {
+		if name == "" {
+			return nil, fmt.Errorf("Config file %s has a pipeline without name.", path)
+		}
+		var addr string
+		if json.Unmarshal(pipeline["admin-addr"], &addr) == nil && addr != "" {
+			if other, ok := adminAddrs[addr]; ok {
+				return nil, fmt.Errorf("Pipelines %s and %s have the same admin-addr %s.", other, name, addr)
+			}
+			adminAddrs[addr] = name
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pipelineNotifier stands for systemd to the pipelines, when the capture
+// command runs under a unit of Type=notify: each pipeline notifies a socket of
+// its own, the command is ready once all of them are, and it pings the
+// watchdog as long as all of them run and ping theirs. systemd only listens to
+// the main process, and the watchdog of the pipelines is skipped otherwise,
+// WATCHDOG_PID being that of the command.
+type pipelineNotifier struct {
+	dir     string
+	sockets map[string]string
+	mu      sync.Mutex
+	ready   map[string]bool
+	// pings has the last watchdog ping, or start, of the running pipelines
+	pings    map[string]time.Time
+	notified bool
+}
+
+// newPipelineNotifier listens to the notifications of the pipelines of names,
+// or returns nil if the command does not run under systemd.
+func newPipelineNotifier(names []string) (*pipelineNotifier, error) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return nil, nil
+	}
+	dir, err := ioutil.TempDir("", "mirror-pipelines")
+	if err != nil {
+		return nil, err
+	}
+	n := &pipelineNotifier{dir: dir, sockets: map[string]string{}, ready: map[string]bool{}, pings: map[string]time.Time{}}
+	for i, name := range names {
+		// names may be too long for a socket path
+		path := filepath.Join(dir, strconv.Itoa(i)+".sock")
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			n.close()
+			return nil, err
+		}
+		n.sockets[name] = path
+		go n.receive(name, conn)
+	}
+	return n, nil
+}
+
+// env returns the environment of the pipeline name, notifying its socket.
+func (n *pipelineNotifier) env(name string) []string {
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "NOTIFY_SOCKET=") && !strings.HasPrefix(v, "WATCHDOG_PID=") {
+			env = append(env, v)
+		}
+	}
+	return append(env, "NOTIFY_SOCKET="+n.sockets[name])
+}
+
+func (n *pipelineNotifier) started(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ready[name], n.pings[name] = false, time.Now()
+}
+
+func (n *pipelineNotifier) exited(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.pings, name)
+}
+
+// receive handles the notifications of the pipeline name. It never returns.
+func (n *pipelineNotifier) receive(name string, conn *net.UnixConn) {
+	buf := make([]byte, 4096)
+	for {
+		size, _, err := conn.ReadFromUnix(buf)
+		if err != nil {
+			log.Println("Error receiving the notifications of pipeline", name, ":", err)
+			return
+		}
+		for _, line := range strings.Split(string(buf[:size]), "\n") {
+			n.mu.Lock()
+			switch line {
+			case "READY=1":
+				n.ready[name] = true
+				if !n.notified && len(n.ready) == len(n.sockets) {
+					all := true
+					for _, ready := range n.ready {
+						all = all && ready
+					}
+					if all {
+						n.notified = true
+						sdNotify("READY=1\nSTATUS=Running " + strconv.Itoa(len(n.sockets)) + " pipelines")
+					}
+				}
+			case "WATCHDOG=1":
+				if _, ok := n.pings[name]; ok {
+					n.pings[name] = time.Now()
+				}
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+// watchdog pings the watchdog of the command, if the unit sets WatchdogSec,
+// while every pipeline runs and pinged its own within the timeout. It never
+// returns.
+func (n *pipelineNotifier) watchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	timeout := time.Duration(usec) * time.Microsecond
+	for range time.Tick(timeout / 2) {
+		n.mu.Lock()
+		alive := len(n.pings) == len(n.sockets)
+		for name, ping := range n.pings {
+			if since := time.Since(ping); since > timeout {
+				log.Println("Pipeline", name, "has not pinged the watchdog for", since.Round(time.Second), "skipping watchdog ping")
+				alive = false
+			}
+		}
+		n.mu.Unlock()
+		if alive {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+func (n *pipelineNotifier) close() {
+	os.RemoveAll(n.dir)
+}
+
+// runPipelines runs a capture process per pipeline and restarts the processes
+// that exit. The signals of pipelineSignals, like SIGHUP, are forwarded to the
+// pipelines, which handle them. On SIGTERM or SIGINT, it forwards the signal to
+// the pipelines, which drain, and waits for them.
+func runPipelines(names []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	notifier, err := newPipelineNotifier(names)
+	if err != nil {
+		return fmt.Errorf("Error listening to the notifications of the pipelines: %v", err)
+	}
+	if notifier != nil {
+		defer notifier.close()
+		go notifier.watchdog()
+	}
+
+	// the pipelines share the NLB health check listener of this process
+	if err := startHealthListener(); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	stopping := false
+	running := map[string]*exec.Cmd{}
+	var wg sync.WaitGroup
+
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				if stopping {
+					mu.Unlock()
+					return
+				}
+				// the flags of the command line take precedence in every pipeline
+				args := append([]string{"capture", "-pipeline=" + name}, os.Args[1:]...)
+				cmd := exec.Command(exe, args...)
+				cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+				if notifier != nil {
+					cmd.Env = notifier.env(name)
+				}
+				err := cmd.Start()
+				if err == nil {
+					running[name] = cmd
+					if notifier != nil {
+						notifier.started(name)
+					}
+				}
+				mu.Unlock()
+
+				if err == nil {
+					log.Println("Started pipeline", name, "pid", cmd.Process.Pid)
+					err = cmd.Wait()
+				}
+				mu.Lock()
+				delete(running, name)
+				if notifier != nil {
+					notifier.exited(name)
+				}
+				done := stopping
+				mu.Unlock()
+				if done {
+					return
+				}
+				stats.inc(labeled("pipeline_restarts", "pipeline", name))
+				log.Println("Pipeline", name, "exited", ":", err, "restarting in 5s")
+				time.Sleep(5 * time.Second)
+			}
+		}(name)
+	}
+
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, pipelineSignals...)...)
+	var sig os.Signal
+	for sig = range signals {
+		if sig == os.Interrupt || sig == syscall.SIGTERM {
+			break
+		}
+		log.Println("Received", sig, "forwarding it to the pipelines")
+		mu.Lock()
+		for name, cmd := range running {
+			if err := cmd.Process.Signal(sig); err != nil {
+				log.Println("Error signaling pipeline", name, ":", err)
+			}
+		}
+		mu.Unlock()
+	}
+	log.Println("Received", sig, "stopping pipelines")
+	sdNotify("STOPPING=1")
+	mu.Lock()
+	stopping = true
+	for name, cmd := range running {
+		if err := cmd.Process.Signal(sig); err != nil {
+			// Windows cannot deliver signals to other processes
+			log.Println("Error signaling pipeline", name, ":", err)
+			cmd.Process.Kill()
+		}
+	}
+	mu.Unlock()
+	wg.Wait()
+	return nil
+}
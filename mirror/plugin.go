@@ -0,0 +1,203 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wasmPlugin runs a WebAssembly module against every captured request.
+//
+// A plugin must export its linear memory and the following functions:
+//
+//	malloc(size i32) i32           allocates size bytes and returns the pointer
+//	on_request(ptr i32, len i32) i64
+//
+// on_request receives a JSON encoded pluginRequest and returns the pointer to a
+// JSON encoded pluginResponse in the upper 32 bits and its length in the lower
+// 32 bits. Returning 0 leaves the request unchanged. If the module also exports
+// free(ptr i32), it is called to release the input, and the output once it is
+// copied; without it, the plugin must reuse its buffers from one call to the
+// next so that its memory does not grow. A call that takes more than timeout
+// is stopped, like a script.
+type wasmPlugin struct {
+	name     string
+	timeout  time.Duration
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	// module instances are not safe for concurrent use, so they are pooled.
+	instances sync.Pool
+}
+
+// pluginRequest is the document exchanged with plugins.
+type pluginRequest struct {
+	Method      string      `json:"method"`
+	URI         string      `json:"uri"`
+	Host        string      `json:"host"`
+	Headers     http.Header `json:"headers"`
+	Body        []byte      `json:"body"`
+	Destination string      `json:"destination,omitempty"`
+}
+
+// pluginResponse is what a plugin returns: the action to take and, unless the
+// request is dropped, the request to forward.
+type pluginResponse struct {
+	Action  string        `json:"action"`
+	Request pluginRequest `json:"request"`
+}
+
+func loadWasmPlugin(path string, timeout time.Duration) (*wasmPlugin, error) {
+	bin, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	// the module instance running a call is closed when its context is done,
+	// which stops a plugin looping forever
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("Error instantiating WASI for plugin %s: %v", path, err)
+	}
+	compiled, err := runtime.CompileModule(ctx, bin)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("Error compiling plugin %s: %v", path, err)
+	}
+	p := &wasmPlugin{name: path, timeout: timeout, runtime: runtime, compiled: compiled}
+	// instantiate once up front, so that missing exports are reported at startup
+	mod, err := p.instantiate()
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	p.instances.Put(mod)
+	return p, nil
+}
+
+// close closes the runtime of the plugin, with its module instances, once no
+// request uses the plugin.
+func (p *wasmPlugin) close() error {
+	return p.runtime.Close(context.Background())
+}
+
+func (p *wasmPlugin) instantiate() (api.Module, error) {
+	// an empty name allows several instances of the same module to coexist
+	mod, err := p.runtime.InstantiateModule(context.Background(), p.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return nil, fmt.Errorf("Error instantiating plugin %s: %v", p.name, err)
+	}
+	if mod.Memory() == nil || mod.ExportedFunction("malloc") == nil || mod.ExportedFunction("on_request") == nil {
+		mod.Close(context.Background())
+		return nil, fmt.Errorf("Plugin %s must export memory, malloc and on_request.", p.name)
+	}
+	return mod, nil
+}
+
+func (p *wasmPlugin) run(req *http.Request, body []byte) (hookResult, error) {
+	var mod api.Module
+	if v := p.instances.Get(); v != nil {
+		mod = v.(api.Module)
+	} else {
+		var err error
+		if mod, err = p.instantiate(); err != nil {
+			return hookResult{}, err
+		}
+	}
+
+	in, err := json.Marshal(pluginRequest{
+		Method:  req.Method,
+		URI:     req.RequestURI,
+		Host:    req.Host,
+		Headers: req.Header,
+		Body:    body,
+	})
+	if err != nil {
+		p.instances.Put(mod)
+		return hookResult{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	out, err := p.call(ctx, mod, in)
+	if err != nil {
+		// the instance may be in an undefined state after a trap, or closed
+		// after a timeout, discard it
+		mod.Close(context.Background())
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			stats.inc("plugin_timeouts")
+			return hookResult{}, fmt.Errorf("plugin %s: stopped after %s", p.name, p.timeout)
+		}
+		return hookResult{}, fmt.Errorf("plugin %s: %v", p.name, err)
+	}
+	p.instances.Put(mod)
+	if out == nil {
+		return hookResult{body: body}, nil
+	}
+
+	var resp pluginResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return hookResult{}, fmt.Errorf("plugin %s returned invalid JSON: %v", p.name, err)
+	}
+	if resp.Action == "drop" {
+		return hookResult{drop: true}, nil
+	}
+	req.Method = resp.Request.Method
+	req.RequestURI = resp.Request.URI
+	req.Host = resp.Request.Host
+	req.Header = resp.Request.Headers
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	return hookResult{destination: resp.Request.Destination, body: resp.Request.Body}, nil
+}
+
+// call copies in to the module memory, invokes on_request and returns a copy of
+// the output, or nil if the plugin left the request unchanged. The functions of
+// the module are stopped once ctx is done.
+func (p *wasmPlugin) call(ctx context.Context, mod api.Module, in []byte) ([]byte, error) {
+	res, err := mod.ExportedFunction("malloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if free := mod.ExportedFunction("free"); free != nil {
+		defer free.Call(ctx, uint64(ptr))
+	}
+	if !mod.Memory().Write(ptr, in) {
+		return nil, fmt.Errorf("malloc returned out of range pointer %d", ptr)
+	}
+	res, err = mod.ExportedFunction("on_request").Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	if res[0] == 0 {
+		return nil, nil
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	out, ok := mod.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("on_request returned out of range result %d:%d", outPtr, outLen)
+	}
+	// out aliases the module memory, which is reused by the next call or freed
+	out = append([]byte(nil), out...)
+	// a plugin may return its input buffer, which the deferred call frees
+	if free := mod.ExportedFunction("free"); free != nil && outPtr != ptr {
+		if _, err := free.Call(ctx, uint64(outPtr)); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,708 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The QUIC versions whose packets are parsed: QUIC v1 (RFC 9000) and QUIC v2
+// (RFC 9369).
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+)
+
+// quicMaxConnections bounds the QUIC connections tracked at once.
+const quicMaxConnections = 100000
+
+// quicMaxQueued bounds the 1-RTT packets of a connection kept until its
+// secrets are appended to the key log.
+const quicMaxQueued = 256
+
+// quicVersion holds what differs between the QUIC versions.
+type quicVersion struct {
+	// salt derives the Initial secrets from the connection ID
+	salt []byte
+	// labelPrefix prefixes the labels of the packet protection keys
+	labelPrefix string
+	// packetTypes names the long header packet types
+	packetTypes [4]string
+}
+
+var quicVersions = map[uint32]quicVersion{
+	quicVersion1: {
+		salt:        []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		labelPrefix: "quic ",
+		packetTypes: [4]string{"initial", "0rtt", "handshake", "retry"},
+	},
+	quicVersion2: {
+		salt:        []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		labelPrefix: "quicv2 ",
+		packetTypes: [4]string{"retry", "initial", "0rtt", "handshake"},
+	},
+}
+
+// quicReader reads the fields of QUIC packets and frames. Reading past the end
+// sets err rather than failing each read.
+type quicReader struct {
+	b   []byte
+	err bool
+}
+
+// varint reads a variable-length integer, whose 2 most significant bits give
+// its length.
+func (r *quicReader) varint() uint64 {
+	if len(r.b) == 0 {
+		r.err = true
+		return 0
+	}
+	n := 1 << (r.b[0] >> 6)
+	if len(r.b) < n {
+		r.err, r.b = true, nil
+		return 0
+	}
+	v := uint64(r.b[0] & 0x3f)
+	for _, c := range r.b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *quicReader) bytes(n uint64) []byte {
+	if uint64(len(r.b)) < n {
+		r.err, r.b = true, nil
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *quicReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+// quicKeys are the packet protection keys of a direction of a packet number
+// space.
+type quicKeys struct {
+	version quicVersion
+	suite   tlsCipherSuite
+	secret  []byte
+	aead    cipher.AEAD
+	iv      []byte
+	// hp returns the header protection mask of a sample of the ciphertext
+	hp func(sample []byte) []byte
+}
+
+func newQUICKeys(version quicVersion, suite tlsCipherSuite, secret []byte) (*quicKeys, error) {
+	k := &quicKeys{version: version, suite: suite, secret: secret}
+	var err error
+	if k.aead, err = suite.aead(hkdfExpandLabel(suite.hash, secret, version.labelPrefix+"key", suite.keyLen)); err != nil {
+		return nil, err
+	}
+	k.iv = hkdfExpandLabel(suite.hash, secret, version.labelPrefix+"iv", 12)
+	hpKey := hkdfExpandLabel(suite.hash, secret, version.labelPrefix+"hp", suite.keyLen)
+	if suite.chacha {
+		k.hp = func(sample []byte) []byte {
+			mask := make([]byte, 5)
+			c, err := chacha20.NewUnauthenticatedCipher(hpKey, sample[4:16])
+			if err == nil {
+				c.SetCounter(binary.LittleEndian.Uint32(sample[0:4]))
+				c.XORKeyStream(mask, mask)
+			}
+			return mask
+		}
+		return k, nil
+	}
+	block, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	k.hp = func(sample []byte) []byte {
+		mask := make([]byte, aes.BlockSize)
+		block.Encrypt(mask, sample)
+		return mask
+	}
+	return k, nil
+}
+
+// quicInitialKeys returns the keys of the Initial packets of a side ("client
+// in" or "server in"), derived from the connection ID the client chose.
+func quicInitialKeys(version quicVersion, dcid []byte, label string) *quicKeys {
+	initial := hkdf.Extract(sha256.New, dcid, version.salt)
+	suite := tlsCipherSuites[0x1301]
+	keys, _ := newQUICKeys(version, suite, hkdfExpandLabel(sha256.New, initial, label, sha256.Size))
+	return keys
+}
+
+// next returns the keys after a key update, which keeps the header protection.
+func (k *quicKeys) next() (*quicKeys, error) {
+	secret := hkdfExpandLabel(k.suite.hash, k.secret, k.version.labelPrefix+"ku", len(k.secret))
+	next, err := newQUICKeys(k.version, k.suite, secret)
+	if err != nil {
+		return nil, err
+	}
+	next.hp = k.hp
+	return next, nil
+}
+
+// open removes the header protection of a packet, whose packet number starts
+// at pnOffset, and decrypts its payload. largest is the largest packet number
+// of the space so far, or -1. The first byte of the header is returned
+// unprotected even if the decryption fails, for its key phase.
+func (k *quicKeys) open(packet []byte, pnOffset int, long bool, largest int64) (byte, int64, []byte, error) {
+	if len(packet) < pnOffset+4+16 {
+		return 0, 0, nil, errors.New("QUIC packet is too short")
+	}
+	mask := k.hp(packet[pnOffset+4 : pnOffset+4+16])
+	header := append([]byte(nil), packet[:pnOffset+4]...)
+	if long {
+		header[0] ^= mask[0] & 0x0f
+	} else {
+		header[0] ^= mask[0] & 0x1f
+	}
+	pnLen := int(header[0]&0x03) + 1
+	var truncated int64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | int64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+	pn := decodePacketNumber(largest, truncated, pnLen)
+	nonce := append([]byte(nil), k.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := k.aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+	return header[0], pn, payload, err
+}
+
+// decodePacketNumber returns the packet number closest to the largest one of
+// the space whose pnLen least significant bytes are truncated (RFC 9000,
+// appendix A.3).
+func decodePacketNumber(largest, truncated int64, pnLen int) int64 {
+	expected := largest + 1
+	window := int64(1) << (8 * pnLen)
+	candidate := expected&^(window-1) | truncated
+	if candidate+window/2 <= expected && candidate < 1<<62-window {
+		return candidate + window
+	}
+	if candidate > expected+window/2 && candidate >= window {
+		return candidate - window
+	}
+	return candidate
+}
+
+// quicLongHeader is the header of a long header packet, sent during the
+// handshake.
+type quicLongHeader struct {
+	version    uint32
+	typ        byte
+	dcid, scid []byte
+	// pnOffset is the offset of the packet number in packet, when the type has one
+	pnOffset int
+	packet   []byte
+}
+
+// parseQUICLongHeader parses the long header packet a datagram starts with,
+// and returns the packets coalesced after it.
+func parseQUICLongHeader(datagram []byte) (quicLongHeader, []byte, error) {
+	errTruncated := errors.New("QUIC long header is truncated")
+	r := &quicReader{b: datagram[1:]}
+	v := r.bytes(4)
+	dcid := r.bytes(uint64(r.byte()))
+	scid := r.bytes(uint64(r.byte()))
+	if r.err {
+		return quicLongHeader{}, nil, errTruncated
+	}
+	h := quicLongHeader{version: binary.BigEndian.Uint32(v), typ: datagram[0] >> 4 & 0x03, dcid: dcid, scid: scid, packet: datagram}
+	version, ok := quicVersions[h.version]
+	if !ok {
+		// version negotiation, or a version whose packets cannot be delimited
+		return h, nil, nil
+	}
+	switch version.packetTypes[h.typ] {
+	case "retry":
+		return h, nil, nil
+	case "initial":
+		r.bytes(r.varint())
+	}
+	length := r.varint()
+	if r.err || length > uint64(len(r.b)) {
+		return quicLongHeader{}, nil, errTruncated
+	}
+	h.pnOffset = len(datagram) - len(r.b)
+	end := h.pnOffset + int(length)
+	h.packet = datagram[:end]
+	return h, datagram[end:], nil
+}
+
+// quicStream reassembles the data of a QUIC stream, or the CRYPTO frames of a
+// packet number space, which can be received out of order.
+type quicStream struct {
+	// next is the offset of the first byte not received yet, and pending holds
+	// the data received after it, by offset
+	next    uint64
+	pending map[uint64][]byte
+	// fin is true when the final size of the stream is known
+	fin  bool
+	size uint64
+	// data holds the data received in order and not consumed yet
+	data []byte
+	// kind is the type of a unidirectional stream, -1 until it is received
+	kind int64
+	// firstSeen is the capture time of the first data of the stream
+	firstSeen time.Time
+	done      bool
+}
+
+// add adds the data of a frame at offset, and returns the data it makes
+// contiguous.
+func (s *quicStream) add(offset uint64, data []byte, fin bool) []byte {
+	end := offset + uint64(len(data))
+	if fin {
+		s.fin, s.size = true, end
+	}
+	if end <= s.next {
+		return nil
+	}
+	if offset > s.next {
+		if s.pending == nil {
+			s.pending = map[uint64][]byte{}
+		}
+		if len(s.pending[offset]) < len(data) {
+			s.pending[offset] = append([]byte(nil), data...)
+		}
+		return nil
+	}
+	out := append([]byte(nil), data[s.next-offset:]...)
+	s.next = end
+	for progress := true; progress; {
+		progress = false
+		for o, p := range s.pending {
+			if o > s.next {
+				continue
+			}
+			delete(s.pending, o)
+			if e := o + uint64(len(p)); e > s.next {
+				out = append(out, p[s.next-o:]...)
+				s.next = e
+			}
+			progress = true
+		}
+	}
+	return out
+}
+
+// complete reports whether the whole stream was received.
+func (s *quicStream) complete() bool {
+	return s.fin && s.next >= s.size
+}
+
+// parseQUICFrames parses the frames of a decrypted packet, passing the data of
+// the CRYPTO and STREAM frames to crypto and stream. It reports whether the
+// packet closes the connection.
+func parseQUICFrames(payload []byte, crypto func(offset uint64, data []byte), stream func(id, offset uint64, data []byte, fin bool)) (bool, error) {
+	r := &quicReader{b: payload}
+	closed := false
+	for len(r.b) > 0 && !r.err {
+		switch typ := r.varint(); {
+		case typ == 0x00 || typ == 0x01 || typ == 0x1e:
+			// PADDING, PING, HANDSHAKE_DONE
+		case typ == 0x02 || typ == 0x03:
+			// ACK: largest acknowledged, delay, ranges, and ECN counts
+			r.varint()
+			r.varint()
+			ranges := r.varint()
+			r.varint()
+			for i := uint64(0); i < ranges && !r.err; i++ {
+				r.varint()
+				r.varint()
+			}
+			if typ == 0x03 {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case typ == 0x04:
+			// RESET_STREAM
+			r.varint()
+			r.varint()
+			r.varint()
+		case typ == 0x05 || typ == 0x11 || typ == 0x15:
+			// STOP_SENDING, MAX_STREAM_DATA, STREAM_DATA_BLOCKED
+			r.varint()
+			r.varint()
+		case typ == 0x06:
+			offset := r.varint()
+			data := r.bytes(r.varint())
+			if !r.err && crypto != nil {
+				crypto(offset, data)
+			}
+		case typ == 0x07:
+			// NEW_TOKEN
+			r.bytes(r.varint())
+		case typ >= 0x08 && typ <= 0x0f:
+			// STREAM, with the OFF, LEN and FIN bits
+			id := r.varint()
+			var offset uint64
+			if typ&0x04 != 0 {
+				offset = r.varint()
+			}
+			var data []byte
+			if typ&0x02 != 0 {
+				data = r.bytes(r.varint())
+			} else {
+				data, r.b = r.b, nil
+			}
+			if !r.err && stream != nil {
+				stream(id, offset, data, typ&0x01 != 0)
+			}
+		case typ == 0x10 || typ == 0x12 || typ == 0x13 || typ == 0x14 || typ == 0x16 || typ == 0x17 || typ == 0x19:
+			// MAX_DATA, MAX_STREAMS, DATA_BLOCKED, STREAMS_BLOCKED, RETIRE_CONNECTION_ID
+			r.varint()
+		case typ == 0x18:
+			// NEW_CONNECTION_ID
+			r.varint()
+			r.varint()
+			r.bytes(uint64(r.byte()))
+			r.bytes(16)
+		case typ == 0x1a || typ == 0x1b:
+			// PATH_CHALLENGE, PATH_RESPONSE
+			r.bytes(8)
+		case typ == 0x1c:
+			// CONNECTION_CLOSE of the transport
+			r.varint()
+			r.varint()
+			r.bytes(r.varint())
+			closed = true
+		case typ == 0x1d:
+			// CONNECTION_CLOSE of the application
+			r.varint()
+			r.bytes(r.varint())
+			closed = true
+		case typ == 0x30:
+			// DATAGRAM to the end of the packet
+			r.b = nil
+		case typ == 0x31:
+			r.bytes(r.varint())
+		default:
+			return closed, fmt.Errorf("unknown QUIC frame type 0x%x", typ)
+		}
+	}
+	if r.err {
+		return closed, errors.New("QUIC frame is truncated")
+	}
+	return closed, nil
+}
+
+// quicTracker tracks the QUIC connections of the datagrams of quic-ports. It is
+// used by the capture loop only.
+type quicTracker struct {
+	ports []portRange
+	// connections holds the connections by connection ID of their flow from the
+	// client to the server
+	connections map[string]*quicConnection
+}
+
+// quicConnection is a QUIC connection, from its first Initial packet.
+type quicConnection struct {
+	net, transport gopacket.Flow
+	version        quicVersion
+	lastSeen       time.Time
+
+	// initial holds the keys of the Initial packets of the client and the
+	// server, largest their largest packet numbers, and crypto and handshake
+	// reassemble their ClientHello and ServerHello
+	initial   [2]*quicKeys
+	largest   [2]int64
+	crypto    [2]quicStream
+	handshake [2]handshakeBuffer
+
+	clientRandom []byte
+	ja3          string
+	// cipherSuite is the cipher suite of the ServerHello, or 0
+	cipherSuite uint16
+	// serverCIDLen is the length of the connection ID of the 1-RTT packets of
+	// the client, the one the server chose, or -1 until it is known
+	serverCIDLen int
+
+	// keys are the 1-RTT keys of the client, nil until they are read from the
+	// key log; the packets received before are queued
+	keys       *quicKeys
+	keyPhase   byte
+	appLargest int64
+	queued     []quicQueuedPacket
+	failed     bool
+
+	streams  map[uint64]*quicStream
+	qpack    qpackDecoder
+	blocked  []uint64
+	requests int
+}
+
+type quicQueuedPacket struct {
+	packet []byte
+	seen   time.Time
+	queued time.Time
+}
+
+func newQUICTracker(list string) *quicTracker {
+	ports, _ := parsePorts("quic-ports", list)
+	return &quicTracker{ports: ports, connections: map[string]*quicConnection{}}
+}
+
+func (q *quicTracker) isPort(port layers.UDPPort) bool {
+	for _, r := range q.ports {
+		if int(port) >= r.from && int(port) <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// handle parses a UDP datagram sent to or from a QUIC port. The datagrams
+// sent to the ports are from the clients.
+func (q *quicTracker) handle(net gopacket.Flow, udp *layers.UDP, seen time.Time) {
+	fromClient := q.isPort(udp.DstPort)
+	if !fromClient && !q.isPort(udp.SrcPort) {
+		return
+	}
+	transport := udp.TransportFlow()
+	if !fromClient {
+		net, transport = net.Reverse(), transport.Reverse()
+	}
+	id := connectionID(net, transport)
+	c := q.connections[id]
+
+	datagram := udp.Payload
+	for len(datagram) > 0 {
+		if datagram[0]&0x80 == 0 {
+			// a short header packet extends to the end of the datagram
+			stats.inc(labeled("quic_packets", "type", "1rtt"))
+			if c != nil && fromClient {
+				c.lastSeen = seen
+				c.shortPacket(datagram, seen)
+			}
+			break
+		}
+		h, rest, err := parseQUICLongHeader(datagram)
+		if err != nil {
+			stats.inc("quic_packets_invalid")
+			return
+		}
+		datagram = rest
+		version, ok := quicVersions[h.version]
+		if !ok {
+			if h.version == 0 {
+				stats.inc(labeled("quic_packets", "type", "version_negotiation"))
+			} else {
+				stats.inc(labeled("quic_packets", "type", "unknown_version"))
+			}
+			continue
+		}
+		kind := version.packetTypes[h.typ]
+		stats.inc(labeled("quic_packets", "type", kind))
+		if kind == "initial" && fromClient && c == nil {
+			c = q.track(id, net, transport, version, h.dcid)
+		}
+		if c == nil {
+			continue
+		}
+		c.lastSeen = seen
+		switch {
+		case kind == "initial":
+			c.initialPacket(h, fromClient)
+		case kind == "retry" && !fromClient:
+			// the client starts again with the connection ID of the server
+			c.initial = [2]*quicKeys{quicInitialKeys(version, h.scid, "client in"), quicInitialKeys(version, h.scid, "server in")}
+			c.largest = [2]int64{-1, -1}
+			c.crypto, c.handshake = [2]quicStream{}, [2]handshakeBuffer{}
+		}
+	}
+}
+
+// track starts tracking a connection from the first Initial packet of its
+// client, whose destination connection ID derives the Initial keys.
+func (q *quicTracker) track(id string, net, transport gopacket.Flow, version quicVersion, dcid []byte) *quicConnection {
+	if len(q.connections) >= quicMaxConnections {
+		stats.inc("quic_connections_untracked")
+		return nil
+	}
+	c := &quicConnection{
+		net:          net,
+		transport:    transport,
+		version:      version,
+		initial:      [2]*quicKeys{quicInitialKeys(version, dcid, "client in"), quicInitialKeys(version, dcid, "server in")},
+		largest:      [2]int64{-1, -1},
+		serverCIDLen: -1,
+		appLargest:   -1,
+	}
+	q.connections[id] = c
+	stats.inc("quic_connections")
+	stats.set("quic_connections_active", int64(len(q.connections)))
+	return c
+}
+
+// expire forgets the connections without packets since before, and those
+// closed.
+func (q *quicTracker) expire(before time.Time) {
+	for id, c := range q.connections {
+		if c.lastSeen.Before(before) {
+			delete(q.connections, id)
+		}
+	}
+	stats.set("quic_connections_active", int64(len(q.connections)))
+}
+
+// initialPacket decrypts an Initial packet, to read the ClientHello of the
+// client, or the ServerHello of the server.
+func (c *quicConnection) initialPacket(h quicLongHeader, fromClient bool) {
+	conf := currentConfig()
+	side, label := 1, "server"
+	if fromClient {
+		side, label = 0, "client"
+	}
+	_, pn, payload, err := c.initial[side].open(h.packet, h.pnOffset, true, c.largest[side])
+	if err != nil {
+		stats.inc(labeled("quic_initials_undecryptable", "side", label))
+		return
+	}
+	if pn > c.largest[side] {
+		c.largest[side] = pn
+	}
+	crypto, handshake := &c.crypto[side], &c.handshake[side]
+	parseQUICFrames(payload, func(offset uint64, data []byte) {
+		handshake.data = append(handshake.data, crypto.add(offset, data, false)...)
+	}, nil)
+	for msg := handshake.next(); msg != nil; msg = handshake.next() {
+		switch {
+		case fromClient && msg[0] == tlsHandshakeClientHello && c.clientRandom == nil:
+			// a second ClientHello, after a HelloRetryRequest, has the same random
+			if len(msg) >= 38 {
+				c.clientRandom = append([]byte(nil), msg[6:38]...)
+			}
+			if conf.ja3 != nil {
+				c.ja3 = conf.ja3.record(msg)
+			}
+		case !fromClient && msg[0] == tlsHandshakeServerHello:
+			hello, err := parseServerHello(msg)
+			if err == nil && !bytes.Equal(hello.serverRandom, helloRetryRandom) {
+				c.cipherSuite = hello.cipherSuite
+				c.serverCIDLen = len(h.scid)
+			}
+		}
+	}
+}
+
+// sessionError counts a connection that cannot be decrypted, by reason.
+func (c *quicConnection) sessionError(reason string) {
+	c.failed, c.queued = true, nil
+	stats.inc(labeled("quic_sessions_failed", "reason", reason))
+}
+
+// shortPacket decrypts a 1-RTT packet of the client with the secrets of the
+// key log, queuing it until they are appended to it.
+func (c *quicConnection) shortPacket(packet []byte, seen time.Time) {
+	if fwdKeyLog == nil || c.failed {
+		return
+	}
+	if c.keys == nil {
+		if !c.setupKeys() {
+			if !c.failed && len(c.queued) < quicMaxQueued {
+				c.queued = append(c.queued, quicQueuedPacket{append([]byte(nil), packet...), seen, time.Now()})
+			}
+			return
+		}
+		queued := c.queued
+		c.queued = nil
+		for _, p := range queued {
+			c.decryptPacket(p.packet, p.seen)
+		}
+	}
+	c.decryptPacket(packet, seen)
+}
+
+// setupKeys derives the 1-RTT keys of the client, and reports whether they are
+// known. The connection fails when the keys cannot be known.
+func (c *quicConnection) setupKeys() bool {
+	switch {
+	case c.clientRandom == nil:
+		c.sessionError("no_client_hello")
+		return false
+	case c.serverCIDLen < 0:
+		c.sessionError("no_server_hello")
+		return false
+	}
+	suite, ok := tlsCipherSuites[c.cipherSuite]
+	if !ok || c.cipherSuite>>8 != 0x13 {
+		c.sessionError("unsupported_cipher")
+		return false
+	}
+	secret := fwdKeyLog.secret(c.clientRandom, "CLIENT_TRAFFIC_SECRET_0", 0)
+	if secret == nil {
+		if len(c.queued) > 0 && time.Since(c.queued[0].queued) > currentConfig().tlsKeyLogWait {
+			c.sessionError("no_keys")
+		}
+		return false
+	}
+	keys, err := newQUICKeys(c.version, suite, secret)
+	if err != nil {
+		c.sessionError("decrypt")
+		return false
+	}
+	c.keys = keys
+	stats.inc("quic_sessions_decrypted")
+	return true
+}
+
+// decryptPacket decrypts a 1-RTT packet of the client, following its key
+// updates, and parses its frames.
+func (c *quicConnection) decryptPacket(packet []byte, seen time.Time) {
+	pnOffset := 1 + c.serverCIDLen
+	first, pn, payload, err := c.keys.open(packet, pnOffset, false, c.appLargest)
+	if err != nil && first&0x04 != c.keyPhase {
+		if next, nErr := c.keys.next(); nErr == nil {
+			if first, pn, payload, err = next.open(packet, pnOffset, false, c.appLargest); err == nil {
+				c.keys, c.keyPhase = next, first&0x04
+				stats.inc("quic_key_updates")
+			}
+		}
+	}
+	if err != nil {
+		stats.inc("quic_packets_undecryptable")
+		return
+	}
+	if pn > c.appLargest {
+		c.appLargest = pn
+	}
+	closed, err := parseQUICFrames(payload, nil, func(id, offset uint64, data []byte, fin bool) {
+		c.streamFrame(id, offset, data, fin, seen)
+	})
+	if err != nil {
+		stats.inc("quic_packets_invalid")
+	}
+	if closed {
+		// the connection is forgotten when it expires, once the packets
+		// retransmitted after the close are seen
+		c.failed = true
+	}
+}
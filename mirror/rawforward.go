@@ -0,0 +1,260 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rawMaxIdlePerHost is the number of idle connections kept per destination.
+const rawMaxIdlePerHost = 16
+
+// rawDrainLimit is the number of bytes of a response read to reuse its connection.
+const rawDrainLimit = 1 << 20
+
+// rawTransport sends requests with the headers in the order and casing they
+// were captured, which net/http normalizes. It writes the request bytes itself
+// over a pool of keep-alive TCP or TLS connections per destination, and parses
+// the responses with net/http.
+type rawTransport struct {
+	mu   sync.Mutex
+	idle map[string][]net.Conn
+}
+
+var fwdRawTransport = &rawTransport{idle: map[string][]net.Conn{}}
+
+// roundTrip sends req with its headers in order, the captured header names, and
+// body, and returns the response. The response body must be closed, which
+// returns the connection to the pool. With connection affinity, pool is the
+// captured connection, whose connections are not shared with other ones.
+func (t *rawTransport) roundTrip(req *http.Request, pool string, order []string, body []byte) (*http.Response, error) {
+	addr := canonicalAddr(req)
+	key := pool + "|" + addr
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := t.get(req, key, addr)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.send(conn, req, order, body)
+		if err == nil {
+			resp.Body = &rawBody{ReadCloser: resp.Body, t: t, key: key, conn: conn, reuse: !resp.Close && !req.Close}
+			return resp, nil
+		}
+		conn.Close()
+		// an idle connection may have been closed by the destination meanwhile
+		if !reused || attempt > 0 || req.Context().Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *rawTransport) send(conn net.Conn, req *http.Request, order []string, body []byte) (*http.Response, error) {
+	if deadline, ok := req.Context().Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Time{})
+	}
+	w := bufio.NewWriter(conn)
+	writeRawRequest(w, req, order, body)
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(conn), req)
+}
+
+// get returns an idle connection of the pool key, or a new one to addr.
+func (t *rawTransport) get(req *http.Request, key, addr string) (net.Conn, bool, error) {
+	t.mu.Lock()
+	if conns := t.idle[key]; len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		if len(conns) == 1 {
+			delete(t.idle, key)
+		} else {
+			t.idle[key] = conns[:len(conns)-1]
+		}
+		t.mu.Unlock()
+		return conn, true, nil
+	}
+	t.mu.Unlock()
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if deadline, ok := req.Context().Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+	if req.URL.Scheme == "https" {
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: req.URL.Hostname()})
+		return conn, false, err
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	return conn, false, err
+}
+
+func (t *rawTransport) put(key string, conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle[key]) >= rawMaxIdlePerHost {
+		conn.Close()
+		return
+	}
+	t.idle[key] = append(t.idle[key], conn)
+}
+
+// closePool closes the idle connections of the pool of a captured connection.
+func (t *rawTransport) closePool(pool string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, conns := range t.idle {
+		if strings.HasPrefix(key, pool+"|") {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			delete(t.idle, key)
+		}
+	}
+}
+
+// rawBody returns the connection of a response to the pool once its body is
+// read and closed.
+type rawBody struct {
+	io.ReadCloser
+	t      *rawTransport
+	key    string
+	conn   net.Conn
+	reuse  bool
+	closed bool
+}
+
+func (b *rawBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(b.ReadCloser, rawDrainLimit))
+	b.ReadCloser.Close()
+	if b.reuse && err == nil && n < rawDrainLimit {
+		b.t.put(b.key, b.conn)
+	} else {
+		b.conn.Close()
+	}
+	return nil
+}
+
+// canonicalAddr returns the host:port of the destination of req.
+func canonicalAddr(req *http.Request) string {
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
+// writeRawRequest writes req in HTTP/1.1 with the header fields of order first,
+// in order and with their original names, then the fields added since the
+// capture. The values are those of req.Header, so the headers set by the
+// replay handler (X-Forwarded-For, X-Mirror-*...) are still applied. The body
+// is sent with a Content-Length, as it was reassembled from chunks if needed,
+// or in a single chunk if the request has trailers.
+func writeRawRequest(w *bufio.Writer, req *http.Request, order []string, body []byte) {
+	target := req.URL.RequestURI()
+	if req.Method == http.MethodConnect {
+		target = req.Host
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", req.Method, target)
+
+	// a request with trailers is sent chunked, with the body in a single chunk
+	chunked := len(req.Trailer) > 0
+	written := map[string]bool{}
+	writeField := func(name, key string) {
+		switch key {
+		case "Host":
+			fmt.Fprintf(w, "%s: %s\r\n", name, host)
+		case "Content-Length":
+			if !chunked && (len(body) > 0 || req.Header.Get(key) != "") {
+				fmt.Fprintf(w, "%s: %s\r\n", name, strconv.Itoa(len(body)))
+			}
+		case "Transfer-Encoding":
+			if chunked {
+				fmt.Fprintf(w, "%s: chunked\r\n", name)
+			}
+		case "Trailer":
+			if chunked {
+				var keys []string
+				for k := range req.Trailer {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				fmt.Fprintf(w, "%s: %s\r\n", name, strings.Join(keys, ", "))
+			}
+		default:
+			for _, v := range req.Header[key] {
+				fmt.Fprintf(w, "%s: %s\r\n", name, v)
+			}
+		}
+	}
+	for _, name := range order {
+		key := http.CanonicalHeaderKey(name)
+		if written[key] {
+			continue
+		}
+		written[key] = true
+		writeField(name, key)
+	}
+
+	var added []string
+	for key := range req.Header {
+		if !written[key] {
+			added = append(added, key)
+			written[key] = true
+		}
+	}
+	required := []string{"Host", "Content-Length"}
+	if chunked {
+		required = []string{"Host", "Transfer-Encoding", "Trailer"}
+	}
+	for _, key := range required {
+		if !written[key] {
+			added = append(added, key)
+			written[key] = true
+		}
+	}
+	sort.Strings(added)
+	for _, key := range added {
+		writeField(key, key)
+	}
+	w.WriteString("\r\n")
+	if !chunked {
+		w.Write(body)
+		return
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(w, "%x\r\n", len(body))
+		w.Write(body)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("0\r\n")
+	for key, values := range req.Trailer {
+		for _, v := range values {
+			fmt.Fprintf(w, "%s: %s\r\n", key, v)
+		}
+	}
+	w.WriteString("\r\n")
+}
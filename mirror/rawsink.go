@@ -0,0 +1,171 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// rawTCPSink forwards the captured bytes of the requests as is, without
+// parsing and serializing them again, so that folded headers, unusual
+// whitespace and other quirks reach the destination. Each captured connection
+// has its own destination connection, on which its requests are written in
+// the order they were captured, like the keep-alive connection of the client;
+// the responses are read and discarded.
+//
+// The requests go through the usual filters and routes, which run concurrently,
+// so every forwarded request of a connection reports to the sink, with its
+// bytes or without if it was dropped, and the sink writes them in sequence.
+type rawTCPSink struct {
+	mu    sync.Mutex
+	conns map[string]*rawSinkConn
+}
+
+// rawSinkConn is the state of a captured connection.
+type rawSinkConn struct {
+	mu sync.Mutex
+	// next is the sequence number of the next request to write
+	next int
+	// total is the number of requests of the connection, or -1 while it is open
+	total   int
+	pending map[int]rawSinkItem
+	dest    string
+	conn    net.Conn
+}
+
+// rawSinkItem is a request of a captured connection, with its destination and
+// bytes, or without bytes if it is not forwarded.
+type rawSinkItem struct {
+	dest string
+	data []byte
+}
+
+var fwdRawSink *rawTCPSink
+
+func newRawTCPSink() *rawTCPSink {
+	return &rawTCPSink{conns: map[string]*rawSinkConn{}}
+}
+
+func (s *rawTCPSink) connection(id string) *rawSinkConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conns[id]
+	if !ok {
+		c = &rawSinkConn{total: -1, pending: map[int]rawSinkItem{}}
+		s.conns[id] = c
+	}
+	return c
+}
+
+// complete reports the request of sequence number seq on the captured connection id.
+func (s *rawTCPSink) complete(id string, seq int, item rawSinkItem) {
+	c := s.connection(id)
+	c.mu.Lock()
+	c.pending[seq] = item
+	for {
+		item, ok := c.pending[c.next]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.next)
+		c.next++
+		if item.data != nil {
+			c.write(item)
+		}
+	}
+	done := c.done()
+	c.mu.Unlock()
+	if done {
+		s.remove(id)
+	}
+}
+
+// closeConnection reports the end of the captured connection id, after total requests.
+func (s *rawTCPSink) closeConnection(id string, total int) {
+	c := s.connection(id)
+	c.mu.Lock()
+	c.total = total
+	done := c.done()
+	c.mu.Unlock()
+	if done {
+		s.remove(id)
+	}
+}
+
+func (s *rawTCPSink) remove(id string) {
+	s.mu.Lock()
+	delete(s.conns, id)
+	s.mu.Unlock()
+}
+
+// done closes the destination connection once every request of the captured
+// connection is written, and reports whether it did.
+func (c *rawSinkConn) done() bool {
+	if c.total < 0 || c.next < c.total {
+		return false
+	}
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return true
+}
+
+// write sends the bytes of item, over a new connection if there is none yet or
+// if the destination changed.
+func (c *rawSinkConn) write(item rawSinkItem) {
+	if c.conn != nil && c.dest != item.dest {
+		c.conn.Close()
+		c.conn = nil
+	}
+	if c.conn == nil {
+		conn, err := dialRawDestination(item.dest)
+		if err != nil {
+			stats.inc("forward_errors")
+			log.Println("Error connecting to", item.dest, ":", err)
+			return
+		}
+		c.conn, c.dest = conn, item.dest
+		// the responses are not parsed, only read so that the destination is not blocked
+		go io.Copy(ioutil.Discard, conn)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.conn.Write(item.data); err != nil {
+		stats.inc("forward_errors")
+		log.Println("Error writing to", item.dest, ":", err)
+		c.conn.Close()
+		c.conn = nil
+		return
+	}
+	stats.inc("requests_forwarded")
+	stats.add("raw_tcp_bytes_sent", int64(len(item.data)))
+}
+
+// dialRawDestination connects to the host of the destination URL dest, with TLS for https.
+func dialRawDestination(dest string) (net.Conn, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if u.Scheme == "https" {
+		return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: u.Hostname()})
+	}
+	return dialer.Dial("tcp", addr)
+}
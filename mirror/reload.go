@@ -0,0 +1,182 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// commandLineFlags holds the flags given on the command line, which a reload
+// does not change.
+var commandLineFlags = map[string]bool{}
+
+// restartFlags are the flags that cannot be changed by a reload, because they
+// are used once at startup.
+var restartFlags = []string{
+	"interface", "capture-open-retry", "snaplen", "pcap-buffer-size", "pcap-immediate-mode", "promisc",
+	"capture-drop-interval", "capture-drop-adapt",
+	"admin-addr", "record", "dry-run-output", "route-table-source", "route-refresh-interval",
+	"quarantine-output", "quarantine-max-size", "record-frame-records", "archive-encryption", "archive-key-file", "archive-kms-key-id",
+	"record-max-disk-usage", "record-max-age", "record-retention", "record-rotate-interval",
+	"stub", "stub-status", "stub-body", "stub-latency", "stub-output",
+	"ecs-clusters", "ecs-refresh-interval", "kube-attribution", "source-names", "source-name-cache-size", "pipeline", "config",
+	"anomalies", "metrics-exporter", "metrics-export-addr", "metrics-flush-interval",
+	"path-report-interval", "fingerprint-report", "fingerprint-report-interval", "openapi-coverage-report", "openapi-coverage-interval", "raw-tcp", "connection-affinity", "cookie-jar",
+	"diff", "diff-output", "diff-sample", "diff-max-per-minute",
+	"scorecard-interval", "scorecard-output",
+	"guardrail-max-error-rate", "guardrail-max-p99", "guardrail-window",
+	"capture-engine", "pfring-queues", "pfring-zc", "uds-paths", "ebpf-object", "listen-addr",
+	"tls-targets", "tls-pid", "tls-side", "tls-ebpf-object", "tls-keylog", "quic-ports",
+	"fleet-dedup", "fleet-dedup-by", "fleet-dedup-window", "fleet-dedup-redis", "fleet-dedup-timeout", "fleet-dedup-listen", "fleet-dedup-peers", "fleet-dedup-delay", "shard",
+	"leader-election", "leader-lock", "leader-lease-duration", "leader-sinks",
+	"flow-export", "flow-export-format", "flow-export-pen", "flow-idle-timeout", "flow-active-timeout",
+	"xdp-filter", "xdp-object", "xdp-mode", "vxlan-ports",
+	"dedup-retransmissions", "capture-cpu", "worker-cpus", "gomaxprocs", "gogc", "memory-limit", "memory-ballast",
+}
+
+var reloadMu sync.Mutex
+
+// reloading is true while setupFlags runs for a reload.
+var reloading bool
+
+// recordCommandLineFlags remembers the flags given on the command line.
+func recordCommandLineFlags() {
+	flags.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+}
+
+// copyFlags returns a copy of the flags, with their current values, for a
+// reload to be applied and checked without changing the live flags.
+func copyFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flags.VisitAll(func(f *flag.Flag) {
+		value := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+		value.Set(f.Value.String())
+		fs.Var(value, f.Name, f.Usage)
+		fs.Lookup(f.Name).DefValue = f.DefValue
+	})
+	return fs
+}
+
+func flagValues(fs *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+func setFlagValues(values map[string]string) {
+	for name, value := range values {
+		flags.Set(name, value)
+	}
+}
+
+// reloadConfig reads the config file again and applies the whole configuration:
+// routes, filters, sampling, header rules, hooks and outputs. If the new
+// configuration is invalid, or changes flags that require a restart, nothing
+// is changed.
+func reloadConfig() error {
+	if *configFile == "" {
+		return fmt.Errorf("Reload requires the config flag.")
+	}
+	return reloadFlags(func(fs *flag.FlagSet) error {
+		// flags removed from the file are back to their defaults
+		fs.VisitAll(func(f *flag.Flag) {
+			if !commandLineFlags[f.Name] {
+				f.Value.Set(f.DefValue)
+			}
+		})
+		return applyConfigFile(fs, *configFile, commandLineFlags)
+	}, *configFile)
+}
+
+// reloadFlags sets the flags with apply on a copy of the flags and applies the
+// whole configuration, see reloadConfig. source names where the flags come
+// from, for the logs.
+//
+// Only the setup reads the reloadable flags, under reloadMu: the capture and
+// the forwards read the snapshot setupFlags publishes, so the flags can be set
+// here while they run.
+func reloadFlags(apply func(fs *flag.FlagSet) error, source string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	fs := copyFlags()
+	if err := apply(fs); err != nil {
+		return fmt.Errorf("Configuration not reloaded: %v", err)
+	}
+	before, after := flagValues(flags), flagValues(fs)
+	var changed []string
+	for _, name := range restartFlags {
+		if before[name] != after[name] {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return fmt.Errorf("Configuration not reloaded: flags %s cannot be reloaded, restart instead", strings.Join(changed, ", "))
+	}
+
+	// only the flags that change are set, and set back on failure
+	previous := map[string]string{}
+	for name, value := range after {
+		if before[name] != value {
+			previous[name] = before[name]
+			flags.Set(name, value)
+		}
+	}
+	oldFilter := bpfFilter()
+	rollback := func(err error) error {
+		setFlagValues(previous)
+		return fmt.Errorf("Configuration not reloaded: %v", err)
+	}
+
+	// the new BPF filter is checked first, as it is the only step that can fail
+	// after the configuration is validated
+	newFilter, err := buildBPFFilter()
+	if err != nil {
+		return rollback(err)
+	}
+	if newFilter != oldFilter {
+		if err := setCaptureFilter(newFilter); err != nil {
+			// the sources set before the failure are set back
+			setCaptureFilter(oldFilter)
+			return rollback(err)
+		}
+	}
+
+	// setupFlags publishes the new configuration only once it is valid
+	reloading = true
+	_, err = setupFlags()
+	reloading = false
+	if err != nil {
+		if newFilter != oldFilter {
+			setCaptureFilter(oldFilter)
+		}
+		return rollback(err)
+	}
+	if newFilter != oldFilter {
+		// the XDP maps are set from the same filter flags as the BPF filter
+		if err := configureXDPFilter(); err != nil {
+			log.Println("Error updating XDP filter", ":", err)
+		}
+	}
+	setSamplingPercentage(*fwdPerc)
+	stats.inc("config_reloads")
+	if newFilter != oldFilter {
+		log.Println("Using BPF filter", newFilter)
+	}
+	log.Println("Configuration reloaded from", source)
+	return nil
+}
@@ -0,0 +1,56 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReloadRollback(t *testing.T) {
+	// a process has one Mirror, so the cases run in order on the same one
+	if _, err := New([]string{"-route-table-json", `{"*": "http://shadow"}`, "-drain-timeout", "10s"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+		err  bool
+		// the drain timeout and latency percentage of the configuration after
+		// the reload
+		drainTimeout      time.Duration
+		latencyPercentage float64
+	}{
+		{"valid", []string{"-drain-timeout", "20s", "-latency-percentage", "50"}, false, 20 * time.Second, 50},
+		{"restart flag", []string{"-drain-timeout", "30s", "-interface", "other0"}, true, 20 * time.Second, 50},
+		{"invalid value", []string{"-drain-timeout", "30s", "-latency-percentage", "150"}, true, 20 * time.Second, 50},
+		{"invalid route table", []string{"-drain-timeout", "30s", "-route-table-json", `{"*": 1}`}, true, 20 * time.Second, 50},
+		{"unknown flag", []string{"-drain-timeout", "30s", "-no-such-flag"}, true, 20 * time.Second, 50},
+		{"valid after failures", []string{"-latency-percentage", "25"}, false, 20 * time.Second, 25},
+	}
+	m := &Mirror{}
+	for _, tt := range tests {
+		before := currentConfig()
+		values := flagValues(flags)
+		err := m.UpdateConfig(tt.args)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: UpdateConfig(%v) = %v, want error %v", tt.name, tt.args, err, tt.err)
+		}
+		conf := currentConfig()
+		if tt.err {
+			if conf != before {
+				t.Errorf("%s: the failed reload published a configuration", tt.name)
+			}
+			for name, value := range flagValues(flags) {
+				if values[name] != value {
+					t.Errorf("%s: the failed reload set flag %s from %q to %q", tt.name, name, values[name], value)
+				}
+			}
+		}
+		if conf.drainTimeout != tt.drainTimeout || conf.latencyPercentage != tt.latencyPercentage {
+			t.Errorf("%s: drain timeout %v and latency percentage %v, want %v and %v", tt.name,
+				conf.drainTimeout, conf.latencyPercentage, tt.drainTimeout, tt.latencyPercentage)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runReplay implements the replay subcommand: it reads the requests recorded
+// by capture -record, or logged in access logs, and runs them through the
+// forwarding pipeline, replay-concurrency at a time or, with replay-ordering
+// strict, one after the other in the order of the archive. With
+// replay-checkpoint, its progress is saved so that -resume goes on from it.
+func runReplay() error {
+	if (*replayArchive == "") == (*accessLog == "") {
+		return fmt.Errorf("One of the flags archive and access-log must be set.")
+	}
+	if *replayConcurrency < 1 {
+		return fmt.Errorf("Flag replay-concurrency must be at least 1. Value: %d.", *replayConcurrency)
+	}
+	if *replayOrdering != "parallel" && *replayOrdering != "strict" {
+		return fmt.Errorf("Flag replay-ordering must be parallel or strict. Value: %s.", *replayOrdering)
+	}
+	if *replayResume && *replayCheckpointFile == "" {
+		return fmt.Errorf("Flag resume requires replay-checkpoint.")
+	}
+	if *replayResume && strings.HasPrefix(*accessLog, "kinesis://") {
+		return fmt.Errorf("Flag resume is not supported with Kinesis access logs.")
+	}
+	if (*replayFromSequence != 0 || *replayFromTime != "") && (*replayArchive == "" || *replayResume) {
+		return fmt.Errorf("Flags replay-from-sequence and replay-from-time require archive, and cannot be used with resume.")
+	}
+	if _, err := time.Parse(time.RFC3339, *replayFromTime); *replayFromTime != "" && err != nil {
+		return fmt.Errorf("Flag replay-from-time must be an RFC 3339 time. Value: %s.", *replayFromTime)
+	}
+	if *replayCheckpointInterval <= 0 {
+		return fmt.Errorf("Flag replay-checkpoint-interval must be positive. Value: %s.", *replayCheckpointInterval)
+	}
+	if *accessLogKinesisStart != "latest" && *accessLogKinesisStart != "trim-horizon" {
+		return fmt.Errorf("Flag access-log-kinesis-start must be latest or trim-horizon. Value: %s.", *accessLogKinesisStart)
+	}
+	var archive recordSource
+	var err error
+	source := *replayArchive
+	if source != "" {
+		archive, err = openArchiveReader(source)
+	} else {
+		source = *accessLog
+		archive, err = openAccessLogReader(source, *accessLogFormat)
+	}
+	if err != nil {
+		return err
+	}
+	defer archive.close()
+
+	progress := newReplayProgress(replayCheckpoint{Source: source})
+	if *replayResume {
+		checkpoint, err := loadReplayCheckpoint(*replayCheckpointFile, source)
+		if err != nil {
+			return err
+		}
+		progress = newReplayProgress(checkpoint)
+		if reader, ok := archive.(*archiveReader); ok && !reader.byOffset() {
+			if checkpoint.Records > 0 {
+				err = reader.skipTo(checkpoint.Sequence+1, time.Time{})
+			}
+		} else if ok {
+			err = reader.seek(checkpoint.Offset)
+		} else {
+			// access logs have no offsets: their records are read again
+			for i := 0; i < checkpoint.Records && err == nil; i++ {
+				_, err = archive.next()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Error resuming %s: %v", source, err)
+		}
+		log.Println("Resuming after", checkpoint.Records, "records, saved", checkpoint.Time)
+	}
+	if *replayFromSequence != 0 || *replayFromTime != "" {
+		from, _ := time.Parse(time.RFC3339, *replayFromTime)
+		if err := archive.(*archiveReader).skipTo(*replayFromSequence, from); err != nil {
+			return fmt.Errorf("Error seeking in %s: %v", source, err)
+		}
+	}
+	if *replayCheckpointFile != "" {
+		stop := make(chan struct{})
+		go progress.saveLoop(*replayCheckpointFile, *replayCheckpointInterval, stop)
+		defer func() {
+			close(stop)
+			if err := progress.save(*replayCheckpointFile); err != nil {
+				log.Println("Error saving replay checkpoint", ":", err)
+			}
+		}()
+	}
+
+	log.Println("Replaying", source)
+	sem := make(chan struct{}, *replayConcurrency)
+	replayed, index := 0, progress.checkpoint.Records
+	// the last sequence of each pipeline, for replay-ordering strict
+	sequences := map[string]uint64{}
+	for {
+		record, err := archive.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error reading %s after %d records: %v", source, replayed, err)
+		}
+		i := index
+		index++
+		var offset int64
+		if reader, ok := archive.(*archiveReader); ok {
+			offset = reader.offset()
+		}
+		if !progress.start(i, offset, record.Sequence) {
+			stats.inc("replay_records_resumed")
+			continue
+		}
+		if *replayOrdering == "strict" {
+			if record.Sequence != 0 && record.Sequence <= sequences[record.Pipeline] {
+				stats.inc("replay_records_out_of_order")
+			}
+			sequences[record.Pipeline] = record.Sequence
+			// each request is forwarded after the response to the previous one
+			atomic.AddInt64(&fwdInFlight, 1)
+			forwardRequest(record.request(), record.captureInfo(), record.Body)
+			progress.complete(i)
+			replayed++
+			continue
+		}
+		sem <- struct{}{}
+		atomic.AddInt64(&fwdInFlight, 1)
+		go func() {
+			forwardRequest(record.request(), record.captureInfo(), record.Body)
+			progress.complete(i)
+			<-sem
+		}()
+		replayed++
+	}
+	drain(currentConfig().drainTimeout)
+	saveFingerprintReport()
+	saveCoverageReport()
+	log.Println("Replayed", replayed, "requests:", stats.snapshot())
+	return nil
+}
@@ -0,0 +1,141 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxSeqRanges is the number of disjoint ranges of data remembered per flow.
+// Older ranges are forgotten first.
+const maxSeqRanges = 8
+
+type flowKey struct {
+	net, transport gopacket.Flow
+}
+
+// seqRange is a range of unwrapped sequence numbers, from included to excluded.
+type seqRange struct {
+	from, to int64
+}
+
+type flowSequences struct {
+	// last is the sequence number of the last packet, and unwrapped its value
+	// without the wrap around of 32 bits
+	last      uint32
+	unwrapped int64
+	// ranges holds the data seen, sorted and disjoint
+	ranges []seqRange
+	seen   time.Time
+}
+
+// retransmissionFilter drops the TCP data already seen in a flow, before it is
+// reassembled. The assembler already ignores retransmissions while a stream is
+// open, but retransmissions that arrive after the stream is closed or flushed
+// start a new stream, whose requests would be parsed twice. The flows are
+// remembered for dedup-window after their last packet, and the data of a flow
+// reaches the HTTP parser at most once during that time.
+type retransmissionFilter struct {
+	flows map[flowKey]*flowSequences
+}
+
+func newRetransmissionFilter() *retransmissionFilter {
+	return &retransmissionFilter{flows: map[flowKey]*flowSequences{}}
+}
+
+// filter trims the data of tcp that was already seen in its flow, and reports
+// whether the packet is still to be assembled.
+func (f *retransmissionFilter) filter(net gopacket.Flow, tcp *layers.TCP, seen time.Time) bool {
+	key := flowKey{net, tcp.TransportFlow()}
+	s, ok := f.flows[key]
+	if !ok || tcp.SYN {
+		// a SYN starts a new connection, which may reuse the tuple
+		s = &flowSequences{last: tcp.Seq}
+		f.flows[key] = s
+	}
+	s.seen = seen
+	payload := tcp.LayerPayload()
+	if len(payload) == 0 || tcp.RST {
+		return true
+	}
+
+	from := s.unwrapped + int64(int32(tcp.Seq-s.last))
+	s.last, s.unwrapped = tcp.Seq, from
+	to := from + int64(len(payload))
+	for _, r := range s.ranges {
+		if from < r.from || from >= r.to {
+			continue
+		}
+		if to <= r.to {
+			stats.inc("tcp_retransmissions_dropped")
+			if !tcp.FIN {
+				return false
+			}
+			// the FIN is kept, after the data it follows
+			tcp.Payload = nil
+			tcp.Seq += uint32(len(payload))
+			return true
+		}
+		trim := r.to - from
+		stats.add("tcp_retransmitted_bytes_trimmed", trim)
+		tcp.Payload = payload[trim:]
+		tcp.Seq += uint32(trim)
+		from = r.to
+	}
+	for _, r := range s.ranges {
+		// the FIN follows the end of the data, which is kept with it
+		if r.from > from && r.from < to && to <= r.to && !tcp.FIN {
+			stats.add("tcp_retransmitted_bytes_trimmed", to-r.from)
+			tcp.Payload = tcp.Payload[:r.from-from]
+			to = r.from
+			break
+		}
+	}
+	s.add(seqRange{from, to})
+	return true
+}
+
+// add inserts r in the ranges and merges the ranges it touches.
+func (s *flowSequences) add(r seqRange) {
+	var merged []seqRange
+	inserted := false
+	for _, other := range s.ranges {
+		switch {
+		case other.to < r.from:
+			merged = append(merged, other)
+		case r.to < other.from:
+			if !inserted {
+				merged = append(merged, r)
+				inserted = true
+			}
+			merged = append(merged, other)
+		default:
+			if other.from < r.from {
+				r.from = other.from
+			}
+			if other.to > r.to {
+				r.to = other.to
+			}
+		}
+	}
+	if !inserted {
+		merged = append(merged, r)
+	}
+	if len(merged) > maxSeqRanges {
+		merged = merged[len(merged)-maxSeqRanges:]
+	}
+	s.ranges = merged
+}
+
+// expire forgets the flows without packets since t.
+func (f *retransmissionFilter) expire(t time.Time) {
+	for key, s := range f.flows {
+		if s.seen.Before(t) {
+			delete(f.flows, key)
+		}
+	}
+}
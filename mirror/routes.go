@@ -0,0 +1,764 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	math_rand "math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery"
+	"github.com/aws/aws-sdk-go-v2/service/servicediscovery/types"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// routeTable maps the Host header of captured requests to forward destinations.
+//
+// Besides exact hosts, keys can be wildcards (*.api.example.com matches the
+// subdomains of api.example.com at any depth) or regular expressions prefixed
+// with ~ (~^api-[0-9]+\.example\.com$). A host is matched by its exact key, then
+// by the longest matching wildcard, then by the first matching regular
+// expression in key order, and then by the default route "*".
+//
+// Keys can include the port the request was captured on (www.example.com:8080),
+// which takes precedence over the key without port. Exact and wildcard keys are
+// matched against the Host without its port; a Host header with a port
+// (www.example.com:8080) also matches the exact key written the same way.
+// Hosts are case insensitive: exact and wildcard keys are lower-cased when the
+// table is set, and the Host is lower-cased before it is matched, also against
+// the regular expressions.
+//
+// A destination is either a static endpoint (http://172.0.0.1) or a reference to
+// a service discovery record, which is resolved periodically:
+//   - srv://_http._tcp.staging.example.com resolves DNS SRV records
+//   - cloudmap://namespace/service resolves healthy AWS Cloud Map instances
+//   - k8s://namespace/service:port watches the ready pods of a Kubernetes Service
+//
+// These schemes forward over http; add +https to the scheme (srv+https://) for https.
+type routeTable struct {
+	mu     sync.RWMutex
+	routes map[string]route
+	// wildcards holds the *.example.com keys, longest first
+	wildcards []string
+	// patterns holds the compiled ~regex keys, in key order
+	patterns []routePattern
+	// destinations holds the dynamic destinations of the routes
+	destinations map[string]bool
+	// endpoints holds the last successful resolution of each dynamic destination
+	endpoints map[string][]string
+	// resolveAt holds when each polled destination is resolved next
+	resolveAt map[string]time.Time
+	// kubeWatches holds the watches of the destinations whose endpoints are
+	// watched rather than polled
+	kubeWatches map[string]*kubeServiceWatch
+	// hits counts the requests matched by each key since the route table was set
+	hits map[string]*int64
+}
+
+var fwdRoutes = &routeTable{routes: map[string]route{}, endpoints: map[string][]string{}, resolveAt: map[string]time.Time{}, kubeWatches: map[string]*kubeServiceWatch{}}
+
+// route is an entry of the route table. In JSON, it is either the destination
+// string or an object with options:
+//
+//	{"destination": "http://172.0.0.1", "timeout": "5s", "max_in_flight": 100}
+//
+// A route can also send the traffic of each tenant to its own destination:
+//
+//	{"destination": "http://shadow", "tenant_by": "header:X-Tenant-Id",
+//	 "tenants": {"a": "http://shadow-a", "b": "http://shadow-b"}}
+//
+// Or split the traffic into slices of consistent cohorts, e.g. for two builds:
+//
+//	{"slices": [{"label": "a", "from": 0, "to": 50, "destination": "http://shadow-a"},
+//	            {"label": "b", "from": 50, "to": 100, "destination": "http://shadow-b"}]}
+type route struct {
+	Destination string `json:"destination"`
+	// Timeout overrides the forward-timeout flag for this route
+	Timeout duration `json:"timeout,omitempty"`
+	// MaxInFlight overrides the max-in-flight-per-destination flag for this route
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+	// TenantBy extracts the tenant of a request: header:<name>, cookie:<name>,
+	// jwt-claim:<claim> or body:<JSON field>
+	TenantBy string `json:"tenant_by,omitempty"`
+	// Tenants maps tenants to destinations; other tenants go to Destination
+	Tenants map[string]string `json:"tenants,omitempty"`
+	// StripTrailers drops the trailers of the requests, for destinations that cannot handle them
+	StripTrailers bool `json:"strip_trailers,omitempty"`
+	// Slices send the requests to destinations by slice bucket; other buckets go
+	// to Destination
+	Slices []routeSlice `json:"slices,omitempty"`
+	// Latency overrides the latency-injection flag for this route, and
+	// LatencyPercentage the latency-percentage flag
+	Latency           *latencyDistribution `json:"latency,omitempty"`
+	LatencyPercentage float64              `json:"latency_percentage,omitempty"`
+	// slice is the label of the slice of the request, set by lookup
+	slice string
+}
+
+// routeSlice is a range of slice buckets, from included to to excluded, see sliceBucket.
+type routeSlice struct {
+	Label       string  `json:"label"`
+	From        float64 `json:"from"`
+	To          float64 `json:"to"`
+	Destination string  `json:"destination"`
+}
+
+func (r *route) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &r.Destination); err == nil {
+		return nil
+	}
+	type plain route
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+func (r route) MarshalJSON() ([]byte, error) {
+	if r.Timeout == 0 && r.MaxInFlight == 0 && r.TenantBy == "" && len(r.Tenants) == 0 && !r.StripTrailers && len(r.Slices) == 0 && r.Latency == nil && r.LatencyPercentage == 0 {
+		return json.Marshal(r.Destination)
+	}
+	type plain route
+	return json.Marshal(plain(r))
+}
+
+// duration is a time.Duration that is written like "5s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type routePattern struct {
+	key string
+	re  *regexp.Regexp
+}
+
+func isRegexRouteKey(key string) bool {
+	return strings.HasPrefix(key, "~")
+}
+
+func isWildcardRouteKey(key string) bool {
+	return strings.HasPrefix(key, "*.")
+}
+
+func (t *routeTable) set(routes map[string]route) {
+	routes = lowerRouteKeys(routes)
+	var wildcards []string
+	var patterns []routePattern
+	for key := range routes {
+		switch {
+		case isWildcardRouteKey(key):
+			wildcards = append(wildcards, key)
+		case isRegexRouteKey(key):
+			re, err := regexp.Compile(key[1:])
+			if err != nil {
+				// routes are validated before they are set, so this is not expected
+				log.Println("Ignoring route", key, ":", err)
+				continue
+			}
+			patterns = append(patterns, routePattern{key: key, re: re})
+		}
+	}
+	sort.Slice(wildcards, func(i, j int) bool {
+		if len(wildcards[i]) != len(wildcards[j]) {
+			return len(wildcards[i]) > len(wildcards[j])
+		}
+		return wildcards[i] < wildcards[j]
+	})
+	sort.Slice(patterns, func(i, j int) bool { return patterns[i].key < patterns[j].key })
+	hits := make(map[string]*int64, len(routes))
+	destinations := map[string]bool{}
+	for key, r := range routes {
+		hits[key] = new(int64)
+		for _, dest := range r.destinations() {
+			if isDynamicDestination(dest) {
+				destinations[dest] = true
+			}
+		}
+	}
+
+	t.mu.Lock()
+	t.routes, t.wildcards, t.patterns, t.hits = routes, wildcards, patterns, hits
+	t.destinations = destinations
+	// the destinations the replaced routes referenced alone are no longer
+	// resolved; the forwards looked up already have their endpoint
+	for dest, w := range t.kubeWatches {
+		if !destinations[dest] {
+			w.stop()
+			delete(t.kubeWatches, dest)
+		}
+	}
+	for dest := range t.endpoints {
+		if !destinations[dest] {
+			delete(t.endpoints, dest)
+		}
+	}
+	for dest := range t.resolveAt {
+		if !destinations[dest] {
+			delete(t.resolveAt, dest)
+		}
+	}
+	t.mu.Unlock()
+}
+
+// lowerRouteKeys returns routes with lower-case exact and wildcard keys.
+func lowerRouteKeys(routes map[string]route) map[string]route {
+	lowered := make(map[string]route, len(routes))
+	for key, r := range routes {
+		if !isRegexRouteKey(key) {
+			key = strings.ToLower(key)
+		}
+		lowered[key] = r
+	}
+	return lowered
+}
+
+// takeHits returns the number of requests matched by each key since the last
+// call, and resets them.
+func (t *routeTable) takeHits() map[string]int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	hits := make(map[string]int64, len(t.hits))
+	for key, c := range t.hits {
+		hits[key] = atomic.SwapInt64(c, 0)
+	}
+	return hits
+}
+
+// destinations returns the default, tenant and slice destinations of r.
+func (r route) destinations() []string {
+	dests := []string{r.Destination}
+	for _, dest := range r.Tenants {
+		dests = append(dests, dest)
+	}
+	for _, s := range r.Slices {
+		dests = append(dests, s.Destination)
+	}
+	return dests
+}
+
+// sliceDestination returns the slice of the request with the slice bucket of
+// the request, if any.
+func (r route) sliceDestination(bucket float64) (routeSlice, bool) {
+	for _, s := range r.Slices {
+		if bucket >= s.From && bucket < s.To {
+			return s, true
+		}
+	}
+	return routeSlice{}, false
+}
+
+// validateSlices checks that the slices are labeled and disjoint ranges within
+// 0 and 100.
+func validateSlices(slices []routeSlice) error {
+	labels := map[string]bool{}
+	for i, s := range slices {
+		if s.Label == "" || labels[s.Label] {
+			return fmt.Errorf("slice %d must have a unique label", i)
+		}
+		labels[s.Label] = true
+		if s.From < 0 || s.To > 100 || s.From >= s.To {
+			return fmt.Errorf("slice %s must have 0 <= from < to <= 100", s.Label)
+		}
+		if s.Destination == "" {
+			return fmt.Errorf("slice %s must have a destination", s.Label)
+		}
+		for _, other := range slices[:i] {
+			if s.From < other.To && other.From < s.To {
+				return fmt.Errorf("slices %s and %s overlap", other.Label, s.Label)
+			}
+		}
+	}
+	return nil
+}
+
+// tenantDestination returns the destination of the tenant of req.
+func (r route) tenantDestination(req *http.Request, body []byte) string {
+	if r.TenantBy == "" || len(r.Tenants) == 0 {
+		return r.Destination
+	}
+	if dest, ok := r.Tenants[tenantValue(req, body, r.TenantBy)]; ok {
+		return dest
+	}
+	return r.Destination
+}
+
+// tenantValue returns the tenant of req according to by, see route.TenantBy.
+func tenantValue(req *http.Request, body []byte, by string) string {
+	switch {
+	case strings.HasPrefix(by, "header:"):
+		return req.Header.Get(strings.TrimPrefix(by, "header:"))
+	case strings.HasPrefix(by, "cookie:"):
+		if cookie, err := req.Cookie(strings.TrimPrefix(by, "cookie:")); err == nil {
+			return cookie.Value
+		}
+	case strings.HasPrefix(by, "jwt-claim:"):
+		return jwtClaim(req, strings.TrimPrefix(by, "jwt-claim:"))
+	case strings.HasPrefix(by, "body:"):
+		field := strings.TrimPrefix(by, "body:")
+		return jsonFields(body, map[string]bool{field: true})[field]
+	}
+	return ""
+}
+
+func validTenantBy(by string) bool {
+	for _, prefix := range []string{"header:", "cookie:", "jwt-claim:", "body:"} {
+		if strings.HasPrefix(by, prefix) {
+			return len(by) > len(prefix)
+		}
+	}
+	return false
+}
+
+// lookup returns the route for the Host of req, captured on its destination port,
+// with its destination resolved to an endpoint and its slice picked with the
+// sampling of conf. It reports false if there is no usable route.
+func (t *routeTable) lookup(conf *configSnapshot, req *http.Request, info captureInfo, body []byte) (route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	key, ok := t.match(req.Host, info.destinationPort)
+	if !ok {
+		return route{}, false
+	}
+	if c := t.hits[key]; c != nil {
+		atomic.AddInt64(c, 1)
+	}
+	r := t.routes[key]
+	r.Destination = r.tenantDestination(req, body)
+	if len(r.Slices) > 0 {
+		if s, ok := r.sliceDestination(sliceBucket(conf, req, info)); ok {
+			r.Destination, r.slice = s.Destination, s.Label
+		}
+	}
+	if r.Destination == "" {
+		return route{}, false
+	}
+	if !isDynamicDestination(r.Destination) {
+		return r, true
+	}
+	endpoints := t.endpoints[r.Destination]
+	if len(endpoints) == 0 {
+		return route{}, false
+	}
+	r.Destination = endpoints[math_rand.Intn(len(endpoints))]
+	return r, true
+}
+
+// defaultRouteKey is the route table key of the route of unmatched hosts.
+const defaultRouteKey = "*"
+
+// match returns the key of the route of host for a request captured on port,
+// see routeTable for the precedence of keys.
+func (t *routeTable) match(host, port string) (string, bool) {
+	host = strings.ToLower(host)
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	if port != "" {
+		if key := net.JoinHostPort(name, port); t.has(key) {
+			return key, true
+		}
+	}
+	if t.has(host) {
+		return host, true
+	}
+	if t.has(name) {
+		return name, true
+	}
+	for _, key := range t.wildcards {
+		if strings.HasSuffix(name, key[1:]) {
+			return key, true
+		}
+	}
+	for _, p := range t.patterns {
+		if p.re.MatchString(host) {
+			return p.key, true
+		}
+	}
+	return defaultRouteKey, t.has(defaultRouteKey)
+}
+
+func (t *routeTable) has(key string) bool {
+	_, ok := t.routes[key]
+	return ok
+}
+
+// unroutedLogInterval is the minimum interval between two logs of unmatched hosts.
+const unroutedLogInterval = 10 * time.Second
+
+// unroutedLogger logs the hosts of requests without a route, at most once per
+// unroutedLogInterval, so that a missing route does not flood the logs.
+type unroutedLogger struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+var fwdUnrouted = &unroutedLogger{}
+
+func (l *unroutedLogger) log(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.last) < unroutedLogInterval {
+		l.suppressed++
+		return
+	}
+	if l.suppressed > 0 {
+		log.Printf("Request Host %s is not found in the route table (%d similar messages suppressed)", host, l.suppressed)
+	} else {
+		log.Println("Request Host", host, "is not found in the route table")
+	}
+	l.last, l.suppressed = time.Now(), 0
+}
+
+func isDynamicDestination(dest string) bool {
+	i := strings.Index(dest, "://")
+	if i < 0 {
+		return false
+	}
+	switch strings.TrimSuffix(dest[:i], "+https") {
+	case "srv", "cloudmap", "k8s":
+		return true
+	}
+	return false
+}
+
+// routeRefreshMinInterval is the shortest time a resolution of a destination
+// is used for, whatever the TTL of its records.
+const routeRefreshMinInterval = time.Second
+
+// refreshLoop resolves the dynamic destinations immediately, then once the TTL
+// of their records expires, or after interval if it is shorter. New
+// destinations are resolved as soon as the routes reference them.
+func (t *routeTable) refreshLoop(interval time.Duration) {
+	tick := interval
+	if tick > routeRefreshMinInterval {
+		tick = routeRefreshMinInterval
+	}
+	for {
+		t.refresh(interval)
+		time.Sleep(tick)
+	}
+}
+
+// refresh resolves the polled destinations that are due, and starts the
+// watches of the Kubernetes destinations.
+func (t *routeTable) refresh(interval time.Duration) {
+	now := time.Now()
+	t.mu.RLock()
+	var dests []string
+	for dest := range t.destinations {
+		if strings.HasPrefix(dest, "k8s") || !now.Before(t.resolveAt[dest]) {
+			dests = append(dests, dest)
+		}
+	}
+	t.mu.RUnlock()
+
+	resolved := map[string][]string{}
+	next := map[string]time.Time{}
+	for _, dest := range dests {
+		if strings.HasPrefix(dest, "k8s") {
+			t.startKubeWatch(dest)
+			continue
+		}
+		endpoints, ttl, err := resolveDestination(dest)
+		if err != nil {
+			// keep serving the previous endpoints until the next successful resolution
+			log.Println("Error resolving destination", dest, ":", err)
+			next[dest] = time.Now().Add(interval)
+			continue
+		}
+		resolved[dest] = endpoints
+		next[dest] = time.Now().Add(refreshDelay(ttl, interval))
+	}
+
+	t.mu.Lock()
+	for dest, at := range next {
+		// the routes may have dropped the destination meanwhile
+		if !t.destinations[dest] {
+			continue
+		}
+		t.resolveAt[dest] = at
+		if endpoints, ok := resolved[dest]; ok {
+			t.endpoints[dest] = endpoints
+		}
+	}
+	t.mu.Unlock()
+}
+
+// refreshDelay returns how long a resolution with the TTL ttl is used: the TTL
+// if it is known, at least routeRefreshMinInterval and at most interval.
+func refreshDelay(ttl, interval time.Duration) time.Duration {
+	if ttl <= 0 || ttl > interval {
+		return interval
+	}
+	if ttl < routeRefreshMinInterval && interval > routeRefreshMinInterval {
+		return routeRefreshMinInterval
+	}
+	return ttl
+}
+
+func (t *routeTable) startKubeWatch(dest string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.kubeWatches[dest] != nil || !t.destinations[dest] {
+		return
+	}
+	w, err := newKubeServiceWatch(dest)
+	if err != nil {
+		log.Println("Error resolving destination", dest, ":", err)
+		return
+	}
+	t.kubeWatches[dest] = w
+	go w.run(t)
+}
+
+// resolveDestination returns the endpoints of the srv or cloudmap destination
+// dest, with the TTL of the records they were resolved from, or 0 if unknown.
+func resolveDestination(dest string) ([]string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	scheme, name := "http", dest[strings.Index(dest, "://")+3:]
+	if strings.Contains(dest[:strings.Index(dest, "://")], "+https") {
+		scheme = "https"
+	}
+
+	var endpoints []string
+	var ttl time.Duration
+	if strings.HasPrefix(dest, "srv") {
+		records, recordsTTL, err := lookupSRV(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = recordsTTL
+		for _, record := range records {
+			endpoints = append(endpoints, fmt.Sprintf("%s://%s:%d", scheme, strings.TrimSuffix(record.Target, "."), record.Port))
+		}
+	} else {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			return nil, 0, fmt.Errorf("Cloud Map destination must be cloudmap://namespace/service")
+		}
+		instances, err := discoverCloudMapInstances(ctx, parts[0], parts[1])
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = cloudMapTTL(ctx, parts[0], parts[1])
+		for _, instance := range instances {
+			ip, port := instance.Attributes["AWS_INSTANCE_IPV4"], instance.Attributes["AWS_INSTANCE_PORT"]
+			if ip == "" {
+				continue
+			}
+			if port == "" {
+				endpoints = append(endpoints, fmt.Sprintf("%s://%s", scheme, ip))
+			} else {
+				endpoints = append(endpoints, fmt.Sprintf("%s://%s:%s", scheme, ip, port))
+			}
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, 0, fmt.Errorf("no endpoints found")
+	}
+	return endpoints, ttl, nil
+}
+
+// lookupSRV resolves the SRV records of name, like net.LookupSRV, and returns
+// the lowest TTL of the answers, or 0 if it is unknown.
+func lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	recorder := &dnsTTLRecorder{}
+	resolver := &net.Resolver{PreferGo: true, Dial: recorder.dial}
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	return records, recorder.lowest(), err
+}
+
+// dnsTTLRecorder records the lowest TTL of the answers of the DNS responses
+// read through the connections it dials, which the resolver does not return.
+type dnsTTLRecorder struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	ok  bool
+}
+
+func (r *dnsTTLRecorder) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	// the resolver tells the datagrams from the streams by their type
+	if udp, ok := conn.(*net.UDPConn); ok {
+		return &dnsTTLPacketConn{UDPConn: udp, recorder: r}, nil
+	}
+	return &dnsTTLStreamConn{Conn: conn, recorder: r}, nil
+}
+
+func (r *dnsTTLRecorder) record(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		ttl := time.Duration(h.TTL) * time.Second
+		r.mu.Lock()
+		if !r.ok || ttl < r.ttl {
+			r.ttl, r.ok = ttl, true
+		}
+		r.mu.Unlock()
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+func (r *dnsTTLRecorder) lowest() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ok && r.ttl == 0 {
+		// a TTL of 0 asks not to cache the records at all
+		return routeRefreshMinInterval
+	}
+	return r.ttl
+}
+
+// dnsTTLPacketConn records the DNS responses read over UDP, one per datagram.
+type dnsTTLPacketConn struct {
+	*net.UDPConn
+	recorder *dnsTTLRecorder
+}
+
+func (c *dnsTTLPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	c.recorder.record(b[:n])
+	return n, err
+}
+
+// dnsTTLStreamConn records the DNS responses read over TCP, which are prefixed
+// with their length and may span reads.
+type dnsTTLStreamConn struct {
+	net.Conn
+	recorder *dnsTTLRecorder
+	buf      []byte
+}
+
+func (c *dnsTTLStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		size := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+size {
+			break
+		}
+		c.recorder.record(c.buf[2 : 2+size])
+		c.buf = c.buf[2+size:]
+	}
+	return n, err
+}
+
+// cloudMapTTLs caches the TTL of the DNS records of Cloud Map services by
+// namespace/service: it rarely changes, and takes more API calls to look up
+// than the instances.
+var cloudMapTTLs sync.Map
+
+// cloudMapTTL returns the lowest TTL of the DNS records of the Cloud Map
+// service, or 0 if it has none, e.g. in an HTTP namespace, or if it cannot be
+// looked up.
+func cloudMapTTL(ctx context.Context, namespace, service string) time.Duration {
+	key := namespace + "/" + service
+	if ttl, ok := cloudMapTTLs.Load(key); ok {
+		return ttl.(time.Duration)
+	}
+	ttl, err := lookupCloudMapTTL(ctx, namespace, service)
+	if err != nil {
+		// the instances are still resolved every route-refresh-interval
+		log.Println("Error looking up the TTL of Cloud Map service", key, ":", err)
+	}
+	cloudMapTTLs.Store(key, ttl)
+	return ttl
+}
+
+func lookupCloudMapTTL(ctx context.Context, namespace, service string) (time.Duration, error) {
+	cfg, err := awsConfig()
+	if err != nil {
+		return 0, err
+	}
+	client := servicediscovery.NewFromConfig(cfg)
+	// DiscoverInstances takes the HTTP name of the namespace
+	namespaces, err := client.ListNamespaces(ctx, &servicediscovery.ListNamespacesInput{
+		Filters: []types.NamespaceFilter{{Name: types.NamespaceFilterNameHttpName, Values: []string{namespace}, Condition: types.FilterConditionEq}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var ttl time.Duration
+	for _, ns := range namespaces.Namespaces {
+		pages := servicediscovery.NewListServicesPaginator(client, &servicediscovery.ListServicesInput{
+			Filters: []types.ServiceFilter{{Name: types.ServiceFilterNameNamespaceId, Values: []string{aws.ToString(ns.Id)}, Condition: types.FilterConditionEq}},
+		})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return 0, err
+			}
+			for _, s := range page.Services {
+				if aws.ToString(s.Name) != service || s.DnsConfig == nil {
+					continue
+				}
+				for _, record := range s.DnsConfig.DnsRecords {
+					if record.TTL == nil {
+						continue
+					}
+					if t := time.Duration(*record.TTL) * time.Second; ttl == 0 || t < ttl {
+						ttl = t
+					}
+				}
+			}
+		}
+	}
+	return ttl, nil
+}
+
+func discoverCloudMapInstances(ctx context.Context, namespace, service string) ([]types.HttpInstanceSummary, error) {
+	cfg, err := awsConfig()
+	if err != nil {
+		return nil, err
+	}
+	out, err := servicediscovery.NewFromConfig(cfg).DiscoverInstances(ctx, &servicediscovery.DiscoverInstancesInput{
+		NamespaceName: aws.String(namespace),
+		ServiceName:   aws.String(service),
+		HealthStatus:  types.HealthStatusFilterHealthy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Instances, nil
+}
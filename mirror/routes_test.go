@@ -0,0 +1,184 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRouteTableMatch(t *testing.T) {
+	table := &routeTable{}
+	table.set(map[string]route{
+		"www.example.com":       {Destination: "http://exact"},
+		"WWW.Example.com:8080":  {Destination: "http://exact-port"},
+		"api.example.com:8443":  {Destination: "http://header-port"},
+		"*.example.com":         {Destination: "http://wildcard"},
+		"*.eu.example.com":      {Destination: "http://longer-wildcard"},
+		`~^api-[0-9]+\.test$`:   {Destination: "http://regex"},
+		`~^api-1[0-9]*\.test$`:  {Destination: "http://regex-later"},
+		`~^Case\.test$`:         {Destination: "http://regex-case"},
+		"*":                     {Destination: "http://default"},
+		"ports.example.org":     {Destination: "http://no-port"},
+		"ports.example.org:443": {Destination: "http://port"},
+	})
+
+	tests := []struct {
+		host, port string
+		key        string
+	}{
+		{"www.example.com", "", "www.example.com"},
+		{"www.example.com", "80", "www.example.com"},
+		// the key with the capture port takes precedence
+		{"www.example.com", "8080", "www.example.com:8080"},
+		{"ports.example.org", "443", "ports.example.org:443"},
+		{"ports.example.org:443", "8443", "ports.example.org:443"},
+		{"ports.example.org:9000", "", "ports.example.org"},
+		// a Host with a port matches the key written the same way
+		{"api.example.com:8443", "", "api.example.com:8443"},
+		{"api.example.com", "", "*.example.com"},
+		// exact keys before wildcards, and the longest wildcard first
+		{"a.b.example.com", "", "*.example.com"},
+		{"paris.eu.example.com", "", "*.eu.example.com"},
+		{"eu.example.com", "", "*.example.com"},
+		{"example.com", "", "*"},
+		// regular expressions in key order, after the wildcards
+		{"api-10.test", "", `~^api-1[0-9]*\.test$`},
+		{"api-2.test", "", `~^api-[0-9]+\.test$`},
+		{"api-x.test", "", "*"},
+		// hosts are case insensitive
+		{"WWW.EXAMPLE.COM", "", "www.example.com"},
+		{"Www.Example.Com", "8080", "www.example.com:8080"},
+		{"API.EU.Example.com", "", "*.eu.example.com"},
+		{"API-2.TEST", "", `~^api-[0-9]+\.test$`},
+		{"case.test", "", "*"},
+		{"other.org", "", "*"},
+	}
+	for _, tt := range tests {
+		key, ok := table.match(tt.host, tt.port)
+		if !ok || key != tt.key {
+			t.Errorf("match(%q, %q) = %q, %v, want %q", tt.host, tt.port, key, ok, tt.key)
+		}
+	}
+
+	table.set(map[string]route{"www.example.com": {Destination: "http://exact"}})
+	if key, ok := table.match("other.org", ""); ok {
+		t.Errorf("match without default route = %q, want no route", key)
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes map[string]route
+		err    bool
+	}{
+		{"exact, wildcard and regex", map[string]route{
+			"www.example.com": {Destination: "http://a"},
+			"*.example.com":   {Destination: "http://b"},
+			`~^api\.test$`:    {Destination: "http://c"},
+		}, false},
+		{"regexes differing in case", map[string]route{
+			`~^api\.test$`: {Destination: "http://a"},
+			`~^API\.test$`: {Destination: "http://b"},
+		}, false},
+		{"hosts differing in case", map[string]route{
+			"www.example.com": {Destination: "http://a"},
+			"WWW.example.com": {Destination: "http://b"},
+		}, true},
+		{"wildcards differing in case", map[string]route{
+			"*.example.com": {Destination: "http://a"},
+			"*.Example.com": {Destination: "http://b"},
+		}, true},
+		{"invalid regex", map[string]route{`~^api[`: {Destination: "http://a"}}, true},
+		{"empty host", map[string]route{"": {Destination: "http://a"}}, true},
+	}
+	for _, tt := range tests {
+		if err := validateRoutes(tt.routes); (err != nil) != tt.err {
+			t.Errorf("%s: validateRoutes() = %v, want error %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRouteTableForgetsRemovedDestinations(t *testing.T) {
+	table := &routeTable{
+		endpoints: map[string][]string{"srv://a.test": {"http://10.0.0.1:80"}, "srv://b.test": {"http://10.0.0.2:80"}},
+		resolveAt: map[string]time.Time{"srv://a.test": time.Now(), "srv://b.test": time.Now()},
+	}
+	table.set(map[string]route{
+		"a.example.com": {Destination: "srv://a.test"},
+		"c.example.com": {Destination: "http://static"},
+	})
+	if !table.destinations["srv://a.test"] || len(table.destinations) != 1 {
+		t.Errorf("destinations = %v, want srv://a.test", table.destinations)
+	}
+	if _, ok := table.endpoints["srv://a.test"]; !ok || len(table.endpoints) != 1 {
+		t.Errorf("endpoints = %v, want those of srv://a.test", table.endpoints)
+	}
+	if _, ok := table.resolveAt["srv://a.test"]; !ok || len(table.resolveAt) != 1 {
+		t.Errorf("resolveAt = %v, want that of srv://a.test", table.resolveAt)
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	tests := []struct {
+		ttl, interval, want time.Duration
+	}{
+		{0, time.Minute, time.Minute},
+		{-time.Second, time.Minute, time.Minute},
+		{10 * time.Second, time.Minute, 10 * time.Second},
+		{5 * time.Minute, time.Minute, time.Minute},
+		{time.Millisecond, time.Minute, routeRefreshMinInterval},
+		// an interval below the minimum is kept
+		{time.Millisecond, 100 * time.Millisecond, time.Millisecond},
+		{time.Second, 100 * time.Millisecond, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := refreshDelay(tt.ttl, tt.interval); got != tt.want {
+			t.Errorf("refreshDelay(%v, %v) = %v, want %v", tt.ttl, tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestDNSTTLRecorder(t *testing.T) {
+	response := func(ttls ...uint32) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+		b.StartQuestions()
+		name := dnsmessage.MustNewName("_http._tcp.shadow.test.")
+		b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET})
+		b.StartAnswers()
+		for _, ttl := range ttls {
+			b.SRVResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl},
+				dnsmessage.SRVResource{Port: 80, Target: dnsmessage.MustNewName("shadow.test.")})
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	tests := []struct {
+		name      string
+		responses [][]byte
+		want      time.Duration
+	}{
+		{"no response", nil, 0},
+		{"no answer", [][]byte{response()}, 0},
+		{"lowest answer", [][]byte{response(300, 30, 60)}, 30 * time.Second},
+		{"lowest response", [][]byte{response(300), response(45)}, 45 * time.Second},
+		{"zero TTL", [][]byte{response(300, 0)}, routeRefreshMinInterval},
+		{"malformed response", [][]byte{[]byte("not dns"), response(20)}, 20 * time.Second},
+	}
+	for _, tt := range tests {
+		r := &dnsTTLRecorder{}
+		for _, msg := range tt.responses {
+			r.record(msg)
+		}
+		if got := r.lowest(); got != tt.want {
+			t.Errorf("%s: lowest() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
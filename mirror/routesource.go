@@ -0,0 +1,262 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A route table source loads the route table from a key-value store and watches it
+// for changes:
+//   - consul://host:8500/some/prefix reads every key below the prefix; the key name
+//     (without the prefix) is the host and the value is the destination, or the
+//     route as a JSON object.
+//   - etcd://host:2379/some/key reads a single key whose value is the route table JSON.
+//
+// Updates are validated before they replace the current route table; invalid
+// updates are logged and ignored.
+
+var routeSourceClient = &http.Client{Timeout: 10 * time.Minute}
+
+// validateRoutes checks that every entry of routes has a host and a usable
+// destination, and that no two hosts differ only in case.
+func validateRoutes(routes map[string]route) error {
+	lowered := make(map[string]string, len(routes))
+	for host, r := range routes {
+		if host == "" {
+			return fmt.Errorf("route table contains an empty host")
+		}
+		if !isRegexRouteKey(host) {
+			if other, ok := lowered[strings.ToLower(host)]; ok {
+				return fmt.Errorf("hosts %s and %s differ only in case", other, host)
+			}
+			lowered[strings.ToLower(host)] = host
+		}
+		if isRegexRouteKey(host) {
+			if _, err := regexp.Compile(host[1:]); err != nil {
+				return fmt.Errorf("host %s is not a valid regular expression: %v", host, err)
+			}
+		}
+		if r.Timeout < 0 {
+			return fmt.Errorf("timeout of host %s must not be negative", host)
+		}
+		if r.MaxInFlight < 0 {
+			return fmt.Errorf("max_in_flight of host %s must not be negative", host)
+		}
+		if r.LatencyPercentage < 0 || r.LatencyPercentage > 100 {
+			return fmt.Errorf("latency_percentage of host %s must be between 0 and 100", host)
+		}
+		if len(r.Tenants) > 0 && !validTenantBy(r.TenantBy) {
+			return fmt.Errorf("tenant_by of host %s (%s) must be like header:<name>, cookie:<name>, jwt-claim:<claim> or body:<field>", host, r.TenantBy)
+		}
+		if len(r.Tenants) > 0 && len(r.Slices) > 0 {
+			return fmt.Errorf("route of host %s cannot have both tenants and slices", host)
+		}
+		if err := validateSlices(r.Slices); err != nil {
+			return fmt.Errorf("route of host %s: %v", host, err)
+		}
+		for _, dest := range r.destinations() {
+			// a route with tenants or slices may have no default destination
+			if dest == "" && (len(r.Tenants) > 0 || len(r.Slices) > 0) {
+				continue
+			}
+			if err := validateDestination(host, dest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateDestination(host, dest string) error {
+	if isDynamicDestination(dest) {
+		return nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return fmt.Errorf("destination of host %s is not a valid URL: %v", host, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("destination of host %s (%s) must be like http://172.0.0.1 or https://www.example.com", host, dest)
+	}
+	return nil
+}
+
+func parseRouteSource(source string) (*url.URL, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "consul" && u.Scheme != "etcd") || u.Host == "" {
+		return nil, fmt.Errorf("Flag route-table-source (%s) must be like consul://host:8500/prefix or etcd://host:2379/key.", source)
+	}
+	return u, nil
+}
+
+// watchRouteSource keeps t in sync with the store referenced by source. It never returns.
+func watchRouteSource(t *routeTable, source *url.URL) {
+	for {
+		var err error
+		if source.Scheme == "consul" {
+			err = watchConsul(t, source)
+		} else {
+			err = watchEtcd(t, source)
+		}
+		log.Println("Error watching route table source", source, ":", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func applyRoutes(t *routeTable, routes map[string]route, source *url.URL) {
+	if err := validateRoutes(routes); err != nil {
+		log.Println("Ignoring invalid route table from", source, ":", err)
+		return
+	}
+	t.set(routes)
+	log.Println("Route table updated from", source, "with", len(routes), "entries")
+}
+
+// watchConsul uses Consul blocking queries to wait for changes below the prefix.
+func watchConsul(t *routeTable, source *url.URL) error {
+	prefix := strings.TrimPrefix(source.Path, "/")
+	index := "0"
+	for {
+		u := fmt.Sprintf("http://%s/v1/kv/%s?recurse=true&wait=5m&index=%s", source.Host, prefix, index)
+		resp, err := routeSourceClient.Get(u)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		var entries []struct {
+			Key   string
+			Value []byte
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			if err := json.Unmarshal(body, &entries); err != nil {
+				return err
+			}
+		case http.StatusNotFound:
+			// the prefix does not exist (yet), which is an empty route table
+		default:
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		newIndex := resp.Header.Get("X-Consul-Index")
+		if newIndex == "" {
+			return fmt.Errorf("response has no X-Consul-Index header")
+		}
+		if newIndex == index {
+			// the blocking query timed out without changes
+			continue
+		}
+		index = newIndex
+
+		routes := map[string]route{}
+		for _, entry := range entries {
+			host := strings.TrimPrefix(strings.TrimPrefix(entry.Key, prefix), "/")
+			if host == "" {
+				continue
+			}
+			var r route
+			if json.Unmarshal(entry.Value, &r) != nil {
+				r.Destination = string(entry.Value)
+			}
+			routes[host] = r
+		}
+		applyRoutes(t, routes, source)
+	}
+}
+
+// watchEtcd reads the key through the etcd v3 JSON gateway, then re-reads it every
+// time the watch stream reports an event.
+func watchEtcd(t *routeTable, source *url.URL) error {
+	key := base64.StdEncoding.EncodeToString([]byte(source.Path))
+	if err := readEtcd(t, source, key); err != nil {
+		return err
+	}
+
+	watch, _ := json.Marshal(map[string]interface{}{"create_request": map[string]string{"key": key}})
+	// the watch stream is long-lived, so it does not use the client timeout
+	resp, err := http.Post(fmt.Sprintf("http://%s/v3/watch", source.Host), "application/json", bytes.NewReader(watch))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg struct {
+			Result struct {
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return err
+		}
+		if len(msg.Result.Events) == 0 {
+			continue
+		}
+		if err := readEtcd(t, source, key); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("watch stream closed")
+}
+
+func readEtcd(t *routeTable, source *url.URL, key string) error {
+	req, _ := json.Marshal(map[string]string{"key": key})
+	resp, err := routeSourceClient.Post(fmt.Sprintf("http://%s/v3/kv/range", source.Host), "application/json", bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var msg struct {
+		Kvs []struct {
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return err
+	}
+	if len(msg.Kvs) == 0 {
+		log.Println("Route table key", source.Path, "not found in", source.Host)
+		return nil
+	}
+
+	var routes map[string]route
+	if err := json.Unmarshal(msg.Kvs[0].Value, &routes); err != nil {
+		log.Println("Ignoring invalid route table from", source, ":", err)
+		return nil
+	}
+	applyRoutes(t, routes, source)
+	return nil
+}
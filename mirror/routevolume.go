@@ -0,0 +1,117 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxVolumeRoutes bounds the number of host and path template pairs whose
+// volume is tracked; the requests of the others are counted under otherPath.
+const maxVolumeRoutes = 1000
+
+// volumeRoute is a host and path template of the captured requests.
+type volumeRoute struct {
+	host, path string
+}
+
+func (r volumeRoute) String() string {
+	return r.host + r.path
+}
+
+// routeVolume counts the captured requests by host and path template, to flag
+// the routes whose volume deviates from their rolling baseline, which usually
+// means the mirror session or the routing upstream broke.
+type routeVolume struct {
+	mu     sync.Mutex
+	counts map[volumeRoute]int64
+	// history holds the requests per minute of each route over the last
+	// intervals, the oldest first
+	history map[volumeRoute][]float64
+}
+
+var fwdRouteVolume *routeVolume
+
+func newRouteVolume() *routeVolume {
+	return &routeVolume{counts: map[volumeRoute]int64{}, history: map[volumeRoute][]float64{}}
+}
+
+// record counts a captured request.
+func (v *routeVolume) record(req *http.Request, templates *pathTemplates) {
+	route := volumeRoute{host: req.Host, path: templates.apply(requestPath(req))}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.history[route]; !ok {
+		if _, ok := v.counts[route]; !ok && len(v.history)+len(v.counts) >= maxVolumeRoutes {
+			route = volumeRoute{path: otherPath}
+		}
+	}
+	v.counts[route]++
+}
+
+// evaluate adds the requests of the interval to the history of each route, and
+// returns the events of the routes whose rate is factor times above or below
+// their baseline, the mean rate of the previous windows intervals. The routes
+// without a full history or with a baseline under minRate requests per minute
+// are left out.
+func (v *routeVolume) evaluate(interval time.Duration, windows int, factor, minRate float64) map[string]alertEvent {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for route := range v.counts {
+		if _, ok := v.history[route]; !ok {
+			v.history[route] = nil
+		}
+	}
+	routes := make([]volumeRoute, 0, len(v.history))
+	for route := range v.history {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].String() < routes[j].String() })
+
+	held := map[string]alertEvent{}
+	for _, route := range routes {
+		rates := v.history[route]
+		rate := float64(v.counts[route]) / interval.Minutes()
+		var baseline float64
+		for _, r := range rates {
+			baseline += r
+		}
+		if len(rates) > 0 {
+			baseline /= float64(len(rates))
+		}
+		if len(rates) >= windows && baseline > 0 && baseline >= minRate {
+			kind := ""
+			if rate > baseline*factor {
+				kind = "volume_spike"
+			} else if rate < baseline/factor {
+				kind = "volume_drop"
+			}
+			if kind != "" {
+				held[kind+" "+route.String()] = alertEvent{
+					Kind:    kind,
+					Name:    route.String(),
+					Message: fmt.Sprintf("route %s received %.1f requests per minute in the last %s, against a baseline of %.1f", route, rate, interval, baseline),
+					Details: map[string]interface{}{"host": route.host, "path": route.path, "rate": rate, "baseline": baseline, "factor": factor},
+				}
+			}
+		}
+
+		rates = append(rates, rate)
+		if len(rates) > windows {
+			rates = rates[len(rates)-windows:]
+		}
+		// the routes without requests in their whole history are forgotten
+		if len(rates) >= windows && baseline == 0 && rate == 0 {
+			delete(v.history, route)
+			continue
+		}
+		v.history[route] = rates
+	}
+	v.counts = map[volumeRoute]int64{}
+	return held
+}
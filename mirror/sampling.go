@@ -0,0 +1,177 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	crypto_rand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	math_rand "math/rand"
+	"net/http"
+	"strings"
+)
+
+var crc64Table = crc64.MakeTable(0xC96C5795D7870F42)
+
+// samplingBucket returns a number between 0 and 100 for req; the request is
+// forwarded if the number is not above the sampling percentage.
+func samplingBucket(conf *configSnapshot, req *http.Request, info captureInfo) (float64, error) {
+	if conf.fwdBy == "" {
+		// if percentage-by is empty, then forward only a certain percentage of requests
+		var b [8]byte
+		_, err := crypto_rand.Read(b[:])
+		if err != nil {
+			return 0, err
+		}
+		// uintForSeed is random
+		uintForSeed := binary.LittleEndian.Uint64(b[:])
+		return math_rand.New(math_rand.NewSource(int64(uintForSeed))).Float64() * 100, nil
+	}
+	// if percentage-by is not empty, then forward only requests from a certain percentage of headers/remoteaddresses
+	return valueBucket(conf, samplingValue(conf, req, info)), nil
+}
+
+// sliceBucket returns the bucket, between 0 and 100, of the route slices of req.
+// It hashes the value requests are sampled by with another seed than the
+// sampling bucket, so that the slices split the sampled cohort whatever the
+// percentage. Without percentage-by, the bucket is random.
+func sliceBucket(conf *configSnapshot, req *http.Request, info captureInfo) float64 {
+	if conf.fwdBy == "" {
+		return math_rand.Float64() * 100
+	}
+	return valueBucket(conf, "slice:"+samplingValue(conf, req, info))
+}
+
+// samplingValue returns the value req is consistently sampled by.
+func samplingValue(conf *configSnapshot, req *http.Request, info captureInfo) string {
+	switch {
+	case conf.fwdBy == "header":
+		return req.Header.Get(conf.fwdHeader)
+	case strings.HasPrefix(conf.fwdBy, "cookie:"):
+		if cookie, err := req.Cookie(strings.TrimPrefix(conf.fwdBy, "cookie:")); err == nil {
+			return cookie.Value
+		}
+		return ""
+	case strings.HasPrefix(conf.fwdBy, "jwt-claim:"):
+		return jwtClaim(req, strings.TrimPrefix(conf.fwdBy, "jwt-claim:"))
+	}
+	return info.sourceIP
+}
+
+// validSamplingBy reports whether by is a valid value of the percentage-by flag.
+func validSamplingBy(by string) bool {
+	switch {
+	case by == "", by == "header", by == "remoteaddr":
+		return true
+	case strings.HasPrefix(by, "cookie:"):
+		return len(by) > len("cookie:")
+	case strings.HasPrefix(by, "jwt-claim:"):
+		return len(by) > len("jwt-claim:")
+	}
+	return false
+}
+
+// jwtClaim returns the claim of the bearer token of req, or an empty string.
+// The signature of the token is not verified: the claim is only used to tell
+// requests apart, not to authenticate them.
+func jwtClaim(req *http.Request, claim string) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	// keep numeric claims as written, e.g. large user IDs
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// valueBucket returns the bucket, between 0 and 100, of a header value or remote
+// address. Every request with the same value falls into the same bucket.
+func valueBucket(conf *configSnapshot, strForSeed string) float64 {
+	// uintForSeed is derived from the salt and strForSeed
+	uintForSeed := crc64.Checksum([]byte(conf.fwdSalt+strForSeed), crc64Table)
+	// generate a consistent random number from the variable uintForSeed
+	return math_rand.New(math_rand.NewSource(int64(uintForSeed))).Float64() * 100
+}
+
+// bucketInfo describes in which bucket a value falls, for debugging.
+type bucketInfo struct {
+	Value      string  `json:"value"`
+	Salt       string  `json:"salt"`
+	Bucket     float64 `json:"bucket"`
+	Percentage float64 `json:"percentage"`
+	Forwarded  bool    `json:"forwarded"`
+}
+
+func inspectBucket(conf *configSnapshot, value string) bucketInfo {
+	bucket := valueBucket(conf, value)
+	return bucketInfo{
+		Value:      value,
+		Salt:       conf.fwdSalt,
+		Bucket:     bucket,
+		Percentage: samplingPercentage(),
+		Forwarded:  bucket <= samplingPercentage(),
+	}
+}
+
+// validateSamplingFlags checks the flags requests are sampled by.
+func validateSamplingFlags() error {
+	if *fwdPerc > 100 || *fwdPerc < 0 {
+		return fmt.Errorf("Flag percentage is not between 0 and 100. Value: %f.", *fwdPerc)
+	} else if !validSamplingBy(*fwdBy) {
+		return fmt.Errorf("Flag percentage-by (%s) is not valid.", *fwdBy)
+	} else if *fwdBy == "header" && *fwdHeader == "" {
+		return fmt.Errorf("Flag percentage-by is set to header, but percentage-by-header is empty.")
+	}
+	return nil
+}
+
+// runBucket implements the bucket subcommand, which prints the bucket of every
+// value given as argument with the configured salt and percentage. Only the
+// sampling flags are checked: the command needs no route table, and neither
+// opens the sinks nor tunes the runtime.
+func runBucket(values []string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("Usage: bucket [flags] value...")
+	}
+	recordCommandLineFlags()
+	if *configFile != "" {
+		if err := applyConfigFile(flags, *configFile, commandLineFlags); err != nil {
+			return err
+		}
+	}
+	if err := validateSamplingFlags(); err != nil {
+		return err
+	}
+	setSamplingPercentage(*fwdPerc)
+	conf := newConfigSnapshot()
+	for _, value := range values {
+		b := inspectBucket(conf, value)
+		fmt.Printf("%q bucket=%.4f percentage=%.4f forwarded=%t\n", b.Value, b.Bucket, b.Percentage, b.Forwarded)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// mirrorSchedule enables forwarding only during time windows. A request is
+// forwarded if the current time is between from and until (when set), and in
+// one of the weekly windows (when there are any).
+type mirrorSchedule struct {
+	windows []scheduleWindow
+	from    time.Time
+	until   time.Time
+	loc     *time.Location
+}
+
+// scheduleWindow is a daily time range, on some days of the week. The range ends
+// on the next day if end is before start, e.g. 22:00-06:00.
+type scheduleWindow struct {
+	days  [7]bool
+	start int // minutes since midnight
+	end   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseSchedule parses the schedule flags. spec is a list of windows separated by
+// semicolons, like "Mon-Fri 09:00-18:00; Sat 10:00-12:00". The days are optional
+// and default to every day. from and until are RFC 3339 timestamps, and tz is the
+// IANA time zone of the windows.
+func parseSchedule(spec, from, until, tz string) (*mirrorSchedule, error) {
+	s := &mirrorSchedule{loc: time.Local}
+	var err error
+	if tz != "" {
+		if s.loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("Flag schedule-timezone (%s) is not valid: %v", tz, err)
+		}
+	}
+	if from != "" {
+		if s.from, err = time.Parse(time.RFC3339, from); err != nil {
+			return nil, fmt.Errorf("Flag schedule-from (%s) is not an RFC 3339 timestamp.", from)
+		}
+	}
+	if until != "" {
+		if s.until, err = time.Parse(time.RFC3339, until); err != nil {
+			return nil, fmt.Errorf("Flag schedule-until (%s) is not an RFC 3339 timestamp.", until)
+		}
+	}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		w, err := parseScheduleWindow(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Flag schedule window (%s) is not valid: %v", entry, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+func parseScheduleWindow(entry string) (scheduleWindow, error) {
+	var w scheduleWindow
+	fields := strings.Fields(entry)
+	hours := fields[len(fields)-1]
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		for _, part := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(strings.ToLower(part), "-", 2)
+			first, ok := weekdays[bounds[0]]
+			if !ok {
+				return w, fmt.Errorf("unknown day %s", bounds[0])
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, ok = weekdays[bounds[1]]; !ok {
+					return w, fmt.Errorf("unknown day %s", bounds[1])
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	default:
+		return w, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+
+	bounds := strings.SplitN(hours, "-", 2)
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("expected a time range like 09:00-18:00")
+	}
+	for i, bound := range bounds {
+		t, err := time.Parse("15:04", bound)
+		if err != nil {
+			return w, fmt.Errorf("time %s is not like 15:04", bound)
+		}
+		if i == 0 {
+			w.start = t.Hour()*60 + t.Minute()
+		} else {
+			w.end = t.Hour()*60 + t.Minute()
+		}
+	}
+	return w, nil
+}
+
+// active reports whether forwarding is enabled at t. Without schedule, it always is.
+func (s *mirrorSchedule) active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	if !s.from.IsZero() && t.Before(s.from) {
+		return false
+	}
+	if !s.until.IsZero() && !t.Before(s.until) {
+		return false
+	}
+	if len(s.windows) == 0 {
+		return true
+	}
+	t = t.In(s.loc)
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.start <= w.end {
+			if w.days[t.Weekday()] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// the window crosses midnight: the early part belongs to the previous day
+		if w.days[t.Weekday()] && minute >= w.start {
+			return true
+		}
+		if w.days[(t.Weekday()+6)%7] && minute < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+// watchSchedule logs the transitions of the schedule and exposes its state in
+// the schedule_active gauge. It never returns.
+func watchSchedule() {
+	active := currentConfig().schedule.active(time.Now())
+	log.Println("Mirroring schedule active:", active)
+	for {
+		if active {
+			stats.set("schedule_active", 1)
+		} else {
+			stats.set("schedule_active", 0)
+		}
+		time.Sleep(10 * time.Second)
+		// the schedule may have been replaced by a reload
+		if now := currentConfig().schedule.active(time.Now()); now != active {
+			active = now
+			log.Println("Mirroring schedule active:", active)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"log"
+	math_rand "math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scorecardSamples is the number of latency samples kept per endpoint and
+// interval, by reservoir sampling, for the percentiles.
+const scorecardSamples = 1000
+
+// endpointScore is the scorecard of an endpoint over an interval.
+type endpointScore struct {
+	Endpoint string  `json:"endpoint"`
+	Compared int64   `json:"compared"`
+	MatchPct float64 `json:"match_pct"`
+	// latencies of production and of the destination, and their difference, in milliseconds
+	ProductionP50Ms float64 `json:"production_p50_ms"`
+	ProductionP95Ms float64 `json:"production_p95_ms"`
+	ShadowP50Ms     float64 `json:"shadow_p50_ms"`
+	ShadowP95Ms     float64 `json:"shadow_p95_ms"`
+	P50DeltaMs      float64 `json:"p50_delta_ms"`
+	P95DeltaMs      float64 `json:"p95_delta_ms"`
+	// the rates of 5xx responses of production and of the destination, and their difference
+	ProductionErrorRate float64 `json:"production_error_rate"`
+	ShadowErrorRate     float64 `json:"shadow_error_rate"`
+	ErrorRateDelta      float64 `json:"error_rate_delta"`
+	// Go is false if one of the thresholds of the scorecard is exceeded
+	Go bool `json:"go"`
+}
+
+// scorecardReport is a scorecard, emitted every scorecard-interval.
+type scorecardReport struct {
+	From      time.Time       `json:"from"`
+	Until     time.Time       `json:"until"`
+	Go        bool            `json:"go"`
+	Endpoints []endpointScore `json:"endpoints"`
+}
+
+type endpointResults struct {
+	compared, matches                int64
+	productionErrors, shadowErrors   int64
+	productionLatency, shadowLatency []time.Duration
+	// seen counts the latency samples offered to the reservoirs
+	seen int64
+}
+
+// shadowScorecard aggregates the response diffs and latencies by endpoint into
+// a periodic go/no-go scorecard for release managers.
+type shadowScorecard struct {
+	mu        sync.Mutex
+	from      time.Time
+	endpoints map[string]*endpointResults
+	last      *scorecardReport
+	enc       *json.Encoder
+}
+
+var fwdScorecard *shadowScorecard
+
+func newShadowScorecard(output string) (*shadowScorecard, error) {
+	s := &shadowScorecard{from: time.Now(), endpoints: map[string]*endpointResults{}}
+	if output != "" {
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.enc = json.NewEncoder(f)
+	}
+	return s, nil
+}
+
+// add records the comparison of the responses of a request to endpoint.
+func (s *shadowScorecard) add(endpoint string, result *diffResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.endpoints[endpoint]
+	if !ok {
+		if len(s.endpoints) >= maxTrackedPaths {
+			endpoint = otherPath
+		}
+		if e, ok = s.endpoints[endpoint]; !ok {
+			e = &endpointResults{}
+			s.endpoints[endpoint] = e
+		}
+	}
+	e.compared++
+	if result.reason == "" {
+		e.matches++
+	}
+	if result.production.status >= 500 {
+		e.productionErrors++
+	}
+	if result.shadow.status >= 500 {
+		e.shadowErrors++
+	}
+	// the latency of production is from the request to the response captured
+	productionLatency := result.production.seen.Sub(result.requestTime)
+	if productionLatency < 0 {
+		return
+	}
+	e.seen++
+	if len(e.productionLatency) < scorecardSamples {
+		e.productionLatency = append(e.productionLatency, productionLatency)
+		e.shadowLatency = append(e.shadowLatency, result.shadow.latency)
+	} else if i := math_rand.Int63n(e.seen); i < scorecardSamples {
+		e.productionLatency[i], e.shadowLatency[i] = productionLatency, result.shadow.latency
+	}
+}
+
+// emit computes the scorecard of the interval, logs it and writes it to the
+// output, and starts the next interval.
+func (s *shadowScorecard) emit() *scorecardReport {
+	conf := currentConfig()
+	s.mu.Lock()
+	endpoints := s.endpoints
+	report := &scorecardReport{From: s.from.UTC(), Until: time.Now().UTC(), Go: true, Endpoints: []endpointScore{}}
+	s.from, s.endpoints = time.Now(), map[string]*endpointResults{}
+	s.mu.Unlock()
+
+	for endpoint, e := range endpoints {
+		score := endpointScore{
+			Endpoint:            endpoint,
+			Compared:            e.compared,
+			MatchPct:            100 * float64(e.matches) / float64(e.compared),
+			ProductionP50Ms:     percentileMs(e.productionLatency, 0.5),
+			ProductionP95Ms:     percentileMs(e.productionLatency, 0.95),
+			ShadowP50Ms:         percentileMs(e.shadowLatency, 0.5),
+			ShadowP95Ms:         percentileMs(e.shadowLatency, 0.95),
+			ProductionErrorRate: float64(e.productionErrors) / float64(e.compared),
+			ShadowErrorRate:     float64(e.shadowErrors) / float64(e.compared),
+		}
+		score.P50DeltaMs = score.ShadowP50Ms - score.ProductionP50Ms
+		score.P95DeltaMs = score.ShadowP95Ms - score.ProductionP95Ms
+		score.ErrorRateDelta = score.ShadowErrorRate - score.ProductionErrorRate
+		score.Go = score.MatchPct >= conf.scorecardMinMatch &&
+			(conf.scorecardMaxP95Delta <= 0 || score.P95DeltaMs <= float64(conf.scorecardMaxP95Delta)/float64(time.Millisecond)) &&
+			score.ErrorRateDelta <= conf.scorecardMaxErrorDelta
+		if !score.Go {
+			report.Go = false
+		}
+		report.Endpoints = append(report.Endpoints, score)
+	}
+	sort.Slice(report.Endpoints, func(i, j int) bool {
+		if report.Endpoints[i].Compared != report.Endpoints[j].Compared {
+			return report.Endpoints[i].Compared > report.Endpoints[j].Compared
+		}
+		return report.Endpoints[i].Endpoint < report.Endpoints[j].Endpoint
+	})
+
+	data, _ := json.Marshal(report)
+	log.Println("Scorecard", string(data))
+	s.mu.Lock()
+	s.last = report
+	if s.enc != nil && sinkEnabled("scorecard-output") {
+		if err := s.enc.Encode(report); err != nil {
+			log.Println("Error writing scorecard", ":", err)
+		}
+	}
+	s.mu.Unlock()
+	return report
+}
+
+// lastReport returns the scorecard of the last interval, or nil before the first one.
+func (s *shadowScorecard) lastReport() *scorecardReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// emitLoop emits the scorecard every interval. It never returns.
+func (s *shadowScorecard) emitLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.emit()
+	}
+}
+
+func percentileMs(samples []time.Duration, p float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p * float64(len(sorted)-1))
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
@@ -0,0 +1,165 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// requestScript runs a user supplied Lua chunk against every captured request.
+//
+// The chunk sees a global table named "request" with the fields method, uri, host,
+// headers and body. It may modify any of them, set request.destination to reroute
+// the request to an arbitrary endpoint, or return false to drop it.
+//
+// Scripts are sandboxed: only the base, string, table and math libraries are
+// opened, without the functions of the base library that load code or reach
+// the global table and the metatables; every run has its own copy of the
+// globals and of the library tables, so that nothing a run sets or modifies is
+// seen by the next one, and is stopped after timeout.
+type requestScript struct {
+	proto   *lua.FunctionProto
+	timeout time.Duration
+	// lua.LState is not safe for concurrent use, so states are pooled.
+	states sync.Pool
+}
+
+// scriptUnsafeGlobals are the functions of the base library removed from the
+// states of scripts. The metatable and raw access functions would reach the
+// tables shared by the runs, e.g. the string library through the metatable of
+// strings.
+var scriptUnsafeGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "getfenv", "setfenv",
+	"getmetatable", "setmetatable", "rawget", "rawset", "rawequal", "rawlen"}
+
+func loadRequestScript(path string, timeout time.Duration) (*requestScript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(f, path)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing script %s: %v", path, err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling script %s: %v", path, err)
+	}
+	s := &requestScript{proto: proto, timeout: timeout}
+	s.states.New = func() interface{} {
+		return newScriptState()
+	}
+	return s, nil
+}
+
+// newScriptState returns a state with the safe libraries only.
+func newScriptState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{{lua.BaseLibName, lua.OpenBase}, {lua.StringLibName, lua.OpenString}, {lua.TabLibName, lua.OpenTable}, {lua.MathLibName, lua.OpenMath}} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range scriptUnsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// scriptGlobals returns the environment of a run: a copy of the globals of L,
+// with copies of the library tables.
+func scriptGlobals(L *lua.LState) *lua.LTable {
+	env := L.NewTable()
+	L.G.Global.ForEach(func(name, value lua.LValue) {
+		if lib, ok := value.(*lua.LTable); ok && lib != L.G.Global {
+			copied := L.NewTable()
+			lib.ForEach(func(k, v lua.LValue) { copied.RawSet(k, v) })
+			value = copied
+		}
+		env.RawSet(name, value)
+	})
+	env.RawSetString("_G", env)
+	return env
+}
+
+// run executes the script against req, modifying it in place.
+func (s *requestScript) run(req *http.Request, body []byte) (hookResult, error) {
+	L := s.states.Get().(*lua.LState)
+	L.SetTop(0)
+
+	tbl := L.NewTable()
+	tbl.RawSetString("method", lua.LString(req.Method))
+	tbl.RawSetString("uri", lua.LString(req.RequestURI))
+	tbl.RawSetString("host", lua.LString(req.Host))
+	tbl.RawSetString("body", lua.LString(body))
+	headers := L.NewTable()
+	for name, values := range req.Header {
+		if len(values) == 1 {
+			headers.RawSetString(name, lua.LString(values[0]))
+			continue
+		}
+		list := L.NewTable()
+		for _, value := range values {
+			list.Append(lua.LString(value))
+		}
+		headers.RawSetString(name, list)
+	}
+	tbl.RawSetString("headers", headers)
+
+	env := scriptGlobals(L)
+	env.RawSetString("request", tbl)
+	fn := L.NewFunctionFromProto(s.proto)
+	fn.Env = env
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(fn)
+	err := L.PCall(0, 1, nil)
+	L.RemoveContext()
+	if err != nil {
+		// the state may be left in the middle of the script, discard it
+		L.Close()
+		return hookResult{}, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	s.states.Put(L)
+	if ret == lua.LFalse {
+		return hookResult{drop: true}, nil
+	}
+
+	// copy the (possibly modified) fields back to the request
+	req.Method = lua.LVAsString(tbl.RawGetString("method"))
+	req.RequestURI = lua.LVAsString(tbl.RawGetString("uri"))
+	req.Host = lua.LVAsString(tbl.RawGetString("host"))
+	req.Header = http.Header{}
+	if headers, ok := tbl.RawGetString("headers").(*lua.LTable); ok {
+		headers.ForEach(func(k, v lua.LValue) {
+			name := lua.LVAsString(k)
+			if list, ok := v.(*lua.LTable); ok {
+				list.ForEach(func(_, value lua.LValue) {
+					req.Header.Add(name, lua.LVAsString(value))
+				})
+			} else {
+				req.Header.Add(name, lua.LVAsString(v))
+			}
+		})
+	}
+	return hookResult{
+		destination: lua.LVAsString(tbl.RawGetString("destination")),
+		body:        []byte(lua.LVAsString(tbl.RawGetString("body"))),
+	}, nil
+}
@@ -0,0 +1,63 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// captureHeartbeat is the time, in Unix nanoseconds, the capture loop last ran.
+var captureHeartbeat int64
+
+func beatCapture() {
+	atomic.StoreInt64(&captureHeartbeat, time.Now().UnixNano())
+}
+
+// sdNotify sends state to the systemd service manager, if the process runs
+// under a unit of Type=notify. It does nothing otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Println("Error notifying systemd", ":", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Println("Error notifying systemd", ":", err)
+	}
+}
+
+// watchdog pings the systemd watchdog, if the unit sets WatchdogSec, for as
+// long as the capture loop keeps running. When the loop is wedged, the pings
+// stop and systemd restarts the service.
+func watchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	timeout := time.Duration(usec) * time.Microsecond
+	for range time.Tick(timeout / 2) {
+		if since := time.Since(time.Unix(0, atomic.LoadInt64(&captureHeartbeat))); since > timeout/2 {
+			log.Println("Capture loop has not run for", since.Round(time.Second), "skipping watchdog ping")
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,18 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !windows
+
+package mirror
+
+import "fmt"
+
+// runService reports false: outside of Windows, the process is managed by
+// systemd (see sdNotify) or a container runtime.
+func runService(capture func() error) (bool, error) {
+	return false, nil
+}
+
+func runServiceCommand(args []string) error {
+	return fmt.Errorf("The service command is only supported on Windows. Elsewhere, use a systemd unit.")
+}
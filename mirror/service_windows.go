@@ -0,0 +1,96 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build windows
+
+package mirror
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "http-requests-mirroring"
+
+// runService runs capture under the Windows service control manager, if the
+// process was started by it. It reports false otherwise.
+func runService(capture func() error) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+	return true, svc.Run(serviceName, &mirrorService{capture: capture})
+}
+
+// mirrorService implements svc.Handler.
+type mirrorService struct {
+	capture func() error
+}
+
+func (m *mirrorService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() {
+		done <- m.capture()
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			// the service manager restarts the service according to its recovery actions
+			log.Println("Error capturing", ":", err)
+			return true, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				shutdown(currentConfig().drainTimeout)
+				return false, 0
+			}
+		}
+	}
+}
+
+// runServiceCommand implements the service subcommand: "service install [flags]"
+// registers the capture command with the flags as an automatic service, and
+// "service uninstall" removes it.
+func runServiceCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "install" && args[0] != "uninstall") {
+		return fmt.Errorf("Usage: service install [flags] | service uninstall")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if args[0] == "uninstall" {
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		return s.Delete()
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "HTTP requests mirroring",
+		StartType:   mgr.StartAutomatic,
+	}, args[1:]...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// restart the service if it exits with an error
+	return s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * 1e9}}, 24*60*60)
+}
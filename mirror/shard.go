@@ -0,0 +1,121 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// shardBuckets is the size of the hash space the connections are spread over.
+// Instances seeing the same traffic, each configured with a shard of the
+// space, forward every connection once as long as their shards partition it.
+const shardBuckets = 1 << 16
+
+// hashShard is the set of buckets of the connections an instance forwards.
+type hashShard struct {
+	spec    string
+	buckets [shardBuckets / 64]uint64
+	count   int
+}
+
+var fwdShard *hashShard
+
+// parseHashShard parses a comma separated list of buckets and inclusive
+// ranges of buckets, like 0-32767.
+func parseHashShard(spec string) (*hashShard, error) {
+	s := &hashShard{spec: spec}
+	for _, r := range strings.Split(spec, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		}
+		if err != nil || first < 0 || last < first || last >= shardBuckets {
+			return nil, fmt.Errorf("Flag shard contains an invalid range (%s). Buckets are between 0 and %d.", r, shardBuckets-1)
+		}
+		for b := first; b <= last; b++ {
+			if !s.contains(uint16(b)) {
+				s.buckets[b/64] |= 1 << uint(b%64)
+				s.count++
+			}
+		}
+	}
+	if s.count == 0 {
+		return nil, fmt.Errorf("Flag shard (%s) has no bucket.", spec)
+	}
+	return s, nil
+}
+
+func (s *hashShard) contains(bucket uint16) bool {
+	return s.buckets[bucket/64]&(1<<uint(bucket%64)) != 0
+}
+
+// connectionBucket returns the bucket of the connection between the two
+// endpoints, given as raw addresses and big-endian ports. It does not depend on
+// the direction, so that both halves of a connection land in the same shard,
+// nor on the instance, so that all of them agree.
+func connectionBucket(ip1, port1, ip2, port2 []byte) uint16 {
+	if c := bytes.Compare(ip1, ip2); c > 0 || c == 0 && bytes.Compare(port1, port2) > 0 {
+		ip1, port1, ip2, port2 = ip2, port2, ip1, port1
+	}
+	h := fnv.New32a()
+	for _, b := range [][]byte{ip1, port1, ip2, port2} {
+		h.Write([]byte{byte(len(b))})
+		h.Write(b)
+	}
+	sum := h.Sum32()
+	return uint16(sum ^ sum>>16)
+}
+
+// packet reports whether the TCP or UDP packet belongs to a connection of the
+// shard.
+func (s *hashShard) packet(network gopacket.NetworkLayer, tcp *layers.TCP, udp *layers.UDP) bool {
+	var transport gopacket.Flow
+	if tcp != nil {
+		transport = tcp.TransportFlow()
+	} else {
+		transport = udp.TransportFlow()
+	}
+	src, dst := network.NetworkFlow().Endpoints()
+	srcPort, dstPort := transport.Endpoints()
+	return s.contains(connectionBucket(src.Raw(), srcPort.Raw(), dst.Raw(), dstPort.Raw()))
+}
+
+// request reports whether the connection of the request belongs to the shard,
+// for the requests that were not captured as packets, like the ingested or
+// replayed ones.
+func (s *hashShard) request(info captureInfo) bool {
+	return s.contains(connectionBucket(rawIP(info.sourceIP), rawPort(info.sourcePort),
+		rawIP(info.destinationIP), rawPort(info.destinationPort)))
+}
+
+// rawIP returns the address as it is in the packets: 4 bytes for IPv4.
+func rawIP(s string) []byte {
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// rawPort returns the port as it is in the packets, big-endian.
+func rawPort(s string) []byte {
+	port, _ := strconv.ParseUint(s, 10, 16)
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(port))
+	return b
+}
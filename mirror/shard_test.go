@@ -0,0 +1,128 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParseHashShard(t *testing.T) {
+	tests := []struct {
+		spec    string
+		count   int
+		in, out []uint16
+		err     bool
+	}{
+		{spec: "0-32767", count: 32768, in: []uint16{0, 32767}, out: []uint16{32768, 65535}},
+		{spec: "32768-65535", count: 32768, in: []uint16{32768, 65535}, out: []uint16{0, 32767}},
+		{spec: "7", count: 1, in: []uint16{7}, out: []uint16{6, 8}},
+		{spec: " 0-9 , 5-14 ,", count: 15, in: []uint16{0, 9, 14}, out: []uint16{15}},
+		{spec: "0-65535", count: shardBuckets, in: []uint16{0, 65535}},
+		{spec: "", err: true},
+		{spec: ",", err: true},
+		{spec: "10-5", err: true},
+		{spec: "-1", err: true},
+		{spec: "0-65536", err: true},
+		{spec: "a-b", err: true},
+	}
+	for _, tt := range tests {
+		s, err := parseHashShard(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseHashShard(%q) succeeded, want an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseHashShard(%q): %v", tt.spec, err)
+			continue
+		}
+		if s.count != tt.count {
+			t.Errorf("parseHashShard(%q) has %d buckets, want %d", tt.spec, s.count, tt.count)
+		}
+		for _, b := range tt.in {
+			if !s.contains(b) {
+				t.Errorf("parseHashShard(%q) does not contain bucket %d", tt.spec, b)
+			}
+		}
+		for _, b := range tt.out {
+			if s.contains(b) {
+				t.Errorf("parseHashShard(%q) contains bucket %d", tt.spec, b)
+			}
+		}
+	}
+}
+
+func TestHashShardPartition(t *testing.T) {
+	var shards []*hashShard
+	for _, spec := range []string{"0-21844", "21845-43690", "43691-65535"} {
+		s, err := parseHashShard(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards = append(shards, s)
+	}
+	for b := 0; b < shardBuckets; b++ {
+		n := 0
+		for _, s := range shards {
+			if s.contains(uint16(b)) {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("bucket %d is in %d shards, want 1", b, n)
+		}
+	}
+}
+
+func TestConnectionBucket(t *testing.T) {
+	tests := []struct {
+		name                   string
+		ip1, port1, ip2, port2 string
+	}{
+		{"ipv4", "10.0.0.1", "51234", "10.0.0.2", "80"},
+		{"ipv6", "2001:db8::1", "51234", "2001:db8::2", "443"},
+		{"same address", "10.0.0.1", "8080", "10.0.0.1", "51234"},
+	}
+	for _, tt := range tests {
+		forward := connectionBucket(rawIP(tt.ip1), rawPort(tt.port1), rawIP(tt.ip2), rawPort(tt.port2))
+		reverse := connectionBucket(rawIP(tt.ip2), rawPort(tt.port2), rawIP(tt.ip1), rawPort(tt.port1))
+		if forward != reverse {
+			t.Errorf("%s: the directions of the connection are in buckets %d and %d", tt.name, forward, reverse)
+		}
+		again := connectionBucket(rawIP(tt.ip1), rawPort(tt.port1), rawIP(tt.ip2), rawPort(tt.port2))
+		if again != forward {
+			t.Errorf("%s: the connection is in buckets %d and %d", tt.name, forward, again)
+		}
+	}
+
+	// the connections of a client spread over the buckets
+	seen := map[uint16]bool{}
+	for port := 40000; port < 41000; port++ {
+		seen[connectionBucket(rawIP("10.0.0.1"), rawPort(strconv.Itoa(port)), rawIP("10.0.0.2"), rawPort("80"))] = true
+	}
+	if len(seen) < 900 {
+		t.Errorf("1000 connections are in %d buckets only", len(seen))
+	}
+}
+
+func TestHashShardRequest(t *testing.T) {
+	info := captureInfo{sourceIP: "10.0.0.1", sourcePort: "51234", destinationIP: "10.0.0.2", destinationPort: "80"}
+	bucket := connectionBucket(rawIP(info.sourceIP), rawPort(info.sourcePort), rawIP(info.destinationIP), rawPort(info.destinationPort))
+	in, err := parseHashShard(strconv.Itoa(int(bucket)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !in.request(info) {
+		t.Errorf("the shard of bucket %d does not contain the request", bucket)
+	}
+	out, err := parseHashShard(strconv.Itoa(int(bucket ^ 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.request(info) {
+		t.Errorf("the shard of bucket %d contains the request of bucket %d", bucket^1, bucket)
+	}
+}
@@ -0,0 +1,43 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !windows
+
+package mirror
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// pipelineSignals are forwarded by the capture command to its pipelines.
+var pipelineSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// handleSignals pauses forwarding on SIGUSR1, resumes it on SIGUSR2, reloads the
+// configuration on SIGHUP, and drains then exits on SIGTERM and SIGINT, for the
+// drain timeout of the configuration in effect.
+func handleSignals(mode pauseMode) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			setPauseMode(mode)
+			log.Println("Forwarding paused by signal, mode", mode)
+		case syscall.SIGUSR2:
+			setPauseMode(pauseNone)
+			undrain()
+			log.Println("Forwarding resumed by signal")
+		case syscall.SIGHUP:
+			if err := reloadConfig(); err != nil {
+				log.Println(err)
+			}
+		default:
+			log.Println("Received", sig, "draining before exit")
+			shutdown(currentConfig().drainTimeout)
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build windows
+
+package mirror
+
+import (
+	"log"
+	"os"
+	"os/signal"
+)
+
+// pipelineSignals are forwarded by the capture command to its pipelines: none
+// on Windows, which cannot deliver signals to other processes.
+var pipelineSignals []os.Signal
+
+// handleSignals drains then exits on Ctrl+C. Windows has no SIGUSR1, SIGUSR2 and
+// SIGHUP: forwarding is paused, resumed and reloaded through the admin API.
+func handleSignals(mode pauseMode) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	for sig := range signals {
+		log.Println("Received", sig, "draining before exit")
+		shutdown(currentConfig().drainTimeout)
+		os.Exit(0)
+	}
+}
@@ -0,0 +1,272 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// configSnapshot is the configuration that a reload can change, as read by the
+// capture, the forwards and the background services: the values of the
+// reloadable flags of the configuration, and what setupFlags built from them.
+// It is never modified once published: a reload builds and validates a new one,
+// which replaces it as a whole, so that a request sees either the old or the
+// new configuration. The flags themselves are only read by the setup.
+type configSnapshot struct {
+	// refs counts the forwards using the snapshot, see acquireConfig
+	refs int64
+
+	contentTypes  *contentTypeFilter
+	bodyRules     *bodyRules
+	geo           *geoFilter
+	bandwidth     *byteRateLimiter
+	schedule      *mirrorSchedule
+	hooks         []requestHook
+	assertions    *responseAssertions
+	paths         *pathStatistics
+	pathTemplates *pathTemplates
+	// vlanIDs holds the VLAN IDs of filter-vlan-ids, or nil to capture every VLAN.
+	vlanIDs       map[uint16]bool
+	multipart     *multipartStripper
+	faults        []requestFault
+	bodyFieldSets []bodyFieldSet
+	ja3           *ja3Statistics
+	fingerprints  *requestFingerprints
+	coverage      *apiCoverage
+	latency       *latencyDistribution
+	pacer         *requestPacer
+
+	affinityKey             string
+	alertSNSTopic           string
+	alertWebhook            string
+	alertWebhookFormat      string
+	amplify                 int
+	amplifyJitter           time.Duration
+	anomalyDropRate         float64
+	anomalyErrorRate        float64
+	anomalyIdleRoutes       bool
+	anomalyInterval         time.Duration
+	anomalyMirrorLag        time.Duration
+	anomalyVolumeFactor     float64
+	anomalyVolumeMinRate    float64
+	anomalyVolumeWindows    int
+	anomalyWindows          int
+	archiveKeyRotation      time.Duration
+	captureDropThreshold    float64
+	captureMaxBufferSize    int
+	captureMinSnaplen       int
+	captureReopen           bool
+	clientCertSANHeader     string
+	clientCertSubjectHeader string
+	decapMaxDepth           int
+	decodeBodies            string
+	decodeMaxBytes          int
+	dedupWindow             time.Duration
+	drainTimeout            time.Duration
+	dryRun                  bool
+	faultHeader             string
+	faultPercentage         float64
+	filterMode              string
+	filterPorts             string
+	reqPort                 int
+	fwdBy                   string
+	fwdHeader               string
+	fwdSalt                 string
+	fwdBy7239               string
+	fwdHeaders              string
+	fwdRFC7239              bool
+	fwdTimeout              time.Duration
+	geoHeader               bool
+	guardrailMinForwards    int
+	idempotencyKeyHeader    string
+	ja3Header               string
+	latencyMax              time.Duration
+	latencyPercentage       float64
+	listenHostSuffix        string
+	listenSourceIPHeader    string
+	maxClockSkew            time.Duration
+	maxHeaderBytes          int
+	maxHeaderCount          int
+	maxURILength            int
+	maxInFlightPerDest      int
+	maxShapingDelay         time.Duration
+	mirrorHeaders           bool
+	openAPIValidation       string
+	ordering                string
+	orderingQueue           int
+	pathReportTop           int
+	quarantineMaxBytes      int
+	rawForwarding           bool
+	scorecardMaxErrorDelta  float64
+	scorecardMaxP95Delta    time.Duration
+	scorecardMinMatch       float64
+	smoothingWindow         time.Duration
+	sourceNameHeader        string
+	sourceNameTTL           time.Duration
+	sourceNameTimeout       time.Duration
+	stripTrailers           bool
+	tlsKeyLogWait           time.Duration
+	traceContext            string
+	traceSynthesize         bool
+}
+
+var fwdConfig atomic.Value
+
+// newConfigSnapshot returns a snapshot of the values of the reloadable flags,
+// without the objects built by setupFlags.
+func newConfigSnapshot() *configSnapshot {
+	return &configSnapshot{
+		pathTemplates:           &pathTemplates{},
+		affinityKey:             *affinityKey,
+		alertSNSTopic:           *alertSNSTopic,
+		alertWebhook:            *alertWebhook,
+		alertWebhookFormat:      *alertWebhookFormat,
+		amplify:                 *amplify,
+		amplifyJitter:           *amplifyJitter,
+		anomalyDropRate:         *anomalyDropRate,
+		anomalyErrorRate:        *anomalyErrorRate,
+		anomalyIdleRoutes:       *anomalyIdleRoutes,
+		anomalyInterval:         *anomalyInterval,
+		anomalyMirrorLag:        *anomalyMirrorLag,
+		anomalyVolumeFactor:     *anomalyVolumeFactor,
+		anomalyVolumeMinRate:    *anomalyVolumeMinRate,
+		anomalyVolumeWindows:    *anomalyVolumeWindows,
+		anomalyWindows:          *anomalyWindows,
+		archiveKeyRotation:      *archiveKeyRotation,
+		captureDropThreshold:    *captureDropThreshold,
+		captureMaxBufferSize:    *captureMaxBufferSize,
+		captureMinSnaplen:       *captureMinSnaplen,
+		captureReopen:           *captureReopen,
+		clientCertSANHeader:     *clientCertSANHeader,
+		clientCertSubjectHeader: *clientCertSubjectHeader,
+		decapMaxDepth:           *decapMaxDepth,
+		decodeBodies:            *decodeBodies,
+		decodeMaxBytes:          *decodeMaxBytes,
+		dedupWindow:             *dedupWindow,
+		drainTimeout:            *drainTimeout,
+		dryRun:                  *dryRun,
+		faultHeader:             *faultHeader,
+		faultPercentage:         *faultPercentage,
+		filterMode:              *filterMode,
+		filterPorts:             *filterPorts,
+		reqPort:                 *reqPort,
+		fwdBy:                   *fwdBy,
+		fwdHeader:               *fwdHeader,
+		fwdSalt:                 *fwdSalt,
+		fwdBy7239:               *fwdBy7239,
+		fwdHeaders:              *fwdHeaders,
+		fwdRFC7239:              *fwdRFC7239,
+		fwdTimeout:              *fwdTimeout,
+		geoHeader:               *geoHeader,
+		guardrailMinForwards:    *guardrailMinForwards,
+		idempotencyKeyHeader:    *idempotencyKeyHeader,
+		ja3Header:               *ja3Header,
+		latencyMax:              *latencyMax,
+		latencyPercentage:       *latencyPercentage,
+		listenHostSuffix:        *listenHostSuffix,
+		listenSourceIPHeader:    *listenSourceIPHeader,
+		maxClockSkew:            *maxClockSkew,
+		maxHeaderBytes:          *maxHeaderBytes,
+		maxHeaderCount:          *maxHeaderCount,
+		maxURILength:            *maxURILength,
+		maxInFlightPerDest:      *maxInFlightPerDest,
+		maxShapingDelay:         *maxShapingDelay,
+		mirrorHeaders:           *mirrorHeaders,
+		openAPIValidation:       *openAPIValidation,
+		ordering:                *ordering,
+		orderingQueue:           *orderingQueue,
+		pathReportTop:           *pathReportTop,
+		quarantineMaxBytes:      *quarantineMaxBytes,
+		rawForwarding:           *rawForwarding,
+		scorecardMaxErrorDelta:  *scorecardMaxErrorDelta,
+		scorecardMaxP95Delta:    *scorecardMaxP95Delta,
+		scorecardMinMatch:       *scorecardMinMatch,
+		smoothingWindow:         *smoothingWindow,
+		sourceNameHeader:        *sourceNameHeader,
+		sourceNameTTL:           *sourceNameTTL,
+		sourceNameTimeout:       *sourceNameTimeout,
+		stripTrailers:           *stripTrailers,
+		tlsKeyLogWait:           *tlsKeyLogWait,
+		traceContext:            *traceContext,
+		traceSynthesize:         *traceSynthesize,
+	}
+}
+
+// currentConfig returns the published configuration. Before setupFlags
+// published one, it returns the defaults of the flags.
+func currentConfig() *configSnapshot {
+	if c, ok := fwdConfig.Load().(*configSnapshot); ok {
+		return c
+	}
+	return newConfigSnapshot()
+}
+
+// acquireConfig returns the published configuration for a forward, which
+// releases it when done, so that the resources of a replaced configuration are
+// only closed once no forward uses them.
+func acquireConfig() *configSnapshot {
+	for {
+		c := currentConfig()
+		atomic.AddInt64(&c.refs, 1)
+		// a snapshot replaced meanwhile may be closed already
+		if current, ok := fwdConfig.Load().(*configSnapshot); !ok || current == c {
+			return c
+		}
+		c.release()
+	}
+}
+
+func (c *configSnapshot) release() {
+	atomic.AddInt64(&c.refs, -1)
+}
+
+// publishConfig replaces the configuration with c, and closes the resources of
+// the previous one once the forwards using it are done.
+func publishConfig(c *configSnapshot) {
+	previous, _ := fwdConfig.Load().(*configSnapshot)
+	fwdConfig.Store(c)
+	if previous != nil {
+		go previous.retire(c)
+	}
+}
+
+// retire waits for the forwards using c, then closes the resources that next
+// does not share with it.
+func (c *configSnapshot) retire(next *configSnapshot) {
+	for atomic.LoadInt64(&c.refs) > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.close(next)
+}
+
+// close closes the GeoIP database and the plugins of c, except those of keep,
+// which may be nil.
+func (c *configSnapshot) close(keep *configSnapshot) {
+	if c.geo != nil && (keep == nil || c.geo != keep.geo) {
+		if err := c.geo.close(); err != nil {
+			log.Println("Error closing GeoIP database", ":", err)
+		}
+	}
+	for _, hook := range c.hooks {
+		if keep != nil && containsHook(keep.hooks, hook) {
+			continue
+		}
+		if closer, ok := hook.(interface{ close() error }); ok {
+			if err := closer.close(); err != nil {
+				log.Println("Error closing request hook", ":", err)
+			}
+		}
+	}
+}
+
+func containsHook(hooks []requestHook, hook requestHook) bool {
+	for _, h := range hooks {
+		if h == hook {
+			return true
+		}
+	}
+	return false
+}
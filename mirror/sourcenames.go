@@ -0,0 +1,190 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// sourceNameLookupTimeout bounds a lookup, which goes on after the requests
+// waiting for it are forwarded, so that the next ones get the name.
+const sourceNameLookupTimeout = 10 * time.Second
+
+// sourceNameMaxLabels bounds the names counted in
+// requests_forwarded_by_source_name; the requests of other names are counted
+// as otherSourceName.
+const sourceNameMaxLabels = 100
+
+const otherSourceName = "(other)"
+
+// sourceName is a cached lookup of a source IP.
+type sourceName struct {
+	ip      string
+	name    string
+	expires time.Time
+	// done is closed when the lookup completes
+	done chan struct{}
+}
+
+// sourceNameResolver resolves the source IPs of captured requests to names,
+// with reverse DNS or the network interfaces of EC2. The names, including the
+// failed lookups, are kept in an LRU cache for source-name-ttl.
+type sourceNameResolver struct {
+	lookup func(ctx context.Context, ip string) (string, error)
+	size   int
+
+	mu sync.Mutex
+	// names holds the entries of lru by IP, the most recently used first
+	names  map[string]*list.Element
+	lru    *list.List
+	labels map[string]bool
+}
+
+var fwdSourceNames *sourceNameResolver
+
+func newSourceNameResolver(method string, size int) *sourceNameResolver {
+	r := &sourceNameResolver{size: size, names: map[string]*list.Element{}, lru: list.New(), labels: map[string]bool{}}
+	switch method {
+	case "rdns":
+		r.lookup = lookupReverseDNS
+	case "ec2":
+		r.lookup = lookupNetworkInterface
+	}
+	return r
+}
+
+// name returns the name of ip, waiting up to source-name-timeout for its
+// lookup on a cache miss, or "" if it has none.
+func (r *sourceNameResolver) name(ip string) string {
+	r.mu.Lock()
+	var entry *sourceName
+	if e, ok := r.names[ip]; ok {
+		entry = e.Value.(*sourceName)
+		if entry.expired() {
+			r.lru.Remove(e)
+			delete(r.names, ip)
+			entry = nil
+		} else {
+			r.lru.MoveToFront(e)
+		}
+	}
+	if entry == nil {
+		entry = &sourceName{ip: ip, done: make(chan struct{})}
+		r.names[ip] = r.lru.PushFront(entry)
+		for r.lru.Len() > r.size {
+			delete(r.names, r.lru.Remove(r.lru.Back()).(*sourceName).ip)
+		}
+		go r.resolve(entry)
+	} else {
+		stats.inc("source_name_cache_hits")
+	}
+	r.mu.Unlock()
+
+	t := time.NewTimer(currentConfig().sourceNameTimeout)
+	defer t.Stop()
+	select {
+	case <-entry.done:
+		return entry.name
+	case <-t.C:
+		stats.inc("source_name_timeouts")
+		return ""
+	}
+}
+
+// expired reports whether the lookup completed longer than its TTL ago. It is
+// called with the lock held.
+func (e *sourceName) expired() bool {
+	select {
+	case <-e.done:
+		return time.Now().After(e.expires)
+	default:
+		return false
+	}
+}
+
+func (r *sourceNameResolver) resolve(entry *sourceName) {
+	stats.inc("source_name_lookups")
+	ctx, cancel := context.WithTimeout(context.Background(), sourceNameLookupTimeout)
+	defer cancel()
+	name, err := r.lookup(ctx, entry.ip)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		err = nil
+	}
+	if err != nil {
+		stats.inc("source_name_lookup_errors")
+	} else if name == "" {
+		stats.inc("source_name_misses")
+	}
+	r.mu.Lock()
+	entry.name, entry.expires = name, time.Now().Add(currentConfig().sourceNameTTL)
+	r.mu.Unlock()
+	close(entry.done)
+}
+
+// label returns name as the label of a metric, the first sourceNameMaxLabels
+// names being counted apart.
+func (r *sourceNameResolver) label(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.labels[name] {
+		if len(r.labels) >= sourceNameMaxLabels {
+			return otherSourceName
+		}
+		r.labels[name] = true
+	}
+	return name
+}
+
+// lookupReverseDNS returns the first PTR name of ip, without its final dot.
+func lookupReverseDNS(ctx context.Context, ip string) (string, error) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return "", err
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
+
+// lookupNetworkInterface returns the name of the EC2 network interface of ip:
+// its Name tag, the instance it is attached to, its description (like "ELB
+// app/web/50dc6c495c0c9188" for the nodes of load balancers), or its ID.
+func lookupNetworkInterface(ctx context.Context, ip string) (string, error) {
+	cfg, err := awsConfig()
+	if err != nil {
+		return "", err
+	}
+	filter := "addresses.private-ip-address"
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		filter = "ipv6-addresses.ipv6-address"
+	}
+	out, err := ec2.NewFromConfig(cfg).DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
+		Filters: []ec2types.Filter{{Name: aws.String(filter), Values: []string{ip}}},
+	})
+	if err != nil || len(out.NetworkInterfaces) == 0 {
+		return "", err
+	}
+	ni := out.NetworkInterfaces[0]
+	for _, tag := range ni.TagSet {
+		if aws.ToString(tag.Key) == "Name" && aws.ToString(tag.Value) != "" {
+			return aws.ToString(tag.Value), nil
+		}
+	}
+	if ni.Attachment != nil && aws.ToString(ni.Attachment.InstanceId) != "" {
+		return aws.ToString(ni.Attachment.InstanceId), nil
+	}
+	if description := aws.ToString(ni.Description); description != "" {
+		return description, nil
+	}
+	return aws.ToString(ni.NetworkInterfaceId), nil
+}
@@ -0,0 +1,290 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	crypto_rand "crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+)
+
+// captureInfo describes where and when a request was captured.
+type captureInfo struct {
+	sourceIP        string
+	sourcePort      string
+	destinationIP   string
+	destinationPort string
+	// time is the capture timestamp of the first packet of the request
+	time time.Time
+	// connectionID identifies the TCP connection, derived from the flow tuple
+	connectionID string
+	// requestID identifies the request, see newRequestID
+	requestID string
+	// headerOrder holds the header names as captured, in order, with raw-forwarding
+	headerOrder []string
+	// index is the 1-based position of the request among the requests of its
+	// connection, or 0 if it is unknown (replays)
+	index int
+	// streamSeq is the TCP sequence number the data of the connection starts
+	// at, which address translation keeps, or 0 if it is unknown
+	streamSeq uint32
+	// raw holds the captured bytes of the request, and sequence its number among
+	// the forwarded requests of the connection, with raw-tcp
+	raw      []byte
+	sequence int
+	// amplified is the number of the copy of an amplified request, or 0
+	amplified int
+	// clientCert is the certificate the client authenticated with, on decrypted
+	// TLS connections
+	clientCert *x509.Certificate
+	// ja3 is the JA3 fingerprint of the ClientHello of the TLS connection
+	ja3 string
+	// sourceName is the name of the source IP, with source-names
+	sourceName string
+}
+
+func newCaptureInfo(net, transport gopacket.Flow, seen time.Time) captureInfo {
+	return captureInfo{
+		sourceIP:        net.Src().String(),
+		sourcePort:      transport.Src().String(),
+		destinationIP:   net.Dst().String(),
+		destinationPort: transport.Dst().String(),
+		time:            seen,
+		connectionID:    connectionID(net, transport),
+		requestID:       newRequestID(),
+	}
+}
+
+// newRequestID returns a random (version 4) UUID, which identifies a mirrored
+// request in logs, archives and forwarded headers.
+func newRequestID() string {
+	var b [16]byte
+	crypto_rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func connectionID(net, transport gopacket.Flow) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%s-%s:%s", net.Src(), transport.Src(), net.Dst(), transport.Dst())
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// timedStream is a tcpreader.ReaderStream that remembers the capture timestamp
+// of the reassembled data, so that readers can tell when a given byte was seen.
+type timedStream struct {
+	tcpreader.ReaderStream
+	mu sync.Mutex
+	// written is the number of bytes handed to the reader so far
+	written int64
+	// segments holds the end offset and timestamp of data not yet read
+	segments []timedSegment
+}
+
+type timedSegment struct {
+	end  int64
+	seen time.Time
+}
+
+func (s *timedStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	// out of order packets are reassembled together with the packets they
+	// waited for, which were captured later: the data is taken as seen when
+	// the earliest of the following packets of the batch was captured
+	seen := make([]time.Time, len(reassemblies))
+	for i := len(reassemblies) - 1; i >= 0; i-- {
+		seen[i] = reassemblies[i].Seen
+		if i+1 < len(reassemblies) && seen[i+1].Before(seen[i]) {
+			seen[i] = seen[i+1]
+		}
+	}
+	s.mu.Lock()
+	for i, r := range reassemblies {
+		if len(r.Bytes) == 0 {
+			continue
+		}
+		s.written += int64(len(r.Bytes))
+		s.segments = append(s.segments, timedSegment{end: s.written, seen: seen[i]})
+	}
+	s.mu.Unlock()
+	s.ReaderStream.Reassembled(reassemblies)
+}
+
+// seenAt returns the capture timestamp of the byte at offset, and forgets the
+// timestamps of earlier bytes.
+func (s *timedStream) seenAt(offset int64) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.segments) > 1 && s.segments[0].end <= offset {
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) == 0 {
+		return time.Now()
+	}
+	return s.segments[0].seen
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// recordingReader is a countingReader that also keeps the bytes read from the
+// offset base on, for the sinks that need the requests as they were captured.
+type recordingReader struct {
+	countingReader
+	// record is false when no sink needs the bytes, which are then not kept
+	record bool
+	base   int64
+	data   []byte
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.countingReader.Read(p)
+	if r.record {
+		r.data = append(r.data, p[:n]...)
+	}
+	return n, err
+}
+
+// bytes returns a copy of the bytes between the offsets from and to.
+func (r *recordingReader) bytes(from, to int64) []byte {
+	return append([]byte(nil), r.data[from-r.base:to-r.base]...)
+}
+
+// forget discards the bytes before offset.
+func (r *recordingReader) forget(offset int64) {
+	if !r.record {
+		return
+	}
+	r.data = append(r.data[:0], r.data[offset-r.base:]...)
+	r.base = offset
+}
+
+// headerNames returns the names of the header fields of a raw request head, in
+// order and with their original casing.
+func headerNames(head []byte) []string {
+	var names []string
+	lines := strings.Split(string(head), "\n")
+	// the first line is the request line
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			// the end of the head, or the continuation of a folded field
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			names = append(names, strings.TrimRight(line[:i], " \t"))
+		}
+	}
+	return names
+}
+
+// requestLine matches the request line of HTTP/1.x requests.
+var requestLine = regexp.MustCompile(`^[A-Z]+ [^ ]+ HTTP/1\.[0-9]\r?\n$`)
+
+// resyncRequest discards the data of buf up to the next line that looks like a
+// request line, which is left in buf.
+func resyncRequest(buf *bufio.Reader) error {
+	for {
+		line, err := peekLine(buf)
+		if err != nil {
+			return err
+		}
+		if requestLine.Match(line) {
+			return nil
+		}
+		buf.Discard(len(line))
+	}
+}
+
+// peekLine returns the next line of buf, including the newline, without
+// consuming it. A line longer than the buffer is returned in parts.
+func peekLine(buf *bufio.Reader) ([]byte, error) {
+	for {
+		b, _ := buf.Peek(buf.Buffered())
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			return b[:i+1], nil
+		}
+		if len(b) == buf.Size() {
+			return b, nil
+		}
+		// read more data into the buffer
+		if _, err := buf.Peek(len(b) + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// The classes of stream errors, logged once per connection and counted as
+// stream_errors_<class>.
+const (
+	// streamErrorNotHTTP is data that is not HTTP at all, like TLS
+	streamErrorNotHTTP = "not_http"
+	// streamErrorTruncated is a request cut short by the end of the connection
+	streamErrorTruncated = "truncated"
+	// streamErrorMalformed is a request that cannot be parsed
+	streamErrorMalformed = "malformed"
+	// streamErrorRejected is a request over a limit of the parser, like
+	// max-header-bytes
+	streamErrorRejected = "rejected"
+	// streamErrorTLS is a TLS connection that cannot be decrypted
+	streamErrorTLS = "tls"
+)
+
+// looksLikeRequest reports whether the next data of buf starts like a request
+// line, with a method made of upper case letters followed by a space. It reports
+// true at the end of the stream, which is reported by the request parser.
+func looksLikeRequest(buf *bufio.Reader) bool {
+	if _, err := buf.Peek(1); err != nil {
+		return true
+	}
+	b, _ := buf.Peek(buf.Buffered())
+	for i, c := range b {
+		switch {
+		case c >= 'A' && c <= 'Z', c == '-' || c == '_':
+		case c == ' ':
+			return i > 0
+		default:
+			return false
+		}
+		if i == 20 {
+			// longer than any method
+			return false
+		}
+	}
+	return true
+}
+
+// looksLikeResponse reports whether the next data of buf is an HTTP response.
+func looksLikeResponse(buf *bufio.Reader) bool {
+	b, _ := buf.Peek(5)
+	return string(b) == "HTTP/"
+}
+
+// flowPort returns the port of a TCP endpoint.
+func flowPort(e gopacket.Endpoint) int {
+	port, _ := strconv.Atoi(e.String())
+	return port
+}
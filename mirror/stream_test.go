@@ -0,0 +1,113 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResyncRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		// next is the line left in the buffer, or "" if resyncRequest fails
+		next string
+	}{
+		{"at a request line", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", "GET / HTTP/1.1\r\n"},
+		{"after garbage", "\x16\x03\x01garbage\r\nmore\nPOST /orders HTTP/1.1\r\n\r\n", "POST /orders HTTP/1.1\r\n"},
+		{"after a body", "Host: a\r\n\r\n{\"id\": 1}\nPUT /x HTTP/1.0\n\n", "PUT /x HTTP/1.0\n"},
+		{"not a request line", "GET / HTTP/2.0\r\nget / HTTP/1.1\r\nGET  / HTTP/1.1\r\n", ""},
+		{"request line without newline", "garbage\nGET / HTTP/1.1", ""},
+		{"empty", "", ""},
+		// lines longer than the buffer of 64 bytes are skipped in parts
+		{"after a long line", strings.Repeat("x", 100) + "\nGET /long HTTP/1.1\r\n\r\n", "GET /long HTTP/1.1\r\n"},
+	}
+	for _, tt := range tests {
+		buf := bufio.NewReaderSize(strings.NewReader(tt.data), 64)
+		err := resyncRequest(buf)
+		if tt.next == "" {
+			if err == nil {
+				line, _ := peekLine(buf)
+				t.Errorf("%s: resyncRequest stopped at %q, want an error", tt.name, line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: resyncRequest: %v", tt.name, err)
+			continue
+		}
+		if line, _ := peekLine(buf); string(line) != tt.next {
+			t.Errorf("%s: resyncRequest stopped at %q, want %q", tt.name, line, tt.next)
+		}
+	}
+}
+
+func TestPeekLine(t *testing.T) {
+	buf := bufio.NewReaderSize(strings.NewReader("short\n"+strings.Repeat("y", 20)+"\nend"), 16)
+	want := []string{"short\n", strings.Repeat("y", 16), "yyyy\n"}
+	for _, w := range want {
+		line, err := peekLine(buf)
+		if err != nil || string(line) != w {
+			t.Fatalf("peekLine = %q, %v, want %q", line, err, w)
+		}
+		buf.Discard(len(line))
+	}
+	// the last line has no newline
+	if line, err := peekLine(buf); err != io.EOF {
+		t.Errorf("peekLine = %q, %v, want EOF", line, err)
+	}
+}
+
+// TestStreamResync reads requests like httpStream.run: the requests pipelined
+// after a malformed one are read once the stream is resynchronized.
+func TestStreamResync(t *testing.T) {
+	data := "GET /1 HTTP/1.1\r\nHost: a\r\n\r\n" +
+		"GET /2 HTTP/1.1\r\nHost a\r\n\r\n" +
+		"POST /3 HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET /4 HTTP/1.1\r\nHost: a\r\n\r\n"
+	buf := bufio.NewReader(strings.NewReader(data))
+	var uris []string
+	for {
+		req, err := http.ReadRequest(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if resyncRequest(buf) != nil {
+				break
+			}
+			continue
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		uris = append(uris, req.RequestURI)
+	}
+	if got := strings.Join(uris, " "); got != "/1 /3 /4" {
+		t.Errorf("read requests %s, want /1 /3 /4", got)
+	}
+}
+
+func TestHeaderNames(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want []string
+	}{
+		{"order and casing", "GET / HTTP/1.1\r\nhost: a\r\nX-Request-ID: 1\r\naccept: */*\r\n\r\n", []string{"host", "X-Request-ID", "accept"}},
+		{"repeated fields", "GET / HTTP/1.1\r\nCookie: a=1\r\nHost: a\r\nCookie: b=2\r\n\r\n", []string{"Cookie", "Host", "Cookie"}},
+		{"bare newlines", "GET / HTTP/1.0\nHost: a\nAccept: */*\n\n", []string{"Host", "Accept"}},
+		{"folded field", "GET / HTTP/1.1\r\nX-Long: a,\r\n b\r\n\tc\r\nHost: a\r\n\r\n", []string{"X-Long", "Host"}},
+		{"space before colon", "GET / HTTP/1.1\r\nHost : a\r\n\r\n", []string{"Host"}},
+		{"line without colon", "GET / HTTP/1.1\r\nHost: a\r\ngarbage\r\n:empty\r\n\r\n", []string{"Host"}},
+		{"no fields", "GET / HTTP/1.1\r\n\r\n", nil},
+	}
+	for _, tt := range tests {
+		if got := headerNames([]byte(tt.head)); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: headerNames = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
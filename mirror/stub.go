@@ -0,0 +1,84 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// stubSink replaces the destinations in stub mode: it records the requests that
+// would have been sent and answers them with a synthetic response, which goes
+// through the assertions, path stats and diffs like a real one. Unlike the dry
+// run, the whole pipeline runs, so the filters, transformations and sampling can
+// be validated in isolation from any destination.
+type stubSink struct {
+	status  int
+	body    []byte
+	latency time.Duration
+	output  *dryRunRecorder
+}
+
+var fwdStub *stubSink
+
+func newStubSink(status int, body string, latency time.Duration, output string) (*stubSink, error) {
+	s := &stubSink{status: status, body: []byte(body), latency: latency}
+	if output != "" {
+		var err error
+		if s.output, err = openDryRunRecorder(output); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *stubSink) roundTrip(forwardReq *http.Request, info captureInfo, body []byte) (*http.Response, error) {
+	if s.latency > 0 {
+		t := time.NewTimer(s.latency)
+		select {
+		case <-t.C:
+		case <-forwardReq.Context().Done():
+			t.Stop()
+			return nil, forwardReq.Context().Err()
+		}
+	}
+	stats.inc("requests_stubbed")
+	if s.output != nil {
+		err := s.output.write(dryRunRecord{
+			Time:       time.Now(),
+			RequestID:  info.requestID,
+			SourceIP:   info.sourceIP,
+			SourceName: info.sourceName,
+			Method:     forwardReq.Method,
+			URL:        forwardReq.URL.String(),
+			Headers:    forwardReq.Header,
+			BodySize:   len(body),
+			Body:       body,
+		})
+		if err != nil {
+			log.Println("Error writing stub output", ":", err)
+		}
+	}
+
+	header := http.Header{}
+	header.Set("Content-Length", strconv.Itoa(len(s.body)))
+	if len(s.body) > 0 {
+		header.Set("Content-Type", http.DetectContentType(s.body))
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(s.status) + " " + http.StatusText(s.status),
+		StatusCode:    s.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(s.body)),
+		ContentLength: int64(len(s.body)),
+		Request:       forwardReq,
+	}, nil
+}
@@ -0,0 +1,55 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// forwardURL returns the URL of the forwarded request: the scheme and host of
+// dest, the path of dest followed by the path of the request target, and the
+// query of the request target exactly as it was sent.
+//
+// The request target (RFC 7230 section 5.3) is in one of four forms:
+//   - origin-form (/path?query), the usual form
+//   - absolute-form (http://www.example.com/path?query), sent to proxies; only
+//     the path and query are kept
+//   - asterisk-form (*), for server wide OPTIONS requests; it is kept as is
+//   - authority-form (www.example.com:443), for CONNECT; the URL is the
+//     destination, and the authority is returned to be sent as the Host
+func forwardURL(dest string, method, target string) (*url.URL, string, error) {
+	base, err := url.Parse(dest)
+	if err != nil {
+		return nil, "", fmt.Errorf("destination %s is not a valid URL: %v", dest, err)
+	}
+	u := &url.URL{Scheme: base.Scheme, User: base.User, Host: base.Host}
+
+	if method == http.MethodConnect {
+		return u, target, nil
+	}
+	if target == "*" {
+		u.Opaque = "*"
+		return u, "", nil
+	}
+
+	t, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, "", fmt.Errorf("request target %q is not valid: %v", target, err)
+	}
+	prefix := strings.TrimSuffix(base.Path, "/")
+	u.Path = prefix + t.Path
+	if t.RawPath != "" || base.RawPath != "" {
+		u.RawPath = strings.TrimSuffix(base.EscapedPath(), "/") + t.EscapedPath()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = t.RawQuery
+	// a trailing ? without query is kept, like the rest of the target
+	u.ForceQuery = t.ForceQuery
+	return u, "", nil
+}
@@ -0,0 +1,191 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package mirror
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// The Go functions probed by the tls capture engine.
+const (
+	goTLSRead  = "crypto/tls.(*Conn).Read"
+	goTLSWrite = "crypto/tls.(*Conn).Write"
+	goTLSClose = "crypto/tls.(*Conn).Close"
+)
+
+// runTLSCapture implements the capture subcommand with the tls capture engine:
+// the plaintext of the TLS connections of the processes using the libraries
+// and binaries of tls-targets is captured with uprobes, and parsed like
+// captured TCP streams.
+func runTLSCapture() error {
+	spec, err := ebpf.LoadCollectionSpec(*tlsEBPFObject)
+	if err != nil {
+		return fmt.Errorf("Error loading eBPF program %s: %v", *tlsEBPFObject, err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+
+	var probes []link.Link
+	defer func() {
+		for _, probe := range probes {
+			probe.Close()
+		}
+	}()
+	for _, target := range splitPatterns(*tlsTargets) {
+		attached, err := attachTLSProbes(coll, target)
+		probes = append(probes, attached...)
+		if err != nil {
+			return fmt.Errorf("Error attaching uprobes to %s: %v", target, err)
+		}
+	}
+	return readStreamEvents(coll, "TLS connections of "+*tlsTargets, &udsCapture{name: "tls"})
+}
+
+// attachTLSProbes attaches the probes of the tls-side to target, a Go binary
+// or the OpenSSL library.
+func attachTLSProbes(coll *ebpf.Collection, target string) ([]link.Link, error) {
+	f, err := elf.Open(target)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ex, err := link.OpenExecutable(target)
+	if err != nil {
+		return nil, err
+	}
+	opts := &link.UprobeOptions{PID: *tlsPID}
+
+	var probes []link.Link
+	attach := func(symbol, program string, ret bool, offset uint64) error {
+		o := *opts
+		o.Offset = offset
+		var probe link.Link
+		var err error
+		if ret {
+			probe, err = ex.Uretprobe(symbol, coll.Programs[program], &o)
+		} else {
+			probe, err = ex.Uprobe(symbol, coll.Programs[program], &o)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", symbol, err)
+		}
+		probes = append(probes, probe)
+		return nil
+	}
+
+	if symbols, _ := f.Symbols(); hasSymbol(symbols, goTLSRead) {
+		log.Println("Attaching uprobes to the crypto/tls package of", target)
+		if *tlsSide == "client" {
+			err = attach(goTLSWrite, "go_tls_write", false, 0)
+		} else {
+			var returns []uint64
+			if returns, err = goReturnOffsets(f, symbols, goTLSRead); err == nil {
+				err = attach(goTLSRead, "go_tls_read", false, 0)
+			}
+			for _, offset := range returns {
+				if err == nil {
+					err = attach(goTLSRead, "go_tls_read_return", false, offset)
+				}
+			}
+		}
+		if err == nil {
+			err = attach(goTLSClose, "go_tls_close", false, 0)
+		}
+		return probes, err
+	}
+
+	dynamic, _ := f.DynamicSymbols()
+	if !hasSymbol(dynamic, "SSL_read") {
+		return nil, fmt.Errorf("neither a Go binary using crypto/tls nor an OpenSSL library")
+	}
+	log.Println("Attaching uprobes to OpenSSL", target)
+	if *tlsSide == "client" {
+		err = attach("SSL_write", "ssl_write", false, 0)
+		if err == nil && hasSymbol(dynamic, "SSL_write_ex") {
+			err = attach("SSL_write_ex", "ssl_write_ex", false, 0)
+		}
+	} else {
+		for _, name := range []string{"SSL_read", "SSL_read_ex"} {
+			// SSL_read_ex exists since OpenSSL 1.1.1
+			if err == nil && hasSymbol(dynamic, name) {
+				program := "ssl_" + name[len("SSL_"):]
+				if err = attach(name, program, false, 0); err == nil {
+					err = attach(name, program+"_return", true, 0)
+				}
+			}
+		}
+	}
+	if err == nil {
+		err = attach("SSL_free", "ssl_free", false, 0)
+	}
+	return probes, err
+}
+
+func hasSymbol(symbols []elf.Symbol, name string) bool {
+	for _, s := range symbols {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// goReturnOffsets returns the offsets of the RET instructions of the function
+// name, relative to its start.
+func goReturnOffsets(f *elf.File, symbols []elf.Symbol, name string) ([]uint64, error) {
+	var symbol elf.Symbol
+	for _, s := range symbols {
+		if s.Name == name {
+			symbol = s
+		}
+	}
+	if int(symbol.Section) >= len(f.Sections) {
+		return nil, fmt.Errorf("%s is not in a section", name)
+	}
+	section := f.Sections[symbol.Section]
+	code := make([]byte, symbol.Size)
+	if _, err := section.ReadAt(code, int64(symbol.Value-section.Addr)); err != nil {
+		return nil, err
+	}
+
+	var offsets []uint64
+	switch f.Machine {
+	case elf.EM_X86_64:
+		for offset := 0; offset < len(code); {
+			inst, err := x86asm.Decode(code[offset:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Error decoding %s at offset %d: %v", name, offset, err)
+			}
+			if inst.Op == x86asm.RET {
+				offsets = append(offsets, uint64(offset))
+			}
+			offset += inst.Len
+		}
+	case elf.EM_AARCH64:
+		for offset := 0; offset+4 <= len(code); offset += 4 {
+			// RET (X30)
+			if binary.LittleEndian.Uint32(code[offset:]) == 0xd65f03c0 {
+				offsets = append(offsets, uint64(offset))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("architecture %s is not supported", f.Machine)
+	}
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("%s has no RET instruction", name)
+	}
+	return offsets, nil
+}
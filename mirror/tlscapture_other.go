@@ -0,0 +1,13 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package mirror
+
+import "fmt"
+
+// runTLSCapture reports an error: the tls capture engine relies on eBPF.
+func runTLSCapture() error {
+	return fmt.Errorf("Flag capture-engine tls is only supported on Linux.")
+}
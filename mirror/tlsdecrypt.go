@@ -0,0 +1,521 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The TLS record content types and handshake message types read by the
+// decryption.
+const (
+	tlsRecordChangeCipherSpec = 20
+	tlsRecordAlert            = 21
+	tlsRecordHandshake        = 22
+	tlsRecordApplicationData  = 23
+
+	tlsHandshakeClientHello = 1
+	tlsHandshakeServerHello = 2
+	tlsHandshakeFinished    = 20
+	tlsHandshakeKeyUpdate   = 24
+
+	tlsVersion12 = 0x0303
+	tlsVersion13 = 0x0304
+
+	// tlsMaxRecord is the maximum length of an encrypted record, with its expansion
+	tlsMaxRecord = 16384 + 2048
+)
+
+// helloRetryRandom is the random of a ServerHello asking the client for
+// another ClientHello.
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// tlsCipherSuite is an AEAD cipher suite of TLS 1.2 or 1.3. CBC suites are not
+// supported.
+type tlsCipherSuite struct {
+	keyLen int
+	hash   func() hash.Hash
+	aead   func(key []byte) (cipher.AEAD, error)
+	// chacha is true for ChaCha20-Poly1305, whose TLS 1.2 nonces are like those
+	// of TLS 1.3
+	chacha bool
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var tlsCipherSuites = map[uint16]tlsCipherSuite{
+	// TLS 1.3
+	0x1301: {16, sha256.New, newAESGCM, false},
+	0x1302: {32, sha512.New384, newAESGCM, false},
+	0x1303: {32, sha256.New, chacha20poly1305.New, true},
+	// TLS 1.2, ECDHE and RSA key exchanges
+	0xc02b: {16, sha256.New, newAESGCM, false},
+	0xc02f: {16, sha256.New, newAESGCM, false},
+	0x009c: {16, sha256.New, newAESGCM, false},
+	0xc02c: {32, sha512.New384, newAESGCM, false},
+	0xc030: {32, sha512.New384, newAESGCM, false},
+	0x009d: {32, sha512.New384, newAESGCM, false},
+	0xcca8: {32, sha256.New, chacha20poly1305.New, true},
+	0xcca9: {32, sha256.New, chacha20poly1305.New, true},
+}
+
+// tlsServerHello is what the decryption of the client side of a connection
+// needs from its server side.
+type tlsServerHello struct {
+	version      uint16
+	cipherSuite  uint16
+	serverRandom []byte
+	seen         time.Time
+}
+
+// serverHellos holds the server hellos read on the server side of the
+// connections, by connection ID of the client side, until it takes them.
+var serverHellos = struct {
+	sync.Mutex
+	hellos map[string]tlsServerHello
+}{hellos: map[string]tlsServerHello{}}
+
+func putServerHello(id string, hello tlsServerHello) {
+	serverHellos.Lock()
+	defer serverHellos.Unlock()
+	serverHellos.hellos[id] = hello
+	for id, h := range serverHellos.hellos {
+		// the client side of the connection was not decrypted
+		if time.Since(h.seen) > time.Minute {
+			delete(serverHellos.hellos, id)
+		}
+	}
+}
+
+// takeServerHello returns the server hello of the connection id, waiting up to
+// wait for its server side to read it.
+func takeServerHello(id string, wait time.Duration) (tlsServerHello, bool) {
+	deadline := time.Now().Add(wait)
+	for {
+		serverHellos.Lock()
+		hello, ok := serverHellos.hellos[id]
+		delete(serverHellos.hellos, id)
+		serverHellos.Unlock()
+		if ok || time.Now().After(deadline) {
+			return hello, ok
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// looksLikeTLS reports whether the next data of buf is a TLS handshake record.
+func looksLikeTLS(buf *bufio.Reader) bool {
+	b, _ := buf.Peek(3)
+	return len(b) == 3 && b[0] == tlsRecordHandshake && b[1] == 3 && b[2] <= 4
+}
+
+func readTLSRecord(r io.Reader) (header, fragment []byte, err error) {
+	header = make([]byte, 5)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header[3:5]))
+	if n > tlsMaxRecord {
+		return nil, nil, fmt.Errorf("TLS record of %d bytes is too long", n)
+	}
+	fragment = make([]byte, n)
+	if _, err = io.ReadFull(r, fragment); err != nil {
+		return nil, nil, err
+	}
+	return header, fragment, nil
+}
+
+// handshakeBuffer reassembles the handshake messages of consecutive records.
+type handshakeBuffer struct {
+	data []byte
+}
+
+// next returns the next complete message, header included, or nil.
+func (b *handshakeBuffer) next() []byte {
+	if len(b.data) < 4 {
+		return nil
+	}
+	n := 4 + uint24(b.data[1:4])
+	if len(b.data) < n {
+		return nil
+	}
+	msg := b.data[:n]
+	b.data = b.data[n:]
+	return msg
+}
+
+// parseServerHello returns the negotiated version and cipher suite of a
+// ServerHello message, and the server random.
+func parseServerHello(msg []byte) (tlsServerHello, error) {
+	errTruncated := errors.New("ServerHello is truncated")
+	body := msg[4:]
+	if len(body) < 35 || len(body) < 35+int(body[34])+3 {
+		return tlsServerHello{}, errTruncated
+	}
+	hello := tlsServerHello{
+		version:      binary.BigEndian.Uint16(body[0:2]),
+		serverRandom: append([]byte(nil), body[2:34]...),
+		seen:         time.Now(),
+	}
+	body = body[35+int(body[34]):]
+	hello.cipherSuite = binary.BigEndian.Uint16(body[0:2])
+	if len(body) < 5 {
+		// no extensions
+		return hello, nil
+	}
+	extensions := body[5:]
+	for len(extensions) >= 4 {
+		kind, n := binary.BigEndian.Uint16(extensions[0:2]), int(binary.BigEndian.Uint16(extensions[2:4]))
+		if len(extensions) < 4+n {
+			return tlsServerHello{}, errTruncated
+		}
+		// supported_versions selects TLS 1.3
+		if kind == 43 && n == 2 {
+			hello.version = binary.BigEndian.Uint16(extensions[4:6])
+		}
+		extensions = extensions[4+n:]
+	}
+	return hello, nil
+}
+
+// decryptTLS reads the handshake of a TLS connection. On the server side, it
+// keeps the server hello for the client side, and returns false. On the client
+// side, it returns the decrypted application data, as read from buf.
+func (h *httpStream) decryptTLS(buf *bufio.Reader) (io.Reader, bool) {
+	d := &tlsDecryptor{raw: buf, stream: h}
+	for {
+		header, fragment, err := readTLSRecord(buf)
+		if err != nil {
+			return nil, false
+		}
+		if header[0] != tlsRecordHandshake {
+			h.tlsError("no_hello", fmt.Errorf("TLS connection does not start with a hello"))
+			return nil, false
+		}
+		d.handshake.data = append(d.handshake.data, fragment...)
+		for msg := d.handshake.next(); msg != nil; msg = d.handshake.next() {
+			switch msg[0] {
+			case tlsHandshakeClientHello:
+				if len(msg) < 4+2+32 {
+					h.tlsError("no_hello", fmt.Errorf("ClientHello is truncated"))
+					return nil, false
+				}
+				d.clientRandom = append([]byte(nil), msg[6:38]...)
+				if ja3 := currentConfig().ja3; ja3 != nil {
+					h.ja3 = ja3.record(msg)
+				}
+				return d, true
+			case tlsHandshakeServerHello:
+				hello, err := parseServerHello(msg)
+				if err != nil {
+					h.tlsError("no_hello", err)
+					return nil, false
+				}
+				// after a HelloRetryRequest, the client sends another ClientHello,
+				// answered by the actual ServerHello
+				if !bytes.Equal(hello.serverRandom, helloRetryRandom) {
+					putServerHello(connectionID(h.net.Reverse(), h.transport.Reverse()), hello)
+					return nil, false
+				}
+			default:
+				h.tlsError("no_hello", fmt.Errorf("TLS connection starts with handshake message %d", msg[0]))
+				return nil, false
+			}
+		}
+	}
+}
+
+// tlsError counts a connection that cannot be decrypted, for reason.
+func (h *httpStream) tlsError(reason string, err error) {
+	stats.inc(labeled("tls_sessions_failed", "reason", reason))
+	h.streamError(streamErrorTLS, err)
+}
+
+// tlsDecryptor decrypts the records sent by the client of a TLS connection,
+// with the secrets of the key log, and returns their application data.
+type tlsDecryptor struct {
+	raw          *bufio.Reader
+	stream       *httpStream
+	clientRandom []byte
+	hello        tlsServerHello
+	suite        tlsCipherSuite
+	// handshake reassembles the plaintext handshake messages, and encrypted
+	// the decrypted ones
+	handshake, encrypted handshakeBuffer
+	// aead is set when the client starts encrypting, after ChangeCipherSpec or
+	// with the first application data record of TLS 1.3
+	encrypting bool
+	aead       cipher.AEAD
+	iv         []byte
+	seq        uint64
+	secret     []byte
+	// established is true when TLS 1.3 switched from the handshake to the
+	// application traffic keys
+	established bool
+	done        bool
+	plain       []byte
+}
+
+func (d *tlsDecryptor) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readRecord(); err != nil {
+			// the parser sees the end of the stream, truncated or not
+			d.done = true
+			if err != io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *tlsDecryptor) readRecord() error {
+	header, fragment, err := readTLSRecord(d.raw)
+	if err != nil {
+		return err
+	}
+	kind := header[0]
+	switch {
+	case kind == tlsRecordChangeCipherSpec:
+		// the records after it are encrypted with TLS 1.2; it is only sent for
+		// compatibility with TLS 1.3, whose records are encrypted anyway
+		if d.aead == nil {
+			if err := d.setupKeys(); err != nil {
+				return err
+			}
+		}
+		d.encrypting = true
+		return nil
+	case d.encrypting:
+	case kind == tlsRecordHandshake:
+		d.handshake.data = append(d.handshake.data, fragment...)
+		for msg := d.handshake.next(); msg != nil; msg = d.handshake.next() {
+			d.handshakeMessage(msg, false)
+		}
+		return nil
+	case kind == tlsRecordApplicationData:
+		if err := d.setupKeys(); err != nil {
+			return err
+		}
+		d.encrypting = true
+	default:
+		return io.EOF
+	}
+
+	plaintext, err := d.decrypt(header, fragment)
+	if err != nil {
+		d.stream.tlsError("decrypt", err)
+		return err
+	}
+	if d.hello.version == tlsVersion13 {
+		// the content type is the last byte before the padding
+		end := len(plaintext) - 1
+		for end >= 0 && plaintext[end] == 0 {
+			end--
+		}
+		if end < 0 {
+			return fmt.Errorf("TLS record has no content type")
+		}
+		kind, plaintext = plaintext[end], plaintext[:end]
+	}
+	switch kind {
+	case tlsRecordApplicationData:
+		d.plain = plaintext
+	case tlsRecordHandshake:
+		d.encrypted.data = append(d.encrypted.data, plaintext...)
+		for msg := d.encrypted.next(); msg != nil; msg = d.encrypted.next() {
+			if err := d.handshakeMessage(msg, true); err != nil {
+				return err
+			}
+		}
+	case tlsRecordAlert:
+		return io.EOF
+	}
+	return nil
+}
+
+// handshakeMessage handles a handshake message of the client: its certificate,
+// and with TLS 1.3 the end of the handshake and the key updates.
+func (d *tlsDecryptor) handshakeMessage(msg []byte, encrypted bool) error {
+	switch msg[0] {
+	case tlsHandshakeCertificate:
+		cert, err := parseCertificateMessage(msg, encrypted && d.hello.version == tlsVersion13)
+		if err != nil {
+			d.stream.streamError(streamErrorTLS, err)
+		} else if cert != nil {
+			d.stream.clientCert = cert
+		}
+	case tlsHandshakeFinished:
+		if d.hello.version == tlsVersion13 && !d.established {
+			d.established = true
+			return d.trafficKeys(d.keyLogSecret("CLIENT_TRAFFIC_SECRET_0"))
+		}
+	case tlsHandshakeKeyUpdate:
+		if d.established {
+			stats.inc("tls_key_updates")
+			return d.trafficKeys(d.expandLabel(d.secret, "traffic upd", d.suite.hash().Size()))
+		}
+	}
+	return nil
+}
+
+func (d *tlsDecryptor) keyLogSecret(label string) []byte {
+	return fwdKeyLog.secret(d.clientRandom, label, currentConfig().tlsKeyLogWait)
+}
+
+// setupKeys sets the keys of the client once it starts encrypting.
+func (d *tlsDecryptor) setupKeys() error {
+	h := d.stream
+	hello, ok := takeServerHello(connectionID(h.net, h.transport), currentConfig().tlsKeyLogWait)
+	if !ok {
+		h.tlsError("no_server_hello", fmt.Errorf("ServerHello of the TLS connection was not captured"))
+		return io.EOF
+	}
+	d.hello = hello
+	if d.suite, ok = tlsCipherSuites[hello.cipherSuite]; !ok {
+		h.tlsError("unsupported_cipher", fmt.Errorf("TLS cipher suite 0x%04x is not supported", hello.cipherSuite))
+		return io.EOF
+	}
+
+	switch hello.version {
+	case tlsVersion13:
+		err := d.trafficKeys(d.keyLogSecret("CLIENT_HANDSHAKE_TRAFFIC_SECRET"))
+		if err == nil {
+			stats.inc("tls_sessions_decrypted")
+		}
+		return err
+	case tlsVersion12:
+		master := d.keyLogSecret("CLIENT_RANDOM")
+		if master == nil {
+			h.tlsError("no_keys", fmt.Errorf("TLS key log has no secret for the connection"))
+			return io.EOF
+		}
+		ivLen := 4
+		if d.suite.chacha {
+			ivLen = 12
+		}
+		seed := append(append([]byte(nil), hello.serverRandom...), d.clientRandom...)
+		block := tls12PRF(d.suite.hash, master, "key expansion", seed, 2*d.suite.keyLen+2*ivLen)
+		d.iv = block[2*d.suite.keyLen : 2*d.suite.keyLen+ivLen]
+		var err error
+		if d.aead, err = d.suite.aead(block[:d.suite.keyLen]); err == nil {
+			stats.inc("tls_sessions_decrypted")
+		}
+		return err
+	}
+	h.tlsError("unsupported_version", fmt.Errorf("TLS version 0x%04x is not supported", hello.version))
+	return io.EOF
+}
+
+// trafficKeys sets the keys of a TLS 1.3 traffic secret.
+func (d *tlsDecryptor) trafficKeys(secret []byte) error {
+	if secret == nil {
+		d.stream.tlsError("no_keys", fmt.Errorf("TLS key log has no secret for the connection"))
+		return io.EOF
+	}
+	aead, err := d.suite.aead(d.expandLabel(secret, "key", d.suite.keyLen))
+	if err != nil {
+		return err
+	}
+	d.aead, d.iv, d.secret, d.seq = aead, d.expandLabel(secret, "iv", 12), secret, 0
+	return nil
+}
+
+func (d *tlsDecryptor) decrypt(header, fragment []byte) ([]byte, error) {
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, d.seq)
+	d.seq++
+	nonce := make([]byte, 12)
+	copy(nonce, d.iv)
+	if d.hello.version == tlsVersion12 && !d.suite.chacha {
+		// the fixed IV followed by the explicit nonce of the record
+		if len(fragment) < 8 {
+			return nil, fmt.Errorf("TLS record is truncated")
+		}
+		copy(nonce[4:], fragment[:8])
+		fragment = fragment[8:]
+	} else {
+		// the IV XOR the sequence number
+		for i := range seq {
+			nonce[4+i] ^= seq[i]
+		}
+	}
+	additional := header
+	if d.hello.version == tlsVersion12 {
+		if len(fragment) < d.aead.Overhead() {
+			return nil, fmt.Errorf("TLS record is truncated")
+		}
+		additional = append(append(seq, header[:3]...), 0, 0)
+		binary.BigEndian.PutUint16(additional[11:], uint16(len(fragment)-d.aead.Overhead()))
+	}
+	return d.aead.Open(nil, nonce, fragment, additional)
+}
+
+// expandLabel implements HKDF-Expand-Label of TLS 1.3.
+func (d *tlsDecryptor) expandLabel(secret []byte, label string, length int) []byte {
+	return hkdfExpandLabel(d.suite.hash, secret, label, length)
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label of TLS 1.3, with an empty
+// context.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(h, secret, info), out)
+	return out
+}
+
+// tls12PRF implements the pseudorandom function of TLS 1.2, P_hash.
+func tls12PRF(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+	var out []byte
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = append(out, mac.Sum(nil)...)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:length]
+}
@@ -0,0 +1,59 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// traceparentFormat matches a version 00 traceparent header of W3C Trace Context.
+var traceparentFormat = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// setTraceContext applies the trace-context flags to the traceparent and
+// tracestate headers of a forwarded request, which are copied from the captured
+// request:
+//   - propagate forwards them unchanged, so the shadow spans join the span of
+//     the original request
+//   - reparent forwards them with a new span ID, so that the shadow request is a
+//     sibling of the original one rather than a duplicate of it
+//   - strip removes them
+//
+// With trace-context-synthesize, a request without a valid traceparent gets a
+// new sampled trace.
+func setTraceContext(conf *configSnapshot, header http.Header) {
+	if conf.traceContext == "strip" {
+		header.Del("Traceparent")
+		header.Del("Tracestate")
+		return
+	}
+
+	m := traceparentFormat.FindStringSubmatch(header.Get("Traceparent"))
+	if m == nil {
+		// an invalid traceparent is ignored, along with its tracestate
+		if header.Get("Traceparent") != "" {
+			header.Del("Traceparent")
+			header.Del("Tracestate")
+			stats.inc("trace_context_invalid")
+		}
+		if conf.traceSynthesize {
+			header.Set("Traceparent", fmt.Sprintf("00-%s-%s-01", randomHex(16), randomHex(8)))
+		}
+		return
+	}
+	if conf.traceContext == "reparent" {
+		header.Set("Traceparent", fmt.Sprintf("00-%s-%s-%s", m[1], randomHex(8), m[3]))
+	}
+}
+
+// randomHex returns n random bytes in hexadecimal. All zero IDs are invalid in
+// trace context, and too unlikely to be worth a check.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	crypto_rand.Read(b)
+	return hex.EncodeToString(b)
+}
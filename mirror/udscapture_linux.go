@@ -0,0 +1,215 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package mirror
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+)
+
+// The events of bpf/uds_capture.c and bpf/tls_capture.c: sock (8 bytes), kind (4), len (4), data.
+const (
+	udsEventData  = 0
+	udsEventClose = 1
+	udsEventLost  = 2
+
+	udsEventHeader = 16
+	udsPathLen     = 108
+)
+
+// udsStream is a captured Unix domain socket connection.
+type udsStream struct {
+	stream   *httpStream
+	lastSeen time.Time
+}
+
+// udsCapture feeds the data written to the captured Unix domain sockets, or
+// read from the captured TLS connections, to the same parser and forwarder as
+// the TCP streams. The connections have no addresses: they are numbered as the
+// source port of 127.0.0.1, and sent to the port of the port flag.
+type udsCapture struct {
+	// name is the prefix of the counters: uds or tls
+	name    string
+	streams map[uint64]*udsStream
+	next    uint16
+}
+
+// runUDSCapture implements the capture subcommand with the uds capture engine.
+func runUDSCapture() error {
+	spec, err := ebpf.LoadCollectionSpec(*ebpfObject)
+	if err != nil {
+		return fmt.Errorf("Error loading eBPF program %s: %v", *ebpfObject, err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+
+	for _, path := range splitPatterns(*udsPaths) {
+		var key [udsPathLen]byte
+		copy(key[:], path)
+		if err := coll.Maps["capture_paths"].Put(key, uint8(1)); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{"unix_stream_sendmsg", "unix_release"} {
+		probe, err := link.Kprobe(name, coll.Programs[name], nil)
+		if err != nil {
+			return fmt.Errorf("Error attaching kprobe %s: %v", name, err)
+		}
+		defer probe.Close()
+	}
+	return readStreamEvents(coll, "Unix domain sockets "+*udsPaths, &udsCapture{name: "uds"})
+}
+
+// readStreamEvents feeds the events of the ring buffer events of coll to c,
+// until the capture is stopped. The programs of the tls capture engine output
+// the same events, which count the drops of the ring buffer in dropped.
+func readStreamEvents(coll *ebpf.Collection, description string, c *udsCapture) error {
+	reader, err := ringbuf.NewReader(coll.Maps["events"])
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := startHealthListener(); err != nil {
+		return err
+	}
+
+	log.Printf("Starting capture on %s", description)
+	beatCapture()
+	sdNotify("READY=1\nSTATUS=Capturing on " + description)
+	go watchdog()
+
+	// closing the reader interrupts a read, which under steady traffic never
+	// reaches the deadline
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-captureStop:
+			reader.Close()
+		case <-done:
+		}
+	}()
+
+	c.streams = map[uint64]*udsStream{}
+	flushed := time.Now()
+	for {
+		// the deadline lets the loop flush idle connections and ping the watchdog without traffic
+		reader.SetDeadline(time.Now().Add(time.Second))
+		record, err := reader.Read()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			beatCapture()
+		} else if errors.Is(err, ringbuf.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if len(record.RawSample) >= udsEventHeader {
+			c.handle(record.RawSample)
+		}
+
+		if time.Since(flushed) > time.Minute {
+			// Every minute, close connections that haven't seen activity in the past 1 minute.
+			c.flushOlderThan(time.Now().Add(-time.Minute))
+			var dropped []uint64
+			if coll.Maps["dropped"].Lookup(uint32(0), &dropped) == nil {
+				var total int64
+				for _, d := range dropped {
+					total += int64(d)
+				}
+				stats.set(c.name+"_events_dropped", total)
+			}
+			flushed = time.Now()
+		}
+	}
+}
+
+// handle processes an event of the ring buffer. The supported architectures
+// (amd64, arm64) are little endian.
+func (c *udsCapture) handle(event []byte) {
+	sock := binary.LittleEndian.Uint64(event[0:8])
+	kind := binary.LittleEndian.Uint32(event[8:12])
+	n := int(binary.LittleEndian.Uint32(event[12:16]))
+	s, ok := c.streams[sock]
+
+	switch kind {
+	case udsEventClose:
+		if ok {
+			c.close(sock, s)
+		}
+		return
+	case udsEventLost:
+		// the rest of the stream cannot be parsed; the next data starts a new stream
+		stats.inc(c.name + "_streams_lost")
+		if ok {
+			c.close(sock, s)
+		}
+		return
+	}
+	if n > len(event)-udsEventHeader {
+		return
+	}
+	if currentPauseMode() == pauseDrop {
+		stats.inc("packets_dropped_paused")
+		return
+	}
+	if !ok {
+		// while draining, new streams are not read at all
+		if draining() {
+			return
+		}
+		s = &udsStream{stream: c.newStream()}
+		c.streams[sock] = s
+		stats.inc(c.name + "_connections")
+	}
+	s.lastSeen = time.Now()
+	s.stream.r.Reassembled([]tcpassembly.Reassembly{{Bytes: event[udsEventHeader : udsEventHeader+n], Seen: s.lastSeen}})
+}
+
+func (c *udsCapture) newStream() *httpStream {
+	c.next++
+	if c.next == 0 {
+		c.next = 1
+	}
+	loopback := net.IPv4(127, 0, 0, 1).To4()
+	src, dst := make([]byte, 2), make([]byte, 2)
+	binary.BigEndian.PutUint16(src, c.next)
+	binary.BigEndian.PutUint16(dst, uint16(currentConfig().reqPort))
+	hstream := &httpStream{
+		net:       gopacket.NewFlow(layers.EndpointIPv4, loopback, loopback),
+		transport: gopacket.NewFlow(layers.EndpointTCPPort, src, dst),
+		r:         timedStream{ReaderStream: tcpreader.NewReaderStream()},
+	}
+	go hstream.run()
+	return hstream
+}
+
+func (c *udsCapture) close(sock uint64, s *udsStream) {
+	s.stream.r.ReassemblyComplete()
+	delete(c.streams, sock)
+}
+
+func (c *udsCapture) flushOlderThan(t time.Time) {
+	for sock, s := range c.streams {
+		if s.lastSeen.Before(t) {
+			c.close(sock, s)
+		}
+	}
+}
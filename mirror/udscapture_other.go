@@ -0,0 +1,13 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package mirror
+
+import "fmt"
+
+// runUDSCapture reports an error: the uds capture engine relies on eBPF.
+func runUDSCapture() error {
+	return fmt.Errorf("Flag capture-engine uds is only supported on Linux.")
+}
@@ -0,0 +1,119 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// runValidate implements the validate subcommand: it checks the flags and the
+// configuration file without capturing any traffic, prints every problem found,
+// and returns the process exit code.
+func runValidate() int {
+	var problems []string
+	recordCommandLineFlags()
+	if *configFile != "" {
+		if err := applyConfigFile(flags, *configFile, commandLineFlags); err != nil {
+			// the remaining checks would run against an incomplete configuration
+			fmt.Fprintln(os.Stderr, "config:", err)
+			return 1
+		}
+	}
+	if _, err := setupFlags(); err != nil {
+		problems = append(problems, fmt.Sprintf("flags: %v", err))
+	}
+	// the other engines do not filter packets
+	if *captureEngine == "pcap" || *captureEngine == "pfring" {
+		if _, err := pcap.CompileBPFFilter(captureLinkType(), *snaplen, bpfFilter()); err != nil {
+			problems = append(problems, fmt.Sprintf("bpf: filter %q: %v", bpfFilter(), err))
+		}
+	}
+	if _, err := net.InterfaceByName(*iface); err != nil {
+		problems = append(problems, fmt.Sprintf("interface: %s: %v", *iface, err))
+	}
+
+	// check that static destinations accept TCP connections
+	var routes map[string]route
+	if json.Unmarshal([]byte(*routeTableJson), &routes) == nil {
+		for host, r := range routes {
+			for _, dest := range r.destinations() {
+				if dest == "" || isDynamicDestination(dest) {
+					continue
+				}
+				if err := checkReachable(dest); err != nil {
+					problems = append(problems, fmt.Sprintf("destination: %s (%s): %v", dest, host, err))
+				}
+			}
+		}
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintln(os.Stderr, len(problems), "problem(s) found")
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
+// captureLinkType returns the link type the BPF filter of the capture is
+// compiled for: that of the interface if it can be opened, or else the one of
+// its kind. The offsets of a filter, and whether it compiles at all, depend on
+// the link type.
+func captureLinkType() layers.LinkType {
+	if *captureEngine == "pfring" {
+		return layers.LinkTypeEthernet
+	}
+	if handle, err := pcap.OpenLive(*iface, 128, false, time.Millisecond); err == nil {
+		defer handle.Close()
+		return handle.LinkType()
+	}
+	if *iface == "any" {
+		// the Linux cooked capture of every interface
+		return layers.LinkTypeLinuxSLL
+	}
+	i, err := net.InterfaceByName(*iface)
+	switch {
+	case err != nil:
+	case i.Flags&net.FlagLoopback != 0 && runtime.GOOS != "linux":
+		// the loopback of Linux has Ethernet headers, the others the BSD loopback encapsulation
+		return layers.LinkTypeNull
+	case len(i.HardwareAddr) == 0 && i.Flags&net.FlagLoopback == 0:
+		// tunnels without link layer, e.g. WireGuard
+		return layers.LinkTypeRaw
+	}
+	// VXLAN and GENEVE interfaces carry the Ethernet frames of the mirror session
+	return layers.LinkTypeEthernet
+}
+
+func checkReachable(dest string) error {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
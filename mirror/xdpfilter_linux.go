@@ -0,0 +1,185 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package mirror
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// The filter_config flags of bpf/xdp_filter.c.
+const (
+	xdpHasSourceInclude      = 1
+	xdpHasSourceExclude      = 2
+	xdpHasDestinationInclude = 4
+	xdpAllowVLAN             = 8
+)
+
+type xdpConfig struct {
+	Direction uint32
+	Flags     uint32
+}
+
+type xdpCIDRKey struct {
+	PrefixLen uint32
+	Addr      [16]byte
+}
+
+// xdpFilter is the XDP program of the capture interface, which drops the
+// packets of the ports and CIDRs that are not captured before the kernel
+// processes them. It implements the filter flags, like buildBPFFilter.
+type xdpFilter struct {
+	coll *ebpf.Collection
+	link link.Link
+}
+
+func attachXDPFilter(iface string) (*xdpFilter, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := ebpf.LoadCollectionSpec(*xdpObject)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading XDP program %s: %v", *xdpObject, err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return nil, err
+	}
+	f := &xdpFilter{coll: coll}
+	// the maps are set before the program drops anything
+	if err := f.configure(); err != nil {
+		coll.Close()
+		return nil, err
+	}
+	flags := link.XDPGenericMode
+	if *xdpMode == "native" {
+		flags = link.XDPDriverMode
+	}
+	f.link, err = link.AttachXDP(link.XDPOptions{Program: coll.Programs["xdp_filter"], Interface: ifi.Index, Flags: flags})
+	if err != nil {
+		coll.Close()
+		return nil, fmt.Errorf("Error attaching XDP program to %s: %v", iface, err)
+	}
+	return f, nil
+}
+
+// configure sets the maps of the program from the filter flags.
+func (f *xdpFilter) configure() error {
+	var config xdpConfig
+	// the DIRECTION values of bpf/xdp_filter.c, dst is 0
+	switch *filterMode {
+	case "src":
+		config.Direction = 1
+	case "either":
+		config.Direction = 2
+	}
+	if *filterVLAN {
+		config.Flags |= xdpAllowVLAN
+	}
+
+	ranges, err := parsePorts("filter-ports", *filterPorts)
+	if err != nil {
+		return err
+	}
+	ranges = append(ranges, portRange{*reqPort, *reqPort})
+	captured := make([]uint8, 65536)
+	for _, r := range ranges {
+		for p := r.from; p <= r.to; p++ {
+			captured[p] = 1
+		}
+	}
+	keys := make([]uint32, len(captured))
+	for i := range keys {
+		keys[i] = uint32(i)
+	}
+	if _, err := f.coll.Maps["ports"].BatchUpdate(keys, captured, nil); err != nil {
+		return err
+	}
+
+	for _, m := range []struct {
+		name, list string
+		flag       uint32
+	}{
+		{"source_include", *filterSourceCIDRs, xdpHasSourceInclude},
+		{"source_exclude", *filterExcludeSourceCIDRs, xdpHasSourceExclude},
+		{"destination_include", *filterDestinationCIDRs, xdpHasDestinationInclude},
+	} {
+		if err := setXDPCIDRs(f.coll.Maps[m.name], m.list); err != nil {
+			return fmt.Errorf("Error setting XDP CIDRs %s: %v", m.name, err)
+		}
+		if m.list != "" {
+			config.Flags |= m.flag
+		}
+	}
+	return f.coll.Maps["config"].Put(uint32(0), config)
+}
+
+// setXDPCIDRs replaces the entries of the LPM trie cidrs with a comma separated
+// list of CIDRs or IPs. IPv4 addresses are mapped to IPv6.
+func setXDPCIDRs(cidrs *ebpf.Map, list string) error {
+	var key xdpCIDRKey
+	var value uint8
+	var old []xdpCIDRKey
+	entries := cidrs.Iterate()
+	for entries.Next(&key, &value) {
+		old = append(old, key)
+	}
+	if err := entries.Err(); err != nil {
+		return err
+	}
+	for _, k := range old {
+		if err := cidrs.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range splitPatterns(list) {
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return err
+			}
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+		}
+		ones, bits := ipNet.Mask.Size()
+		key := xdpCIDRKey{PrefixLen: uint32(ones)}
+		if bits == 32 {
+			key.PrefixLen += 96
+		}
+		copy(key.Addr[:], ipNet.IP.To16())
+		if err := cidrs.Put(key, uint8(1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropped returns the number of packets dropped by the program.
+func (f *xdpFilter) dropped() int64 {
+	var counts []uint64
+	if f.coll.Maps["dropped"].Lookup(uint32(0), &counts) != nil {
+		return 0
+	}
+	var total int64
+	for _, c := range counts {
+		total += int64(c)
+	}
+	return total
+}
+
+func (f *xdpFilter) Close() error {
+	f.link.Close()
+	f.coll.Close()
+	return nil
+}
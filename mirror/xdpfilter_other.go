@@ -0,0 +1,21 @@
+// Modification Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package mirror
+
+import "fmt"
+
+// xdpFilter is not supported outside of Linux.
+type xdpFilter struct{}
+
+func attachXDPFilter(iface string) (*xdpFilter, error) {
+	return nil, fmt.Errorf("Flag xdp-filter is only supported on Linux.")
+}
+
+func (f *xdpFilter) configure() error { return nil }
+
+func (f *xdpFilter) dropped() int64 { return 0 }
+
+func (f *xdpFilter) Close() error { return nil }